@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// requireAdmin guards admin routes with the configured admin bearer token
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *adminToken == "" {
+			writeMatrixError(w, http.StatusForbidden, errcodeForbidden, "Admin API disabled")
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+			writeMatrixError(w, http.StatusUnauthorized, errcodeUnauthorized, "Unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// PeerStatus describes a federation peer connection
+type PeerStatus struct {
+	ServerName  string    `json:"server_name"`
+	Connected   bool      `json:"connected"`
+	LastSeen    time.Time `json:"last_seen"`
+	OutboxDepth int       `json:"outbox_depth"`
+	Circuit     string    `json:"circuit"`
+}
+
+// ListConnectedServers returns the state of every peer connection, plus
+// unconnected peers whose circuit breaker isn't closed, sorted by server name
+func (fs *FederationServer) ListConnectedServers() []PeerStatus {
+	fs.connectionsMu.RLock()
+	peers := make([]PeerStatus, 0, len(fs.connections))
+	for name, conn := range fs.connections {
+		peers = append(peers, PeerStatus{
+			ServerName:  name,
+			Connected:   conn.Connected(),
+			LastSeen:    conn.LastSeen(),
+			OutboxDepth: len(conn.Outbox),
+		})
+	}
+	fs.connectionsMu.RUnlock()
+
+	fs.breakersMu.Lock()
+	breakers := make(map[string]*peerBreaker, len(fs.breakers))
+	for name, b := range fs.breakers {
+		breakers[name] = b
+	}
+	fs.breakersMu.Unlock()
+
+	for i := range peers {
+		peers[i].Circuit = circuitClosed
+		if b, ok := breakers[peers[i].ServerName]; ok {
+			peers[i].Circuit = b.State()
+			delete(breakers, peers[i].ServerName)
+		}
+	}
+	for name, b := range breakers {
+		if state := b.State(); state != circuitClosed {
+			peers = append(peers, PeerStatus{ServerName: name, Circuit: state})
+		}
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ServerName < peers[j].ServerName
+	})
+	return peers
+}
+
+// handleListPeers lists federation peer connections
+func (fs *FederationServer) handleListPeers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"peers": fs.ListConnectedServers(),
+	})
+}
+
+// handleConnectPeer forces a connection to a federation server, lifting any
+// denylisting
+func (fs *FederationServer) handleConnectPeer(w http.ResponseWriter, r *http.Request) {
+	serverName, ok := decodePeerRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := fs.allowPeer(r.Context(), serverName); err != nil {
+		fs.logger.Error("Failed to update peer denylist", zap.String("server", serverName), zap.Error(err))
+		writeMatrixError(w, http.StatusInternalServerError, errcodeUnknown, "Failed to update denylist")
+		return
+	}
+
+	fs.connectionsMu.RLock()
+	_, connected := fs.connections[serverName]
+	fs.connectionsMu.RUnlock()
+	if connected {
+		writeMatrixError(w, http.StatusConflict, errcodeUnknown, "Already connected")
+		return
+	}
+
+	if err := fs.ConnectToServer(serverName); err != nil {
+		fs.logger.Warn("Manual peer connect failed", zap.String("server", serverName), zap.Error(err))
+		writeMatrixError(w, http.StatusBadGateway, errcodeUnknown, "Failed to connect")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDisconnectPeer closes a peer connection and denylists the server so
+// discovery doesn't reconnect it
+func (fs *FederationServer) handleDisconnectPeer(w http.ResponseWriter, r *http.Request) {
+	serverName, ok := decodePeerRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := fs.DisconnectServer(r.Context(), serverName); err != nil {
+		fs.logger.Error("Failed to disconnect peer", zap.String("server", serverName), zap.Error(err))
+		writeMatrixError(w, http.StatusInternalServerError, errcodeUnknown, "Failed to disconnect")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodePeerRequest reads the server name from a peering request body
+func decodePeerRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		ServerName string `json:"server_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ServerName == "" {
+		writeMatrixError(w, http.StatusBadRequest, errcodeBadJSON, "Invalid JSON")
+		return "", false
+	}
+	return body.ServerName, true
+}
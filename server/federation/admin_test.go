@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListConnectedServers(t *testing.T) {
+	a := newTestServer(t, "a.example")
+	for _, name := range []string{"c.example", "b.example"} {
+		servePeer(t, newTestServer(t, name), a)
+		if err := a.ConnectToServer(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	down := a.breaker("d.example")
+	for i := 0; i < *peerBreakerThreshold; i++ {
+		down.Failure()
+	}
+
+	peers := a.ListConnectedServers()
+	if len(peers) != 3 {
+		t.Fatalf("listed %d peers, want 3: %+v", len(peers), peers)
+	}
+	for i, name := range []string{"b.example", "c.example"} {
+		peer := peers[i]
+		if peer.ServerName != name || !peer.Connected || peer.Circuit != circuitClosed {
+			t.Errorf("peer %d = %+v, want connected %s", i, peer, name)
+		}
+		if time.Since(peer.LastSeen) > time.Minute {
+			t.Errorf("%s last seen %v", name, peer.LastSeen)
+		}
+	}
+	if peer := peers[2]; peer.ServerName != "d.example" || peer.Connected || peer.Circuit != circuitOpen {
+		t.Errorf("peer 2 = %+v, want unconnected d.example with an open circuit", peer)
+	}
+}
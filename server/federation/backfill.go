@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// Backfill limits
+const (
+	defaultBackfillLimit = 20
+	maxBackfillLimit     = 100
+	backfillBatchSize    = 20
+)
+
+// errPeerNotConnected is returned when a peer has no live connection
+var errPeerNotConnected = errors.New("federation peer not connected")
+
+// BackfillRequest asks a peer for historical room events over the WebSocket
+type BackfillRequest struct {
+	RequestID string   `json:"request_id"`
+	RoomID    string   `json:"room_id"`
+	From      []string `json:"v,omitempty"`
+	Limit     int      `json:"limit"`
+}
+
+// BackfillResponse carries one batch of backfilled events. The final batch
+// of a request has Done set.
+type BackfillResponse struct {
+	RequestID string            `json:"request_id"`
+	RoomID    string            `json:"room_id"`
+	Events    []json.RawMessage `json:"events"`
+	Done      bool              `json:"done"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// clampBackfillLimit bounds a requested backfill limit
+func clampBackfillLimit(limit int) int {
+	if limit <= 0 {
+		return defaultBackfillLimit
+	}
+	if limit > maxBackfillLimit {
+		return maxBackfillLimit
+	}
+	return limit
+}
+
+// RequestBackfill asks a connected peer for room history and collects the
+// streamed response batches until the peer signals completion
+func (fs *FederationServer) RequestBackfill(ctx context.Context, serverName, roomID string, from []string, limit int) ([]json.RawMessage, error) {
+	fs.connectionsMu.RLock()
+	conn, ok := fs.connections[serverName]
+	fs.connectionsMu.RUnlock()
+
+	if !ok || !conn.Connected() {
+		return nil, errPeerNotConnected
+	}
+
+	req := BackfillRequest{
+		RequestID: uuid.New().String(),
+		RoomID:    roomID,
+		From:      from,
+		Limit:     clampBackfillLimit(limit),
+	}
+
+	// Buffered to hold every batch of a maximal request, so the read loop
+	// never blocks on a slow or departed requester
+	responses := make(chan BackfillResponse, maxBackfillLimit/backfillBatchSize+1)
+
+	fs.backfillsMu.Lock()
+	fs.backfills[req.RequestID] = responses
+	fs.backfillsMu.Unlock()
+
+	defer func() {
+		fs.backfillsMu.Lock()
+		delete(fs.backfills, req.RequestID)
+		fs.backfillsMu.Unlock()
+	}()
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := FederationMessage{
+		Type:       msgTypeBackfillRequest,
+		DestServer: serverName,
+		Payload:    payload,
+		Timestamp:  time.Now().Unix(),
+		Hops:       maxRelayHops,
+	}
+
+	select {
+	case conn.Outbox <- msg:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	var events []json.RawMessage
+	for {
+		select {
+		case resp := <-responses:
+			if resp.Error != "" {
+				return events, errors.New(resp.Error)
+			}
+			events = append(events, resp.Events...)
+			if resp.Done {
+				return events, nil
+			}
+		case <-ctx.Done():
+			return events, ctx.Err()
+		}
+	}
+}
+
+// handleBackfillRequest streams stored room history back to the requesting
+// peer in batches through its outbox
+func (fs *FederationServer) handleBackfillRequest(sourceServer string, payload json.RawMessage) error {
+	var req BackfillRequest
+	if err := decodePayload(payload, &req); err != nil {
+		return err
+	}
+
+	fs.connectionsMu.RLock()
+	conn, ok := fs.connections[sourceServer]
+	fs.connectionsMu.RUnlock()
+
+	if !ok {
+		return errPeerNotConnected
+	}
+
+	// Stream outside the read loop so the connection keeps reading
+	go func() {
+		events, err := fs.events.GetRoomEvents(fs.ctx, req.RoomID, req.From, clampBackfillLimit(req.Limit))
+		if err != nil {
+			fs.logger.Error("Failed to load backfill events",
+				zap.String("room_id", req.RoomID),
+				zap.Error(err))
+			fs.sendBackfillResponse(conn, BackfillResponse{
+				RequestID: req.RequestID,
+				RoomID:    req.RoomID,
+				Done:      true,
+				Error:     "failed to load events",
+			})
+			return
+		}
+
+		for start := 0; ; start += backfillBatchSize {
+			end := start + backfillBatchSize
+			if end > len(events) {
+				end = len(events)
+			}
+
+			resp := BackfillResponse{
+				RequestID: req.RequestID,
+				RoomID:    req.RoomID,
+				Events:    events[start:end],
+				Done:      end == len(events),
+			}
+			if !fs.sendBackfillResponse(conn, resp) || resp.Done {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// sendBackfillResponse queues a backfill batch, giving up if the server is
+// shutting down or the peer disconnects
+func (fs *FederationServer) sendBackfillResponse(conn *FederationConnection, resp BackfillResponse) bool {
+	if !conn.Connected() {
+		return false
+	}
+
+	payload, err := json.Marshal(resp)
+	if err != nil {
+		fs.logger.Error("Failed to marshal backfill response", zap.Error(err))
+		return false
+	}
+
+	msg := FederationMessage{
+		Type:       msgTypeBackfillResponse,
+		DestServer: conn.ServerName,
+		Payload:    payload,
+		Timestamp:  time.Now().Unix(),
+		Hops:       maxRelayHops,
+	}
+
+	select {
+	case conn.Outbox <- msg:
+		return true
+	case <-fs.ctx.Done():
+		return false
+	}
+}
+
+// handleBackfillResponse hands a backfill batch to the waiting requester
+func (fs *FederationServer) handleBackfillResponse(payload json.RawMessage) error {
+	var resp BackfillResponse
+	if err := decodePayload(payload, &resp); err != nil {
+		return err
+	}
+
+	fs.backfillsMu.Lock()
+	responses, ok := fs.backfills[resp.RequestID]
+	fs.backfillsMu.Unlock()
+
+	if !ok {
+		// Requester gave up or timed out
+		return nil
+	}
+
+	select {
+	case responses <- resp:
+	default:
+		fs.logger.Warn("Dropping unexpected backfill batch",
+			zap.String("request_id", resp.RequestID))
+	}
+	return nil
+}
+
+// decodePayload decodes a message payload into a typed value
+func decodePayload(payload json.RawMessage, v interface{}) error {
+	return json.Unmarshal(payload, v)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackfillOverWebSocket(t *testing.T) {
+	a := newTestServer(t, "a.example")
+	b := newTestServer(t, "b.example")
+	servePeer(t, b, a)
+
+	const room = "!room:b.example"
+	for depth := 1; depth <= 30; depth++ {
+		event := fmt.Sprintf(`{"event_id":"$e%d","room_id":%q,"depth":%d}`, depth, room, depth)
+		if err := b.events.StoreEvent(context.Background(), json.RawMessage(event)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := a.ConnectToServer("b.example"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "b to register a", func() bool { return connected(b, "a.example") })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events, err := a.RequestBackfill(ctx, "b.example", room, []string{"$e26"}, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything before $e26, newest first, across two batches
+	if len(events) != 25 {
+		t.Fatalf("backfilled %d events, want 25", len(events))
+	}
+	for i, event := range events {
+		var header eventHeader
+		if err := json.Unmarshal(event, &header); err != nil {
+			t.Fatal(err)
+		}
+		if want := int64(25 - i); header.Depth != want {
+			t.Errorf("event %d has depth %d, want %d", i, header.Depth, want)
+		}
+	}
+
+	if _, err := a.RequestBackfill(ctx, "c.example", room, nil, 10); err != errPeerNotConnected {
+		t.Errorf("backfill from an unconnected peer = %v, want errPeerNotConnected", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Peer circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// errCircuitOpen is returned when a peer's circuit breaker stops a
+// connection attempt
+var errCircuitOpen = errors.New("peer circuit breaker open")
+
+// peerBreaker stops dialing and sending to a peer after repeated failures.
+// After the cooldown a single connection attempt is let through to probe
+// whether the peer has recovered.
+type peerBreaker struct {
+	server    string
+	mu        sync.Mutex
+	failures  int
+	state     string
+	openUntil time.Time
+	logger    *zap.Logger
+}
+
+// newPeerBreaker creates a closed breaker for a peer
+func newPeerBreaker(server string, logger *zap.Logger) *peerBreaker {
+	return &peerBreaker{server: server, state: circuitClosed, logger: logger}
+}
+
+// Allow reports whether a connection attempt may proceed. Once the cooldown
+// has elapsed one attempt is allowed as a probe; others wait for its result.
+func (b *peerBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitClosed:
+		return true
+	case circuitOpen:
+		if time.Now().Before(b.openUntil) {
+			return false
+		}
+		b.state = circuitHalfOpen
+		return true
+	}
+	return false
+}
+
+// Open reports whether sends to the peer should go straight to the queue
+func (b *peerBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != circuitClosed
+}
+
+// State returns the breaker state
+func (b *peerBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Success records a successful dial or write, closing the breaker
+func (b *peerBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	if b.state != circuitClosed {
+		b.state = circuitClosed
+		metrics.CircuitOpen.WithLabelValues(b.server).Set(0)
+		b.logger.Info("Federation peer recovered, circuit closed", zap.String("server", b.server))
+	}
+}
+
+// Failure records a failed dial or write. The breaker opens once the
+// threshold is reached, or straight away when a probe fails.
+func (b *peerBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == circuitClosed && b.failures < *peerBreakerThreshold {
+		return
+	}
+
+	b.openUntil = time.Now().Add(*peerBreakerCooldown)
+	if b.state != circuitOpen {
+		b.state = circuitOpen
+		metrics.CircuitOpen.WithLabelValues(b.server).Set(1)
+		b.logger.Warn("Federation peer failing, circuit open",
+			zap.String("server", b.server),
+			zap.Int("failures", b.failures),
+			zap.Duration("cooldown", *peerBreakerCooldown))
+	}
+}
+
+// breaker returns a peer's circuit breaker, creating it on first use
+func (fs *FederationServer) breaker(serverName string) *peerBreaker {
+	fs.breakersMu.Lock()
+	defer fs.breakersMu.Unlock()
+
+	b, ok := fs.breakers[serverName]
+	if !ok {
+		b = newPeerBreaker(serverName, fs.logger)
+		fs.breakers[serverName] = b
+	}
+	return b
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestPeerBreaker(t *testing.T) {
+	threshold, cooldown := *peerBreakerThreshold, *peerBreakerCooldown
+	*peerBreakerThreshold, *peerBreakerCooldown = 3, time.Hour
+	t.Cleanup(func() { *peerBreakerThreshold, *peerBreakerCooldown = threshold, cooldown })
+
+	b := newPeerBreaker("remote.example", zap.NewNop())
+	for i := 0; i < 2; i++ {
+		b.Failure()
+	}
+	if b.State() != circuitClosed || !b.Allow() {
+		t.Fatalf("breaker %s below the threshold, want closed", b.State())
+	}
+
+	b.Failure()
+	if b.State() != circuitOpen || b.Allow() || !b.Open() {
+		t.Fatalf("breaker %s at the threshold, want open and refusing", b.State())
+	}
+
+	// Once the cooldown is over a single probe is let through
+	b.openUntil = time.Now().Add(-time.Second)
+	if !b.Allow() || b.State() != circuitHalfOpen {
+		t.Fatalf("breaker %s after cooldown, want a half-open probe", b.State())
+	}
+	if b.Allow() {
+		t.Error("second attempt allowed while probing")
+	}
+
+	// A failed probe reopens the breaker at once
+	b.Failure()
+	if b.State() != circuitOpen || b.Allow() {
+		t.Fatalf("breaker %s after failed probe, want open", b.State())
+	}
+
+	b.openUntil = time.Now().Add(-time.Second)
+	b.Allow()
+	b.Success()
+	if b.State() != circuitClosed || !b.Allow() || b.Open() {
+		t.Fatalf("breaker %s after successful probe, want closed", b.State())
+	}
+
+	// Failures count from zero again after recovery
+	b.Failure()
+	if b.State() != circuitClosed {
+		t.Errorf("breaker %s after one failure, want closed", b.State())
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"empty object", `{}`, `{}`},
+		{"sorted keys", `{"b": 2, "a": 1}`, `{"a":1,"b":2}`},
+		{"nested", `{"one": 1, "two": "Two", "a": {"z": [3, {"y": null, "x": true}], "b": false}}`,
+			`{"a":{"b":false,"z":[3,{"x":true,"y":null}]},"one":1,"two":"Two"}`},
+		{"code point order", `{"日": 1, "b": 2, "B": 3}`, `{"B":3,"b":2,"日":1}`},
+		{"raw non-ASCII", `{"a": "日本語"}`, `{"a":"日本語"}`},
+		{"unicode escapes written raw", `{"a": "\u65e5\u2028\u2029"}`, "{\"a\":\"\u65e5\u2028\u2029\"}"},
+		{"html characters", `{"a": "<b>&</b>"}`, `{"a":"<b>&</b>"}`},
+		{"escapes", `{"a": "\"\\\n\t\u0001"}`, `{"a":"\"\\\n\t\u0001"}`},
+		{"numbers kept", `{"a": 12345678901234567890, "b": -0.5}`, `{"a":12345678901234567890,"b":-0.5}`},
+	}
+	for _, tt := range tests {
+		obj, err := decodeJSONObject([]byte(tt.input))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := canonicalJSON(obj)
+		if err != nil {
+			t.Fatalf("%s: canonicalJSON: %v", tt.name, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: canonicalJSON = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalJSONStruct(t *testing.T) {
+	v := struct {
+		Zeta  string          `json:"zeta"`
+		Alpha json.RawMessage `json:"alpha"`
+	}{"z", json.RawMessage(`{"y": 1, "x": 2}`)}
+
+	got, err := canonicalJSON(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"alpha":{"x":2,"y":1},"zeta":"z"}`; string(got) != want {
+		t.Errorf("canonicalJSON = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// selfCheckTimeout bounds each network check run by -check
+const selfCheckTimeout = 5 * time.Second
+
+// checkResult is the outcome of one -check self-test
+type checkResult struct {
+	Name string
+	Err  error
+}
+
+// runSelfChecks validates the configuration the server needs before taking
+// traffic: Redis connectivity, the signing key and the server name
+func runSelfChecks() []checkResult {
+	return []checkResult{
+		{"redis", checkRedis()},
+		{"key", checkServerKey(*serverKey)},
+		{"server", checkServerName(*serverName)},
+	}
+}
+
+// checkRedis connects to and pings Redis
+func checkRedis() error {
+	client, err := newRedisClient(*redisAddr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfCheckTimeout)
+	defer cancel()
+	return client.Ping(ctx).Err()
+}
+
+// checkServerKey reports a missing server signing key
+func checkServerKey(key string) error {
+	if key == "" {
+		return errors.New("no server key configured (-server-key or FEDERATION_KEY)")
+	}
+	_, err := parseSigningKey(key)
+	return err
+}
+
+// checkServerName resolves the host part of the server name, which peers
+// must reach for discovery
+func checkServerName(name string) error {
+	if name == "" {
+		return errors.New("no server name configured")
+	}
+
+	host := name
+	if h, _, err := net.SplitHostPort(name); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfCheckTimeout)
+	defer cancel()
+	_, err := net.DefaultResolver.LookupHost(ctx, host)
+	return err
+}
+
+// reportSelfChecks writes one line per check and reports whether all passed
+func reportSelfChecks(w io.Writer, results []checkResult) bool {
+	ok := true
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(w, "FAIL %-6s %v\n", r.Name, r.Err)
+			ok = false
+			continue
+		}
+		fmt.Fprintf(w, "ok   %s\n", r.Name)
+	}
+	return ok
+}
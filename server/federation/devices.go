@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Device list store keys
+const (
+	userDevicesKey      = "federation:devices:"       // hash of device ID -> device
+	userDeviceStreamKey = "federation:device_stream:" // latest device list stream ID
+)
+
+// eduTypeDeviceListUpdate announces a change to a remote user's devices
+const eduTypeDeviceListUpdate = "m.device_list_update"
+
+// Device is one of a user's devices with its end-to-end encryption keys
+type Device struct {
+	DeviceID    string          `json:"device_id"`
+	DisplayName string          `json:"device_display_name,omitempty"`
+	Keys        json.RawMessage `json:"keys,omitempty"`
+}
+
+// DeviceListUpdate is the content of an m.device_list_update EDU
+type DeviceListUpdate struct {
+	UserID      string          `json:"user_id"`
+	DeviceID    string          `json:"device_id"`
+	DisplayName string          `json:"device_display_name,omitempty"`
+	StreamID    int64           `json:"stream_id"`
+	PrevID      []int64         `json:"prev_id,omitempty"`
+	Deleted     bool            `json:"deleted,omitempty"`
+	Keys        json.RawMessage `json:"keys,omitempty"`
+}
+
+func (s *redisEventStore) GetDevices(ctx context.Context, userID string) (int64, []Device, error) {
+	streamID, err := s.redis.Get(ctx, s.key(userDeviceStreamKey+userID)).Int64()
+	if err != nil && err != redis.Nil {
+		return 0, nil, err
+	}
+
+	entries, err := s.redis.HGetAll(ctx, s.key(userDevicesKey+userID)).Result()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	devices := make([]Device, 0, len(entries))
+	for _, data := range entries {
+		var device Device
+		if err := json.Unmarshal([]byte(data), &device); err != nil {
+			continue
+		}
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+	return streamID, devices, nil
+}
+
+func (s *redisEventStore) UpdateDevice(ctx context.Context, update DeviceListUpdate) (bool, error) {
+	current, err := s.redis.Get(ctx, s.key(userDeviceStreamKey+update.UserID)).Int64()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	if err == nil && update.StreamID <= current {
+		return false, nil
+	}
+
+	pipe := s.redis.TxPipeline()
+	if update.Deleted {
+		pipe.HDel(ctx, s.key(userDevicesKey+update.UserID), update.DeviceID)
+	} else {
+		data, err := json.Marshal(Device{
+			DeviceID:    update.DeviceID,
+			DisplayName: update.DisplayName,
+			Keys:        update.Keys,
+		})
+		if err != nil {
+			return false, err
+		}
+		pipe.HSet(ctx, s.key(userDevicesKey+update.UserID), update.DeviceID, data)
+	}
+	pipe.Set(ctx, s.key(userDeviceStreamKey+update.UserID), update.StreamID, 0)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// handleUserDevices returns a local user's device list with their keys
+func (fs *FederationServer) handleUserDevices(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	server := userServer(userID)
+	if server == "" {
+		writeMatrixError(w, http.StatusBadRequest, errcodeInvalidParam, "Invalid user ID")
+		return
+	}
+	if server != fs.serverName {
+		writeMatrixError(w, http.StatusForbidden, errcodeForbidden, "User is not local to this server")
+		return
+	}
+
+	streamID, devices, err := fs.events.GetDevices(r.Context(), userID)
+	if err != nil {
+		fs.logger.Error("Failed to load devices", zap.String("user_id", userID), zap.Error(err))
+		writeMatrixError(w, http.StatusInternalServerError, errcodeUnknown, "Failed to load devices")
+		return
+	}
+
+	response := map[string]interface{}{
+		"user_id":   userID,
+		"stream_id": streamID,
+		"devices":   devices,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// processDeviceListUpdateEDU records a change to a remote user's devices.
+// Updates older than the stored stream position are ignored.
+func (fs *FederationServer) processDeviceListUpdateEDU(ctx context.Context, origin string, content json.RawMessage) error {
+	var update DeviceListUpdate
+	if err := json.Unmarshal(content, &update); err != nil || update.DeviceID == "" {
+		return errInvalidEDU
+	}
+	if userServer(update.UserID) != origin {
+		return errForeignUser
+	}
+
+	applied, err := fs.events.UpdateDevice(ctx, update)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		fs.logger.Debug("Ignoring stale device list update",
+			zap.String("user_id", update.UserID),
+			zap.Int64("stream_id", update.StreamID))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// deviceListEDU encodes an m.device_list_update EDU
+func deviceListEDU(update DeviceListUpdate) json.RawMessage {
+	content, _ := json.Marshal(update)
+	raw, _ := json.Marshal(EDU{Type: eduTypeDeviceListUpdate, Content: content})
+	return raw
+}
+
+func TestDeviceListUpdateEDU(t *testing.T) {
+	fs := newTestServer(t, "a.example")
+	ctx := context.Background()
+	const bob = "@bob:b.example"
+
+	steps := []struct {
+		name    string
+		origin  string
+		update  DeviceListUpdate
+		wantErr error
+	}{
+		{"phone added", "b.example", DeviceListUpdate{UserID: bob, DeviceID: "PHONE", StreamID: 1, Keys: json.RawMessage(`{"algorithms":["m.olm.v1"]}`)}, nil},
+		{"laptop added", "b.example", DeviceListUpdate{UserID: bob, DeviceID: "LAPTOP", DisplayName: "Laptop", StreamID: 2}, nil},
+		{"stale delete", "b.example", DeviceListUpdate{UserID: bob, DeviceID: "LAPTOP", StreamID: 2, Deleted: true}, nil},
+		{"phone deleted", "b.example", DeviceListUpdate{UserID: bob, DeviceID: "PHONE", StreamID: 3, PrevID: []int64{2}, Deleted: true}, nil},
+		{"from another server", "c.example", DeviceListUpdate{UserID: bob, DeviceID: "EVIL", StreamID: 4}, errForeignUser},
+		{"no device", "b.example", DeviceListUpdate{UserID: bob, StreamID: 5}, errInvalidEDU},
+	}
+	for _, step := range steps {
+		if err := fs.processEDU(ctx, step.origin, deviceListEDU(step.update)); err != step.wantErr {
+			t.Errorf("%s: %v, want %v", step.name, err, step.wantErr)
+		}
+	}
+
+	streamID, devices, err := fs.events.GetDevices(ctx, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Device{{DeviceID: "LAPTOP", DisplayName: "Laptop"}}
+	if streamID != 3 || !reflect.DeepEqual(devices, want) {
+		t.Errorf("stored stream %d with %+v, want stream 3 with %+v", streamID, devices, want)
+	}
+}
+
+func TestLocalUserDevices(t *testing.T) {
+	fs := newTestServer(t, "a.example")
+	ctx := context.Background()
+	const alice = "@alice:a.example"
+
+	keys := json.RawMessage(`{"device_id":"PHONE","keys":{"ed25519:PHONE":"key"}}`)
+	for _, update := range []DeviceListUpdate{
+		{UserID: alice, DeviceID: "PHONE", DisplayName: "Phone", StreamID: 1, Keys: keys},
+		{UserID: alice, DeviceID: "DESKTOP", StreamID: 2},
+	} {
+		if _, err := fs.events.UpdateDevice(ctx, update); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	newRouter(fs).ServeHTTP(w, httptest.NewRequest("GET", "/_matrix/federation/v1/user/devices/"+alice, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	var body struct {
+		UserID   string   `json:"user_id"`
+		StreamID int64    `json:"stream_id"`
+		Devices  []Device `json:"devices"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	want := []Device{{DeviceID: "DESKTOP"}, {DeviceID: "PHONE", DisplayName: "Phone", Keys: keys}}
+	if body.UserID != alice || body.StreamID != 2 || !reflect.DeepEqual(body.Devices, want) {
+		t.Errorf("got %+v, want %s at stream 2 with %+v", body, alice, want)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// aliasCacheKey prefixes cached alias lookups. Unknown aliases are cached
+// as an empty room ID for -alias-negative-ttl, so a newly created alias
+// shows up soon.
+const aliasCacheKey = "federation:alias:"
+
+// Alias cache results, used as metric labels
+const (
+	aliasCacheHit         = "hit"
+	aliasCacheNegativeHit = "negative_hit"
+	aliasCacheMiss        = "miss"
+)
+
+// errAliasNotFound is returned when no room has an alias
+var errAliasNotFound = errors.New("room alias not found")
+
+// lookupRoomAlias resolves a room alias to its room ID through the Redis
+// cache, falling back to the directory store on a miss
+func (fs *FederationServer) lookupRoomAlias(ctx context.Context, alias string) (string, error) {
+	roomID, err := fs.redis.Get(ctx, fs.key(aliasCacheKey+alias)).Result()
+	if err == nil {
+		if roomID == "" {
+			metrics.AliasCache.WithLabelValues(aliasCacheNegativeHit).Inc()
+			return "", errAliasNotFound
+		}
+		metrics.AliasCache.WithLabelValues(aliasCacheHit).Inc()
+		return roomID, nil
+	}
+	if err != redis.Nil {
+		fs.logger.Warn("Failed to read alias cache", zap.String("alias", alias), zap.Error(err))
+	}
+	metrics.AliasCache.WithLabelValues(aliasCacheMiss).Inc()
+
+	roomID, err = fs.getRoomForAlias(alias)
+	ttl := *aliasCacheTTL
+	if err == errAliasNotFound {
+		roomID, ttl = "", *aliasMissTTL
+	} else if err != nil {
+		return "", err
+	}
+
+	if ttl > 0 {
+		if err := fs.redis.Set(ctx, fs.key(aliasCacheKey+alias), roomID, ttl).Err(); err != nil {
+			fs.logger.Warn("Failed to cache room alias", zap.String("alias", alias), zap.Error(err))
+		}
+	}
+
+	if roomID == "" {
+		return "", errAliasNotFound
+	}
+	return roomID, nil
+}
+
+// invalidateRoomAlias drops an alias from the cache after the directory
+// changes it
+func (fs *FederationServer) invalidateRoomAlias(ctx context.Context, alias string) error {
+	return fs.redis.Del(ctx, fs.key(aliasCacheKey+alias)).Err()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestLookupRoomAliasCache(t *testing.T) {
+	// The cache expires on miniredis's clock, which the test moves forward
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	fs := newTestServerOn(t, "a.example", rdb)
+	ctx := context.Background()
+
+	counts := func() map[string]float64 {
+		got := make(map[string]float64)
+		for _, result := range []string{aliasCacheHit, aliasCacheNegativeHit, aliasCacheMiss} {
+			got[result] = testutil.ToFloat64(metrics.AliasCache.WithLabelValues(result))
+		}
+		return got
+	}
+
+	// An unknown alias cached by an earlier lookup
+	fs.redis.Set(ctx, fs.key(aliasCacheKey+"#gone:a.example"), "", *aliasMissTTL)
+
+	steps := []struct {
+		name    string
+		alias   string
+		advance func()
+		want    string
+		result  string
+	}{
+		{"first lookup", "#lobby:a.example", nil, "room_id", aliasCacheMiss},
+		{"second lookup", "#lobby:a.example", nil, "room_id", aliasCacheHit},
+		{"cached unknown alias", "#gone:a.example", nil, "", aliasCacheNegativeHit},
+		{"unknown alias expired", "#gone:a.example", func() { mr.FastForward(*aliasMissTTL) }, "room_id", aliasCacheMiss},
+		{"before the cache expires", "#lobby:a.example", func() { mr.FastForward(*aliasCacheTTL - *aliasMissTTL - 1) }, "room_id", aliasCacheHit},
+		{"cache expired", "#lobby:a.example", func() { mr.FastForward(*aliasMissTTL + 1) }, "room_id", aliasCacheMiss},
+	}
+	for _, step := range steps {
+		if step.advance != nil {
+			step.advance()
+		}
+		before := counts()
+		roomID, err := fs.lookupRoomAlias(ctx, step.alias)
+		if step.want == "" && err != errAliasNotFound {
+			t.Errorf("%s: got %q, %v, want errAliasNotFound", step.name, roomID, err)
+		} else if step.want != "" && (roomID != step.want || err != nil) {
+			t.Errorf("%s: got %q, %v, want %q", step.name, roomID, err, step.want)
+		}
+
+		after := counts()
+		for result, n := range after {
+			want := 0.0
+			if result == step.result {
+				want = 1
+			}
+			if n-before[result] != want {
+				t.Errorf("%s: %s counted %v times, want %v", step.name, result, n-before[result], want)
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// knownServersKey is the Redis set of servers discovery connects to
+const knownServersKey = "federation:servers"
+
+// PeerDiscovery lists the federation servers this server should connect to
+type PeerDiscovery interface {
+	// KnownServers returns the names of the known servers
+	KnownServers(ctx context.Context) ([]string, error)
+}
+
+// redisPeerDiscovery reads known servers from a Redis set
+type redisPeerDiscovery struct {
+	redis *redis.Client
+	key   string
+}
+
+// NewRedisPeerDiscovery creates a discovery source reading the known
+// servers set, whose key starts with namespace
+func NewRedisPeerDiscovery(redisClient *redis.Client, namespace string) PeerDiscovery {
+	return &redisPeerDiscovery{redis: redisClient, key: namespace + knownServersKey}
+}
+
+func (d *redisPeerDiscovery) KnownServers(ctx context.Context) ([]string, error) {
+	return d.redis.SMembers(ctx, d.key).Result()
+}
+
+// staticPeerDiscovery returns a fixed list of servers
+type staticPeerDiscovery []string
+
+// NewStaticPeerDiscovery creates a discovery source always returning servers
+func NewStaticPeerDiscovery(servers []string) PeerDiscovery {
+	return staticPeerDiscovery(servers)
+}
+
+func (d staticPeerDiscovery) KnownServers(ctx context.Context) ([]string, error) {
+	return d, nil
+}
+
+// parsePeerList parses a list of server names separated by commas or
+// newlines, ignoring blanks and lines starting with #
+func parsePeerList(list string) []string {
+	var servers []string
+	for _, line := range strings.Split(list, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, server := range strings.Split(line, ",") {
+			server = strings.TrimSpace(server)
+			if server != "" {
+				servers = append(servers, server)
+			}
+		}
+	}
+	return servers
+}
+
+// newPeerDiscovery picks the discovery source from the flags: the servers
+// in -peers and -peers-file when either is set, otherwise the Redis set
+func newPeerDiscovery(redisClient *redis.Client) (PeerDiscovery, error) {
+	if *staticPeers == "" && *peersFile == "" {
+		return NewRedisPeerDiscovery(redisClient, redisNamespacePrefix(*redisNS)), nil
+	}
+
+	servers := parsePeerList(*staticPeers)
+	if *peersFile != "" {
+		data, err := os.ReadFile(*peersFile)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, parsePeerList(string(data))...)
+	}
+	return NewStaticPeerDiscovery(servers), nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePeerList(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{"", nil},
+		{"a.example", []string{"a.example"}},
+		{"a.example, b.example,,c.example:8448", []string{"a.example", "b.example", "c.example:8448"}},
+		{"# peers\na.example\n\n  # b.example\nc.example, d.example\n", []string{"a.example", "c.example", "d.example"}},
+	}
+	for _, tt := range tests {
+		if got := parsePeerList(tt.list); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePeerList(%q) = %q, want %q", tt.list, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// errDraining is returned for work refused while the server drains
+var errDraining = errors.New("federation server draining")
+
+// beginRequest registers an inbound request that Drain must wait for,
+// reporting false once draining has begun
+func (fs *FederationServer) beginRequest() bool {
+	fs.drainMu.Lock()
+	defer fs.drainMu.Unlock()
+
+	if fs.draining {
+		return false
+	}
+	fs.inflight.Add(1)
+	return true
+}
+
+// isDraining reports whether Drain has been called
+func (fs *FederationServer) isDraining() bool {
+	fs.drainMu.Lock()
+	defer fs.drainMu.Unlock()
+	return fs.draining
+}
+
+// Drain winds the server down ahead of Close: new inbound connections,
+// transactions and outbound dials are refused, in-flight transactions are
+// allowed to finish, and each peer connection stops writing, has its outbox
+// persisted to the Redis queue and is closed with a going-away frame. It
+// returns ctx's error if ctx ends first; outboxes are still flushed.
+func (fs *FederationServer) Drain(ctx context.Context) error {
+	fs.drainMu.Lock()
+	fs.draining = true
+	fs.drainMu.Unlock()
+
+	fs.logger.Info("Draining federation server")
+
+	done := make(chan struct{})
+	go func() {
+		fs.inflight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		fs.logger.Warn("Drain timed out waiting for in-flight transactions")
+	}
+
+	for _, conn := range fs.takeConnections() {
+		conn.stopOnce.Do(func() {
+			close(conn.stop)
+		})
+
+		// Let an in-flight write finish before the socket goes away
+		select {
+		case <-conn.writerDone:
+		case <-ctx.Done():
+		}
+
+		if conn.WebSocket != nil {
+			conn.WebSocket.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(time.Second))
+		}
+		conn.close()
+		fs.flushOutbox(ctx, conn)
+	}
+
+	return err
+}
+
+// takeConnections removes and returns every peer connection
+func (fs *FederationServer) takeConnections() []*FederationConnection {
+	fs.connectionsMu.Lock()
+	defer fs.connectionsMu.Unlock()
+
+	conns := make([]*FederationConnection, 0, len(fs.connections))
+	for name, conn := range fs.connections {
+		conns = append(conns, conn)
+		delete(fs.connections, name)
+	}
+	return conns
+}
+
+// refuseWhileDraining answers a request with 503 once draining has begun
+func refuseWhileDraining(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "30")
+	writeMatrixError(w, http.StatusServiceUnavailable, errcodeUnknown, "Server is shutting down")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainWaitsAndPersistsOutboxes(t *testing.T) {
+	fs := newTestServer(t, "a.example")
+	stalledConnection(fs, "b.example")
+	conn := fs.connections["b.example"]
+	conn.Outbox = make(chan FederationMessage, 2)
+	for _, nonce := range []string{"1", "2"} {
+		conn.Outbox <- FederationMessage{Type: msgTypeMessage, Nonce: nonce}
+	}
+
+	// A transaction still being processed
+	if !fs.beginRequest() {
+		t.Fatal("request refused before draining")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	drained := make(chan error, 1)
+	go func() { drained <- fs.Drain(ctx) }()
+
+	waitFor(t, "draining to begin", fs.isDraining)
+	select {
+	case err := <-drained:
+		t.Fatalf("Drain returned %v with a transaction in flight", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// New transactions are turned away meanwhile
+	w := httptest.NewRecorder()
+	newRouter(fs).ServeHTTP(w, httptest.NewRequest("PUT", "/_matrix/federation/v1/send/txn1", strings.NewReader("{}")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("transaction while draining: status %d, want 503", w.Code)
+	}
+
+	fs.inflight.Done()
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatalf("Drain: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Drain didn't return once the transaction finished")
+	}
+
+	if connected(fs, "b.example") {
+		t.Error("b still connected after Drain")
+	}
+	entries, err := fs.redis.LRange(context.Background(), fs.key(queueKeyPrefix+"b.example"), 0, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The queue is newest first
+	var nonces []string
+	for i := len(entries) - 1; i >= 0; i-- {
+		var entry queuedMessage
+		if err := json.Unmarshal([]byte(entries[i]), &entry); err != nil {
+			t.Fatal(err)
+		}
+		nonces = append(nonces, entry.Message.Nonce)
+	}
+	if want := []string{"1", "2"}; !reflect.DeepEqual(nonces, want) {
+		t.Errorf("queued %v after Drain, want %v", nonces, want)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// EDU types handled from federated servers
+const (
+	eduTypePresence = "m.presence"
+	eduTypeTyping   = "m.typing"
+	eduTypeReceipt  = "m.receipt"
+)
+
+// EDU processing results for the EDUs counter
+const (
+	eduResultProcessed = "processed"
+	eduResultInvalid   = "invalid"
+	eduResultIgnored   = "ignored"
+)
+
+// Redis keys and channel of the signaling server, whose presence records and
+// room delivery remote users are routed into
+const (
+	signalingPresenceKey     = "lr:presence:"
+	signalingPresenceTTL     = time.Hour
+	signalingPresenceVersion = 2
+	signalingChannel         = "lr:signaling"
+)
+
+// Signaling presence states accepted from remote servers
+var remotePresenceStates = map[string]bool{
+	"online":      true,
+	"unavailable": true,
+	"offline":     true,
+}
+
+var (
+	errInvalidEDU   = errors.New("invalid EDU")
+	errForeignUser  = errors.New("EDU names a user of another server")
+	errUnknownState = errors.New("unknown presence state")
+)
+
+// EDU is an ephemeral data unit received in a federation transaction
+type EDU struct {
+	Type    string          `json:"edu_type"`
+	Content json.RawMessage `json:"content"`
+}
+
+// processEDU dispatches an EDU from origin by type. Unknown types are
+// ignored, as other servers may send EDUs this server doesn't implement.
+func (fs *FederationServer) processEDU(ctx context.Context, origin string, raw json.RawMessage) error {
+	var edu EDU
+	if err := json.Unmarshal(raw, &edu); err != nil || len(edu.Content) == 0 {
+		metrics.EDUs.WithLabelValues("other", eduResultInvalid).Inc()
+		return errInvalidEDU
+	}
+
+	var err error
+	switch edu.Type {
+	case eduTypePresence:
+		err = fs.processPresenceEDU(ctx, origin, edu.Content)
+	case eduTypeTyping:
+		err = fs.processTypingEDU(ctx, origin, edu.Content)
+	case eduTypeReceipt:
+		err = fs.processReceiptEDU(ctx, origin, edu.Content)
+	case eduTypeDeviceListUpdate:
+		err = fs.processDeviceListUpdateEDU(ctx, origin, edu.Content)
+	default:
+		metrics.EDUs.WithLabelValues("other", eduResultIgnored).Inc()
+		return nil
+	}
+
+	if err != nil {
+		metrics.EDUs.WithLabelValues(edu.Type, eduResultInvalid).Inc()
+		return err
+	}
+	metrics.EDUs.WithLabelValues(edu.Type, eduResultProcessed).Inc()
+	return nil
+}
+
+// processPresenceEDU writes remote users' presence into the signaling
+// server's presence records, so presence queries report it
+func (fs *FederationServer) processPresenceEDU(ctx context.Context, origin string, content json.RawMessage) error {
+	var body struct {
+		Push []struct {
+			UserID          string `json:"user_id"`
+			Presence        string `json:"presence"`
+			StatusMsg       string `json:"status_msg,omitempty"`
+			LastActiveAgo   int64  `json:"last_active_ago"`
+			CurrentlyActive bool   `json:"currently_active"`
+		} `json:"push"`
+	}
+	if err := json.Unmarshal(content, &body); err != nil {
+		return errInvalidEDU
+	}
+
+	now := time.Now().UnixMilli()
+	for _, update := range body.Push {
+		if userServer(update.UserID) != origin {
+			return errForeignUser
+		}
+		if !remotePresenceStates[update.Presence] {
+			return errUnknownState
+		}
+
+		// Matrix "unavailable" is the signaling server's "away"
+		state := update.Presence
+		if state == "unavailable" {
+			state = "away"
+		}
+
+		record, err := json.Marshal(map[string]interface{}{
+			"v":                signalingPresenceVersion,
+			"presence":         state,
+			"status_msg":       update.StatusMsg,
+			"last_active_ts":   now - update.LastActiveAgo,
+			"currently_active": update.CurrentlyActive,
+		})
+		if err != nil {
+			return err
+		}
+		if err := fs.redis.Set(ctx, fs.key(signalingPresenceKey+update.UserID), record, signalingPresenceTTL).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processTypingEDU delivers a remote user's typing state to the room's
+// members on the signaling servers
+func (fs *FederationServer) processTypingEDU(ctx context.Context, origin string, content json.RawMessage) error {
+	var body struct {
+		RoomID string `json:"room_id"`
+		UserID string `json:"user_id"`
+		Typing bool   `json:"typing"`
+	}
+	if err := json.Unmarshal(content, &body); err != nil || body.RoomID == "" {
+		return errInvalidEDU
+	}
+	if userServer(body.UserID) != origin {
+		return errForeignUser
+	}
+
+	return fs.publishToRoom(ctx, "typing", body.UserID, body.RoomID, map[string]interface{}{
+		"typing": body.Typing,
+	})
+}
+
+// processReceiptEDU delivers remote users' read receipts to the rooms'
+// members on the signaling servers
+func (fs *FederationServer) processReceiptEDU(ctx context.Context, origin string, content json.RawMessage) error {
+	// room ID -> receipt type -> user ID -> receipt
+	var body map[string]map[string]map[string]struct {
+		EventIDs []string `json:"event_ids"`
+	}
+	if err := json.Unmarshal(content, &body); err != nil {
+		return errInvalidEDU
+	}
+
+	for roomID, receipts := range body {
+		for userID, receipt := range receipts["m.read"] {
+			if userServer(userID) != origin {
+				return errForeignUser
+			}
+			if len(receipt.EventIDs) == 0 || !validEventID(receipt.EventIDs[0]) {
+				return errInvalidEDU
+			}
+
+			err := fs.publishToRoom(ctx, "receipt", userID, roomID, map[string]interface{}{
+				"message_id": receipt.EventIDs[0],
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// publishToRoom publishes a message from a remote user on the signaling
+// channel, where each signaling server delivers it to its room members
+func (fs *FederationServer) publishToRoom(ctx context.Context, msgType, userID, roomID string, payload interface{}) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"type":      msgType,
+		"from":      userID,
+		"room":      roomID,
+		"payload":   payload,
+		"timestamp": time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	return fs.redis.Publish(ctx, fs.key(signalingChannel), data).Err()
+}
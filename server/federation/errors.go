@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Matrix error codes
+const (
+	errcodeNotFound      = "M_NOT_FOUND"
+	errcodeBadJSON       = "M_BAD_JSON"
+	errcodeUnauthorized  = "M_UNAUTHORIZED"
+	errcodeForbidden     = "M_FORBIDDEN"
+	errcodeInvalidParam  = "M_INVALID_PARAM"
+	errcodeMissingParam  = "M_MISSING_PARAM"
+	errcodeLimitExceeded = "M_LIMIT_EXCEEDED"
+	errcodeIncompatible  = "M_INCOMPATIBLE_VERSION"
+	errcodeUnknown       = "M_UNKNOWN"
+)
+
+// writeMatrixError writes an error response in the Matrix {errcode, error}
+// format
+func writeMatrixError(w http.ResponseWriter, status int, errcode, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"errcode": errcode,
+		"error":   msg,
+	})
+}
@@ -10,5 +10,7 @@ require (
 	github.com/prometheus/client_golang v1.18.0
 	go.uber.org/zap v1.26.0
 	golang.org/x/crypto v0.17.0
+	golang.org/x/time v0.5.0
 	google.golang.org/protobuf v1.32.0
+	github.com/alicebob/miniredis/v2 v2.31.1
 )
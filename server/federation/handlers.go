@@ -3,28 +3,42 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 )
 
 // Federation HTTP Handlers
 
 // handleSend handles incoming federation send requests
 func (fs *FederationServer) handleSend(w http.ResponseWriter, r *http.Request) {
+	if !fs.beginRequest() {
+		refuseWhileDraining(w)
+		return
+	}
+	defer fs.inflight.Done()
+
 	vars := mux.Vars(r)
 	txnID := vars["txnID"]
+	if !validTxnID(txnID) {
+		writeMatrixError(w, http.StatusBadRequest, errcodeBadJSON, "Invalid transaction ID")
+		return
+	}
 
 	var body struct {
-		Origin         string        `json:"origin"`
-		OriginServerTS int64         `json:"origin_server_ts"`
-		PDUs           []interface{} `json:"pdus"`
-		EDUs           []interface{} `json:"edus"`
+		Origin         string            `json:"origin"`
+		OriginServerTS int64             `json:"origin_server_ts"`
+		PDUs           []json.RawMessage `json:"pdus"`
+		EDUs           []json.RawMessage `json:"edus"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		writeMatrixError(w, http.StatusBadRequest, errcodeBadJSON, "Invalid JSON")
 		return
 	}
 
@@ -34,18 +48,37 @@ func (fs *FederationServer) handleSend(w http.ResponseWriter, r *http.Request) {
 		zap.Int("pdu_count", len(body.PDUs)),
 		zap.Int("edu_count", len(body.EDUs)))
 
-	// Process PDUs and EDUs
+	// Process PDUs and EDUs, reporting the outcome of each PDU
+	results := make(map[string]interface{}, len(body.PDUs))
 	for _, pdu := range body.PDUs {
-		fs.processPDU(pdu)
+		timer := prometheus.NewTimer(metrics.PDUProcessing)
+		eventID, err := fs.processPDU(r.Context(), pdu)
+		timer.ObserveDuration()
+
+		if eventID == "" {
+			fs.logger.Warn("Dropped PDU without event ID", zap.String("origin", body.Origin))
+			continue
+		}
+		if err != nil {
+			fs.logger.Warn("Rejected PDU",
+				zap.String("origin", body.Origin),
+				zap.String("event_id", eventID),
+				zap.Error(err))
+			results[eventID] = map[string]string{"error": err.Error()}
+			continue
+		}
+		results[eventID] = map[string]interface{}{}
 	}
 
+	// EDUs are ephemeral; failures are logged and not reported back
 	for _, edu := range body.EDUs {
-		fs.processEDU(edu)
+		if err := fs.processEDU(r.Context(), body.Origin, edu); err != nil {
+			fs.logger.Debug("Dropped EDU", zap.String("origin", body.Origin), zap.Error(err))
+		}
 	}
 
-	// Respond with success
 	response := map[string]interface{}{
-		"pdus": map[string]interface{}{},
+		"pdus": results,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -57,9 +90,14 @@ func (fs *FederationServer) handleQueryDirectory(w http.ResponseWriter, r *http.
 	roomAlias := r.URL.Query().Get("room_alias")
 
 	// Look up room ID for alias
-	roomID, err := fs.getRoomForAlias(roomAlias)
+	roomID, err := fs.lookupRoomAlias(r.Context(), roomAlias)
+	if err == errAliasNotFound {
+		writeMatrixError(w, http.StatusNotFound, errcodeNotFound, "Room not found")
+		return
+	}
 	if err != nil {
-		http.Error(w, "Room not found", http.StatusNotFound)
+		fs.logger.Error("Failed to look up room alias", zap.String("alias", roomAlias), zap.Error(err))
+		writeMatrixError(w, http.StatusInternalServerError, errcodeUnknown, "Failed to look up room alias")
 		return
 	}
 
@@ -72,42 +110,93 @@ func (fs *FederationServer) handleQueryDirectory(w http.ResponseWriter, r *http.
 	json.NewEncoder(w).Encode(response)
 }
 
-// handleQueryProfile handles user profile queries
+// handleQueryProfile handles user profile queries, optionally limited to a
+// single field
 func (fs *FederationServer) handleQueryProfile(w http.ResponseWriter, r *http.Request) {
 	userID := r.URL.Query().Get("user_id")
+	field := r.URL.Query().Get("field")
+
+	if field != "" && field != profileFieldDisplayName && field != profileFieldAvatarURL {
+		writeMatrixError(w, http.StatusBadRequest, errcodeInvalidParam, "Unknown profile field")
+		return
+	}
 
 	// Get user profile from local database
 	profile, err := fs.getUserProfile(userID)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+		writeMatrixError(w, http.StatusNotFound, errcodeNotFound, "User not found")
 		return
 	}
 
-	response := map[string]interface{}{
-		"displayname": profile.DisplayName,
-		"avatar_url":  profile.AvatarURL,
+	response := map[string]interface{}{}
+	if profile.DisplayName != "" {
+		response[profileFieldDisplayName] = profile.DisplayName
+	}
+	if validMXCURI(profile.AvatarURL) {
+		response[profileFieldAvatarURL] = profile.AvatarURL
+	} else if profile.AvatarURL != "" {
+		fs.logger.Warn("Omitting malformed avatar URL", zap.String("user_id", userID))
+	}
+
+	if field != "" {
+		value, ok := response[field]
+		if !ok {
+			writeMatrixError(w, http.StatusNotFound, errcodeNotFound, "Profile field not set")
+			return
+		}
+		response = map[string]interface{}{field: value}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// handleQueryEvent handles event queries
+// Profile fields that can be queried individually
+const (
+	profileFieldDisplayName = "displayname"
+	profileFieldAvatarURL   = "avatar_url"
+)
+
+// mxcURIPattern matches mxc://<server-name>/<media-id>
+var mxcURIPattern = regexp.MustCompile(`^mxc://[A-Za-z0-9.\-]+(:[0-9]{1,5})?/[A-Za-z0-9_\-]+$`)
+
+// validMXCURI reports whether uri is a well-formed Matrix content URI
+func validMXCURI(uri string) bool {
+	return mxcURIPattern.MatchString(uri)
+}
+
+// handleQueryEvent returns an event together with its auth chain
 func (fs *FederationServer) handleQueryEvent(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	eventID := vars["eventID"]
+	if !validEventID(eventID) {
+		writeMatrixError(w, http.StatusBadRequest, errcodeInvalidParam, "Invalid event ID")
+		return
+	}
 
-	// Look up event
-	event, err := fs.getEvent(eventID)
+	event, err := fs.events.GetEvent(r.Context(), eventID)
+	if err == errEventNotFound {
+		writeMatrixError(w, http.StatusNotFound, errcodeNotFound, "Event not found")
+		return
+	}
 	if err != nil {
-		http.Error(w, "Event not found", http.StatusNotFound)
+		fs.logger.Error("Failed to load event", zap.String("event_id", eventID), zap.Error(err))
+		writeMatrixError(w, http.StatusInternalServerError, errcodeUnknown, "Failed to load event")
+		return
+	}
+
+	authChain, err := getAuthChain(r.Context(), fs.events, event)
+	if err != nil {
+		fs.logger.Error("Failed to load auth chain", zap.String("event_id", eventID), zap.Error(err))
+		writeMatrixError(w, http.StatusInternalServerError, errcodeUnknown, "Failed to load auth chain")
 		return
 	}
 
 	response := map[string]interface{}{
-		"origin":         fs.serverName,
-		"origin_server_ts": time.Now().Unix(),
-		"event":          event,
+		"origin":           fs.serverName,
+		"origin_server_ts": time.Now().UnixMilli(),
+		"event":            event,
+		"auth_chain":       authChain,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -119,13 +208,19 @@ func (fs *FederationServer) handleBackfill(w http.ResponseWriter, r *http.Reques
 	vars := mux.Vars(r)
 	roomID := vars["roomID"]
 
-	limit := r.URL.Query().Get("limit")
-	// Process backfill request
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	// Load history preceding the requested events
+	events, err := fs.events.GetRoomEvents(r.Context(), roomID, r.URL.Query()["v"], clampBackfillLimit(limit))
+	if err != nil {
+		writeMatrixError(w, http.StatusInternalServerError, errcodeUnknown, "Failed to load events")
+		return
+	}
 
 	response := map[string]interface{}{
-		"origin":         fs.serverName,
+		"origin":           fs.serverName,
 		"origin_server_ts": time.Now().Unix(),
-		"events":         []interface{}{},
+		"events":           events,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -134,48 +229,71 @@ func (fs *FederationServer) handleBackfill(w http.ResponseWriter, r *http.Reques
 
 // handlePublicRooms handles public room list requests
 func (fs *FederationServer) handlePublicRooms(w http.ResponseWriter, r *http.Request) {
-	// Get public rooms
-	rooms, err := fs.getPublicRooms()
+	query := r.URL.Query()
+
+	limit, err := parsePublicRoomsLimit(query.Get("limit"))
 	if err != nil {
-		http.Error(w, "Failed to get rooms", http.StatusInternalServerError)
+		writeMatrixError(w, http.StatusBadRequest, errcodeInvalidParam, "Invalid limit")
 		return
 	}
 
-	response := map[string]interface{}{
-		"chunk": rooms,
+	// Get a page of public rooms
+	page, err := fs.getPublicRooms(query.Get("since"), limit)
+	if err == errInvalidBatchToken {
+		writeMatrixError(w, http.StatusBadRequest, errcodeInvalidParam, "Invalid pagination token")
+		return
+	}
+	if err != nil {
+		writeMatrixError(w, http.StatusInternalServerError, errcodeUnknown, "Failed to get rooms")
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(page)
 }
 
 // handleWebSocket handles WebSocket federation connections
 func (fs *FederationServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		fs.logger.Error("WebSocket upgrade failed", zap.Error(err))
-		return
-	}
-
 	// Authenticate connection (simplified)
 	serverName := r.URL.Query().Get("server_name")
 	if serverName == "" {
-		conn.Close()
+		writeMatrixError(w, http.StatusBadRequest, errcodeMissingParam, "Missing server_name")
 		return
 	}
 
-	// Register connection
-	fedConn := &FederationConnection{
-		ServerName: serverName,
-		WebSocket:  conn,
-		LastSeen:   time.Now(),
-		Connected:  true,
-		Outbox:     make(chan FederationMessage, 1000),
+	if fs.isDraining() {
+		refuseWhileDraining(w)
+		return
 	}
 
-	fs.connectionsMu.Lock()
-	fs.connections[serverName] = fedConn
-	fs.connectionsMu.Unlock()
+	// Refuse servers an operator has disconnected
+	if denied, err := fs.isPeerDenied(r.Context(), serverName); err != nil || denied {
+		writeMatrixError(w, http.StatusForbidden, errcodeForbidden, "Server not permitted")
+		return
+	}
+
+	// Agree on a protocol version, echoing it as the subprotocol to peers
+	// that offered versions
+	offered := websocket.Subprotocols(r)
+	version, err := negotiateVersion(offered)
+	if err != nil {
+		writeMatrixError(w, http.StatusBadRequest, errcodeIncompatible, "No supported protocol version offered")
+		return
+	}
+	var header http.Header
+	if len(offered) > 0 {
+		header = http.Header{"Sec-WebSocket-Protocol": {versionSubprotocol(version)}}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		fs.logger.Error("WebSocket upgrade failed", zap.Error(err))
+		return
+	}
+
+	// Register connection, replacing any previous one from the server
+	fedConn := newFederationConnection(serverName, conn, version)
+	fs.replaceConnection(fedConn)
 
 	fs.logger.Info("Federation WebSocket connected",
 		zap.String("server", serverName))
@@ -208,14 +326,6 @@ func (fs *FederationServer) handleClientWellKnown(w http.ResponseWriter, r *http
 
 // Stub methods for event processing
 
-func (fs *FederationServer) processPDU(pdu interface{}) {
-	// Process PDU (Persistent Data Unit)
-}
-
-func (fs *FederationServer) processEDU(edu interface{}) {
-	// Process EDU (Ephemeral Data Unit)
-}
-
 func (fs *FederationServer) getRoomForAlias(alias string) (string, error) {
 	// Look up room ID for alias
 	return "room_id", nil
@@ -232,14 +342,3 @@ func (fs *FederationServer) getUserProfile(userID string) (*UserProfile, error)
 		AvatarURL:   "mxc://example.com/avatar",
 	}, nil
 }
-
-func (fs *FederationServer) getEvent(eventID string) (interface{}, error) {
-	return map[string]interface{}{}, nil
-}
-
-func (fs *FederationServer) getPublicRooms() ([]interface{}, error) {
-	return []interface{}{}, nil
-}
-
-// Add missing import
-import "go.uber.org/zap"
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidMXCURI(t *testing.T) {
+	tests := map[string]bool{
+		"mxc://example.org/abc123":           true,
+		"mxc://example.org:8448/media_id-1":  true,
+		"mxc://127.0.0.1/SEsfnsuifSDFSSEF":   true,
+		"":                                   false,
+		"https://example.org/abc123":         false,
+		"mxc://example.org/":                 false,
+		"mxc:///abc123":                      false,
+		"mxc://example.org/abc/def":          false,
+		"mxc://example.org/abc?x=1":          false,
+		"mxc://example.org:123456/abc":       false,
+		"mxc://example.org/abc\"onerror=x":   false,
+		"javascript:alert(1)//mxc://a.b/abc": false,
+	}
+	for uri, want := range tests {
+		if got := validMXCURI(uri); got != want {
+			t.Errorf("validMXCURI(%q) = %v, want %v", uri, got, want)
+		}
+	}
+}
+
+func TestMatrixErrors(t *testing.T) {
+	token := *adminToken
+	t.Cleanup(func() { *adminToken = token })
+
+	fs := newTestServer(t, "a.example")
+	router := newRouter(fs)
+
+	// Alias lookups have no backing store yet, so cache a miss
+	if err := fs.redis.Set(context.Background(), fs.key(aliasCacheKey+"#nope:a.example"), "", time.Minute).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		adminToken   string
+		method, path string
+		body         string
+		header       string
+		status       int
+		errcode      string
+	}{
+		{"invalid transaction ID", "", "PUT", "/_matrix/federation/v1/send/" + strings.Repeat("a", 256), "{}", "", http.StatusBadRequest, errcodeBadJSON},
+		{"invalid transaction body", "", "PUT", "/_matrix/federation/v1/send/txn1", "{", "", http.StatusBadRequest, errcodeBadJSON},
+		{"unknown alias", "", "GET", "/_matrix/federation/v1/query/directory?room_alias=%23nope:a.example", "", "", http.StatusNotFound, errcodeNotFound},
+		{"unknown profile field", "", "GET", "/_matrix/federation/v1/query/profile?user_id=@alice:a.example&field=email", "", "", http.StatusBadRequest, errcodeInvalidParam},
+		{"invalid event ID", "", "GET", "/_matrix/federation/v1/event/nope", "", "", http.StatusBadRequest, errcodeInvalidParam},
+		{"unknown event", "", "GET", "/_matrix/federation/v1/event/$missing:a.example", "", "", http.StatusNotFound, errcodeNotFound},
+		{"invalid room list limit", "", "GET", "/_matrix/federation/v1/publicRooms?limit=x", "", "", http.StatusBadRequest, errcodeInvalidParam},
+		{"invalid pagination token", "", "GET", "/_matrix/federation/v1/publicRooms?since=%25%25", "", "", http.StatusBadRequest, errcodeInvalidParam},
+		{"invalid device user", "", "GET", "/_matrix/federation/v1/user/devices/alice", "", "", http.StatusBadRequest, errcodeInvalidParam},
+		{"remote device user", "", "GET", "/_matrix/federation/v1/user/devices/@bob:b.example", "", "", http.StatusForbidden, errcodeForbidden},
+		{"WebSocket without server name", "", "GET", "/_matrix/federation/v1/ws", "", "", http.StatusBadRequest, errcodeMissingParam},
+		{"admin API disabled", "", "GET", "/admin/federation/peers", "", "", http.StatusForbidden, errcodeForbidden},
+		{"admin without token", "secret", "GET", "/admin/federation/peers", "", "", http.StatusUnauthorized, errcodeUnauthorized},
+		{"admin invalid body", "secret", "POST", "/admin/federation/connect", "{", "Bearer secret", http.StatusBadRequest, errcodeBadJSON},
+	}
+	for _, tt := range tests {
+		*adminToken = tt.adminToken
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		var body struct {
+			Errcode string `json:"errcode"`
+			Error   string `json:"error"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+			t.Errorf("%s: undecodable error response: %v", tt.name, err)
+			continue
+		}
+		if w.Code != tt.status || body.Errcode != tt.errcode || body.Error == "" {
+			t.Errorf("%s: %d %+v, want %d %s", tt.name, w.Code, body, tt.status, tt.errcode)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: Content-Type %q", tt.name, ct)
+		}
+	}
+}
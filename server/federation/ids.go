@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strings"
+)
+
+// Matrix identifier sigils and limits
+const (
+	eventIDSigil   = "$"
+	userIDSigil    = "@"
+	maxIDLength    = 255
+	maxTxnIDLength = 255
+)
+
+// txnIDPattern restricts transaction IDs to URL-unreserved characters
+var txnIDPattern = regexp.MustCompile(`^[A-Za-z0-9._~-]+$`)
+
+// validTxnID reports whether a transaction ID is safe to use as a cache key
+// and log field
+func validTxnID(txnID string) bool {
+	return len(txnID) > 0 && len(txnID) <= maxTxnIDLength && txnIDPattern.MatchString(txnID)
+}
+
+// validEventID reports whether id looks like an event ID: the event sigil
+// followed by printable characters, within the length limit
+func validEventID(id string) bool {
+	if len(id) < 2 || len(id) > maxIDLength || !strings.HasPrefix(id, eventIDSigil) {
+		return false
+	}
+	for _, r := range id[1:] {
+		if r <= ' ' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// userServer returns the server name of a user ID, or "" if it isn't one
+func userServer(userID string) string {
+	if !strings.HasPrefix(userID, userIDSigil) || len(userID) > maxIDLength {
+		return ""
+	}
+	if i := strings.IndexByte(userID, ':'); i > 1 {
+		return userID[i+1:]
+	}
+	return ""
+}
+
+// newEventID derives the ID of a locally-originated event from its
+// reference hash: the unpadded URL-safe base64 sha256 of the redacted event
+// without signatures. The event must already carry its content hash.
+func newEventID(event map[string]interface{}) (string, error) {
+	redacted := redactEvent(event)
+	delete(redacted, "signatures")
+	delete(redacted, "unsigned")
+	delete(redacted, "event_id")
+
+	data, err := canonicalJSON(redacted)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return eventIDSigil + base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidTxnID(t *testing.T) {
+	tests := map[string]bool{
+		"1700000000000":          true,
+		"m1.abc_DEF-~":           true,
+		strings.Repeat("a", 255): true,
+		"":                       false,
+		strings.Repeat("a", 256): false,
+		"a/b":                    false,
+		"a b":                    false,
+		"txn\n":                  false,
+		"federation:txn:*":       false,
+	}
+	for id, want := range tests {
+		if got := validTxnID(id); got != want {
+			t.Errorf("validTxnID(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestValidEventID(t *testing.T) {
+	tests := map[string]bool{
+		"$abc:example.org":                     true,
+		"$Rqnc-F-dvnEYJTyHq_iKxU2bZ1CI92-kuZq": true,
+		"$" + strings.Repeat("a", 254):         true,
+		"":                                     false,
+		"$":                                    false,
+		"abc:example.org":                      false,
+		"$" + strings.Repeat("a", 255):         false,
+		"$abc def":                             false,
+		"$abc\x7f":                             false,
+		"$abc\n":                               false,
+	}
+	for id, want := range tests {
+		if got := validEventID(id); got != want {
+			t.Errorf("validEventID(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
+
+func TestNewEventID(t *testing.T) {
+	event := testEvent(t)
+	id, err := newEventID(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !validEventID(id) {
+		t.Fatalf("newEventID = %q, not a valid event ID", id)
+	}
+
+	// Fields outside the redacted event don't change the ID
+	event["unsigned"] = map[string]interface{}{"age": 1}
+	event["event_id"] = "$other"
+	event["signatures"] = map[string]interface{}{"remote.example": map[string]interface{}{}}
+	if again, _ := newEventID(event); again != id {
+		t.Errorf("newEventID changed with unsigned, event_id or signatures: %s != %s", again, id)
+	}
+
+	event["depth"] = 13
+	if changed, _ := newEventID(event); changed == id {
+		t.Error("newEventID unchanged after editing depth")
+	}
+}
+
+func TestUserServer(t *testing.T) {
+	tests := map[string]string{
+		"@alice:example.org":      "example.org",
+		"@alice:example.org:8448": "example.org:8448",
+		"@:example.org":           "",
+		"alice:example.org":       "",
+		"@alice":                  "",
+		"":                        "",
+		"@" + strings.Repeat("a", 250) + ":example.org": "",
+	}
+	for userID, want := range tests {
+		if got := userServer(userID); got != want {
+			t.Errorf("userServer(%q) = %q, want %q", userID, got, want)
+		}
+	}
+}
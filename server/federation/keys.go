@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Server signing key cache settings
+const (
+	serverKeysKey      = "federation:keys:"
+	minServerKeysTTL   = 5 * time.Minute
+	maxServerKeysTTL   = 24 * time.Hour
+	maxKeyResponseSize = 64 * 1024
+)
+
+// errKeyServerMismatch is returned when a key response names another server
+var errKeyServerMismatch = errors.New("key response is for a different server")
+
+// serverKeys returns a server's ed25519 verify keys by key ID, fetching
+// them from the server and caching them in Redis
+func (fs *FederationServer) serverKeys(ctx context.Context, serverName string) (map[string]ed25519.PublicKey, error) {
+	encoded := make(map[string]string)
+
+	if data, err := fs.redis.Get(ctx, fs.key(serverKeysKey+serverName)).Bytes(); err == nil && json.Unmarshal(data, &encoded) == nil {
+		return decodeVerifyKeys(encoded)
+	}
+
+	encoded, ttl, err := fs.fetchServerKeys(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err := json.Marshal(encoded); err == nil {
+		if err := fs.redis.Set(ctx, fs.key(serverKeysKey+serverName), data, ttl).Err(); err != nil {
+			fs.logger.Warn("Failed to cache server keys",
+				zap.String("server", serverName),
+				zap.Error(err))
+		}
+	}
+
+	return decodeVerifyKeys(encoded)
+}
+
+// fetchServerKeys fetches a server's self-signed verify keys and how long
+// they may be cached
+func (fs *FederationServer) fetchServerKeys(ctx context.Context, serverName string) (map[string]string, time.Duration, error) {
+	host, err := fs.resolveServerHost(ctx, serverName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+host+"/_matrix/key/v2/server", nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := fs.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("key server returned status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxKeyResponseSize))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var body struct {
+		ServerName   string `json:"server_name"`
+		ValidUntilTS int64  `json:"valid_until_ts"`
+		VerifyKeys   map[string]struct {
+			Key string `json:"key"`
+		} `json:"verify_keys"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, 0, err
+	}
+	if body.ServerName != serverName {
+		return nil, 0, errKeyServerMismatch
+	}
+
+	encoded := make(map[string]string, len(body.VerifyKeys))
+	for keyID, key := range body.VerifyKeys {
+		encoded[keyID] = key.Key
+	}
+	keys, err := decodeVerifyKeys(encoded)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// The response must be signed by the keys it publishes
+	obj, err := decodeJSONObject(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := verifyJSONSignature(obj, serverName, keys); err != nil {
+		return nil, 0, err
+	}
+
+	ttl := time.Until(time.UnixMilli(body.ValidUntilTS))
+	if ttl < minServerKeysTTL {
+		ttl = minServerKeysTTL
+	}
+	if ttl > maxServerKeysTTL {
+		ttl = maxServerKeysTTL
+	}
+
+	return encoded, ttl, nil
+}
+
+// decodeVerifyKeys decodes unpadded base64 ed25519 keys, ignoring other
+// algorithms
+func decodeVerifyKeys(encoded map[string]string) (map[string]ed25519.PublicKey, error) {
+	keys := make(map[string]ed25519.PublicKey, len(encoded))
+	for keyID, key := range encoded {
+		if !strings.HasPrefix(keyID, "ed25519:") {
+			continue
+		}
+		raw, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(key, "="))
+		if err != nil || len(raw) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid verify key %s", keyID)
+		}
+		keys[keyID] = ed25519.PublicKey(raw)
+	}
+	return keys, nil
+}
@@ -15,30 +15,70 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
 var (
-	addr       = flag.String("addr", ":8082", "HTTP server address")
-	serverName = flag.String("server-name", "libertyreach.io", "Federation server name")
-	serverKey  = flag.String("server-key", os.Getenv("FEDERATION_KEY"), "Server private key")
-	redisAddr  = flag.String("redis", "localhost:6379", "Redis server address")
+	addr                 = flag.String("addr", ":8082", "HTTP server address")
+	serverName           = flag.String("server-name", "libertyreach.io", "Federation server name")
+	serverKey            = flag.String("server-key", os.Getenv("FEDERATION_KEY"), "Server private key")
+	redisAddr            = flag.String("redis", "localhost:6379", "Redis server address")
+	selfCheck            = flag.Bool("check", false, "Check Redis, the server key and server name resolution, print a report and exit (non-zero on failure)")
+	redisNS              = flag.String("redis-namespace", "", "Prefix for every Redis key and channel; must match the signaling server's -redis-namespace")
+	replayWindow         = flag.Duration("replay-window", 5*time.Minute, "Accepted clock difference for federation message timestamps")
+	outboxSize           = flag.Int("outbox-size", 1000, "Messages buffered per peer connection")
+	outboxOverflow       = flag.String("outbox-overflow", overflowQueue, "Policy when a peer's outbox is full (queue|drop-oldest)")
+	adminToken           = flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token for the admin API (disabled if empty)")
+	inboundRPS           = flag.Float64("inbound-rps", 20, "Inbound federation requests per second allowed per remote address")
+	inboundBurst         = flag.Int("inbound-burst", 100, "Burst of inbound federation requests allowed per remote address")
+	queueAttempts        = flag.Int("queue-max-attempts", 5, "Delivery attempts before a queued message is dead-lettered")
+	queueTTL             = flag.Duration("queue-ttl", 24*time.Hour, "How long a message may wait for its server before it is dead-lettered")
+	shutdownGrace        = flag.Duration("shutdown-grace", 10*time.Second, "Time allowed on shutdown to flush peer outboxes to the queue")
+	maxFrameSize         = flag.Int64("max-frame-size", 4<<20, "Largest WebSocket message accepted from a federation peer, in bytes")
+	outboundTimeout      = flag.Duration("outbound-timeout", 10*time.Second, "Timeout for outbound federation HTTP requests")
+	aliasCacheTTL        = flag.Duration("alias-cache-ttl", time.Hour, "How long resolved room aliases are cached (0 disables)")
+	aliasMissTTL         = flag.Duration("alias-negative-ttl", 5*time.Minute, "How long unknown room aliases are cached (0 disables)")
+	peerBreakerThreshold = flag.Int("peer-breaker-threshold", 5, "Consecutive dial or write failures before a peer's circuit breaker opens")
+	peerBreakerCooldown  = flag.Duration("peer-breaker-cooldown", time.Minute, "How long an open peer circuit breaker waits before probing the peer again")
+	staticPeers          = flag.String("peers", "", "Comma-separated servers to federate with, instead of the Redis known servers set")
+	peersFile            = flag.String("peers-file", "", "File listing servers to federate with, one per line, instead of the Redis known servers set")
+	txnMaxPDUs           = flag.Int("txn-max-pdus", maxTxnPDUs, "PDUs per outbound transaction before it is sent (at most 50)")
+	txnMaxEDUs           = flag.Int("txn-max-edus", maxTxnEDUs, "EDUs per outbound transaction before it is sent (at most 100)")
+	txnMaxBytes          = flag.Int("txn-max-bytes", 1<<20, "Event bytes per outbound transaction before it is sent (0 disables)")
+	txnFlushDelay        = flag.Duration("txn-flush-delay", 100*time.Millisecond, "How long an outbound transaction waits for more events before it is sent")
+	proxyCIDRs           = flag.String("trusted-proxies", "", "Comma-separated proxy networks whose X-Forwarded-For and X-Real-IP headers are believed")
 )
 
 var (
-	logger     *zap.Logger
-	upgrader   = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin:     func(r *http.Request) bool { return true },
+	logger   *zap.Logger
+	upgrader = websocket.Upgrader{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		CheckOrigin:       func(r *http.Request) bool { return true },
+		EnableCompression: true,
 	}
-	metrics = NewFederationMetrics()
+	dialer = websocket.Dialer{
+		Proxy:             http.ProxyFromEnvironment,
+		HandshakeTimeout:  45 * time.Second,
+		EnableCompression: true,
+		Subprotocols:      versionSubprotocols(),
+	}
+	metrics = NewFederationMetrics(prometheus.DefaultRegisterer)
 )
 
 func main() {
 	flag.Parse()
 
+	if *selfCheck {
+		if !reportSelfChecks(os.Stdout, runSelfChecks()) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	var err error
 	logger, err = zap.NewProduction()
 	if err != nil {
@@ -46,6 +86,15 @@ func main() {
 	}
 	defer logger.Sync()
 
+	if *outboxOverflow != overflowQueue && *outboxOverflow != overflowDropOldest {
+		logger.Fatal("Invalid outbox overflow policy", zap.String("policy", *outboxOverflow))
+	}
+
+	trustedProxies, err = parseCIDRs(*proxyCIDRs)
+	if err != nil {
+		logger.Fatal("Invalid trusted proxies", zap.Error(err))
+	}
+
 	// Initialize components
 	redisClient, err := newRedisClient(*redisAddr)
 	if err != nil {
@@ -53,29 +102,14 @@ func main() {
 	}
 	defer redisClient.Close()
 
-	server := NewFederationServer(*serverName, *serverKey, redisClient, logger)
+	discovery, err := newPeerDiscovery(redisClient)
+	if err != nil {
+		logger.Fatal("Failed to load peers", zap.Error(err))
+	}
 
-	// Setup routes
-	router := mux.NewRouter()
-	
-	// Federation API
-	router.HandleFunc("/_matrix/federation/v1/send/{txnID}", server.handleSend).Methods("PUT")
-	router.HandleFunc("/_matrix/federation/v1/query/directory", server.handleQueryDirectory).Methods("GET")
-	router.HandleFunc("/_matrix/federation/v1/query/profile", server.handleQueryProfile).Methods("GET")
-	router.HandleFunc("/_matrix/federation/v1/event/{eventID}", server.handleQueryEvent).Methods("GET")
-	router.HandleFunc("/_matrix/federation/v1/backfill/{roomID}", server.handleBackfill).Methods("GET")
-	router.HandleFunc("/_matrix/federation/v1/publicRooms", server.handlePublicRooms).Methods("GET")
-	
-	// WebSocket federation connections
-	router.HandleFunc("/_matrix/federation/v1/ws", server.handleWebSocket).Methods("GET")
-	
-	// Well-known discovery
-	router.HandleFunc("/.well-known/matrix/server", server.handleWellKnown).Methods("GET")
-	router.HandleFunc("/.well-known/matrix/client", server.handleClientWellKnown).Methods("GET")
-	
-	// Health and metrics
-	router.HandleFunc("/health", handleHealth).Methods("GET")
-	router.HandleFunc("/metrics", promhttp.Handler().ServeHTTP).Methods("GET")
+	server := NewFederationServer(*serverName, *serverKey, redisClient, discovery, logger)
+
+	router := newRouter(server)
 
 	// Create server
 	httpServer := &http.Server{
@@ -94,18 +128,22 @@ func main() {
 		logger.Info("Starting Federation Server",
 			zap.String("address", *addr),
 			zap.String("server-name", *serverName))
-		
+
 		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			logger.Fatal("Server failed", zap.Error(err))
 		}
 	}()
 
 	<-ctx.Done()
-	
+
 	logger.Info("Shutting down federation server...")
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
-	
+
+	if err := server.Drain(shutdownCtx); err != nil {
+		logger.Warn("Federation drain incomplete", zap.Error(err))
+	}
+
 	if err := httpServer.Shutdown(shutdownCtx); err != nil {
 		logger.Error("Server shutdown failed", zap.Error(err))
 	}
@@ -114,6 +152,57 @@ func main() {
 	logger.Info("Federation server stopped")
 }
 
+// newRouter sets up the federation, discovery, admin and health routes
+func newRouter(server *FederationServer) *mux.Router {
+	router := mux.NewRouter()
+
+	// Federation API, rate limited per remote address
+	federation := router.PathPrefix("/_matrix/federation/v1").Subrouter()
+	federation.Use(server.rateLimitInbound)
+	federation.HandleFunc("/send/{txnID}", server.handleSend).Methods("PUT")
+	federation.HandleFunc("/query/directory", server.handleQueryDirectory).Methods("GET")
+	federation.HandleFunc("/query/profile", server.handleQueryProfile).Methods("GET")
+	federation.HandleFunc("/event/{eventID}", server.handleQueryEvent).Methods("GET")
+	federation.HandleFunc("/backfill/{roomID}", server.handleBackfill).Methods("GET")
+	federation.HandleFunc("/publicRooms", server.handlePublicRooms).Methods("GET")
+	federation.HandleFunc("/user/devices/{userID}", server.handleUserDevices).Methods("GET")
+
+	// WebSocket federation connections
+	federation.HandleFunc("/ws", server.handleWebSocket).Methods("GET")
+
+	// Well-known discovery
+	router.HandleFunc("/.well-known/matrix/server", server.handleWellKnown).Methods("GET")
+	router.HandleFunc("/.well-known/matrix/client", server.handleClientWellKnown).Methods("GET")
+
+	// Admin API
+	admin := router.PathPrefix("/admin/federation").Subrouter()
+	admin.Use(requireAdmin)
+	admin.HandleFunc("/peers", server.handleListPeers).Methods("GET")
+	admin.HandleFunc("/connect", server.handleConnectPeer).Methods("POST")
+	admin.HandleFunc("/disconnect", server.handleDisconnectPeer).Methods("POST")
+	admin.HandleFunc("/deadletter", server.handleListDeadLetters).Methods("GET")
+
+	// Health and metrics
+	router.HandleFunc("/health", handleHealth).Methods("GET")
+	router.HandleFunc("/metrics", promhttp.Handler().ServeHTTP).Methods("GET")
+
+	return router
+}
+
+// newRedisClient connects to the Redis server at addr
+func newRedisClient(addr string) (*redis.Client, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -13,37 +13,94 @@ type FederationMetrics struct {
 	SendQueueSize      prometheus.Gauge
 	EventSendLatency   prometheus.Histogram
 	ConnectionDuration prometheus.Histogram
+	PDUProcessing      prometheus.Histogram
+	OutboxOverflow     *prometheus.CounterVec
+	InboundRateLimited prometheus.Counter
+	DeadLetters        *prometheus.CounterVec
+	PDUsRejected       *prometheus.CounterVec
+	RelayTTLExceeded   prometheus.Counter
+	EDUs               *prometheus.CounterVec
+	AliasCache         *prometheus.CounterVec
+	CircuitOpen        *prometheus.GaugeVec
+	Transactions       *prometheus.CounterVec
+	TxnPDUsRejected    prometheus.Counter
 }
 
-// NewFederationMetrics creates and registers federation metrics
-func NewFederationMetrics() *FederationMetrics {
+// NewFederationMetrics creates federation metrics and registers them with reg
+func NewFederationMetrics(reg prometheus.Registerer) *FederationMetrics {
+	factory := promauto.With(reg)
 	m := &FederationMetrics{
-		MessagesSent: promauto.NewCounter(prometheus.CounterOpts{
+		MessagesSent: factory.NewCounter(prometheus.CounterOpts{
 			Name: "federation_messages_sent_total",
 			Help: "Total number of federation messages sent",
 		}),
-		MessagesReceived: promauto.NewCounter(prometheus.CounterOpts{
+		MessagesReceived: factory.NewCounter(prometheus.CounterOpts{
 			Name: "federation_messages_received_total",
 			Help: "Total number of federation messages received",
 		}),
-		ConnectedServers: promauto.NewGauge(prometheus.GaugeOpts{
+		ConnectedServers: factory.NewGauge(prometheus.GaugeOpts{
 			Name: "federation_connected_servers",
 			Help: "Number of connected federation servers",
 		}),
-		SendQueueSize: promauto.NewGauge(prometheus.GaugeOpts{
+		SendQueueSize: factory.NewGauge(prometheus.GaugeOpts{
 			Name: "federation_send_queue_size",
 			Help: "Current size of send queue",
 		}),
-		EventSendLatency: promauto.NewHistogram(prometheus.HistogramOpts{
+		EventSendLatency: factory.NewHistogram(prometheus.HistogramOpts{
 			Name:    "federation_event_send_latency_seconds",
 			Help:    "Latency of sending events to other servers",
 			Buckets: prometheus.DefBuckets,
 		}),
-		ConnectionDuration: promauto.NewHistogram(prometheus.HistogramOpts{
+		ConnectionDuration: factory.NewHistogram(prometheus.HistogramOpts{
 			Name:    "federation_connection_duration_seconds",
 			Help:    "Duration of federation connections",
 			Buckets: prometheus.ExponentialBuckets(60, 2, 10),
 		}),
+		PDUProcessing: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "federation_pdu_processing_seconds",
+			Help:    "Time spent processing incoming PDUs",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}),
+		OutboxOverflow: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "federation_outbox_overflow_total",
+			Help: "Total number of messages that found a peer's outbox full",
+		}, []string{"policy"}),
+		InboundRateLimited: factory.NewCounter(prometheus.CounterOpts{
+			Name: "federation_inbound_rate_limited_total",
+			Help: "Total number of inbound federation requests rejected by rate limiting",
+		}),
+		DeadLetters: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "federation_deadletter_total",
+			Help: "Total number of queued federation messages moved to the dead-letter queue",
+		}, []string{"reason"}),
+		PDUsRejected: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "federation_pdus_rejected_total",
+			Help: "Total number of incoming PDUs rejected during verification",
+		}, []string{"reason"}),
+		RelayTTLExceeded: factory.NewCounter(prometheus.CounterOpts{
+			Name: "federation_relay_ttl_exceeded_total",
+			Help: "Total number of federation messages dropped after exhausting their relay hops",
+		}),
+		EDUs: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "federation_edus_total",
+			Help: "Total number of incoming EDUs, by type and result",
+		}, []string{"type", "result"}),
+		AliasCache: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "federation_alias_cache_total",
+			Help: "Total number of room alias lookups, by cache result",
+		}, []string{"result"}),
+		CircuitOpen: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "federation_circuit_open",
+			Help: "Whether a federation peer's circuit breaker is open (1) or closed (0)",
+		}, []string{"server"}),
+		Transactions: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "federation_transactions_sent_total",
+			Help: "Total number of outbound transaction attempts, by result",
+		}, []string{"result"}),
+		TxnPDUsRejected: factory.NewCounter(prometheus.CounterOpts{
+			Name: "federation_transaction_pdus_rejected_total",
+			Help: "Total number of PDUs in outbound transactions that destinations rejected",
+		}),
 	}
 	return m
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"go.uber.org/zap"
+)
+
+// Outbox overflow policies
+const (
+	overflowQueue      = "queue"       // spill to the Redis retry queue
+	overflowDropOldest = "drop-oldest" // discard the oldest queued message
+)
+
+// errOutboxFull is returned when a message can't be placed in an outbox
+var errOutboxFull = errors.New("outbox full")
+
+// newOutbox creates a connection outbox of the configured size
+func newOutbox() chan FederationMessage {
+	return make(chan FederationMessage, *outboxSize)
+}
+
+// enqueueOutbound places a message in a peer's outbox, applying the
+// overflow policy when it is full
+func (fs *FederationServer) enqueueOutbound(conn *FederationConnection, msg FederationMessage) error {
+	select {
+	case conn.Outbox <- msg:
+		return nil
+	default:
+	}
+
+	metrics.OutboxOverflow.WithLabelValues(*outboxOverflow).Inc()
+
+	if *outboxOverflow == overflowDropOldest {
+		select {
+		case <-conn.Outbox:
+		default:
+		}
+
+		select {
+		case conn.Outbox <- msg:
+			return nil
+		default:
+			return errOutboxFull
+		}
+	}
+
+	return fs.queueMessage(fs.ctx, conn.ServerName, msg)
+}
+
+// flushOutbox moves messages still buffered in a connection's outbox to its
+// server's Redis queue
+func (fs *FederationServer) flushOutbox(ctx context.Context, conn *FederationConnection) {
+	flushed := 0
+	defer func() {
+		if flushed > 0 {
+			fs.logger.Info("Flushed federation outbox to queue",
+				zap.String("server", conn.ServerName),
+				zap.Int("messages", flushed))
+		}
+	}()
+
+	for {
+		select {
+		case msg, ok := <-conn.Outbox:
+			if !ok {
+				return
+			}
+			if err := fs.queueMessage(ctx, conn.ServerName, msg); err != nil {
+				fs.logger.Error("Failed to flush federation outbox",
+					zap.String("server", conn.ServerName),
+					zap.Int("remaining", len(conn.Outbox)+1),
+					zap.Error(err))
+				return
+			}
+			flushed++
+		default:
+			return
+		}
+	}
+}
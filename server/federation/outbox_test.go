@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// outboxNonces empties an outbox, returning its messages' nonces in order
+func outboxNonces(outbox chan FederationMessage) []string {
+	var nonces []string
+	for {
+		select {
+		case msg := <-outbox:
+			nonces = append(nonces, msg.Nonce)
+		default:
+			return nonces
+		}
+	}
+}
+
+func TestEnqueueOutboundOverflow(t *testing.T) {
+	policy := *outboxOverflow
+	t.Cleanup(func() { *outboxOverflow = policy })
+
+	tests := []struct {
+		policy     string
+		wantOutbox []string
+		wantQueued int64
+	}{
+		{overflowQueue, []string{"1", "2"}, 1},
+		{overflowDropOldest, []string{"2", "3"}, 0},
+	}
+	for _, tt := range tests {
+		*outboxOverflow = tt.policy
+		fs := newTestServer(t, "a.example")
+		conn := &FederationConnection{ServerName: "b.example", Outbox: make(chan FederationMessage, 2)}
+		overflows := testutil.ToFloat64(metrics.OutboxOverflow.WithLabelValues(tt.policy))
+
+		for _, nonce := range []string{"1", "2", "3"} {
+			if err := fs.enqueueOutbound(conn, FederationMessage{Type: "pdu", Nonce: nonce}); err != nil {
+				t.Fatalf("%s: enqueueOutbound(%s): %v", tt.policy, nonce, err)
+			}
+		}
+
+		if got := outboxNonces(conn.Outbox); !reflect.DeepEqual(got, tt.wantOutbox) {
+			t.Errorf("%s: outbox holds %v, want %v", tt.policy, got, tt.wantOutbox)
+		}
+		queued, err := fs.redis.LLen(context.Background(), fs.key(queueKeyPrefix+"b.example")).Result()
+		if err != nil || queued != tt.wantQueued {
+			t.Errorf("%s: %d messages queued in Redis (%v), want %d", tt.policy, queued, err, tt.wantQueued)
+		}
+		if got := testutil.ToFloat64(metrics.OutboxOverflow.WithLabelValues(tt.policy)) - overflows; got != 1 {
+			t.Errorf("%s: overflow counted %v times, want once", tt.policy, got)
+		}
+	}
+}
+
+func TestCloseQueuesOutbox(t *testing.T) {
+	fs := newTestServer(t, "a.example")
+	stalledConnection(fs, "b.example")
+	conn := fs.connections["b.example"]
+	conn.Outbox = make(chan FederationMessage, 3)
+	for _, nonce := range []string{"1", "2", "3"} {
+		conn.Outbox <- FederationMessage{Type: msgTypeMessage, Nonce: nonce}
+	}
+
+	fs.Close()
+
+	entries, err := fs.redis.LRange(context.Background(), fs.key(queueKeyPrefix+"b.example"), 0, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The queue is newest first
+	var nonces []string
+	for i := len(entries) - 1; i >= 0; i-- {
+		var entry queuedMessage
+		if err := json.Unmarshal([]byte(entries[i]), &entry); err != nil {
+			t.Fatal(err)
+		}
+		nonces = append(nonces, entry.Message.Nonce)
+	}
+	if want := []string{"1", "2", "3"}; !reflect.DeepEqual(nonces, want) {
+		t.Errorf("queued %v after Close, want %v", nonces, want)
+	}
+}
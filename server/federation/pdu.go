@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// PDU verification errors
+var (
+	errInvalidPDU       = errors.New("invalid PDU")
+	errMissingHash      = errors.New("PDU has no sha256 content hash")
+	errHashMismatch     = errors.New("PDU content hash mismatch")
+	errMissingSignature = errors.New("PDU not signed by a known key of its origin")
+	errBadSignature     = errors.New("PDU signature invalid")
+)
+
+// PDU rejection reasons for the rejected PDUs counter
+const (
+	pduRejectInvalid   = "invalid"
+	pduRejectHash      = "hash"
+	pduRejectSignature = "signature"
+	pduRejectKeys      = "keys"
+)
+
+// redactedTopLevelKeys are the event keys that survive redaction
+var redactedTopLevelKeys = map[string]bool{
+	"event_id": true, "type": true, "room_id": true, "sender": true,
+	"state_key": true, "content": true, "hashes": true, "signatures": true,
+	"depth": true, "prev_events": true, "prev_state": true, "auth_events": true,
+	"origin": true, "origin_server_ts": true, "membership": true,
+}
+
+// redactedContentKeys are the content keys that survive redaction, by
+// event type
+var redactedContentKeys = map[string][]string{
+	"m.room.member":             {"membership"},
+	"m.room.create":             {"creator"},
+	"m.room.join_rules":         {"join_rule"},
+	"m.room.power_levels":       {"ban", "events", "events_default", "kick", "redact", "state_default", "users", "users_default"},
+	"m.room.aliases":            {"aliases"},
+	"m.room.history_visibility": {"history_visibility"},
+}
+
+// processPDU verifies an incoming PDU's content hash and its origin's
+// signature, storing it if both check out. It returns the event ID so the
+// result can be reported per PDU.
+func (fs *FederationServer) processPDU(ctx context.Context, raw json.RawMessage) (string, error) {
+	event, err := decodeJSONObject(raw)
+	if err != nil {
+		metrics.PDUsRejected.WithLabelValues(pduRejectInvalid).Inc()
+		return "", errInvalidPDU
+	}
+
+	eventID, _ := event["event_id"].(string)
+	if !validEventID(eventID) {
+		metrics.PDUsRejected.WithLabelValues(pduRejectInvalid).Inc()
+		return "", errInvalidPDU
+	}
+
+	if err := fs.verifyPDU(ctx, event); err != nil {
+		return eventID, err
+	}
+
+	if err := fs.events.StoreEvent(ctx, raw); err != nil {
+		return eventID, err
+	}
+	return eventID, nil
+}
+
+// verifyPDU checks a PDU's content hash and the signature of the server
+// that sent it over the redacted event
+func (fs *FederationServer) verifyPDU(ctx context.Context, event map[string]interface{}) error {
+	hashes, _ := event["hashes"].(map[string]interface{})
+	expected, _ := hashes["sha256"].(string)
+	if expected == "" {
+		metrics.PDUsRejected.WithLabelValues(pduRejectHash).Inc()
+		return errMissingHash
+	}
+
+	actual, err := contentHash(event)
+	if err != nil {
+		metrics.PDUsRejected.WithLabelValues(pduRejectInvalid).Inc()
+		return errInvalidPDU
+	}
+	if actual != strings.TrimRight(expected, "=") {
+		metrics.PDUsRejected.WithLabelValues(pduRejectHash).Inc()
+		return errHashMismatch
+	}
+
+	origin := pduOrigin(event)
+	if origin == "" {
+		metrics.PDUsRejected.WithLabelValues(pduRejectInvalid).Inc()
+		return errInvalidPDU
+	}
+
+	keys, err := fs.serverKeys(ctx, origin)
+	if err != nil {
+		metrics.PDUsRejected.WithLabelValues(pduRejectKeys).Inc()
+		return err
+	}
+
+	if err := verifyJSONSignature(redactEvent(event), origin, keys); err != nil {
+		metrics.PDUsRejected.WithLabelValues(pduRejectSignature).Inc()
+		return err
+	}
+	return nil
+}
+
+// pduOrigin returns the server that must have signed an event: the domain
+// of its sender
+func pduOrigin(event map[string]interface{}) string {
+	sender, _ := event["sender"].(string)
+	return userServer(sender)
+}
+
+// contentHash computes an event's sha256 content hash as unpadded base64
+func contentHash(event map[string]interface{}) (string, error) {
+	stripped := make(map[string]interface{}, len(event))
+	for key, value := range event {
+		if key != "unsigned" && key != "signatures" && key != "hashes" {
+			stripped[key] = value
+		}
+	}
+
+	data, err := canonicalJSON(stripped)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
+
+// redactEvent strips an event down to the keys covered by its signatures
+func redactEvent(event map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(redactedTopLevelKeys))
+	for key, value := range event {
+		if redactedTopLevelKeys[key] {
+			redacted[key] = value
+		}
+	}
+
+	content, _ := event["content"].(map[string]interface{})
+	eventType, _ := event["type"].(string)
+	kept := make(map[string]interface{})
+	for _, key := range redactedContentKeys[eventType] {
+		if value, ok := content[key]; ok {
+			kept[key] = value
+		}
+	}
+	redacted["content"] = kept
+
+	return redacted
+}
+
+// verifyJSONSignature checks that a JSON object carries a valid ed25519
+// signature from signer under one of its keys
+func verifyJSONSignature(obj map[string]interface{}, signer string, keys map[string]ed25519.PublicKey) error {
+	signatures, _ := obj["signatures"].(map[string]interface{})
+	serverSignatures, _ := signatures[signer].(map[string]interface{})
+
+	unsigned := make(map[string]interface{}, len(obj))
+	for key, value := range obj {
+		if key != "signatures" && key != "unsigned" {
+			unsigned[key] = value
+		}
+	}
+	message, err := canonicalJSON(unsigned)
+	if err != nil {
+		return err
+	}
+
+	for keyID, encoded := range serverSignatures {
+		key, ok := keys[keyID]
+		if !ok {
+			continue
+		}
+		sigText, _ := encoded.(string)
+		sig, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(sigText, "="))
+		if err != nil || !ed25519.Verify(key, message, sig) {
+			return errBadSignature
+		}
+		return nil
+	}
+
+	return errMissingSignature
+}
+
+// decodeJSONObject decodes a JSON object keeping numbers exact, so it can be
+// re-encoded canonically
+func decodeJSONObject(data []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var obj map[string]interface{}
+	if err := decoder.Decode(&obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, errInvalidPDU
+	}
+	return obj, nil
+}
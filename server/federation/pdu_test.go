@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+// testEvent returns a member event decoded the way PDUs are
+func testEvent(t *testing.T) map[string]interface{} {
+	t.Helper()
+	event, err := decodeJSONObject([]byte(`{
+		"event_id": "$abc:remote.example",
+		"type": "m.room.member",
+		"room_id": "!room:remote.example",
+		"sender": "@alice:remote.example",
+		"state_key": "@alice:remote.example",
+		"origin_server_ts": 1700000000000,
+		"depth": 12,
+		"content": {"membership": "join", "displayname": "Alice"},
+		"unsigned": {"age": 1234},
+		"extra": true
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestContentHash(t *testing.T) {
+	event := testEvent(t)
+	hash, err := contentHash(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stripped := testEvent(t)
+	delete(stripped, "unsigned")
+	data, err := canonicalJSON(stripped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if want := base64.RawStdEncoding.EncodeToString(sum[:]); hash != want {
+		t.Errorf("contentHash = %s, want %s", hash, want)
+	}
+
+	// Hashes, signatures and unsigned data are not covered
+	event["hashes"] = map[string]interface{}{"sha256": hash}
+	event["signatures"] = map[string]interface{}{"remote.example": map[string]interface{}{}}
+	event["unsigned"] = map[string]interface{}{"age": 99}
+	if again, _ := contentHash(event); again != hash {
+		t.Errorf("contentHash changed with hashes, signatures or unsigned: %s != %s", again, hash)
+	}
+
+	event["content"].(map[string]interface{})["displayname"] = "Mallory"
+	if changed, _ := contentHash(event); changed == hash {
+		t.Error("contentHash unchanged after editing content")
+	}
+}
+
+func TestRedactEvent(t *testing.T) {
+	redacted := redactEvent(testEvent(t))
+
+	for _, key := range []string{"unsigned", "extra"} {
+		if _, ok := redacted[key]; ok {
+			t.Errorf("redacted event kept %q", key)
+		}
+	}
+	for _, key := range []string{"event_id", "type", "room_id", "sender", "state_key", "origin_server_ts", "depth"} {
+		if _, ok := redacted[key]; !ok {
+			t.Errorf("redacted event dropped %q", key)
+		}
+	}
+	if want := map[string]interface{}{"membership": "join"}; !reflect.DeepEqual(redacted["content"], want) {
+		t.Errorf("redacted content = %v, want %v", redacted["content"], want)
+	}
+
+	message := redactEvent(map[string]interface{}{
+		"type":    "m.room.message",
+		"content": map[string]interface{}{"body": "hello"},
+	})
+	if content := message["content"].(map[string]interface{}); len(content) != 0 {
+		t.Errorf("redacted message content = %v, want empty", content)
+	}
+}
+
+func TestVerifyJSONSignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]ed25519.PublicKey{"ed25519:1": public}
+
+	event := redactEvent(testEvent(t))
+	message, err := canonicalJSON(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := base64.RawStdEncoding.EncodeToString(ed25519.Sign(private, message))
+	event["signatures"] = map[string]interface{}{
+		"remote.example": map[string]interface{}{"ed25519:1": sig},
+	}
+
+	if err := verifyJSONSignature(event, "remote.example", keys); err != nil {
+		t.Errorf("valid signature: %v", err)
+	}
+	if err := verifyJSONSignature(event, "other.example", keys); err != errMissingSignature {
+		t.Errorf("other signer = %v, want errMissingSignature", err)
+	}
+	if err := verifyJSONSignature(event, "remote.example", map[string]ed25519.PublicKey{"ed25519:2": public}); err != errMissingSignature {
+		t.Errorf("unknown key = %v, want errMissingSignature", err)
+	}
+
+	event["depth"] = 13
+	if err := verifyJSONSignature(event, "remote.example", keys); err != errBadSignature {
+		t.Errorf("tampered event = %v, want errBadSignature", err)
+	}
+}
+
+func TestDecodeVerifyKeys(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.RawStdEncoding.EncodeToString(public)
+
+	keys, err := decodeVerifyKeys(map[string]string{"ed25519:a": encoded, "curve25519:b": "ignored"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !keys["ed25519:a"].Equal(public) {
+		t.Errorf("decodeVerifyKeys = %v", keys)
+	}
+
+	for name, key := range map[string]string{"not base64": "!!", "short": encoded[:10]} {
+		if _, err := decodeVerifyKeys(map[string]string{"ed25519:a": key}); err == nil {
+			t.Errorf("%s: decodeVerifyKeys succeeded", name)
+		}
+	}
+}
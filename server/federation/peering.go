@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// peerDenylistKey holds servers that discovery must not connect to
+const peerDenylistKey = "federation:denylist"
+
+// DisconnectServer closes the connection to a server and denylists it so
+// discovery doesn't reconnect it
+func (fs *FederationServer) DisconnectServer(ctx context.Context, serverName string) error {
+	if err := fs.redis.SAdd(ctx, fs.key(peerDenylistKey), serverName).Err(); err != nil {
+		return err
+	}
+
+	fs.connectionsMu.Lock()
+	conn, ok := fs.connections[serverName]
+	if ok {
+		delete(fs.connections, serverName)
+		conn.close()
+	}
+	fs.connectionsMu.Unlock()
+
+	fs.logger.Info("Disconnected federation peer",
+		zap.String("server", serverName),
+		zap.Bool("was_connected", ok))
+
+	return nil
+}
+
+// allowPeer removes a server from the denylist
+func (fs *FederationServer) allowPeer(ctx context.Context, serverName string) error {
+	return fs.redis.SRem(ctx, fs.key(peerDenylistKey), serverName).Err()
+}
+
+// isPeerDenied reports whether a server is denylisted
+func (fs *FederationServer) isPeerDenied(ctx context.Context, serverName string) (bool, error) {
+	return fs.redis.SIsMember(ctx, fs.key(peerDenylistKey), serverName).Result()
+}
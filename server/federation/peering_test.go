@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// peerRequest calls a peering admin handler for server and returns the
+// response status
+func peerRequest(handler http.HandlerFunc, server string) int {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/admin/peers", strings.NewReader(`{"server_name":"`+server+`"}`)))
+	return w.Code
+}
+
+func TestPeeringConnectDisconnect(t *testing.T) {
+	a := newTestServer(t, "a.example")
+	b := newTestServer(t, "b.example")
+	a.discovery = NewStaticPeerDiscovery([]string{"b.example"})
+	servePeer(t, a, b)
+	servePeer(t, b, a)
+
+	a.discoverPeers()
+	if !connected(a, "b.example") {
+		t.Fatal("discovery did not connect b")
+	}
+
+	if status := peerRequest(a.handleDisconnectPeer, "b.example"); status != http.StatusNoContent {
+		t.Fatalf("disconnect: status %d", status)
+	}
+	if connected(a, "b.example") {
+		t.Fatal("b still connected after disconnect")
+	}
+
+	// Neither discovery nor b itself brings the connection back
+	a.discoverPeers()
+	if connected(a, "b.example") {
+		t.Error("discovery reconnected a denylisted server")
+	}
+	waitFor(t, "b to notice the disconnect", func() bool { return !connected(b, "a.example") })
+	if err := b.ConnectToServer("a.example"); err == nil {
+		t.Error("denylisted server connected in")
+	}
+
+	// A manual connect lifts the denylisting
+	if status := peerRequest(a.handleConnectPeer, "b.example"); status != http.StatusNoContent {
+		t.Fatalf("connect: status %d", status)
+	}
+	if !connected(a, "b.example") {
+		t.Error("b not connected after a manual connect")
+	}
+	if status := peerRequest(a.handleConnectPeer, "b.example"); status != http.StatusConflict {
+		t.Errorf("second connect: status %d, want 409", status)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Redis keys for the federation retry and dead-letter queues
+const (
+	queueKeyPrefix = "federation:queue:"
+	deadLetterKey  = "federation:deadletter"
+)
+
+// Queue processing limits
+const (
+	queueBatchSize     = 100   // messages moved per server per pass
+	maxDeadLetters     = 10000 // dead letters retained, newest first
+	defaultDeadLetters = 100   // dead letters returned by the admin API
+)
+
+// Dead-letter reasons
+const (
+	deadLetterExpired     = "expired"
+	deadLetterMaxAttempts = "max_attempts"
+)
+
+// queuedMessage is a federation message waiting in a server's retry queue
+type queuedMessage struct {
+	Message  FederationMessage `json:"message"`
+	Attempts int               `json:"attempts"`
+	QueuedAt int64             `json:"queued_at"`
+}
+
+// DeadLetter is a message that was given up on, with why
+type DeadLetter struct {
+	Server   string            `json:"server"`
+	Reason   string            `json:"reason"`
+	Attempts int               `json:"attempts"`
+	QueuedAt int64             `json:"queued_at"`
+	FailedAt int64             `json:"failed_at"`
+	Message  FederationMessage `json:"message"`
+}
+
+// queueMessage stores a message for delivery once the server is reachable
+func (fs *FederationServer) queueMessage(ctx context.Context, server string, msg FederationMessage) error {
+	data, err := json.Marshal(queuedMessage{
+		Message:  msg,
+		QueuedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	return fs.redis.LPush(ctx, fs.key(queueKeyPrefix+server), data).Err()
+}
+
+// processQueuedMessages moves queued messages into the outboxes of
+// connected servers and dead-letters those that expired or ran out of
+// attempts
+func (fs *FederationServer) processQueuedMessages() {
+	keys, err := fs.redis.Keys(fs.ctx, fs.key(queueKeyPrefix+"*")).Result()
+	if err != nil {
+		fs.logger.Error("Failed to list federation queues", zap.Error(err))
+		return
+	}
+
+	for _, key := range keys {
+		fs.processQueue(key[len(fs.key(queueKeyPrefix)):])
+	}
+}
+
+// processQueue works through one server's queue, oldest message first
+func (fs *FederationServer) processQueue(server string) {
+	key := fs.key(queueKeyPrefix + server)
+
+	fs.connectionsMu.RLock()
+	conn, ok := fs.connections[server]
+	fs.connectionsMu.RUnlock()
+	connected := ok && conn.Connected() && !fs.breaker(server).Open()
+
+	for i := 0; i < queueBatchSize; i++ {
+		data, err := fs.redis.LIndex(fs.ctx, key, -1).Result()
+		if err != nil {
+			return
+		}
+
+		var entry queuedMessage
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			fs.logger.Warn("Dropping unreadable queued message", zap.String("server", server), zap.Error(err))
+			fs.redis.RPop(fs.ctx, key)
+			continue
+		}
+
+		reason := ""
+		switch {
+		case time.Since(time.Unix(entry.QueuedAt, 0)) > *queueTTL:
+			reason = deadLetterExpired
+		case entry.Attempts >= *queueAttempts:
+			reason = deadLetterMaxAttempts
+		}
+
+		if reason != "" {
+			if err := fs.redis.RPop(fs.ctx, key).Err(); err != nil {
+				return
+			}
+			fs.deadLetter(server, entry, reason)
+			continue
+		}
+
+		// The queue is in order, so with the server away nothing behind
+		// this message can have expired either
+		if !connected {
+			return
+		}
+
+		if err := fs.redis.RPop(fs.ctx, key).Err(); err != nil {
+			return
+		}
+
+		entry.Attempts++
+		select {
+		case conn.Outbox <- entry.Message:
+		default:
+			// Outbox still full; put the message back at the front and
+			// retry on the next pass
+			if data, err := json.Marshal(entry); err == nil {
+				fs.redis.RPush(fs.ctx, key, data)
+			}
+			return
+		}
+	}
+}
+
+// deadLetter records a message that will not be delivered
+func (fs *FederationServer) deadLetter(server string, entry queuedMessage, reason string) {
+	data, err := json.Marshal(DeadLetter{
+		Server:   server,
+		Reason:   reason,
+		Attempts: entry.Attempts,
+		QueuedAt: entry.QueuedAt,
+		FailedAt: time.Now().Unix(),
+		Message:  entry.Message,
+	})
+	if err != nil {
+		fs.logger.Error("Failed to marshal dead letter", zap.Error(err))
+		return
+	}
+
+	pipe := fs.redis.TxPipeline()
+	pipe.LPush(fs.ctx, fs.key(deadLetterKey), data)
+	pipe.LTrim(fs.ctx, fs.key(deadLetterKey), 0, maxDeadLetters-1)
+	if _, err := pipe.Exec(fs.ctx); err != nil {
+		fs.logger.Error("Failed to store dead letter", zap.String("server", server), zap.Error(err))
+		return
+	}
+
+	metrics.DeadLetters.WithLabelValues(reason).Inc()
+
+	fs.logger.Warn("Dead-lettered federation message",
+		zap.String("server", server),
+		zap.String("reason", reason),
+		zap.Int("attempts", entry.Attempts))
+}
+
+// handleListDeadLetters returns the most recent dead letters
+func (fs *FederationServer) handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	limit := defaultDeadLetters
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > maxDeadLetters {
+			writeMatrixError(w, http.StatusBadRequest, errcodeInvalidParam, "Invalid limit")
+			return
+		}
+		limit = n
+	}
+
+	entries, err := fs.redis.LRange(r.Context(), fs.key(deadLetterKey), 0, int64(limit-1)).Result()
+	if err != nil {
+		fs.logger.Error("Failed to load dead letters", zap.Error(err))
+		writeMatrixError(w, http.StatusInternalServerError, errcodeUnknown, "Failed to load dead letters")
+		return
+	}
+
+	letters := make([]DeadLetter, 0, len(entries))
+	for _, data := range entries {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(data), &letter); err != nil {
+			continue
+		}
+		letters = append(letters, letter)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dead_letters": letters,
+	})
+}
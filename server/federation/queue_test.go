@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// stalledConnection registers a connection to server whose outbox never
+// accepts a message
+func stalledConnection(fs *FederationServer, server string) {
+	conn := &FederationConnection{
+		ServerName: server,
+		Outbox:     make(chan FederationMessage),
+		writerDone: make(chan struct{}),
+		stop:       make(chan struct{}),
+	}
+	conn.connected.Store(true)
+	close(conn.writerDone)
+
+	fs.connectionsMu.Lock()
+	fs.connections[server] = conn
+	fs.connectionsMu.Unlock()
+}
+
+// deadLetters returns fs's dead letters, newest first
+func deadLetters(t *testing.T, fs *FederationServer) []DeadLetter {
+	t.Helper()
+	entries, err := fs.redis.LRange(context.Background(), fs.key(deadLetterKey), 0, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	letters := make([]DeadLetter, len(entries))
+	for i, data := range entries {
+		if err := json.Unmarshal([]byte(data), &letters[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return letters
+}
+
+func TestDeadLetterAfterMaxAttempts(t *testing.T) {
+	attempts := *queueAttempts
+	*queueAttempts = 2
+	t.Cleanup(func() { *queueAttempts = attempts })
+
+	fs := newTestServer(t, "a.example")
+	stalledConnection(fs, "b.example")
+	if err := fs.queueMessage(context.Background(), "b.example", FederationMessage{Type: msgTypeMessage, Nonce: "n1"}); err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(metrics.DeadLetters.WithLabelValues(deadLetterMaxAttempts))
+
+	// Each pass finds the outbox full and counts an attempt
+	for i := 0; i < *queueAttempts; i++ {
+		fs.processQueue("b.example")
+		if letters := deadLetters(t, fs); len(letters) != 0 {
+			t.Fatalf("dead-lettered after %d attempts", i+1)
+		}
+	}
+	fs.processQueue("b.example")
+
+	letters := deadLetters(t, fs)
+	if len(letters) != 1 {
+		t.Fatalf("%d dead letters, want 1", len(letters))
+	}
+	if l := letters[0]; l.Server != "b.example" || l.Reason != deadLetterMaxAttempts || l.Attempts != 2 || l.Message.Nonce != "n1" {
+		t.Errorf("dead letter %+v", l)
+	}
+	if n, _ := fs.redis.LLen(context.Background(), fs.key(queueKeyPrefix+"b.example")).Result(); n != 0 {
+		t.Errorf("%d messages still queued", n)
+	}
+	if got := testutil.ToFloat64(metrics.DeadLetters.WithLabelValues(deadLetterMaxAttempts)) - before; got != 1 {
+		t.Errorf("dead letters counted %v times, want once", got)
+	}
+}
+
+func TestDeadLetterExpired(t *testing.T) {
+	fs := newTestServer(t, "a.example")
+	data, _ := json.Marshal(queuedMessage{
+		Message:  FederationMessage{Type: msgTypeMessage, Nonce: "old"},
+		QueuedAt: time.Now().Add(-*queueTTL - time.Minute).Unix(),
+	})
+	if err := fs.redis.LPush(context.Background(), fs.key(queueKeyPrefix+"c.example"), data).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expiry applies while the server is away
+	fs.processQueue("c.example")
+
+	letters := deadLetters(t, fs)
+	if len(letters) != 1 || letters[0].Reason != deadLetterExpired || letters[0].Message.Nonce != "old" {
+		t.Errorf("dead letters %+v, want the expired message", letters)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// clientLimiterIdle is how long an address's rate limiter is kept after its
+// last request; its bucket has long refilled by then
+const clientLimiterIdle = 10 * time.Minute
+
+// clientLimiter is the inbound token bucket of one remote address
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimitInbound applies a per-address token bucket to federation routes.
+// It keys on the client IP rather than the X-Matrix origin, which is not
+// verified and could be varied to get a fresh bucket per request.
+func (fs *FederationServer) rateLimitInbound(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !fs.inboundLimiter(clientIP(r)).Allow() {
+			metrics.InboundRateLimited.Inc()
+			writeMatrixError(w, http.StatusTooManyRequests, errcodeLimitExceeded, "Too many requests")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// inboundLimiter gets or creates the rate limiter for a remote address
+func (fs *FederationServer) inboundLimiter(ip string) *rate.Limiter {
+	fs.clientLimitersMu.Lock()
+	defer fs.clientLimitersMu.Unlock()
+
+	entry, ok := fs.clientLimiters[ip]
+	if !ok {
+		entry = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(*inboundRPS), *inboundBurst)}
+		fs.clientLimiters[ip] = entry
+	}
+	entry.lastSeen = time.Now()
+	return entry.limiter
+}
+
+// pruneClientLimiters forgets addresses that have been idle for
+// clientLimiterIdle
+func (fs *FederationServer) pruneClientLimiters() {
+	fs.clientLimitersMu.Lock()
+	defer fs.clientLimitersMu.Unlock()
+
+	for ip, entry := range fs.clientLimiters {
+		if time.Since(entry.lastSeen) > clientLimiterIdle {
+			delete(fs.clientLimiters, ip)
+		}
+	}
+}
+
+// clientLimiterPruner periodically prunes idle address rate limiters
+func (fs *FederationServer) clientLimiterPruner() {
+	ticker := time.NewTicker(clientLimiterIdle)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fs.pruneClientLimiters()
+		case <-fs.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInboundRateLimit(t *testing.T) {
+	rps, burst := *inboundRPS, *inboundBurst
+	*inboundRPS, *inboundBurst = 0.001, 2
+	t.Cleanup(func() { *inboundRPS, *inboundBurst = rps, burst })
+
+	fs := newTestServer(t, "a.example")
+	router := newRouter(fs)
+
+	// Claiming a different origin each time doesn't earn a fresh bucket
+	var w *httptest.ResponseRecorder
+	for _, origin := range []string{"b.example", "c.example", "d.example"} {
+		r := httptest.NewRequest("PUT", "/_matrix/federation/v1/send/txn-"+origin, strings.NewReader(`{"origin":"`+origin+`"}`))
+		r.Header.Set("Authorization", `X-Matrix origin="`+origin+`",key="ed25519:1",sig="x"`)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+	}
+
+	var body struct {
+		Errcode string `json:"errcode"`
+	}
+	json.NewDecoder(w.Body).Decode(&body)
+	if w.Code != http.StatusTooManyRequests || body.Errcode != errcodeLimitExceeded {
+		t.Errorf("third request: %d %q, want 429 %s", w.Code, body.Errcode, errcodeLimitExceeded)
+	}
+}
+
+func TestPruneClientLimiters(t *testing.T) {
+	fs := &FederationServer{clientLimiters: make(map[string]*clientLimiter)}
+	fs.inboundLimiter("192.0.2.1")
+	fs.inboundLimiter("192.0.2.2")
+	fs.clientLimiters["192.0.2.1"].lastSeen = time.Now().Add(-2 * clientLimiterIdle)
+
+	fs.pruneClientLimiters()
+
+	if _, ok := fs.clientLimiters["192.0.2.1"]; ok {
+		t.Error("idle address kept")
+	}
+	if _, ok := fs.clientLimiters["192.0.2.2"]; !ok {
+		t.Error("active address pruned")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// nonceKeyPrefix prefixes the Redis keys recording seen message nonces
+const nonceKeyPrefix = "federation:nonce:"
+
+var (
+	errMissingNonce    = errors.New("federation message has no nonce")
+	errStaleMessage    = errors.New("federation message timestamp outside acceptance window")
+	errReplayedMessage = errors.New("federation message nonce already seen")
+)
+
+// errRelayTTLExceeded is returned for messages with no relay hops left
+var errRelayTTLExceeded = errors.New("federation message exceeded its relay hop limit")
+
+// checkReplay rejects messages without a nonce, with a timestamp outside
+// the acceptance window, or whose nonce has already been seen from the
+// source server
+func (fs *FederationServer) checkReplay(sourceServer string, msg FederationMessage) error {
+	if msg.Nonce == "" {
+		return errMissingNonce
+	}
+
+	skew := time.Since(time.Unix(msg.Timestamp, 0))
+	if skew > *replayWindow || skew < -*replayWindow {
+		return errStaleMessage
+	}
+
+	// A message may be accepted up to one window either side of now, so
+	// its nonce must be remembered for two windows
+	ctx, cancel := context.WithTimeout(fs.ctx, 5*time.Second)
+	defer cancel()
+
+	fresh, err := fs.redis.SetNX(ctx, fs.key(nonceKeyPrefix+sourceServer+":"+msg.Nonce), 1, 2*(*replayWindow)).Result()
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		fs.logger.Warn("Rejected replayed federation message",
+			zap.String("from", sourceServer),
+			zap.String("type", msg.Type))
+		return errReplayedMessage
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCheckReplayRejectsWithoutRedis(t *testing.T) {
+	fs := &FederationServer{}
+	now := time.Now()
+	tests := []struct {
+		name string
+		msg  FederationMessage
+		want error
+	}{
+		{"missing nonce", FederationMessage{Timestamp: now.Unix()}, errMissingNonce},
+		{"too old", FederationMessage{Nonce: "n1", Timestamp: now.Add(-*replayWindow - time.Minute).Unix()}, errStaleMessage},
+		{"too far ahead", FederationMessage{Nonce: "n2", Timestamp: now.Add(*replayWindow + time.Minute).Unix()}, errStaleMessage},
+	}
+	for _, tt := range tests {
+		if err := fs.checkReplay("remote.example", tt.msg); err != tt.want {
+			t.Errorf("%s: checkReplay = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestExpiredMessageKeepsNonce(t *testing.T) {
+	fs := newTestServer(t, "a.example")
+	msg := FederationMessage{Type: msgTypeMessage, Nonce: "n1", Timestamp: time.Now().Unix(), Payload: json.RawMessage(`{}`)}
+	data, _ := json.Marshal(msg)
+	if err := fs.processIncomingMessage("remote.example", protocolV1, data); err != errRelayTTLExceeded {
+		t.Fatalf("message with no hops left = %v, want errRelayTTLExceeded", err)
+	}
+
+	// A live copy of the message is not taken for a replay
+	msg.Hops = 1
+	data, _ = json.Marshal(msg)
+	if err := fs.processIncomingMessage("remote.example", protocolV1, data); err != nil {
+		t.Errorf("live message after an expired one = %v, want accepted", err)
+	}
+}
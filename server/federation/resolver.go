@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Server resolution settings
+const (
+	resolveCacheKey       = "federation:resolve:"
+	defaultFederationPort = "8448"
+	defaultWellKnownTTL   = 24 * time.Hour
+	maxWellKnownTTL       = 48 * time.Hour
+	resolveFallbackTTL    = time.Hour
+	maxWellKnownBodySize  = 64 * 1024
+)
+
+// newHTTPClient creates the shared HTTP client for outbound federation requests
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// resolveServer resolves a server name to its federation WebSocket URL,
+// naming this server to the peer
+func (fs *FederationServer) resolveServer(serverName string) (string, error) {
+	host, err := fs.resolveServerHost(fs.ctx, serverName)
+	if err != nil {
+		return "", err
+	}
+	return "wss://" + host + "/_matrix/federation/v1/ws?server_name=" + url.QueryEscape(fs.serverName), nil
+}
+
+// resolveServerHost returns the host:port serving federation for a server
+// name, using the Redis cache when possible
+func (fs *FederationServer) resolveServerHost(ctx context.Context, serverName string) (string, error) {
+	if serverName == "" {
+		return "", errors.New("empty server name")
+	}
+
+	if host, err := fs.redis.Get(ctx, fs.key(resolveCacheKey+serverName)).Result(); err == nil {
+		return host, nil
+	}
+
+	host, ttl := fs.lookupServerHost(ctx, serverName)
+
+	if err := fs.redis.Set(ctx, fs.key(resolveCacheKey+serverName), host, ttl).Err(); err != nil {
+		fs.logger.Warn("Failed to cache server resolution",
+			zap.String("server", serverName),
+			zap.Error(err))
+	}
+
+	return host, nil
+}
+
+// lookupServerHost performs server discovery: explicit ports and IP
+// literals are used as-is, then .well-known delegation, then DNS SRV, and
+// finally the default federation port
+func (fs *FederationServer) lookupServerHost(ctx context.Context, serverName string) (string, time.Duration) {
+	if _, _, err := net.SplitHostPort(serverName); err == nil {
+		return serverName, defaultWellKnownTTL
+	}
+	if net.ParseIP(strings.Trim(serverName, "[]")) != nil {
+		return net.JoinHostPort(strings.Trim(serverName, "[]"), defaultFederationPort), defaultWellKnownTTL
+	}
+
+	delegated, ttl, err := fs.fetchWellKnown(ctx, serverName)
+	if err == nil {
+		if _, _, err := net.SplitHostPort(delegated); err == nil {
+			return delegated, ttl
+		}
+		if host := lookupFederationSRV(ctx, delegated); host != "" {
+			return host, ttl
+		}
+		return net.JoinHostPort(delegated, defaultFederationPort), ttl
+	}
+
+	fs.logger.Debug("No .well-known delegation",
+		zap.String("server", serverName),
+		zap.Error(err))
+
+	if host := lookupFederationSRV(ctx, serverName); host != "" {
+		return host, resolveFallbackTTL
+	}
+	return net.JoinHostPort(serverName, defaultFederationPort), resolveFallbackTTL
+}
+
+// fetchWellKnown fetches a server's .well-known/matrix/server delegation and
+// how long it may be cached
+func (fs *FederationServer) fetchWellKnown(ctx context.Context, serverName string) (string, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+serverName+"/.well-known/matrix/server", nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	resp, err := fs.httpClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("well-known returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Server string `json:"m.server"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, maxWellKnownBodySize)).Decode(&body); err != nil {
+		return "", 0, err
+	}
+	if body.Server == "" {
+		return "", 0, errors.New("well-known has no m.server")
+	}
+
+	return body.Server, wellKnownTTL(resp.Header.Get("Cache-Control")), nil
+}
+
+// wellKnownTTL derives the cache lifetime of a well-known response from its
+// Cache-Control max-age, capped to a sane maximum
+func wellKnownTTL(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.TrimSpace(directive)
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+
+		seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err != nil || seconds <= 0 {
+			break
+		}
+
+		ttl := time.Duration(seconds) * time.Second
+		if ttl > maxWellKnownTTL {
+			ttl = maxWellKnownTTL
+		}
+		return ttl
+	}
+	return defaultWellKnownTTL
+}
+
+// lookupSRV resolves SRV records; tests replace it
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+// lookupFederationSRV resolves the federation SRV record for a host,
+// returning "" if there is none
+func lookupFederationSRV(ctx context.Context, host string) string {
+	for _, service := range []string{"matrix-fed", "matrix"} {
+		_, records, err := lookupSRV(ctx, service, "tcp", host)
+		if err != nil || len(records) == 0 {
+			continue
+		}
+
+		target := strings.TrimSuffix(records[0].Target, ".")
+		return net.JoinHostPort(target, strconv.Itoa(int(records[0].Port)))
+	}
+	return ""
+}
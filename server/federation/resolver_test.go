@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// stubSRV answers SRV lookups from records, keyed by service and host
+func stubSRV(t *testing.T, records map[string]*net.SRV) {
+	t.Helper()
+	lookup := lookupSRV
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if srv, ok := records[service+" "+name]; ok {
+			return "", []*net.SRV{srv}, nil
+		}
+		return "", nil, errors.New("no such host")
+	}
+	t.Cleanup(func() { lookupSRV = lookup })
+}
+
+// serveWellKnown answers every server's .well-known/matrix/server request
+// with body, or 404 when body is empty
+func serveWellKnown(t *testing.T, fs *FederationServer, body, cacheControl string) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body == "" || r.URL.Path != "/.well-known/matrix/server" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	fs.httpClient = &http.Client{Transport: transport, Timeout: time.Second}
+}
+
+func TestLookupServerHost(t *testing.T) {
+	stubSRV(t, map[string]*net.SRV{
+		"matrix-fed delegated.example.com": {Target: "fed.example.com.", Port: 9000},
+		"matrix srv.example.com":           {Target: "matrix.srv.example.com.", Port: 8449},
+	})
+
+	tests := []struct {
+		name         string
+		serverName   string
+		wellKnown    string
+		cacheControl string
+		wantHost     string
+		wantTTL      time.Duration
+	}{
+		{"explicit port", "example.com:8000", `{"m.server":"other.example.com"}`, "", "example.com:8000", defaultWellKnownTTL},
+		{"IP literal", "[::1]", "", "", "[::1]:8448", defaultWellKnownTTL},
+		{"well-known with port", "example.com", `{"m.server":"delegated.example.com:443"}`, "max-age=600", "delegated.example.com:443", 10 * time.Minute},
+		{"well-known then SRV", "example.com", `{"m.server":"delegated.example.com"}`, "", "fed.example.com:9000", defaultWellKnownTTL},
+		{"well-known without SRV", "example.com", `{"m.server":"plain.example.com"}`, "max-age=999999999", "plain.example.com:8448", maxWellKnownTTL},
+		{"no well-known, SRV", "srv.example.com", "", "", "matrix.srv.example.com:8449", resolveFallbackTTL},
+		{"no well-known, plain hostname", "example.com", "", "", "example.com:8448", resolveFallbackTTL},
+		{"well-known without m.server", "example.com", `{}`, "", "example.com:8448", resolveFallbackTTL},
+	}
+	for _, tt := range tests {
+		fs := &FederationServer{logger: zap.NewNop()}
+		serveWellKnown(t, fs, tt.wellKnown, tt.cacheControl)
+
+		host, ttl := fs.lookupServerHost(context.Background(), tt.serverName)
+		if host != tt.wantHost || ttl != tt.wantTTL {
+			t.Errorf("%s: lookupServerHost = %s, %v; want %s, %v", tt.name, host, ttl, tt.wantHost, tt.wantTTL)
+		}
+	}
+}
+
+func TestResolveServerCaches(t *testing.T) {
+	stubSRV(t, nil)
+	fs := newTestServer(t, "a.example")
+	serveWellKnown(t, fs, `{"m.server":"delegated.example.com:443"}`, "")
+
+	addr, err := fs.resolveServer("b.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "wss://delegated.example.com:443/_matrix/federation/v1/ws?server_name=a.example"; addr != want {
+		t.Errorf("resolveServer = %s, want %s", addr, want)
+	}
+
+	// Later lookups are answered from the cache
+	serveWellKnown(t, fs, `{"m.server":"moved.example.com:443"}`, "")
+	if host, err := fs.resolveServerHost(context.Background(), "b.example.com"); err != nil || host != "delegated.example.com:443" {
+		t.Errorf("cached resolveServerHost = %s, %v", host, err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Public room directory keys
+const (
+	publicRoomsKey    = "federation:public_rooms"
+	publicRoomDataKey = "federation:public_room:"
+)
+
+// Public room directory paging limits
+const (
+	defaultPublicRoomsLimit = 100
+	maxPublicRoomsLimit     = 500
+)
+
+// errInvalidBatchToken is returned when a pagination token can't be decoded
+var errInvalidBatchToken = errors.New("invalid pagination token")
+
+// PublicRoom represents an entry in the public room directory
+type PublicRoom struct {
+	RoomID           string `json:"room_id"`
+	Name             string `json:"name,omitempty"`
+	Topic            string `json:"topic,omitempty"`
+	CanonicalAlias   string `json:"canonical_alias,omitempty"`
+	AvatarURL        string `json:"avatar_url,omitempty"`
+	NumJoinedMembers int64  `json:"num_joined_members"`
+	WorldReadable    bool   `json:"world_readable"`
+	GuestCanJoin     bool   `json:"guest_can_join"`
+}
+
+// PublicRoomsPage is a single page of the public room directory
+type PublicRoomsPage struct {
+	Chunk     []PublicRoom `json:"chunk"`
+	NextBatch string       `json:"next_batch,omitempty"`
+	PrevBatch string       `json:"prev_batch,omitempty"`
+	Total     int64        `json:"total_room_count_estimate"`
+}
+
+// publishRoom adds or updates a room in the public directory
+func (fs *FederationServer) publishRoom(room PublicRoom) error {
+	data, err := json.Marshal(room)
+	if err != nil {
+		return err
+	}
+
+	pipe := fs.redis.TxPipeline()
+	pipe.Set(fs.ctx, fs.key(publicRoomDataKey+room.RoomID), data, 0)
+	pipe.ZAdd(fs.ctx, fs.key(publicRoomsKey), redis.Z{
+		Score:  float64(room.NumJoinedMembers),
+		Member: room.RoomID,
+	})
+	if _, err := pipe.Exec(fs.ctx); err != nil {
+		return err
+	}
+
+	// The room's alias may now point somewhere else
+	if room.CanonicalAlias != "" {
+		return fs.invalidateRoomAlias(fs.ctx, room.CanonicalAlias)
+	}
+	return nil
+}
+
+// unpublishRoom removes a room from the public directory
+func (fs *FederationServer) unpublishRoom(roomID string) error {
+	pipe := fs.redis.TxPipeline()
+	pipe.Del(fs.ctx, fs.key(publicRoomDataKey+roomID))
+	pipe.ZRem(fs.ctx, fs.key(publicRoomsKey), roomID)
+	_, err := pipe.Exec(fs.ctx)
+	return err
+}
+
+// getPublicRooms returns a page of public rooms ordered by member count
+func (fs *FederationServer) getPublicRooms(since string, limit int) (*PublicRoomsPage, error) {
+	offset := 0
+	if since != "" {
+		var err error
+		if offset, err = decodeBatchToken(since); err != nil {
+			return nil, err
+		}
+	}
+
+	total, err := fs.redis.ZCard(fs.ctx, fs.key(publicRoomsKey)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	page := &PublicRoomsPage{
+		Chunk: []PublicRoom{},
+		Total: total,
+	}
+
+	roomIDs, err := fs.redis.ZRevRange(fs.ctx, fs.key(publicRoomsKey), int64(offset), int64(offset+limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(roomIDs) > 0 {
+		keys := make([]string, len(roomIDs))
+		for i, roomID := range roomIDs {
+			keys[i] = fs.key(publicRoomDataKey + roomID)
+		}
+
+		values, err := fs.redis.MGet(fs.ctx, keys...).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for i, value := range values {
+			room := PublicRoom{RoomID: roomIDs[i]}
+			if s, ok := value.(string); ok {
+				json.Unmarshal([]byte(s), &room)
+			}
+			page.Chunk = append(page.Chunk, room)
+		}
+	}
+
+	if int64(offset+limit) < total {
+		page.NextBatch = encodeBatchToken(offset + limit)
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		page.PrevBatch = encodeBatchToken(prev)
+	}
+
+	return page, nil
+}
+
+// parsePublicRoomsLimit parses the limit query parameter, clamping it to the maximum
+func parsePublicRoomsLimit(value string) (int, error) {
+	if value == "" {
+		return defaultPublicRoomsLimit, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return 0, errors.New("invalid limit")
+	}
+	if limit > maxPublicRoomsLimit {
+		limit = maxPublicRoomsLimit
+	}
+	return limit, nil
+}
+
+// encodeBatchToken encodes a directory offset as an opaque pagination token
+func encodeBatchToken(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("o" + strconv.Itoa(offset)))
+}
+
+// decodeBatchToken decodes a pagination token back to a directory offset
+func decodeBatchToken(token string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, errInvalidBatchToken
+	}
+
+	s := string(raw)
+	if !strings.HasPrefix(s, "o") {
+		return 0, errInvalidBatchToken
+	}
+
+	offset, err := strconv.Atoi(s[1:])
+	if err != nil || offset < 0 {
+		return 0, errInvalidBatchToken
+	}
+	return offset, nil
+}
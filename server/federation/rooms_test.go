@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestBatchTokenRoundTrip(t *testing.T) {
+	for _, offset := range []int{0, 1, 100, 123456} {
+		got, err := decodeBatchToken(encodeBatchToken(offset))
+		if err != nil {
+			t.Fatalf("decodeBatchToken(encodeBatchToken(%d)): %v", offset, err)
+		}
+		if got != offset {
+			t.Errorf("round trip of %d = %d", offset, got)
+		}
+	}
+}
+
+func TestDecodeBatchTokenInvalid(t *testing.T) {
+	tests := map[string]string{
+		"not base64":     "!!!",
+		"missing prefix": base64.RawURLEncoding.EncodeToString([]byte("100")),
+		"not a number":   base64.RawURLEncoding.EncodeToString([]byte("oabc")),
+		"negative":       base64.RawURLEncoding.EncodeToString([]byte("o-5")),
+		"empty offset":   base64.RawURLEncoding.EncodeToString([]byte("o")),
+	}
+	for name, token := range tests {
+		if _, err := decodeBatchToken(token); err != errInvalidBatchToken {
+			t.Errorf("%s: err = %v, want errInvalidBatchToken", name, err)
+		}
+	}
+}
+
+func TestParsePublicRoomsLimit(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"", defaultPublicRoomsLimit, false},
+		{"10", 10, false},
+		{"100000", maxPublicRoomsLimit, false},
+		{"0", 0, true},
+		{"-1", 0, true},
+		{"ten", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePublicRoomsLimit(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePublicRoomsLimit(%q) err = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parsePublicRoomsLimit(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
@@ -3,85 +3,224 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
 // FederationServer handles inter-server communication
 type FederationServer struct {
-	serverName   string
-	serverKey    string
-	redis        *redis.Client
-	logger       *zap.Logger
-	connections  map[string]*FederationConnection
-	connectionsMu sync.RWMutex
-	ctx          context.Context
-	cancel       context.CancelFunc
+	serverName       string
+	serverKey        string
+	redis            *redis.Client
+	namespace        string // -redis-namespace prefix of every key and channel
+	logger           *zap.Logger
+	connections      map[string]*FederationConnection
+	connectionsMu    sync.RWMutex
+	events           EventStore
+	discovery        PeerDiscovery
+	httpClient       *http.Client
+	backfills        map[string]chan BackfillResponse
+	backfillsMu      sync.Mutex
+	clientLimiters   map[string]*clientLimiter
+	clientLimitersMu sync.Mutex
+	dialLocks        map[string]*sync.Mutex
+	dialLocksMu      sync.Mutex
+	breakers         map[string]*peerBreaker
+	breakersMu       sync.Mutex
+	txnBuilders      map[string]*TransactionBuilder
+	txnBuildersMu    sync.Mutex
+	signing          *signingKey // nil if -server-key holds no usable key
+	draining         bool
+	drainMu          sync.Mutex
+	inflight         sync.WaitGroup // inbound transactions Drain waits for
+	ctx              context.Context
+	cancel           context.CancelFunc
 }
 
 // FederationConnection represents a connection to another server
 type FederationConnection struct {
-	ServerName   string
-	WebSocket    *websocket.Conn
-	LastSeen     time.Time
-	Connected    bool
-	Outbox       chan FederationMessage
+	ServerName string
+	WebSocket  *websocket.Conn
+	lastSeen   atomic.Int64 // Unix nanoseconds; written by the read loop
+	connected  atomic.Bool
+	Version    int // protocol version negotiated in the handshake
+	Outbox     chan FederationMessage
+	writerDone chan struct{} // closed when the write pump exits
+	stop       chan struct{} // closed to stop the write pump
+	stopOnce   sync.Once
 }
 
+// newFederationConnection wraps an established WebSocket to a server
+// speaking the given protocol version
+func newFederationConnection(serverName string, ws *websocket.Conn, version int) *FederationConnection {
+	conn := &FederationConnection{
+		ServerName: serverName,
+		WebSocket:  ws,
+		Version:    version,
+		Outbox:     newOutbox(),
+		writerDone: make(chan struct{}),
+		stop:       make(chan struct{}),
+	}
+	conn.connected.Store(true)
+	conn.touch()
+	return conn
+}
+
+// Connected reports whether the connection is still live
+func (c *FederationConnection) Connected() bool {
+	return c.connected.Load()
+}
+
+// LastSeen returns when a message was last read from the server
+func (c *FederationConnection) LastSeen() time.Time {
+	return time.Unix(0, c.lastSeen.Load())
+}
+
+// touch records that a message was read from the server
+func (c *FederationConnection) touch() {
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+// close marks the connection dead, stops its write pump and closes the
+// socket. Its outbox is left open so concurrent senders can't panic.
+func (c *FederationConnection) close() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	c.connected.Store(false)
+	if c.WebSocket != nil {
+		c.WebSocket.Close()
+	}
+}
+
+// Federation message types
+const (
+	msgTypeMessage          = "message"
+	msgTypeBroadcast        = "broadcast"
+	msgTypeBackfillRequest  = "backfill_request"
+	msgTypeBackfillResponse = "backfill_response"
+)
+
 // FederationMessage represents a message to send to another server
 type FederationMessage struct {
-	Type      string      `json:"type"`
-	DestServer string     `json:"dest_server"`
-	Payload   interface{} `json:"payload"`
-	Timestamp int64       `json:"timestamp"`
+	Type       string          `json:"type"`
+	DestServer string          `json:"dest_server"`
+	Payload    json.RawMessage `json:"payload"` // kept raw so numbers survive relaying intact
+	Timestamp  int64           `json:"timestamp"`
+	Nonce      string          `json:"nonce"`
+	Hops       int             `json:"hops"`              // relays remaining before the message is dropped
+	Version    int             `json:"version,omitempty"` // protocol version negotiated for the connection
+}
+
+// maxRelayHops is the hop limit given to messages this server originates.
+// Each server that accepts a message spends one, so a relay loop between
+// peers cannot circulate it forever.
+const maxRelayHops = 8
+
+// redisNamespacePrefix turns -redis-namespace into the prefix of every key
+// and channel, so environments sharing a Redis instance stay apart
+func redisNamespacePrefix(namespace string) string {
+	if namespace == "" || strings.HasSuffix(namespace, ":") {
+		return namespace
+	}
+	return namespace + ":"
+}
+
+// key prefixes a Redis key, key pattern or channel with the namespace
+func (fs *FederationServer) key(k string) string {
+	return fs.namespace + k
 }
 
 // NewFederationServer creates a new federation server
-func NewFederationServer(serverName, serverKey string, redisClient *redis.Client, logger *zap.Logger) *FederationServer {
+func NewFederationServer(serverName, serverKey string, redisClient *redis.Client, discovery PeerDiscovery, logger *zap.Logger) *FederationServer {
 	ctx, cancel := context.WithCancel(context.Background())
-	
+
 	fs := &FederationServer{
-		serverName:  serverName,
-		serverKey:   serverKey,
-		redis:       redisClient,
-		logger:      logger,
-		connections: make(map[string]*FederationConnection),
-		ctx:         ctx,
-		cancel:      cancel,
+		serverName:     serverName,
+		serverKey:      serverKey,
+		redis:          redisClient,
+		namespace:      redisNamespacePrefix(*redisNS),
+		logger:         logger,
+		connections:    make(map[string]*FederationConnection),
+		events:         NewRedisEventStore(redisClient, redisNamespacePrefix(*redisNS)),
+		discovery:      discovery,
+		httpClient:     newHTTPClient(*outboundTimeout),
+		backfills:      make(map[string]chan BackfillResponse),
+		clientLimiters: make(map[string]*clientLimiter),
+		dialLocks:      make(map[string]*sync.Mutex),
+		breakers:       make(map[string]*peerBreaker),
+		txnBuilders:    make(map[string]*TransactionBuilder),
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+
+	signing, err := parseSigningKey(serverKey)
+	if err != nil {
+		logger.Warn("Outbound transactions disabled: invalid server key", zap.Error(err))
 	}
+	fs.signing = signing
 
 	// Start background tasks
 	go fs.discoveryLoop()
 	go fs.queueProcessor()
+	go fs.clientLimiterPruner()
 
 	return fs
 }
 
-// Close shuts down the federation server
+// Close shuts down the federation server. Write pumps are stopped first and
+// whatever is left in their outboxes is moved to the Redis queue, so
+// buffered messages survive a restart.
 func (fs *FederationServer) Close() {
 	fs.cancel()
-	
-	fs.connectionsMu.Lock()
-	for _, conn := range fs.connections {
-		if conn.WebSocket != nil {
-			conn.WebSocket.Close()
+
+	conns := fs.takeConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownGrace)
+	defer cancel()
+
+	for _, conn := range conns {
+		// Let an in-flight write finish before the socket goes away
+		select {
+		case <-conn.writerDone:
+		case <-ctx.Done():
 		}
-		close(conn.Outbox)
+
+		conn.close()
+		fs.flushOutbox(ctx, conn)
 	}
-	fs.connectionsMu.Unlock()
+}
+
+// encodePayload marshals a message payload. Payloads already in JSON form
+// are used as-is.
+func encodePayload(payload interface{}) (json.RawMessage, error) {
+	if raw, ok := payload.(json.RawMessage); ok {
+		return raw, nil
+	}
+	return json.Marshal(payload)
 }
 
 // SendMessage sends a message to another federation server
 func (fs *FederationServer) SendMessage(destServer string, payload interface{}) error {
+	data, err := encodePayload(payload)
+	if err != nil {
+		return err
+	}
+
 	msg := FederationMessage{
-		Type:       "message",
+		Type:       msgTypeMessage,
 		DestServer: destServer,
-		Payload:    payload,
+		Payload:    data,
 		Timestamp:  time.Now().Unix(),
+		Hops:       maxRelayHops,
 	}
 
 	// Try to send via existing connection
@@ -89,37 +228,38 @@ func (fs *FederationServer) SendMessage(destServer string, payload interface{})
 	conn, ok := fs.connections[destServer]
 	fs.connectionsMu.RUnlock()
 
-	if ok && conn.Connected {
-		select {
-		case conn.Outbox <- msg:
-			return nil
-		default:
-			// Queue full, will be processed by queue processor
-		}
+	if ok && conn.Connected() && !fs.breaker(destServer).Open() {
+		return fs.enqueueOutbound(conn, msg)
 	}
 
-	// Queue for later delivery
-	return fs.queueMessage(destServer, msg)
+	// Queue for later delivery, or while the peer keeps failing
+	return fs.queueMessage(fs.ctx, destServer, msg)
 }
 
 // BroadcastMessage sends a message to all connected servers
 func (fs *FederationServer) BroadcastMessage(payload interface{}) error {
+	data, err := encodePayload(payload)
+	if err != nil {
+		return err
+	}
+
 	fs.connectionsMu.RLock()
 	defer fs.connectionsMu.RUnlock()
 
 	for serverName, conn := range fs.connections {
-		if conn.Connected {
+		if conn.Connected() {
 			msg := FederationMessage{
-				Type:       "broadcast",
+				Type:       msgTypeBroadcast,
 				DestServer: serverName,
-				Payload:    payload,
+				Payload:    data,
 				Timestamp:  time.Now().Unix(),
+				Hops:       maxRelayHops,
 			}
-			
-			select {
-			case conn.Outbox <- msg:
-			default:
-				fs.queueMessage(serverName, msg)
+
+			if err := fs.enqueueOutbound(conn, msg); err != nil {
+				fs.logger.Warn("Failed to enqueue broadcast",
+					zap.String("server", serverName),
+					zap.Error(err))
 			}
 		}
 	}
@@ -127,33 +267,53 @@ func (fs *FederationServer) BroadcastMessage(payload interface{}) error {
 	return nil
 }
 
-// ConnectToServer establishes a connection to another federation server
+// ConnectToServer establishes a connection to another federation server.
+// It is a no-op while a healthy connection exists; concurrent calls for the
+// same server dial at most once.
 func (fs *FederationServer) ConnectToServer(serverName string) error {
+	lock := fs.dialLock(serverName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	fs.connectionsMu.RLock()
+	existing, ok := fs.connections[serverName]
+	fs.connectionsMu.RUnlock()
+	if ok && existing.Connected() {
+		return nil
+	}
+	if fs.isDraining() {
+		return errDraining
+	}
+
+	breaker := fs.breaker(serverName)
+	if !breaker.Allow() {
+		return errCircuitOpen
+	}
+
 	// Resolve server address via DNS or well-known
 	addr, err := fs.resolveServer(serverName)
 	if err != nil {
+		breaker.Failure()
 		return err
 	}
 
-	// Establish WebSocket connection
-	conn, _, err := websocket.DefaultDialer.Dial(fs.ctx, addr, nil)
+	// Establish WebSocket connection, offering the protocol versions this
+	// server speaks
+	conn, _, err := dialer.DialContext(fs.ctx, addr, nil)
 	if err != nil {
+		breaker.Failure()
 		return err
 	}
+	breaker.Success()
 
-	fs.connectionsMu.Lock()
-	defer fs.connectionsMu.Unlock()
-
-	// Create or update connection
-	fedConn := &FederationConnection{
-		ServerName: serverName,
-		WebSocket:  conn,
-		LastSeen:   time.Now(),
-		Connected:  true,
-		Outbox:     make(chan FederationMessage, 1000),
+	version, err := acceptedVersion(conn.Subprotocol())
+	if err != nil {
+		conn.Close()
+		return err
 	}
 
-	fs.connections[serverName] = fedConn
+	fedConn := newFederationConnection(serverName, conn, version)
+	fs.replaceConnection(fedConn)
 
 	// Start connection handlers
 	go fs.handleConnection(fedConn)
@@ -161,17 +321,63 @@ func (fs *FederationServer) ConnectToServer(serverName string) error {
 	return nil
 }
 
+// dialLock returns the lock serializing connection attempts to a server
+func (fs *FederationServer) dialLock(serverName string) *sync.Mutex {
+	fs.dialLocksMu.Lock()
+	defer fs.dialLocksMu.Unlock()
+
+	lock, ok := fs.dialLocks[serverName]
+	if !ok {
+		lock = &sync.Mutex{}
+		fs.dialLocks[serverName] = lock
+	}
+	return lock
+}
+
+// replaceConnection registers a new connection to a server, closing any
+// previous one and carrying over the messages still in its outbox
+func (fs *FederationServer) replaceConnection(conn *FederationConnection) {
+	fs.connectionsMu.Lock()
+	old, ok := fs.connections[conn.ServerName]
+	fs.connections[conn.ServerName] = conn
+	fs.connectionsMu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	old.close()
+	for {
+		select {
+		case msg := <-old.Outbox:
+			if err := fs.enqueueOutbound(conn, msg); err != nil {
+				fs.logger.Warn("Dropped message from replaced connection",
+					zap.String("server", conn.ServerName),
+					zap.Error(err))
+			}
+		default:
+			return
+		}
+	}
+}
+
 // handleConnection manages a federation connection
 func (fs *FederationServer) handleConnection(conn *FederationConnection) {
-	// Read pump
+	// Read pump. Frames over the limit make the websocket library close the
+	// connection with CloseMessageTooBig before ReadMessage returns.
+	conn.WebSocket.SetReadLimit(*maxFrameSize)
+
 	go func() {
-		defer func() {
-			conn.Connected = false
-			conn.WebSocket.Close()
-		}()
+		defer conn.close()
 
 		for {
 			_, message, err := conn.WebSocket.ReadMessage()
+			if err == websocket.ErrReadLimit {
+				fs.logger.Warn("Federation peer exceeded frame size limit",
+					zap.String("server", conn.ServerName),
+					zap.Int64("limit", *maxFrameSize))
+				return
+			}
 			if err != nil {
 				fs.logger.Error("Failed to read from federation connection",
 					zap.String("server", conn.ServerName),
@@ -179,16 +385,39 @@ func (fs *FederationServer) handleConnection(conn *FederationConnection) {
 				return
 			}
 
-			if err := fs.processIncomingMessage(conn.ServerName, message); err != nil {
+			if err := fs.processIncomingMessage(conn.ServerName, conn.Version, message); err != nil {
 				fs.logger.Error("Failed to process federation message", zap.Error(err))
 			}
 
-			conn.LastSeen = time.Now()
+			conn.touch()
 		}
 	}()
 
-	// Write pump
-	for msg := range conn.Outbox {
+	// Write pump; stops on shutdown so Close can flush the outbox
+	defer close(conn.writerDone)
+
+	breaker := fs.breaker(conn.ServerName)
+
+	for {
+		var msg FederationMessage
+		select {
+		case <-fs.ctx.Done():
+			return
+		case <-conn.stop:
+			return
+		case next, ok := <-conn.Outbox:
+			if !ok {
+				return
+			}
+			msg = next
+		}
+
+		// Stamp at send time so queued messages stay inside the peer's
+		// replay window
+		msg.Nonce = uuid.New().String()
+		msg.Timestamp = time.Now().Unix()
+		msg.Version = conn.Version
+
 		data, err := json.Marshal(msg)
 		if err != nil {
 			fs.logger.Error("Failed to marshal message", zap.Error(err))
@@ -198,34 +427,68 @@ func (fs *FederationServer) handleConnection(conn *FederationConnection) {
 		conn.WebSocket.SetWriteDeadline(time.Now().Add(10 * time.Second))
 		if err := conn.WebSocket.WriteMessage(websocket.TextMessage, data); err != nil {
 			fs.logger.Error("Failed to write to federation connection", zap.Error(err))
-			conn.WebSocket.Close()
-			conn.Connected = false
-			break
+			breaker.Failure()
+			conn.close()
+			return
 		}
+		breaker.Success()
 
 		metrics.MessagesSent.Inc()
 	}
 }
 
-// processIncomingMessage handles incoming federation messages
-func (fs *FederationServer) processIncomingMessage(sourceServer string, data []byte) error {
+// processIncomingMessage handles incoming federation messages on a
+// connection speaking the given protocol version
+func (fs *FederationServer) processIncomingMessage(sourceServer string, version int, data []byte) error {
 	var msg FederationMessage
 	if err := json.Unmarshal(data, &msg); err != nil {
 		return err
 	}
 
+	// Peers predating versioning leave the version out
+	if msg.Version == 0 {
+		msg.Version = protocolV1
+	}
+	if msg.Version != version {
+		return errVersionMismatch
+	}
+
+	// Expired messages are dropped before they can take a nonce
+	if msg.Hops <= 0 {
+		metrics.RelayTTLExceeded.Inc()
+		return errRelayTTLExceeded
+	}
+	msg.Hops--
+
+	if err := fs.checkReplay(sourceServer, msg); err != nil {
+		return err
+	}
+
 	fs.logger.Info("Received federation message",
 		zap.String("from", sourceServer),
-		zap.String("type", msg.Type))
+		zap.String("type", msg.Type),
+		zap.Int("version", msg.Version))
+
+	switch version {
+	case protocolV1:
+		return fs.processV1Message(sourceServer, msg)
+	}
+	return errUnsupportedVersion
+}
 
-	// Process based on message type
+// processV1Message dispatches a version 1 message on its type
+func (fs *FederationServer) processV1Message(sourceServer string, msg FederationMessage) error {
 	switch msg.Type {
-	case "message":
+	case msgTypeMessage:
 		// Route to local recipients
 		return fs.routeToLocalRecipients(msg.Payload)
-	case "broadcast":
+	case msgTypeBroadcast:
 		// Handle broadcast
 		return fs.handleBroadcast(sourceServer, msg.Payload)
+	case msgTypeBackfillRequest:
+		return fs.handleBackfillRequest(sourceServer, msg.Payload)
+	case msgTypeBackfillResponse:
+		return fs.handleBackfillResponse(msg.Payload)
 	}
 
 	return nil
@@ -246,10 +509,9 @@ func (fs *FederationServer) discoveryLoop() {
 	}
 }
 
-// discoverPeers finds federation peers via DNS and Redis
+// discoverPeers connects to the servers known to the discovery source
 func (fs *FederationServer) discoverPeers() {
-	// Get known servers from Redis
-	servers, err := fs.getKnownServers()
+	servers, err := fs.discovery.KnownServers(fs.ctx)
 	if err != nil {
 		fs.logger.Error("Failed to get known servers", zap.Error(err))
 		return
@@ -257,12 +519,24 @@ func (fs *FederationServer) discoverPeers() {
 
 	// Connect to new servers
 	for _, server := range servers {
+		denied, err := fs.isPeerDenied(fs.ctx, server)
+		if err != nil {
+			fs.logger.Warn("Failed to check peer denylist",
+				zap.String("server", server),
+				zap.Error(err))
+			continue
+		}
+		if denied {
+			continue
+		}
+
 		fs.connectionsMu.RLock()
 		_, connected := fs.connections[server]
 		fs.connectionsMu.RUnlock()
 
 		if !connected {
-			if err := fs.ConnectToServer(server); err != nil {
+			err := fs.ConnectToServer(server)
+			if err != nil && err != errCircuitOpen && err != errDraining {
 				fs.logger.Warn("Failed to connect to server",
 					zap.String("server", server),
 					zap.Error(err))
@@ -286,43 +560,19 @@ func (fs *FederationServer) queueProcessor() {
 	}
 }
 
-// Helper methods (stubs for brevity)
-
-func (fs *FederationServer) resolveServer(serverName string) (string, error) {
-	// In production: DNS SRV lookup or .well-known
-	return "wss://" + serverName + "/_matrix/federation/v1/ws", nil
-}
+// incomingChannel carries messages for local recipients
+const incomingChannel = "federation:incoming"
 
-func (fs *FederationServer) queueMessage(server string, msg FederationMessage) error {
-	key := "federation:queue:" + server
-	data, _ := json.Marshal(msg)
-	return fs.redis.LPush(fs.ctx, key, data).Err()
-}
-
-func (fs *FederationServer) processQueuedMessages() {
-	// Process queued messages for reconnection
-}
-
-func (fs *FederationServer) getKnownServers() ([]string, error) {
-	// Get list of known federation servers from Redis
-	result := fs.redis.Keys(fs.ctx, "federation:server:*").Val()
-	servers := make([]string, len(result))
-	for i, key := range result {
-		servers[i] = key[len("federation:server:"):]
-	}
-	return servers, nil
-}
+// Helper methods (stubs for brevity)
 
-func (fs *FederationServer) routeToLocalRecipients(payload interface{}) error {
-	// Route message to local recipients via Redis pub/sub
-	return fs.redis.Publish(fs.ctx, "federation:incoming", payload).Err()
+func (fs *FederationServer) routeToLocalRecipients(payload json.RawMessage) error {
+	// Route message to local recipients via Redis pub/sub, as the JSON the
+	// peer sent
+	return fs.redis.Publish(fs.ctx, fs.key(incomingChannel), []byte(payload)).Err()
 }
 
-func (fs *FederationServer) handleBroadcast(sourceServer string, payload interface{}) error {
+func (fs *FederationServer) handleBroadcast(sourceServer string, payload json.RawMessage) error {
 	// Handle broadcast message
 	fs.logger.Info("Received broadcast", zap.String("from", sourceServer))
 	return nil
 }
-
-// Add missing import
-import "github.com/gorilla/websocket"
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+func TestRedisNamespacePrefix(t *testing.T) {
+	tests := map[string]string{
+		"":         "",
+		"staging":  "staging:",
+		"staging:": "staging:",
+	}
+	for namespace, want := range tests {
+		if got := redisNamespacePrefix(namespace); got != want {
+			t.Errorf("redisNamespacePrefix(%q) = %q, want %q", namespace, got, want)
+		}
+	}
+
+	fs := &FederationServer{namespace: redisNamespacePrefix("staging")}
+	if got := fs.key(nonceKeyPrefix + "a"); got != "staging:federation:nonce:a" {
+		t.Errorf("key = %q", got)
+	}
+}
+
+// newTestRedis returns a client for the Redis server at REDIS_ADDR, or for
+// an in-process miniredis when REDIS_ADDR is unset
+func newTestRedis(t *testing.T) *redis.Client {
+	t.Helper()
+
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = miniredis.RunT(t).Addr()
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		t.Skipf("Redis not available at %s: %v", addr, err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newTestServer returns a federation server named name on newTestRedis,
+// under a namespace of its own, that discovers no peers
+func newTestServer(t *testing.T, name string) *FederationServer {
+	t.Helper()
+	return newTestServerOn(t, name, newTestRedis(t))
+}
+
+// newTestServerOn is newTestServer using client
+func newTestServerOn(t *testing.T, name string, client *redis.Client) *FederationServer {
+	t.Helper()
+
+	ns := *redisNS
+	*redisNS = "test-" + uuid.New().String()
+	fs := NewFederationServer(name, "", client, NewStaticPeerDiscovery(nil), zap.NewNop())
+	*redisNS = ns
+
+	t.Cleanup(fs.Close)
+	return fs
+}
+
+// servePeer serves a federation server's routes over TLS, resolving its
+// name to the test server for each of peers
+func servePeer(t *testing.T, fs *FederationServer, peers ...*FederationServer) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(newRouter(fs))
+	t.Cleanup(srv.Close)
+
+	tlsConfig := dialer.TLSClientConfig
+	dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	t.Cleanup(func() { dialer.TLSClientConfig = tlsConfig })
+
+	for _, peer := range peers {
+		err := peer.redis.Set(context.Background(), peer.key(resolveCacheKey+fs.serverName), srv.Listener.Addr().String(), 0).Err()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return srv
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// connected reports whether fs has a live connection to server
+func connected(fs *FederationServer, server string) bool {
+	fs.connectionsMu.RLock()
+	defer fs.connectionsMu.RUnlock()
+	conn, ok := fs.connections[server]
+	return ok && conn.Connected()
+}
+
+// subscribeIncoming subscribes to the messages fs routes to local recipients
+func subscribeIncoming(t *testing.T, fs *FederationServer) <-chan *redis.Message {
+	t.Helper()
+	pubsub := fs.redis.Subscribe(context.Background(), fs.key(incomingChannel))
+	t.Cleanup(func() { pubsub.Close() })
+	if _, err := pubsub.Receive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return pubsub.Channel()
+}
+
+func TestCompressedFrames(t *testing.T) {
+	a := newTestServer(t, "a.example")
+	b := newTestServer(t, "b.example")
+	servePeer(t, b, a)
+	incoming := subscribeIncoming(t, b)
+
+	addr, err := a.resolveServer("b.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe, resp, err := dialer.Dial(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe.Close()
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Errorf("negotiated extensions %q, want permessage-deflate", ext)
+	}
+
+	if err := a.ConnectToServer("b.example"); err != nil {
+		t.Fatal(err)
+	}
+	payload := `{"body":"` + strings.Repeat("hello federation ", 10000) + `"}`
+	if err := a.SendMessage("b.example", json.RawMessage(payload)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-incoming:
+		if m.Payload != payload {
+			t.Errorf("received %d bytes, want the %d sent", len(m.Payload), len(payload))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not delivered")
+	}
+}
+
+func TestLargeIntegerPayload(t *testing.T) {
+	a := newTestServer(t, "a.example")
+	b := newTestServer(t, "b.example")
+	servePeer(t, b, a)
+	incoming := subscribeIncoming(t, b)
+	if err := a.ConnectToServer("b.example"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2^53+1 and beyond don't survive a float64
+	payloads := []interface{}{
+		map[string]int64{"event_id": 1<<53 + 1},
+		json.RawMessage(`{"seq":18446744073709551615}`),
+	}
+	want := []string{`{"event_id":9007199254740993}`, `{"seq":18446744073709551615}`}
+	for i, payload := range payloads {
+		if err := a.SendMessage("b.example", payload); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m := <-incoming:
+			if m.Payload != want[i] {
+				t.Errorf("received %s, want %s", m.Payload, want[i])
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s not delivered", want[i])
+		}
+	}
+}
+
+func TestOversizedFrameRejected(t *testing.T) {
+	limit := *maxFrameSize
+	*maxFrameSize = 4 << 10
+	t.Cleanup(func() { *maxFrameSize = limit })
+
+	a := newTestServer(t, "a.example")
+	b := newTestServer(t, "b.example")
+	servePeer(t, b, a)
+	incoming := subscribeIncoming(t, b)
+	if err := a.ConnectToServer("b.example"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "b to register a", func() bool { return connected(b, "a.example") })
+
+	// Random data doesn't compress below the limit
+	noise := make([]byte, 64<<10)
+	rand.Read(noise)
+	payload, _ := json.Marshal(map[string]string{"body": base64.StdEncoding.EncodeToString(noise)})
+	if err := a.SendMessage("b.example", json.RawMessage(payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "b to drop a", func() bool { return !connected(b, "a.example") })
+	select {
+	case <-incoming:
+		t.Error("oversized message delivered")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestConcurrentConnectDialsOnce(t *testing.T) {
+	a := newTestServer(t, "a.example")
+	b := newTestServer(t, "b.example")
+	servePeer(t, b, a)
+
+	// Point a at a server that counts b's handshakes
+	var dials atomic.Int32
+	router := newRouter(b)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dials.Add(1)
+		router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	if err := a.redis.Set(context.Background(), a.key(resolveCacheKey+"b.example"), srv.Listener.Addr().String(), 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := a.ConnectToServer("b.example"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := dials.Load(); n != 1 {
+		t.Errorf("concurrent connects dialed %d times, want once", n)
+	}
+	if !connected(a, "b.example") {
+		t.Error("b not connected")
+	}
+}
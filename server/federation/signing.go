@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// errNoSigningKey is returned when a request needs signing but -server-key
+// holds no usable key
+var errNoSigningKey = errors.New("no usable server signing key")
+
+// signingKey is this server's ed25519 signing key
+type signingKey struct {
+	id  string // e.g. "ed25519:a_key"
+	key ed25519.PrivateKey
+}
+
+// parseSigningKey parses a key in the "ed25519 <version> <seed>" form of
+// Synapse signing key files, the seed in unpadded base64
+func parseSigningKey(s string) (*signingKey, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 3 || fields[0] != "ed25519" {
+		return nil, errors.New(`server key must be "ed25519 <version> <base64 seed>"`)
+	}
+	seed, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(fields[2], "="))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("server key seed must be 32 bytes of base64")
+	}
+	return &signingKey{
+		id:  "ed25519:" + fields[1],
+		key: ed25519.NewKeyFromSeed(seed),
+	}, nil
+}
+
+// signRequest adds an X-Matrix Authorization header to a federation request
+// for destination. content is the JSON request body, nil without one.
+func (fs *FederationServer) signRequest(req *http.Request, destination string, content json.RawMessage) error {
+	if fs.signing == nil {
+		return errNoSigningKey
+	}
+
+	request := map[string]interface{}{
+		"method":      req.Method,
+		"uri":         req.URL.RequestURI(),
+		"origin":      fs.serverName,
+		"destination": destination,
+	}
+	if content != nil {
+		request["content"] = content
+	}
+	message, err := canonicalJSON(request)
+	if err != nil {
+		return err
+	}
+
+	sig := base64.RawStdEncoding.EncodeToString(ed25519.Sign(fs.signing.key, message))
+	req.Header.Set("Authorization", fmt.Sprintf(`X-Matrix origin="%s",destination="%s",key="%s",sig="%s"`,
+		fs.serverName, destination, fs.signing.id, sig))
+	return nil
+}
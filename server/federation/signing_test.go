@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// testSeed is a fixed 32-byte signing key seed
+var testSeed = base64.RawStdEncoding.EncodeToString([]byte(strings.Repeat("k", ed25519.SeedSize)))
+
+func TestParseSigningKey(t *testing.T) {
+	key, err := parseSigningKey("ed25519 a_key " + testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.id != "ed25519:a_key" {
+		t.Errorf("key id = %q, want ed25519:a_key", key.id)
+	}
+	if padded, err := parseSigningKey("ed25519 a_key " + testSeed + "="); err != nil || !padded.key.Equal(key.key) {
+		t.Errorf("padded seed: %v", err)
+	}
+
+	invalid := map[string]string{
+		"empty":          "",
+		"two fields":     "ed25519 " + testSeed,
+		"wrong algo":     "curve25519 a_key " + testSeed,
+		"not base64":     "ed25519 a_key !!!",
+		"short seed":     "ed25519 a_key " + base64.RawStdEncoding.EncodeToString([]byte("short")),
+		"trailing field": "ed25519 a_key " + testSeed + " extra",
+	}
+	for name, s := range invalid {
+		if _, err := parseSigningKey(s); err == nil {
+			t.Errorf("%s: parseSigningKey succeeded", name)
+		}
+	}
+}
+
+// xMatrixPattern splits an X-Matrix Authorization header
+var xMatrixPattern = regexp.MustCompile(`^X-Matrix origin="([^"]*)",destination="([^"]*)",key="([^"]*)",sig="([^"]*)"$`)
+
+func TestSignRequest(t *testing.T) {
+	key, err := parseSigningKey("ed25519 a_key " + testSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &FederationServer{serverName: "local.example", signing: key}
+
+	content := json.RawMessage(`{"pdus":[],"origin":"local.example"}`)
+	req := httptest.NewRequest("PUT", "/_matrix/federation/v1/send/1?x=y", nil)
+	if err := fs.signRequest(req, "remote.example", content); err != nil {
+		t.Fatal(err)
+	}
+
+	parts := xMatrixPattern.FindStringSubmatch(req.Header.Get("Authorization"))
+	if parts == nil {
+		t.Fatalf("Authorization = %q", req.Header.Get("Authorization"))
+	}
+	if parts[1] != "local.example" || parts[2] != "remote.example" || parts[3] != "ed25519:a_key" {
+		t.Errorf("header fields = %q", parts[1:4])
+	}
+
+	message, err := canonicalJSON(map[string]interface{}{
+		"method":      "PUT",
+		"uri":         "/_matrix/federation/v1/send/1?x=y",
+		"origin":      "local.example",
+		"destination": "remote.example",
+		"content":     map[string]interface{}{"pdus": []interface{}{}, "origin": "local.example"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || !ed25519.Verify(key.key.Public().(ed25519.PublicKey), message, sig) {
+		t.Error("signature does not verify over the canonical request")
+	}
+
+	if err := (&FederationServer{}).signRequest(req, "remote.example", nil); err != errNoSigningKey {
+		t.Errorf("signRequest without a key = %v, want errNoSigningKey", err)
+	}
+}
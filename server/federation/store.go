@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Event store keys
+const (
+	eventKey      = "federation:event:"
+	roomEventsKey = "federation:room_events:"
+)
+
+// errEventNotFound is returned when an event isn't in the store
+var errEventNotFound = errors.New("event not found")
+
+// EventStore persists federation events (PDUs) in their JSON wire form
+type EventStore interface {
+	// StoreEvent saves an event and indexes it in its room's timeline
+	StoreEvent(ctx context.Context, event json.RawMessage) error
+	// GetEvent loads a single event by ID
+	GetEvent(ctx context.Context, eventID string) (json.RawMessage, error)
+	// GetRoomEvents returns up to limit events preceding the given events,
+	// newest first. With no starting events it returns the latest events.
+	GetRoomEvents(ctx context.Context, roomID string, from []string, limit int) ([]json.RawMessage, error)
+	// GetDevices returns a user's devices and the stream ID of the last
+	// change to them
+	GetDevices(ctx context.Context, userID string) (int64, []Device, error)
+	// UpdateDevice applies a device list update, reporting false when it is
+	// not newer than the stored stream ID
+	UpdateDevice(ctx context.Context, update DeviceListUpdate) (bool, error)
+}
+
+// eventHeader holds the event fields the store indexes on
+type eventHeader struct {
+	EventID string `json:"event_id"`
+	RoomID  string `json:"room_id"`
+	Depth   int64  `json:"depth"`
+}
+
+// redisEventStore is an EventStore backed by Redis
+type redisEventStore struct {
+	redis     *redis.Client
+	namespace string // prefix of every key
+}
+
+// NewRedisEventStore creates a Redis-backed event store whose keys start
+// with namespace
+func NewRedisEventStore(redisClient *redis.Client, namespace string) EventStore {
+	return &redisEventStore{redis: redisClient, namespace: namespace}
+}
+
+// key prefixes a key with the store's namespace
+func (s *redisEventStore) key(k string) string {
+	return s.namespace + k
+}
+
+func (s *redisEventStore) StoreEvent(ctx context.Context, event json.RawMessage) error {
+	var header eventHeader
+	if err := json.Unmarshal(event, &header); err != nil {
+		return err
+	}
+	if header.EventID == "" || header.RoomID == "" {
+		return errors.New("event is missing event_id or room_id")
+	}
+
+	pipe := s.redis.TxPipeline()
+	pipe.Set(ctx, s.key(eventKey+header.EventID), []byte(event), 0)
+	pipe.ZAdd(ctx, s.key(roomEventsKey+header.RoomID), redis.Z{
+		Score:  float64(header.Depth),
+		Member: header.EventID,
+	})
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *redisEventStore) GetEvent(ctx context.Context, eventID string) (json.RawMessage, error) {
+	data, err := s.redis.Get(ctx, s.key(eventKey+eventID)).Bytes()
+	if err == redis.Nil {
+		return nil, errEventNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(data), nil
+}
+
+func (s *redisEventStore) GetRoomEvents(ctx context.Context, roomID string, from []string, limit int) ([]json.RawMessage, error) {
+	// Start just below the deepest of the starting events
+	max := "+inf"
+	found := false
+	var maxDepth float64
+	for _, eventID := range from {
+		depth, err := s.redis.ZScore(ctx, s.key(roomEventsKey+roomID), eventID).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !found || depth > maxDepth {
+			maxDepth = depth
+			found = true
+		}
+	}
+	if found {
+		max = "(" + strconv.FormatFloat(maxDepth, 'f', -1, 64)
+	}
+
+	eventIDs, err := s.redis.ZRevRangeByScore(ctx, s.key(roomEventsKey+roomID), &redis.ZRangeBy{
+		Max:   max,
+		Min:   "-inf",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]json.RawMessage, 0, len(eventIDs))
+	for _, eventID := range eventIDs {
+		event, err := s.GetEvent(ctx, eventID)
+		if err == errEventNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// authEventIDs returns the IDs in an event's auth_events, which are plain
+// IDs in current room versions and [id, hashes] pairs in room version 1 and 2
+func authEventIDs(event json.RawMessage) []string {
+	var body struct {
+		AuthEvents []json.RawMessage `json:"auth_events"`
+	}
+	if err := json.Unmarshal(event, &body); err != nil {
+		return nil
+	}
+
+	ids := make([]string, 0, len(body.AuthEvents))
+	for _, ref := range body.AuthEvents {
+		var id string
+		if err := json.Unmarshal(ref, &id); err == nil {
+			ids = append(ids, id)
+			continue
+		}
+
+		var pair []json.RawMessage
+		if err := json.Unmarshal(ref, &pair); err == nil && len(pair) > 0 {
+			if err := json.Unmarshal(pair[0], &id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// getAuthChain returns the transitive auth events of an event from the
+// store. Auth events missing from the store are skipped.
+func getAuthChain(ctx context.Context, store EventStore, event json.RawMessage) ([]json.RawMessage, error) {
+	chain := make([]json.RawMessage, 0)
+	seen := make(map[string]bool)
+	queue := authEventIDs(event)
+
+	for len(queue) > 0 {
+		eventID := queue[0]
+		queue = queue[1:]
+		if seen[eventID] {
+			continue
+		}
+		seen[eventID] = true
+
+		authEvent, err := store.GetEvent(ctx, eventID)
+		if err == errEventNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, authEvent)
+		queue = append(queue, authEventIDs(authEvent)...)
+	}
+	return chain, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// mapEventStore serves GetEvent from a map; other methods are not used
+type mapEventStore struct {
+	EventStore
+	events map[string]json.RawMessage
+}
+
+func (s mapEventStore) GetEvent(ctx context.Context, eventID string) (json.RawMessage, error) {
+	event, ok := s.events[eventID]
+	if !ok {
+		return nil, errEventNotFound
+	}
+	return event, nil
+}
+
+func TestAuthEventIDs(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		want  []string
+	}{
+		{"plain ids", `{"auth_events":["$a","$b"]}`, []string{"$a", "$b"}},
+		{"room v1 pairs", `{"auth_events":[["$a",{"sha256":"x"}],["$b",{}]]}`, []string{"$a", "$b"}},
+		{"mixed", `{"auth_events":["$a",["$b",{}],[],42]}`, []string{"$a", "$b"}},
+		{"no auth events", `{}`, []string{}},
+		{"invalid json", `{`, nil},
+	}
+	for _, tt := range tests {
+		if got := authEventIDs(json.RawMessage(tt.event)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: authEventIDs = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetAuthChain(t *testing.T) {
+	store := mapEventStore{events: map[string]json.RawMessage{
+		"$create": json.RawMessage(`{"event_id":"$create","auth_events":[]}`),
+		"$member": json.RawMessage(`{"event_id":"$member","auth_events":["$create"]}`),
+		"$power":  json.RawMessage(`{"event_id":"$power","auth_events":["$create","$member"]}`),
+	}}
+	event := json.RawMessage(`{"auth_events":["$power","$member","$missing"]}`)
+
+	chain, err := getAuthChain(context.Background(), store, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, raw := range chain {
+		var body struct {
+			EventID string `json:"event_id"`
+		}
+		if err := json.Unmarshal(raw, &body); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, body.EventID)
+	}
+	if want := []string{"$power", "$member", "$create"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("auth chain = %q, want %q", ids, want)
+	}
+}
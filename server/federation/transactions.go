@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Transaction limits. A transaction carries at most 50 PDUs and 100 EDUs.
+const (
+	maxTxnPDUs        = 50
+	maxTxnEDUs        = 100
+	maxTxnResponse    = 1 << 20
+	txnRetryMin       = time.Second
+	txnRetryMax       = 5 * time.Minute
+	maxPendingTxnSize = 10000 // PDUs and EDUs waiting per destination
+)
+
+var (
+	errInvalidEvent   = errors.New("event is not a JSON object")
+	errTxnBacklogFull = errors.New("transaction backlog full")
+)
+
+// Transaction is the body of PUT /_matrix/federation/v1/send/{txnID}
+type Transaction struct {
+	Origin         string            `json:"origin"`
+	OriginServerTS int64             `json:"origin_server_ts"`
+	PDUs           []json.RawMessage `json:"pdus"`
+	EDUs           []json.RawMessage `json:"edus,omitempty"`
+}
+
+// transactionSender delivers one transaction to a destination, returning
+// the per-PDU results the destination reported
+type transactionSender func(ctx context.Context, dest, txnID string, txn Transaction) (map[string]string, error)
+
+// TransactionBuilder batches the PDUs and EDUs bound for one destination
+// into transactions. A transaction is sent once it holds -txn-max-pdus PDUs,
+// -txn-max-edus EDUs or -txn-max-bytes bytes, or -txn-flush-delay after its
+// first event. One transaction is in flight at a time, so the destination
+// sees events in order; a failed transaction is retried with the same ID,
+// which the destination uses to drop duplicates, until it is acknowledged
+// or the server shuts down. Events still pending at shutdown are lost.
+type TransactionBuilder struct {
+	dest   string
+	origin string
+	send   transactionSender
+	logger *zap.Logger
+	ctx    context.Context
+
+	maxPDUs  int
+	maxEDUs  int
+	maxBytes int
+	delay    time.Duration
+
+	mu       sync.Mutex
+	pdus     []json.RawMessage
+	edus     []json.RawMessage
+	size     int
+	timer    *time.Timer
+	inFlight bool
+	retry    time.Duration
+}
+
+// newTransactionBuilder creates a builder for dest using the -txn-* limits.
+// Delivery stops when ctx is cancelled.
+func newTransactionBuilder(ctx context.Context, dest, origin string, send transactionSender, logger *zap.Logger) *TransactionBuilder {
+	return &TransactionBuilder{
+		dest:     dest,
+		origin:   origin,
+		send:     send,
+		logger:   logger,
+		ctx:      ctx,
+		maxPDUs:  clampTxnLimit(*txnMaxPDUs, maxTxnPDUs),
+		maxEDUs:  clampTxnLimit(*txnMaxEDUs, maxTxnEDUs),
+		maxBytes: *txnMaxBytes,
+		delay:    *txnFlushDelay,
+	}
+}
+
+// clampTxnLimit bounds a configured per-transaction limit to the protocol's
+func clampTxnLimit(limit, max int) int {
+	if limit <= 0 || limit > max {
+		return max
+	}
+	return limit
+}
+
+// Add queues a PDU or EDU, flushing if it fills the transaction
+func (b *TransactionBuilder) Add(event json.RawMessage, isEDU bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.pdus)+len(b.edus) >= maxPendingTxnSize {
+		return errTxnBacklogFull
+	}
+
+	if isEDU {
+		b.edus = append(b.edus, event)
+	} else {
+		b.pdus = append(b.pdus, event)
+	}
+	b.size += len(event)
+
+	if b.full() {
+		b.flushLocked()
+	} else if b.timer == nil && !b.inFlight {
+		b.timer = time.AfterFunc(b.delay, b.Flush)
+	}
+	return nil
+}
+
+// full reports whether the pending events fill a transaction. The caller
+// must hold mu.
+func (b *TransactionBuilder) full() bool {
+	return len(b.pdus) >= b.maxPDUs || len(b.edus) >= b.maxEDUs ||
+		(b.maxBytes > 0 && b.size >= b.maxBytes)
+}
+
+// Flush sends the pending events now, unless a transaction is in flight
+func (b *TransactionBuilder) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+// flushLocked starts sending the next transaction. The caller must hold mu.
+func (b *TransactionBuilder) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if b.inFlight || (len(b.pdus) == 0 && len(b.edus) == 0) {
+		return
+	}
+
+	txn := b.take()
+	b.inFlight = true
+	go b.deliver(newTxnID(), txn)
+}
+
+// take removes up to one transaction's worth of pending events. The caller
+// must hold mu.
+func (b *TransactionBuilder) take() Transaction {
+	txn := Transaction{Origin: b.origin, PDUs: []json.RawMessage{}}
+
+	size := 0
+	for len(b.pdus) > 0 && len(txn.PDUs) < b.maxPDUs && (b.maxBytes <= 0 || size == 0 || size+len(b.pdus[0]) <= b.maxBytes) {
+		txn.PDUs = append(txn.PDUs, b.pdus[0])
+		size += len(b.pdus[0])
+		b.pdus = b.pdus[1:]
+	}
+	for len(b.edus) > 0 && len(txn.EDUs) < b.maxEDUs && (b.maxBytes <= 0 || size == 0 || size+len(b.edus[0]) <= b.maxBytes) {
+		txn.EDUs = append(txn.EDUs, b.edus[0])
+		size += len(b.edus[0])
+		b.edus = b.edus[1:]
+	}
+	b.size -= size
+	return txn
+}
+
+// deliver sends a transaction until the destination acknowledges it, then
+// moves on to whatever was queued meanwhile
+func (b *TransactionBuilder) deliver(txnID string, txn Transaction) {
+	for {
+		txn.OriginServerTS = time.Now().UnixMilli()
+		results, err := b.send(b.ctx, b.dest, txnID, txn)
+		if err == nil {
+			metrics.Transactions.WithLabelValues("sent").Inc()
+			for eventID, reason := range results {
+				metrics.TxnPDUsRejected.Inc()
+				b.logger.Warn("Destination rejected PDU",
+					zap.String("server", b.dest),
+					zap.String("event_id", eventID),
+					zap.String("reason", reason))
+			}
+			break
+		}
+
+		metrics.Transactions.WithLabelValues("failed").Inc()
+		delay := b.backoff()
+		b.logger.Warn("Failed to send transaction",
+			zap.String("server", b.dest),
+			zap.String("txn_id", txnID),
+			zap.Duration("retry_in", delay),
+			zap.Error(err))
+
+		select {
+		case <-time.After(delay):
+		case <-b.ctx.Done():
+			return
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inFlight = false
+	b.retry = 0
+	if b.full() {
+		b.flushLocked()
+	} else if len(b.pdus)+len(b.edus) > 0 && b.timer == nil {
+		b.timer = time.AfterFunc(b.delay, b.Flush)
+	}
+}
+
+// backoff returns how long to wait before retrying the transaction in
+// flight, doubling with each failure
+func (b *TransactionBuilder) backoff() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.retry == 0 {
+		b.retry = txnRetryMin
+	} else if b.retry *= 2; b.retry > txnRetryMax {
+		b.retry = txnRetryMax
+	}
+	return b.retry
+}
+
+// txnCounter makes transaction IDs unique within a millisecond
+var txnCounter int64
+
+// newTxnID returns a transaction ID unique to this server process
+func newTxnID() string {
+	return strconv.FormatInt(time.Now().UnixMilli(), 10) + "." + strconv.FormatInt(atomic.AddInt64(&txnCounter, 1), 10)
+}
+
+// QueueEvent queues a PDU or EDU for destServer, to be sent in the next
+// transaction to it. Events with an edu_type are EDUs.
+func (fs *FederationServer) QueueEvent(destServer string, event json.RawMessage) error {
+	var header struct {
+		EDUType string `json:"edu_type"`
+	}
+	if err := json.Unmarshal(event, &header); err != nil {
+		return errInvalidEvent
+	}
+	return fs.txnBuilder(destServer).Add(event, header.EDUType != "")
+}
+
+// txnBuilder returns the transaction builder for a destination, creating it
+// on first use
+func (fs *FederationServer) txnBuilder(destServer string) *TransactionBuilder {
+	fs.txnBuildersMu.Lock()
+	defer fs.txnBuildersMu.Unlock()
+
+	b, ok := fs.txnBuilders[destServer]
+	if !ok {
+		b = newTransactionBuilder(fs.ctx, destServer, fs.serverName, fs.sendTransaction, fs.logger)
+		fs.txnBuilders[destServer] = b
+	}
+	return b
+}
+
+// sendTransaction PUTs a signed transaction to a destination and returns
+// the PDUs it rejected, by event ID
+func (fs *FederationServer) sendTransaction(ctx context.Context, dest, txnID string, txn Transaction) (map[string]string, error) {
+	breaker := fs.breaker(dest)
+	if !breaker.Allow() {
+		return nil, errCircuitOpen
+	}
+
+	body, err := json.Marshal(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := fs.resolveServerHost(ctx, dest)
+	if err != nil {
+		breaker.Failure()
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut,
+		"https://"+host+"/_matrix/federation/v1/send/"+url.PathEscape(txnID), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := fs.signRequest(req, dest, body); err != nil {
+		return nil, err
+	}
+
+	resp, err := fs.httpClient.Do(req)
+	if err != nil {
+		breaker.Failure()
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		breaker.Failure()
+		return nil, fmt.Errorf("destination returned status %d", resp.StatusCode)
+	}
+	breaker.Success()
+
+	var result struct {
+		PDUs map[string]struct {
+			Error string `json:"error"`
+		} `json:"pdus"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxTxnResponse)).Decode(&result); err != nil {
+		// Delivered; only the per-PDU results are lost
+		return nil, nil
+	}
+
+	rejected := make(map[string]string)
+	for eventID, r := range result.PDUs {
+		if r.Error != "" {
+			rejected[eventID] = r.Error
+		}
+	}
+	return rejected, nil
+}
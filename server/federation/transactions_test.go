@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestClampTxnLimit(t *testing.T) {
+	tests := []struct{ limit, max, want int }{
+		{10, 50, 10},
+		{50, 50, 50},
+		{51, 50, 50},
+		{0, 50, 50},
+		{-1, 100, 100},
+	}
+	for _, tt := range tests {
+		if got := clampTxnLimit(tt.limit, tt.max); got != tt.want {
+			t.Errorf("clampTxnLimit(%d, %d) = %d, want %d", tt.limit, tt.max, got, tt.want)
+		}
+	}
+}
+
+// events returns n PDUs or EDUs of the given size
+func events(n, size int) []json.RawMessage {
+	out := make([]json.RawMessage, n)
+	for i := range out {
+		out[i] = json.RawMessage(`"` + strings.Repeat("x", size-2) + `"`)
+	}
+	return out
+}
+
+func TestTransactionTake(t *testing.T) {
+	tests := []struct {
+		name               string
+		maxPDUs, maxEDUs   int
+		maxBytes           int
+		pdus, edus         int
+		wantPDUs, wantEDUs int
+	}{
+		{"everything fits", 50, 100, 0, 3, 2, 3, 2},
+		{"pdu limit", 2, 100, 0, 5, 1, 2, 1},
+		{"edu limit", 50, 3, 0, 0, 5, 0, 3},
+		{"byte limit", 50, 100, 250, 2, 2, 2, 0},
+		{"oversized event still sent", 50, 100, 50, 2, 0, 1, 0},
+	}
+	for _, tt := range tests {
+		b := &TransactionBuilder{origin: "local.example", maxPDUs: tt.maxPDUs, maxEDUs: tt.maxEDUs, maxBytes: tt.maxBytes}
+		b.pdus, b.edus = events(tt.pdus, 100), events(tt.edus, 100)
+		b.size = 100 * (tt.pdus + tt.edus)
+
+		txn := b.take()
+		if len(txn.PDUs) != tt.wantPDUs || len(txn.EDUs) != tt.wantEDUs {
+			t.Errorf("%s: took %d PDUs and %d EDUs, want %d and %d", tt.name, len(txn.PDUs), len(txn.EDUs), tt.wantPDUs, tt.wantEDUs)
+		}
+		if left := len(b.pdus) + len(b.edus); b.size != 100*left {
+			t.Errorf("%s: size = %d with %d events left", tt.name, b.size, left)
+		}
+		if txn.Origin != "local.example" || txn.PDUs == nil {
+			t.Errorf("%s: transaction = %+v", tt.name, txn)
+		}
+	}
+}
+
+func TestTransactionBuilderBatches(t *testing.T) {
+	maxPDUs, delay := *txnMaxPDUs, *txnFlushDelay
+	*txnMaxPDUs, *txnFlushDelay = 2, time.Hour
+	t.Cleanup(func() { *txnMaxPDUs, *txnFlushDelay = maxPDUs, delay })
+
+	sent := make(chan Transaction, 4)
+	send := func(ctx context.Context, dest, txnID string, txn Transaction) (map[string]string, error) {
+		sent <- txn
+		return nil, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := newTransactionBuilder(ctx, "remote.example", "local.example", send, zap.NewNop())
+
+	for _, event := range events(3, 10) {
+		if err := b.Add(event, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case txn := <-sent:
+		if len(txn.PDUs) != 2 {
+			t.Errorf("first transaction has %d PDUs, want 2", len(txn.PDUs))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("full transaction was not sent")
+	}
+
+	// Flush does nothing while a transaction is in flight
+	for inFlight := true; inFlight; {
+		b.mu.Lock()
+		inFlight = b.inFlight
+		b.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	b.Flush()
+	select {
+	case txn := <-sent:
+		if len(txn.PDUs) != 1 {
+			t.Errorf("flushed transaction has %d PDUs, want 1", len(txn.PDUs))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending PDU was not sent on Flush")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Federation protocol versions. Peers agree on one during the WebSocket
+// handshake: the dialing server offers a subprotocol per version it speaks
+// and the accepting server picks the newest it speaks too. Peers that offer
+// no subprotocol predate versioning and speak version 1.
+const (
+	protocolV1 = 1
+
+	minProtocolVersion = protocolV1 // oldest version this server speaks
+	maxProtocolVersion = protocolV1 // newest version this server speaks
+)
+
+// versionSubprotocolPrefix starts the subprotocol naming a protocol version
+const versionSubprotocolPrefix = "liberty-reach.federation.v"
+
+var (
+	// errUnsupportedVersion is returned when a peer speaks no protocol
+	// version this server does
+	errUnsupportedVersion = errors.New("unsupported federation protocol version")
+	// errVersionMismatch is returned for messages stamped with a version
+	// other than the one negotiated for their connection
+	errVersionMismatch = errors.New("federation message version does not match the connection")
+)
+
+// versionSubprotocol returns the subprotocol naming a protocol version
+func versionSubprotocol(version int) string {
+	return versionSubprotocolPrefix + strconv.Itoa(version)
+}
+
+// versionSubprotocols lists the subprotocols of the versions this server
+// speaks, newest first
+func versionSubprotocols() []string {
+	var protocols []string
+	for v := maxProtocolVersion; v >= minProtocolVersion; v-- {
+		protocols = append(protocols, versionSubprotocol(v))
+	}
+	return protocols
+}
+
+// supportedVersion parses a version subprotocol, reporting false when it
+// names no version this server speaks
+func supportedVersion(protocol string) (int, bool) {
+	if !strings.HasPrefix(protocol, versionSubprotocolPrefix) {
+		return 0, false
+	}
+	v, err := strconv.Atoi(strings.TrimPrefix(protocol, versionSubprotocolPrefix))
+	if err != nil || v < minProtocolVersion || v > maxProtocolVersion {
+		return 0, false
+	}
+	return v, true
+}
+
+// negotiateVersion picks the newest version among the subprotocols a
+// dialing peer offered
+func negotiateVersion(offered []string) (int, error) {
+	if len(offered) == 0 {
+		return protocolV1, nil
+	}
+
+	best := 0
+	for _, protocol := range offered {
+		if v, ok := supportedVersion(protocol); ok && v > best {
+			best = v
+		}
+	}
+	if best == 0 {
+		return 0, errUnsupportedVersion
+	}
+	return best, nil
+}
+
+// acceptedVersion returns the version the accepting peer picked in its
+// handshake response
+func acceptedVersion(protocol string) (int, error) {
+	if protocol == "" {
+		return protocolV1, nil
+	}
+	v, ok := supportedVersion(protocol)
+	if !ok {
+		return 0, errUnsupportedVersion
+	}
+	return v, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestNegotiateVersion(t *testing.T) {
+	v1 := versionSubprotocol(protocolV1)
+	tests := []struct {
+		name    string
+		offered []string
+		want    int
+		wantErr error
+	}{
+		{"no subprotocols", nil, protocolV1, nil},
+		{"v1", []string{v1}, protocolV1, nil},
+		{"newer and v1", []string{versionSubprotocolPrefix + "99", v1}, protocolV1, nil},
+		{"unrelated and v1", []string{"chat", v1}, protocolV1, nil},
+		{"only unknown", []string{versionSubprotocolPrefix + "99", "chat"}, 0, errUnsupportedVersion},
+		{"malformed", []string{versionSubprotocolPrefix + "x"}, 0, errUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		got, err := negotiateVersion(tt.offered)
+		if got != tt.want || err != tt.wantErr {
+			t.Errorf("%s: negotiateVersion = %d, %v; want %d, %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestAcceptedVersion(t *testing.T) {
+	tests := []struct {
+		protocol string
+		want     int
+		wantErr  error
+	}{
+		{"", protocolV1, nil},
+		{versionSubprotocol(protocolV1), protocolV1, nil},
+		{versionSubprotocolPrefix + "0", 0, errUnsupportedVersion},
+		{"chat", 0, errUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		got, err := acceptedVersion(tt.protocol)
+		if got != tt.want || err != tt.wantErr {
+			t.Errorf("acceptedVersion(%q) = %d, %v; want %d, %v", tt.protocol, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestVersionSubprotocols(t *testing.T) {
+	protocols := versionSubprotocols()
+	if len(protocols) != maxProtocolVersion-minProtocolVersion+1 {
+		t.Fatalf("versionSubprotocols = %q", protocols)
+	}
+	for i, p := range protocols {
+		v, ok := supportedVersion(p)
+		if !ok || v != maxProtocolVersion-i {
+			t.Errorf("subprotocol %d = %q, want version %d newest first", i, p, maxProtocolVersion-i)
+		}
+	}
+}
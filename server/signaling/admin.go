@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// requireAdmin guards admin routes with the configured admin bearer token
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *adminToken == "" {
+			http.Error(w, "Admin API disabled", http.StatusForbidden)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+			audit.Log(auditAdminDenied, "", clientIP(r), r.Method+" "+r.URL.Path)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleSetJoinRule sets a room's join rule
+func handleSetJoinRule(connManager *ConnectionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := mux.Vars(r)["room"]
+
+		var body struct {
+			JoinRule string `json:"join_rule"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if err := connManager.SetJoinRule(room, body.JoinRule); err != nil {
+			if err == errInvalidJoinRule {
+				http.Error(w, "Invalid join rule", http.StatusBadRequest)
+				return
+			}
+			logger.Error("Failed to set join rule", zap.String("room", room), zap.Error(err))
+			http.Error(w, "Failed to set join rule", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleInviteUser adds a user to a room's invite list
+func handleInviteUser(connManager *ConnectionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := mux.Vars(r)["room"]
+
+		var body struct {
+			UserID string `json:"user_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.UserID == "" {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if err := connManager.InviteUser(room, body.UserID); err != nil {
+			logger.Error("Failed to invite user", zap.String("room", room), zap.Error(err))
+			http.Error(w, "Failed to invite user", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleRevokeInvite removes a user from a room's invite list
+func handleRevokeInvite(connManager *ConnectionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		if err := connManager.RevokeInvite(vars["room"], vars["userID"]); err != nil {
+			logger.Error("Failed to revoke invite", zap.String("room", vars["room"]), zap.Error(err))
+			http.Error(w, "Failed to revoke invite", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleCreateRoom creates a room with metadata
+func handleCreateRoom(connManager *ConnectionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var info RoomInfo
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil || info.ID == "" {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		room, err := connManager.CreateRoom(info)
+		if err == errRoomExists {
+			http.Error(w, "Room already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to create room", zap.String("room", info.ID), zap.Error(err))
+			http.Error(w, "Failed to create room", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(room)
+	}
+}
+
+// handleGetRoom returns a room's metadata
+func handleGetRoom(connManager *ConnectionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, err := connManager.GetRoom(mux.Vars(r)["room"])
+		if err == errRoomNotFound {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to get room", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(room)
+	}
+}
+
+// handleListRooms lists all created rooms
+func handleListRooms(connManager *ConnectionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rooms, err := connManager.ListRooms()
+		if err != nil {
+			http.Error(w, "Failed to list rooms", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rooms": rooms,
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// redisAnnounceChannel carries server announcements to every instance
+const redisAnnounceChannel = "lr:announce"
+
+// Announcement limits
+const (
+	maxAnnounceRooms = 1000 // rooms a single announcement may target
+	announceBurst    = 5    // announcements allowed at once beyond -announce-rate
+)
+
+// errTooManyAnnounceRooms is returned for announcements naming too many rooms
+var errTooManyAnnounceRooms = errors.New("too many rooms in announcement")
+
+// errAnnounceNotPublished is returned, wrapping the cause, for announcements
+// delivered on this server that could not be published to the others
+var errAnnounceNotPublished = errors.New("announcement not published to other servers")
+
+// announcement is a server announcement as published to other instances.
+// Without rooms it goes to every connected client.
+type announcement struct {
+	Origin  string           `json:"origin"` // server ID of the publisher
+	Rooms   []string         `json:"rooms,omitempty"`
+	Message SignalingMessage `json:"message"`
+}
+
+// BroadcastToAll sends a server-originated message to every client on every
+// instance
+func (cm *ConnectionManager) BroadcastToAll(msg SignalingMessage) error {
+	return cm.announce(announcement{Message: msg})
+}
+
+// BroadcastToRooms sends a server-originated message to the members of
+// rooms on every instance. A client in several of the rooms gets it once.
+func (cm *ConnectionManager) BroadcastToRooms(rooms []string, msg SignalingMessage) error {
+	if len(rooms) > maxAnnounceRooms {
+		return errTooManyAnnounceRooms
+	}
+	if len(rooms) == 0 {
+		return nil
+	}
+	return cm.announce(announcement{Rooms: rooms, Message: msg})
+}
+
+// announce delivers an announcement locally and publishes it once for the
+// other instances. A failed publish is not retried, since Redis may have
+// delivered it anyway.
+func (cm *ConnectionManager) announce(a announcement) error {
+	a.Origin = cm.serverID
+	a.Message.From = ""
+	if a.Message.Timestamp == 0 {
+		a.Message.Timestamp = time.Now().Unix()
+	}
+
+	cm.deliverAnnouncement(a)
+
+	data, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	err = cm.withRedisOnce("announce", func(ctx context.Context) error {
+		return cm.redis.Publish(ctx, cm.key(redisAnnounceChannel), data).Err()
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", errAnnounceNotPublished, err)
+	}
+	return nil
+}
+
+// deliverAnnouncement sends an announcement to its recipients on this
+// server
+func (cm *ConnectionManager) deliverAnnouncement(a announcement) {
+	if len(a.Rooms) == 0 {
+		data, err := cm.marshalMessage(a.Message)
+		if err != nil {
+			return
+		}
+
+		cm.clientsMu.RLock()
+		clients := make([]*Client, 0, len(cm.clients))
+		for _, client := range cm.clients {
+			clients = append(clients, client)
+		}
+		cm.clientsMu.RUnlock()
+
+		cm.sendAnnouncement(clients, data)
+		return
+	}
+
+	seen := make(map[*Client]bool)
+	for _, room := range a.Rooms {
+		cm.roomsMu.RLock()
+		var members []*Client
+		if r, ok := cm.rooms[room]; ok {
+			for _, client := range r.members {
+				if !seen[client] {
+					seen[client] = true
+					members = append(members, client)
+				}
+			}
+		}
+		cm.roomsMu.RUnlock()
+		if len(members) == 0 {
+			continue
+		}
+
+		msg := a.Message
+		msg.Room = room
+		data, err := cm.marshalMessage(msg)
+		if err != nil {
+			return
+		}
+		cm.sendAnnouncement(members, data)
+	}
+}
+
+// sendAnnouncement queues an encoded announcement for clients
+func (cm *ConnectionManager) sendAnnouncement(clients []*Client, data []byte) {
+	fanOut(clients, *broadcastWorkers, func(client *Client) {
+		if err := client.Enqueue(data); err != nil {
+			cm.logger.Debug("Failed to send announcement", zap.String("client_id", client.ID), zap.Error(err))
+		}
+	})
+}
+
+// announcementSubscriber delivers announcements published by other
+// instances
+func (cm *ConnectionManager) announcementSubscriber() {
+	pubsub := cm.redis.Subscribe(cm.ctx, cm.key(redisAnnounceChannel))
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-cm.ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			var a announcement
+			if err := json.Unmarshal([]byte(msg.Payload), &a); err != nil {
+				continue
+			}
+			// Delivered locally when published
+			if a.Origin == cm.serverID {
+				continue
+			}
+			cm.deliverAnnouncement(a)
+		}
+	}
+}
+
+// handleAdminBroadcast sends an announcement to the given rooms, or to every
+// connected client without rooms. Announcements are rate limited by
+// -announce-rate across all admins of the instance. The response reports
+// whether the announcement reached the other instances; clients of this one
+// have it either way.
+func handleAdminBroadcast(connManager *ConnectionManager) http.HandlerFunc {
+	limiter := rate.NewLimiter(rate.Limit(*announceRate), announceBurst)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Rooms   []string    `json:"rooms"`
+			Payload interface{} `json:"payload"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Payload == nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if !limiter.Allow() {
+			writeRateLimited(w, retryDelay(limiter))
+			return
+		}
+
+		msg := SignalingMessage{Type: MsgAnnouncement, Payload: body.Payload}
+		var err error
+		if len(body.Rooms) == 0 {
+			err = connManager.BroadcastToAll(msg)
+		} else {
+			err = connManager.BroadcastToRooms(body.Rooms, msg)
+		}
+		if err == errTooManyAnnounceRooms {
+			http.Error(w, "Too many rooms", http.StatusBadRequest)
+			return
+		}
+		if err != nil && !errors.Is(err, errAnnounceNotPublished) {
+			logger.Error("Failed to send announcement", zap.Error(err))
+			http.Error(w, "Failed to send announcement", http.StatusInternalServerError)
+			return
+		}
+		if err != nil {
+			logger.Warn("Announcement delivered on this server only", zap.Error(err))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"published": err == nil,
+		})
+	}
+}
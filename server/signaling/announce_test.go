@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// broadcast posts an announcement to a test server's admin API and returns
+// whether it was published to the other servers
+func broadcast(t *testing.T, srv *httptest.Server, payload string) bool {
+	t.Helper()
+	resp := adminRequest(t, srv, "POST", "/broadcast", `{"payload":"`+payload+`"}`)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("broadcast %q: status %d", payload, resp.StatusCode)
+	}
+	var body struct {
+		Published bool `json:"published"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Published
+}
+
+func TestBroadcastAcrossServers(t *testing.T) {
+	useAdminToken(t)
+	client, namespace := newTestRedis(t), "test-"+uuid.New().String()
+	a, b := newTestManagerOn(t, client, namespace), newTestManagerOn(t, client, namespace)
+	srvA, srvB := serveTestManager(t, a), serveTestManager(t, b)
+
+	alice := dialTest(t, srvA, "alice", "phone")
+	bob := dialTest(t, srvB, "bob", "laptop")
+	waitFor(t, "both to connect", func() bool { return a.HasDevice("alice", "phone") && b.HasDevice("bob", "laptop") })
+	waitFor(t, "both servers to subscribe", func() bool {
+		channel := a.key(redisAnnounceChannel)
+		return client.PubSubNumSub(context.Background(), channel).Val()[channel] == 2
+	})
+
+	if !broadcast(t, srvA, "maintenance") {
+		t.Error("announcement not published with Redis up")
+	}
+	for _, c := range []*testConn{alice, bob} {
+		if msg := c.next(MsgAnnouncement); msg.Payload != "maintenance" || msg.From != "" {
+			t.Errorf("announcement %+v, want the maintenance payload from the server", msg)
+		}
+	}
+
+	// Failing to publish still delivers on the receiving server, once
+	failCommands(t, a, "publish", 1, false)
+	if broadcast(t, srvA, "local") {
+		t.Error("announcement reported published with the publish failing")
+	}
+	if msg := alice.next(MsgAnnouncement); msg.Payload != "local" {
+		t.Errorf("announcement %+v, want the local payload", msg)
+	}
+	alice.none(MsgAnnouncement, 200*time.Millisecond)
+	bob.none(MsgAnnouncement, 200*time.Millisecond)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditAuthFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := NewAuditLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := audit
+	audit = a
+	t.Cleanup(func() { audit = saved })
+
+	srv := serveTestManager(t, newTestManager(t))
+	forged, err := GenerateJWT("alice", "phone", "not-the-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, header := range []http.Header{
+		{},
+		{"Authorization": {"Bearer " + forged}},
+	} {
+		if _, resp, _ := dialWith(t, srv, header); resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("handshake with %v: response %v, want 401", header, resp)
+		}
+	}
+	if err := a.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var events []map[string]interface{}
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var event map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("audit record %q is not JSON: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 2 {
+		t.Fatalf("recorded %d audit events, want 2: %v", len(events), events)
+	}
+
+	for i, event := range events {
+		if event["logger"] != "audit" || event["msg"] != "audit" || event["ts"] == nil {
+			t.Errorf("event %d envelope %v, want an audit record with a timestamp", i, event)
+		}
+		if event["event_type"] != auditAuthFailure || event["user_id"] != "" || event["ip"] != "127.0.0.1" {
+			t.Errorf("event %d = %v, want an auth failure from 127.0.0.1 with no user", i, event)
+		}
+	}
+	if reason := events[0]["reason"]; reason != errMissingToken.Error() {
+		t.Errorf("missing token recorded with reason %v, want %q", reason, errMissingToken.Error())
+	}
+	if reason, _ := events[1]["reason"].(string); reason == "" || reason == errMissingToken.Error() {
+		t.Errorf("forged token recorded with reason %q, want the validation error", reason)
+	}
+}
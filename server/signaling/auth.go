@@ -2,42 +2,246 @@ package main
 
 import (
 	"errors"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/liberty-reach/signaling/protocol"
+	"go.uber.org/zap"
 )
 
+// Token scopes
+const (
+	ScopeRTC      = "signaling:rtc"
+	ScopeRooms    = "signaling:rooms"
+	ScopePresence = "signaling:presence"
+
+	// ScopeGuest is granted to tokenless guest sessions and only allows
+	// joining and leaving public rooms
+	ScopeGuest = "signaling:guest"
+)
+
+// allScopes is granted to tokens that carry no explicit scopes
+var allScopes = []string{ScopeRTC, ScopeRooms, ScopePresence}
+
+// errMissingToken is returned when a request carries no credentials
+var errMissingToken = errors.New("missing token")
+
+// errNoJWTSecret is returned at startup when no JWT secret is configured
+var errNoJWTSecret = errors.New("no JWT secret configured (-jwt-secret or JWT_SECRET)")
+
+// Authenticator derives a client's identity from an incoming request.
+// Implementations return errMissingToken when no credentials are present.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Claims, error)
+}
+
+// JWTAuthenticator authenticates requests carrying a signed JWT, found by
+// requestToken
+type JWTAuthenticator struct {
+	Secret   string
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+}
+
+// Authenticate validates the request's JWT
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Claims, error) {
+	token := requestToken(r)
+	if token == "" {
+		return nil, errMissingToken
+	}
+
+	claims, err := validateJWT(token, a.Secret, a.Issuer, a.Audience, a.Leeway)
+	if err != nil {
+		return nil, err
+	}
+
+	if *tokenBinding {
+		if err := a.checkBinding(claims, clientIP(r), r.Header.Get(deviceFingerprintHeader)); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+// checkBinding verifies a token's binding claims, which are keyed by the
+// secret
+func (a *JWTAuthenticator) checkBinding(claims *Claims, ip, fingerprint string) error {
+	return checkTokenBinding(claims, a.Secret, ip, fingerprint)
+}
+
+// requestToken returns the bearer token of a request, looking in the
+// Authorization header, then the access_token subprotocol, then (unless
+// -allow-query-token is off) the token query parameter, which ends up in
+// proxy and access logs
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	offered := websocket.Subprotocols(r)
+	for i, p := range offered {
+		if p == protocol.SubprotocolAccessToken && i+1 < len(offered) {
+			return offered[i+1]
+		}
+	}
+
+	if *allowQueryToken {
+		return r.URL.Query().Get("token")
+	}
+	return ""
+}
+
 // Claims represents JWT token claims
 type Claims struct {
-	UserID   string `json:"user_id"`
-	DeviceID string `json:"device_id"`
+	UserID   string   `json:"user_id"`
+	DeviceID string   `json:"device_id"`
+	Scopes   []string `json:"scopes,omitempty"`
+	Guest    bool     `json:"-"`
+
+	// Optional binding to the network and device the token was issued to,
+	// enforced with -token-binding
+	IPHash     string `json:"ip_hash,omitempty"`
+	DeviceHash string `json:"device_hash,omitempty"`
+
 	jwt.RegisteredClaims
 }
 
+// newGuestClaims creates the identity of a tokenless guest session
+func newGuestClaims() *Claims {
+	id := uuid.New().String()
+	return &Claims{
+		UserID:   "guest-" + id,
+		DeviceID: id,
+		Scopes:   []string{ScopeGuest},
+		Guest:    true,
+	}
+}
+
+// EffectiveScopes returns the token's scopes, defaulting to all scopes for
+// tokens issued without any
+func (c *Claims) EffectiveScopes() []string {
+	if len(c.Scopes) == 0 {
+		return allScopes
+	}
+	return c.Scopes
+}
+
+// HasScope reports whether the token grants a scope
+func (c *Claims) HasScope(scope string) bool {
+	for _, s := range c.EffectiveScopes() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredScope returns the scope needed to send a message type, or "" if
+// the type is always allowed
+func requiredScope(msgType string) string {
+	switch msgType {
+	case MsgOffer, MsgAnswer, MsgCandidate:
+		return ScopeRTC
+	case MsgSubscribe, MsgUnsubscribe, MsgKnock, MsgTyping, MsgReceipt:
+		return ScopeRooms
+	case MsgPresence, MsgPresenceSubscribe:
+		return ScopePresence
+	}
+	return ""
+}
+
+// guestAllowed reports whether guests may send a message type
+func guestAllowed(msgType string) bool {
+	return msgType == MsgSubscribe || msgType == MsgUnsubscribe
+}
+
+// requireJWTSecret checks that a JWT secret is configured, since an empty
+// HMAC key validates tokens anyone can sign. With allowInsecure it only warns.
+func requireJWTSecret(secret string, allowInsecure bool, logger *zap.Logger) error {
+	if secret != "" {
+		return nil
+	}
+	if !allowInsecure {
+		return errNoJWTSecret
+	}
+	logger.Warn("INSECURE: no JWT secret configured, any forged token will be accepted. " +
+		"-allow-insecure-auth is for development only")
+	return nil
+}
+
+// TokenOption customizes a token issued by GenerateJWT
+type TokenOption func(*Claims, string)
+
+// WithScopes limits a token to scopes. Without it the token is granted all
+// scopes.
+func WithScopes(scopes ...string) TokenOption {
+	return func(claims *Claims, _ string) {
+		claims.Scopes = scopes
+	}
+}
+
+// BindToIP binds a token to the network of a client IP, for -token-binding
+func BindToIP(ip string) TokenOption {
+	return func(claims *Claims, secret string) {
+		claims.IPHash = bindingHash(secret, ipBinding(ip))
+	}
+}
+
+// BindToDevice binds a token to a device fingerprint, for -token-binding
+func BindToDevice(fingerprint string) TokenOption {
+	return func(claims *Claims, secret string) {
+		claims.DeviceHash = bindingHash(secret, fingerprint)
+	}
+}
+
 // GenerateJWT creates a new JWT token
-func GenerateJWT(userID, deviceID, secret string) (string, error) {
+func GenerateJWT(userID, deviceID, secret string, opts ...TokenOption) (string, error) {
 	claims := Claims{
 		UserID:   userID,
 		DeviceID: deviceID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			Issuer:    "liberty-reach-signaling",
+			Issuer:    *jwtIssuer,
 		},
 	}
+	if *jwtAudience != "" {
+		claims.Audience = jwt.ClaimStrings{*jwtAudience}
+	}
+	for _, opt := range opts {
+		opt(&claims, secret)
+	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(secret))
 }
 
-// ValidateJWT validates a JWT token
-func validateJWT(tokenString, secret string) (*Claims, error) {
+// ValidateJWT validates a JWT token. A non-empty issuer or audience must
+// match the token's iss or aud claim. exp, nbf and iat are checked with the
+// given clock-skew leeway.
+func validateJWT(tokenString, secret, issuer, audience string, leeway time.Duration) (*Claims, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithLeeway(leeway),
+		jwt.WithIssuedAt(),
+	}
+	if issuer != "" {
+		opts = append(opts, jwt.WithIssuer(issuer))
+	}
+	if audience != "" {
+		opts = append(opts, jwt.WithAudience(audience))
+	}
+
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, errors.New("unexpected signing method")
 		}
 		return []byte(secret), nil
-	})
+	}, opts...)
 
 	if err != nil {
 		return nil, err
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testSecret = "test-secret"
+
+// signTestToken signs claims for user alice with testSecret
+func signTestToken(t *testing.T, claims jwt.RegisteredClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{UserID: "alice", RegisteredClaims: claims}).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRequiredScope(t *testing.T) {
+	tests := map[string]string{
+		MsgOffer:       ScopeRTC,
+		MsgAnswer:      ScopeRTC,
+		MsgCandidate:   ScopeRTC,
+		MsgSubscribe:   ScopeRooms,
+		MsgUnsubscribe: ScopeRooms,
+		MsgPresence:    ScopePresence,
+		MsgPing:        "",
+		"bogus":        "",
+	}
+	for msgType, want := range tests {
+		if got := requiredScope(msgType); got != want {
+			t.Errorf("requiredScope(%q) = %q, want %q", msgType, got, want)
+		}
+	}
+}
+
+func TestClaimsHasScope(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		scope  string
+		want   bool
+	}{
+		{nil, ScopeRTC, true},
+		{nil, ScopePresence, true},
+		{nil, ScopeGuest, false},
+		{[]string{ScopeRTC}, ScopeRTC, true},
+		{[]string{ScopeRTC}, ScopeRooms, false},
+		{[]string{ScopeRooms, ScopePresence}, ScopePresence, true},
+	}
+	for _, tt := range tests {
+		claims := &Claims{Scopes: tt.scopes}
+		if got := claims.HasScope(tt.scope); got != tt.want {
+			t.Errorf("Claims{Scopes: %q}.HasScope(%q) = %v, want %v", tt.scopes, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestValidateJWTIssuerAudience(t *testing.T) {
+	exp := jwt.NewNumericDate(time.Now().Add(time.Hour))
+	tests := []struct {
+		name             string
+		claims           jwt.RegisteredClaims
+		issuer, audience string
+		wantErr          bool
+	}{
+		{"no checks", jwt.RegisteredClaims{ExpiresAt: exp}, "", "", false},
+		{"no audience check ignores aud", jwt.RegisteredClaims{ExpiresAt: exp, Audience: jwt.ClaimStrings{"other"}}, "", "", false},
+		{"matching issuer", jwt.RegisteredClaims{ExpiresAt: exp, Issuer: "liberty-reach"}, "liberty-reach", "", false},
+		{"wrong issuer", jwt.RegisteredClaims{ExpiresAt: exp, Issuer: "other"}, "liberty-reach", "", true},
+		{"matching audience", jwt.RegisteredClaims{ExpiresAt: exp, Audience: jwt.ClaimStrings{"signaling"}}, "", "signaling", false},
+		{"missing audience", jwt.RegisteredClaims{ExpiresAt: exp}, "", "signaling", true},
+		{"wrong audience", jwt.RegisteredClaims{ExpiresAt: exp, Audience: jwt.ClaimStrings{"other"}}, "", "signaling", true},
+	}
+	for _, tt := range tests {
+		_, err := validateJWT(signTestToken(t, tt.claims), testSecret, tt.issuer, tt.audience, 0)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateJWT err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateJWTLeeway(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		claims  jwt.RegisteredClaims
+		wantErr bool
+	}{
+		{"expired within leeway", jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(-10 * time.Second))}, false},
+		{"expired beyond leeway", jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(-time.Minute))}, true},
+		{"issued slightly ahead", jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(now.Add(10 * time.Second))}, false},
+		{"issued far ahead", jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(now.Add(time.Minute))}, true},
+		{"not yet valid within leeway", jwt.RegisteredClaims{NotBefore: jwt.NewNumericDate(now.Add(10 * time.Second))}, false},
+		{"not yet valid beyond leeway", jwt.RegisteredClaims{NotBefore: jwt.NewNumericDate(now.Add(time.Minute))}, true},
+	}
+	for _, tt := range tests {
+		_, err := validateJWT(signTestToken(t, tt.claims), testSecret, "", "", 30*time.Second)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: validateJWT err = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestGuestClaims(t *testing.T) {
+	a, b := newGuestClaims(), newGuestClaims()
+	if !a.Guest || a.UserID == b.UserID || a.DeviceID == b.DeviceID {
+		t.Fatalf("guest sessions share an identity: %+v, %+v", a, b)
+	}
+	for _, scope := range []string{ScopeRTC, ScopeRooms, ScopePresence} {
+		if a.HasScope(scope) {
+			t.Errorf("guest claims grant %s", scope)
+		}
+	}
+
+	allowed := map[string]bool{
+		MsgSubscribe:   true,
+		MsgUnsubscribe: true,
+		MsgOffer:       false,
+		MsgPresence:    false,
+		MsgKnock:       false,
+	}
+	for msgType, want := range allowed {
+		if got := guestAllowed(msgType); got != want {
+			t.Errorf("guestAllowed(%q) = %v, want %v", msgType, got, want)
+		}
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	allow := *allowQueryToken
+	t.Cleanup(func() { *allowQueryToken = allow })
+
+	tests := []struct {
+		name         string
+		header       string
+		subprotocols string
+		query        string
+		allowQuery   bool
+		want         string
+	}{
+		{"bearer header", "Bearer h", "access_token, s", "?token=q", true, "h"},
+		{"non-bearer header", "Basic x", "", "", true, ""},
+		{"subprotocol", "", "liberty-reach.v1+json, access_token, s", "?token=q", true, "s"},
+		{"subprotocol without token", "", "access_token", "", true, ""},
+		{"query", "", "", "?token=q", true, "q"},
+		{"query disabled", "", "", "?token=q", false, ""},
+	}
+	for _, tt := range tests {
+		*allowQueryToken = tt.allowQuery
+		r := httptest.NewRequest("GET", "/ws"+tt.query, nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if tt.subprotocols != "" {
+			r.Header.Set("Sec-WebSocket-Protocol", tt.subprotocols)
+		}
+		if got := requestToken(r); got != tt.want {
+			t.Errorf("%s: requestToken = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// headerAuthenticator trusts identity headers set by a fronting proxy
+type headerAuthenticator struct{}
+
+func (headerAuthenticator) Authenticate(r *http.Request) (*Claims, error) {
+	user := r.Header.Get("X-User-ID")
+	if user == "" {
+		return nil, errMissingToken
+	}
+	if user == "mallory" {
+		return nil, errors.New("user suspended")
+	}
+	return &Claims{UserID: user, DeviceID: r.Header.Get("X-Device-ID"), Scopes: []string{ScopeRTC}}, nil
+}
+
+func TestCustomAuthenticator(t *testing.T) {
+	cm := newTestManager(t)
+	cm.auth = headerAuthenticator{}
+	srv := httptest.NewServer(newRouter(cm, cm.auth))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := dialWith(t, srv, http.Header{"X-User-ID": {"alice"}, "X-Device-ID": {"phone"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := &testConn{t: t, conn: conn}
+	alice.send(SignalingMessage{Type: MsgWhoami})
+	info, _ := alice.next(MsgWhoami).Payload.(map[string]interface{})
+	if info["user_id"] != "alice" || info["device_id"] != "phone" {
+		t.Errorf("session info %v, want alice's phone", info)
+	}
+	alice.send(SignalingMessage{Type: MsgSubscribe, Room: "standup"})
+	if msg := alice.next(MsgError); !strings.Contains(fmt.Sprint(msg.Payload), ScopeRooms) {
+		t.Errorf("subscribe without the rooms scope got %v", msg.Payload)
+	}
+
+	for name, header := range map[string]http.Header{
+		"no identity":                  nil,
+		"refused by the authenticator": {"X-User-ID": {"mallory"}},
+	} {
+		if _, resp, err := dialWith(t, srv, header); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: dial got %v, want 401", name, err)
+		}
+	}
+}
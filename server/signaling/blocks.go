@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// redisBlocksKey prefixes the set of users each user has blocked
+const redisBlocksKey = "lr:blocks:"
+
+// maxBlockedUsers caps each user's block list
+const maxBlockedUsers = 1000
+
+// Block list errors
+var (
+	errBlocked        = errors.New("recipient is not accepting messages from you")
+	errTooManyBlocks  = errors.New("block list is full")
+	errInvalidBlockee = errors.New("invalid user to block")
+)
+
+// BlockUser stops blocked from relaying messages to userID
+func (cm *ConnectionManager) BlockUser(userID, blocked string) error {
+	if blocked == "" || blocked == userID {
+		return errInvalidBlockee
+	}
+
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	count, err := cm.redis.SCard(ctx, cm.key(redisBlocksKey+userID)).Result()
+	if err != nil {
+		return err
+	}
+	if count >= maxBlockedUsers {
+		return errTooManyBlocks
+	}
+	return cm.redis.SAdd(ctx, cm.key(redisBlocksKey+userID), blocked).Err()
+}
+
+// UnblockUser lets blocked relay messages to userID again
+func (cm *ConnectionManager) UnblockUser(userID, blocked string) error {
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	return cm.redis.SRem(ctx, cm.key(redisBlocksKey+userID), blocked).Err()
+}
+
+// BlockedUsers returns the users userID has blocked, sorted
+func (cm *ConnectionManager) BlockedUsers(userID string) ([]string, error) {
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	blocked, err := cm.redis.SMembers(ctx, cm.key(redisBlocksKey+userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(blocked)
+	return blocked, nil
+}
+
+// isBlocked reports whether recipient has blocked sender. Lookups that fail
+// are treated as not blocked so a Redis outage doesn't stop calls.
+func (cm *ConnectionManager) isBlocked(recipient, sender string) bool {
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	blocked, err := cm.redis.SIsMember(ctx, cm.key(redisBlocksKey+recipient), sender).Result()
+	if err != nil {
+		metrics.RedisErrors.WithLabelValues("block_check").Inc()
+		cm.logger.Debug("Failed to check block list", zap.String("user_id", recipient), zap.Error(err))
+		return false
+	}
+	return blocked
+}
+
+// writeBlockList writes a user's block list as {"blocked": [...]}
+func writeBlockList(w http.ResponseWriter, connManager *ConnectionManager, userID string) {
+	blocked, err := connManager.BlockedUsers(userID)
+	if err != nil {
+		logger.Error("Failed to load block list", zap.String("user_id", userID), zap.Error(err))
+		http.Error(w, "Failed to load block list", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"blocked": blocked,
+	})
+}
+
+// updateBlockList blocks or unblocks a user on userID's behalf
+func updateBlockList(w http.ResponseWriter, connManager *ConnectionManager, userID, target string, block bool) {
+	var err error
+	if block {
+		err = connManager.BlockUser(userID, target)
+	} else {
+		err = connManager.UnblockUser(userID, target)
+	}
+
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errInvalidBlockee:
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+	case errTooManyBlocks:
+		http.Error(w, "Block list is full", http.StatusConflict)
+	default:
+		logger.Error("Failed to update block list", zap.String("user_id", userID), zap.Error(err))
+		http.Error(w, "Failed to update block list", http.StatusInternalServerError)
+	}
+}
+
+// handleBlocks manages the authenticated user's own block list: GET lists
+// it, PUT /blocks/{userID} blocks a user and DELETE unblocks them
+func handleBlocks(connManager *ConnectionManager, auth Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := authenticateHTTP(w, r, connManager, auth)
+		if !ok {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeBlockList(w, connManager, claims.UserID)
+		case http.MethodPut:
+			updateBlockList(w, connManager, claims.UserID, mux.Vars(r)["userID"], true)
+		case http.MethodDelete:
+			updateBlockList(w, connManager, claims.UserID, mux.Vars(r)["userID"], false)
+		}
+	}
+}
+
+// handleAdminBlocks manages any user's block list
+func handleAdminBlocks(connManager *ConnectionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		switch r.Method {
+		case http.MethodGet:
+			writeBlockList(w, connManager, vars["userID"])
+		case http.MethodPut:
+			updateBlockList(w, connManager, vars["userID"], vars["blockedID"], true)
+		case http.MethodDelete:
+			updateBlockList(w, connManager, vars["userID"], vars["blockedID"], false)
+		}
+	}
+}
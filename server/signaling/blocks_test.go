@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// updateBlock blocks or unblocks target on behalf of the token's user and
+// returns the response status
+func updateBlock(t *testing.T, srvURL, token, method, target string) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, srvURL+"/blocks/"+target, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestBlockedSenderNotDelivered(t *testing.T) {
+	notify := *notifyBlocked
+	*notifyBlocked = true
+	t.Cleanup(func() { *notifyBlocked = notify })
+
+	cm := newTestManager(t)
+	srv := serveTestManager(t, cm)
+	alice := dialTest(t, srv, "alice", "phone")
+	bob := dialTest(t, srv, "bob", "laptop")
+	carol := dialTest(t, srv, "carol", "phone")
+	waitFor(t, "everyone to connect", func() bool { clients, _ := cm.Counts(); return clients == 3 })
+
+	if status := updateBlock(t, srv.URL, testToken(t, "bob", "laptop"), http.MethodPut, "alice"); status != http.StatusNoContent {
+		t.Fatalf("block: status %d", status)
+	}
+	blocked := testutil.ToFloat64(metrics.BlockedMessages)
+
+	alice.send(SignalingMessage{Type: MsgOffer, To: "bob", Payload: map[string]interface{}{"sdp": "from alice"}})
+	data, _ := json.Marshal(alice.next(MsgError).Payload)
+	var refusal ErrorPayload
+	json.Unmarshal(data, &refusal)
+	if refusal.Code != ErrCodeForbidden {
+		t.Errorf("blocked sender got error %+v, want %s", refusal, ErrCodeForbidden)
+	}
+
+	// Had alice's offer gone through it would have reached bob first
+	carol.send(SignalingMessage{Type: MsgOffer, To: "bob", Payload: map[string]interface{}{"sdp": "from carol"}})
+	if msg := bob.next(MsgOffer); msg.From != "carol" {
+		t.Errorf("bob received an offer from %s, want carol's", msg.From)
+	}
+	if got := testutil.ToFloat64(metrics.BlockedMessages) - blocked; got != 1 {
+		t.Errorf("blocked messages counted %v times, want once", got)
+	}
+
+	if status := updateBlock(t, srv.URL, testToken(t, "bob", "laptop"), http.MethodDelete, "alice"); status != http.StatusNoContent {
+		t.Fatalf("unblock: status %d", status)
+	}
+	alice.send(SignalingMessage{Type: MsgOffer, To: "bob", Payload: map[string]interface{}{"sdp": "from alice"}})
+	if msg := bob.next(MsgOffer); msg.From != "alice" {
+		t.Errorf("after unblocking bob received an offer from %s, want alice's", msg.From)
+	}
+}
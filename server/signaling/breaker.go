@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Redis retry and circuit breaker settings
+const (
+	redisRetryAttempts    = 3
+	redisRetryBackoff     = 50 * time.Millisecond
+	redisBreakerThreshold = 5
+	redisBreakerCooldown  = 10 * time.Second
+)
+
+// errRedisUnavailable is returned while the Redis circuit breaker is open
+var errRedisUnavailable = errors.New("redis unavailable")
+
+// circuitBreaker stops calling Redis after repeated failures and probes
+// again once the cooldown has elapsed
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	open      bool
+	openUntil time.Time
+	logger    *zap.Logger
+}
+
+// newCircuitBreaker creates a closed circuit breaker
+func newCircuitBreaker(logger *zap.Logger) *circuitBreaker {
+	return &circuitBreaker{logger: logger}
+}
+
+// Allow reports whether a call may proceed. Once the cooldown has elapsed a
+// single call is let through to probe whether Redis has recovered; the rest
+// are refused until it succeeds, or until another cooldown passes without
+// an answer.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = now.Add(redisBreakerCooldown)
+	return true
+}
+
+// Success records a successful call, closing the breaker if it was open
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	if b.open {
+		b.open = false
+		b.logger.Info("Redis recovered, resuming cross-server delivery")
+	}
+}
+
+// Failure records a failed call, opening the breaker past the threshold
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.failures < redisBreakerThreshold {
+		return
+	}
+
+	b.openUntil = time.Now().Add(redisBreakerCooldown)
+	if !b.open {
+		b.open = true
+		b.logger.Warn("Redis unavailable, falling back to local-only delivery",
+			zap.Int("failures", b.failures))
+	}
+}
+
+// withRedisRetry runs an idempotent Redis operation with retry and backoff,
+// guarded by the circuit breaker. Each attempt gets its own operation
+// context.
+func (cm *ConnectionManager) withRedisRetry(op string, fn func(ctx context.Context) error) error {
+	return cm.callRedis(op, redisRetryAttempts, fn)
+}
+
+// withRedisOnce runs a Redis operation that must not be repeated, such as a
+// publish or a list push, in a single attempt guarded by the circuit
+// breaker. An attempt that timed out may still have taken effect, so
+// retrying it could deliver or queue a message twice.
+func (cm *ConnectionManager) withRedisOnce(op string, fn func(ctx context.Context) error) error {
+	return cm.callRedis(op, 1, fn)
+}
+
+// callRedis runs a Redis operation up to attempts times
+func (cm *ConnectionManager) callRedis(op string, attempts int, fn func(ctx context.Context) error) error {
+	if !cm.breaker.Allow() {
+		return errRedisUnavailable
+	}
+
+	backoff := redisRetryBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := cm.redisContext()
+		err = fn(ctx)
+		cancel()
+
+		if err == nil || err == redis.Nil {
+			cm.breaker.Success()
+			return err
+		}
+
+		metrics.RedisErrors.WithLabelValues(op).Inc()
+		if attempt == attempts {
+			break
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-cm.ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+
+	cm.breaker.Failure()
+	return err
+}
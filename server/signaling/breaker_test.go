@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// errInjected is the error failingHook makes commands return
+var errInjected = errors.New("injected Redis failure")
+
+// failingHook fails the first n Redis commands named cmd. With after set the
+// command still reaches Redis, as when the reply to a write is lost.
+type failingHook struct {
+	cmd   string
+	n     atomic.Int32
+	after bool
+}
+
+// failCommands makes the first n commands named cmd on the manager's Redis
+// client fail
+func failCommands(t *testing.T, cm *ConnectionManager, cmd string, n int, after bool) {
+	t.Helper()
+	hook := &failingHook{cmd: cmd, after: after}
+	hook.n.Store(int32(n))
+	cm.redis.(*redis.Client).AddHook(hook)
+}
+
+func (h *failingHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *failingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() != h.cmd || h.n.Add(-1) < 0 {
+			return next(ctx, cmd)
+		}
+		if h.after {
+			if err := next(ctx, cmd); err != nil {
+				return err
+			}
+		}
+		cmd.SetErr(errInjected)
+		return errInjected
+	}
+}
+
+func (h *failingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	b := newCircuitBreaker(zap.NewNop())
+	for i := 0; i < redisBreakerThreshold; i++ {
+		b.Failure()
+	}
+	if b.Allow() {
+		t.Fatal("open breaker allowed a call")
+	}
+
+	b.mu.Lock()
+	b.openUntil = time.Now().Add(-time.Millisecond)
+	b.mu.Unlock()
+
+	if !b.Allow() {
+		t.Fatal("breaker refused the probe after its cooldown")
+	}
+	if b.Allow() {
+		t.Fatal("half-open breaker allowed a second probe")
+	}
+
+	b.Success()
+	if !b.Allow() || !b.Allow() {
+		t.Error("breaker still refusing calls after a successful probe")
+	}
+}
+
+// relayTarget registers bob's phone as connected to another server and
+// subscribes to the channel relays to it are published on
+func relayTarget(t *testing.T, cm *ConnectionManager) <-chan *redis.Message {
+	t.Helper()
+	ctx := context.Background()
+	if err := cm.redis.Set(ctx, cm.key(redisClientKey+"bob:phone"), `{"server_id":"other"}`, time.Hour).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.redis.SAdd(ctx, cm.key(redisDevicesKey+"bob"), "phone").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	pubsub := cm.redis.Subscribe(ctx, cm.key(redisPubSubChannel))
+	t.Cleanup(func() { pubsub.Close() })
+	if _, err := pubsub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return pubsub.Channel()
+}
+
+// countMessages counts the messages arriving on ch within wait
+func countMessages(ch <-chan *redis.Message, wait time.Duration) int {
+	n := 0
+	timeout := time.After(wait)
+	for {
+		select {
+		case <-ch:
+			n++
+		case <-timeout:
+			return n
+		}
+	}
+}
+
+func TestRelayTransientFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		cmd     string
+		after   bool
+		wantErr bool
+	}{
+		{"lookup fails once", "smembers", false, false},
+		{"publish reply lost", "publish", true, true},
+	}
+	for _, tt := range tests {
+		cm := newTestManager(t)
+		relays := relayTarget(t, cm)
+		failCommands(t, cm, tt.cmd, 1, tt.after)
+
+		msg := SignalingMessage{Type: MsgOffer, To: "bob", Hops: maxRelayHops}
+		if err := cm.relayViaRedis(msg, "alice"); (err != nil) != tt.wantErr {
+			t.Errorf("%s: relayViaRedis = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if n := countMessages(relays, 200*time.Millisecond); n != 1 {
+			t.Errorf("%s: relay published %d times, want once", tt.name, n)
+		}
+	}
+}
+
+func TestUpdatePresenceLogsFailure(t *testing.T) {
+	cm := newTestManager(t)
+	core, logs := observer.New(zapcore.WarnLevel)
+	cm.logger = zap.New(core)
+	failCommands(t, cm, "set", redisRetryAttempts, false)
+
+	cm.UpdatePresence("alice", Presence{Presence: PresenceAway})
+
+	if logs.FilterMessage("Failed to store presence").Len() != 1 {
+		t.Errorf("presence write failure not logged: %v", logs.All())
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed certificate for localhost and its key
+// to temporary files
+func writeKeyPair(t *testing.T, name string) (certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestSelfChecks(t *testing.T) {
+	addr, secret, cert, key := *redisAddr, *jwtSecret, *certFile, *keyFile
+	t.Cleanup(func() { *redisAddr, *jwtSecret, *certFile, *keyFile = addr, secret, cert, key })
+
+	// An address nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := l.Addr().String()
+	l.Close()
+
+	live := newTestRedis(t).Options().Addr
+	goodCert, goodKey := writeKeyPair(t, "server")
+	_, otherKey := writeKeyPair(t, "other")
+
+	tests := []struct {
+		name      string
+		redis     string
+		cert, key string
+		wantFail  []string
+	}{
+		{"healthy", live, goodCert, goodKey, nil},
+		{"redis unreachable", unreachable, goodCert, goodKey, []string{"redis"}},
+		{"mismatched key pair", live, goodCert, otherKey, []string{"tls"}},
+	}
+	for _, tt := range tests {
+		*redisAddr, *jwtSecret, *certFile, *keyFile = tt.redis, testSecret, tt.cert, tt.key
+
+		var out bytes.Buffer
+		ok := reportSelfChecks(&out, runSelfChecks())
+		if ok != (len(tt.wantFail) == 0) {
+			t.Errorf("%s: checks passed = %v, want %v:\n%s", tt.name, ok, len(tt.wantFail) == 0, out.String())
+		}
+
+		failed := map[string]bool{}
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "FAIL" {
+				failed[fields[1]] = true
+			}
+		}
+		if len(failed) != len(tt.wantFail) {
+			t.Errorf("%s: failed checks %v, want %v", tt.name, failed, tt.wantFail)
+		}
+		for _, name := range tt.wantFail {
+			if !failed[name] {
+				t.Errorf("%s: %s check passed:\n%s", tt.name, name, out.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,346 @@
+// Package client is a Go client for the signaling server. It keeps a
+// WebSocket connection alive with pings, reconnects with backoff when the
+// connection drops, and restores room subscriptions after reconnecting.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/liberty-reach/signaling/protocol"
+)
+
+// WebSocket timing and reconnect settings
+const (
+	writeWait         = 10 * time.Second
+	pongWait          = 60 * time.Second
+	pingPeriod        = (pongWait * 9) / 10
+	maxMessageSize    = 512 * 1024
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+var (
+	// ErrClosed is returned when using a client after Close
+	ErrClosed = errors.New("client closed")
+	// ErrNotConnected is returned when sending while reconnecting
+	ErrNotConnected = errors.New("not connected")
+)
+
+// MessageHandler is called for every message received from the server
+type MessageHandler func(msg protocol.SignalingMessage)
+
+// Client is a connection to the signaling server
+type Client struct {
+	url    string
+	dialer *websocket.Dialer
+
+	mu      sync.Mutex // guards token, conn, rooms and handler, and serializes writes
+	token   string
+	conn    *websocket.Conn
+	rooms   map[string]bool
+	handler MessageHandler
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Dial connects to the signaling server's WebSocket endpoint, authenticating
+// with a JWT in the Authorization header
+func Dial(serverURL, token string) (*Client, error) {
+	c := &Client{
+		url:    serverURL,
+		token:  token,
+		dialer: websocket.DefaultDialer,
+		rooms:  make(map[string]bool),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	conn, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	go c.run(conn)
+
+	return c, nil
+}
+
+// OnMessage sets the handler for messages received from the server. It is
+// called from the client's read goroutine.
+func (c *Client) OnMessage(handler MessageHandler) {
+	c.mu.Lock()
+	c.handler = handler
+	c.mu.Unlock()
+}
+
+// SendOffer sends an SDP offer to another client
+func (c *Client) SendOffer(to string, sdp interface{}) error {
+	return c.Send(protocol.SignalingMessage{Type: protocol.MsgOffer, To: to, Payload: sdp})
+}
+
+// RestartICE sends an offer renegotiating an established call session with
+// fresh ICE credentials
+func (c *Client) RestartICE(to, sessionID, sdp string) error {
+	return c.SendOffer(to, protocol.SessionDescription{
+		Type:       protocol.MsgOffer,
+		SDP:        sdp,
+		SessionID:  sessionID,
+		ICERestart: true,
+	})
+}
+
+// SendAnswer sends an SDP answer to another client
+func (c *Client) SendAnswer(to string, sdp interface{}) error {
+	return c.Send(protocol.SignalingMessage{Type: protocol.MsgAnswer, To: to, Payload: sdp})
+}
+
+// SendCandidate sends an ICE candidate to another client
+func (c *Client) SendCandidate(to string, candidate interface{}) error {
+	return c.Send(protocol.SignalingMessage{Type: protocol.MsgCandidate, To: to, Payload: candidate})
+}
+
+// SendTyping starts or stops the typing indicator in a room. The server stops
+// it after a few seconds unless it is sent again.
+func (c *Client) SendTyping(room string, typing bool) error {
+	return c.Send(protocol.SignalingMessage{
+		Type:    protocol.MsgTyping,
+		Room:    room,
+		Payload: protocol.TypingPayload{Typing: typing},
+	})
+}
+
+// SendReceipt tells a room's other members that messages up to messageID
+// have been read
+func (c *Client) SendReceipt(room, messageID string) error {
+	return c.Send(protocol.SignalingMessage{
+		Type:    protocol.MsgReceipt,
+		Room:    room,
+		Payload: protocol.ReceiptPayload{MessageID: messageID},
+	})
+}
+
+// Reauth hands the server a fresh token before the current one expires,
+// keeping the connection open. The token is also used for later reconnects.
+func (c *Client) Reauth(token string) error {
+	c.mu.Lock()
+	c.token = token
+	c.mu.Unlock()
+
+	return c.Send(protocol.SignalingMessage{
+		Type:    protocol.MsgReauth,
+		Payload: protocol.ReauthPayload{Token: token},
+	})
+}
+
+// Subscribe joins a room. The subscription is restored after reconnecting.
+func (c *Client) Subscribe(room string) error {
+	c.mu.Lock()
+	c.rooms[room] = true
+	c.mu.Unlock()
+
+	return c.Send(protocol.SignalingMessage{Type: protocol.MsgSubscribe, Room: room})
+}
+
+// Unsubscribe leaves a room
+func (c *Client) Unsubscribe(room string) error {
+	c.mu.Lock()
+	delete(c.rooms, room)
+	c.mu.Unlock()
+
+	return c.Send(protocol.SignalingMessage{Type: protocol.MsgUnsubscribe, Room: room})
+}
+
+// Send sends a message to the server
+func (c *Client) Send(msg protocol.SignalingMessage) error {
+	select {
+	case <-c.closed:
+		return ErrClosed
+	default:
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	return c.write(c.conn, data)
+}
+
+// Close closes the connection and stops reconnecting
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+
+		c.mu.Lock()
+		if c.conn != nil {
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(writeWait))
+			c.conn.Close()
+		}
+		c.mu.Unlock()
+	})
+
+	<-c.done
+	return nil
+}
+
+// connect dials the server and installs the connection
+func (c *Client) connect() (*websocket.Conn, error) {
+	c.mu.Lock()
+	header := http.Header{"Authorization": {"Bearer " + c.token}}
+	c.mu.Unlock()
+
+	conn, _, err := c.dialer.Dial(c.url, header)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+
+	return conn, nil
+}
+
+// run reads from the connection, reconnecting whenever it drops
+func (c *Client) run(conn *websocket.Conn) {
+	defer close(c.done)
+
+	for {
+		c.readLoop(conn)
+
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+
+		conn = c.reconnect()
+		if conn == nil {
+			return
+		}
+	}
+}
+
+// readLoop dispatches incoming messages until the connection fails,
+// pinging the server in the background
+func (c *Client) readLoop(conn *websocket.Conn) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.pingLoop(conn, stop)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		// Servers coalescing writes send several newline-separated
+		// messages in one frame
+		for _, line := range bytes.Split(data, []byte{'\n'}) {
+			var msg protocol.SignalingMessage
+			if err := json.Unmarshal(line, &msg); err != nil {
+				continue
+			}
+
+			c.mu.Lock()
+			handler := c.handler
+			c.mu.Unlock()
+
+			if handler != nil {
+				handler(msg)
+			}
+		}
+	}
+}
+
+// pingLoop sends WebSocket pings so dead connections are detected
+func (c *Client) pingLoop(conn *websocket.Conn, stop chan struct{}) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				conn.Close()
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reconnect dials with exponential backoff until it succeeds or the client
+// is closed, then restores room subscriptions. It returns nil once closed.
+func (c *Client) reconnect() *websocket.Conn {
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-time.After(delay):
+		case <-c.closed:
+			return nil
+		}
+
+		conn, err := c.connect()
+		if err != nil {
+			delay *= 2
+			if delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+
+		// Close may have run while dialing
+		select {
+		case <-c.closed:
+			conn.Close()
+			return nil
+		default:
+		}
+
+		c.resubscribe(conn)
+		return conn
+	}
+}
+
+// resubscribe restores room subscriptions on a new connection
+func (c *Client) resubscribe(conn *websocket.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for room := range c.rooms {
+		data, _ := json.Marshal(protocol.SignalingMessage{Type: protocol.MsgSubscribe, Room: room})
+		if err := c.write(conn, data); err != nil {
+			return
+		}
+	}
+}
+
+// write writes a single text frame; c.mu must be held
+func (c *Client) write(conn *websocket.Conn, data []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
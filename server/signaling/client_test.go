@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liberty-reach/signaling/client"
+	"github.com/liberty-reach/signaling/protocol"
+)
+
+// dialClient connects the client package to a test server as a user's device
+func dialClient(t *testing.T, srvURL, userID, deviceID string) (*client.Client, <-chan protocol.SignalingMessage) {
+	t.Helper()
+	c, err := client.Dial("ws"+strings.TrimPrefix(srvURL, "http")+"/ws", testToken(t, userID, deviceID))
+	if err != nil {
+		t.Fatalf("dial as %s/%s: %v", userID, deviceID, err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	received := make(chan protocol.SignalingMessage, 64)
+	c.OnMessage(func(msg protocol.SignalingMessage) { received <- msg })
+	return c, received
+}
+
+// nextOfType returns the next message of type msgType, discarding others
+func nextOfType(t *testing.T, received <-chan protocol.SignalingMessage, msgType string) protocol.SignalingMessage {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case msg := <-received:
+			if msg.Type == msgType {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("no %s message received", msgType)
+		}
+	}
+}
+
+func TestClientPackage(t *testing.T) {
+	cm := newTestManager(t)
+	srv := serveTestManager(t, cm)
+
+	alice, _ := dialClient(t, srv.URL, "alice", "phone")
+	bob, bobReceived := dialClient(t, srv.URL, "bob", "laptop")
+	waitFor(t, "both to connect", func() bool { return cm.HasDevice("alice", "phone") && cm.HasDevice("bob", "laptop") })
+
+	if err := alice.SendOffer("bob", protocol.SessionDescription{Type: protocol.MsgOffer, SDP: "v=0", SessionID: "call-1"}); err != nil {
+		t.Fatal(err)
+	}
+	offer := nextOfType(t, bobReceived, protocol.MsgOffer)
+	if offer.From != "alice" {
+		t.Errorf("offer from %q, want alice", offer.From)
+	}
+
+	// Subscriptions survive the server dropping the connection
+	if err := bob.Subscribe("standup"); err != nil {
+		t.Fatal(err)
+	}
+	member := func() bool {
+		clients := cm.GetClientByUserID("bob")
+		return len(clients) == 1 && cm.isMember(clients[0], "standup")
+	}
+	waitFor(t, "bob to join", member)
+	first := cm.GetClientByUserID("bob")[0]
+	first.Disconnect()
+	waitFor(t, "bob to reconnect and rejoin", func() bool {
+		return member() && cm.GetClientByUserID("bob")[0] != first
+	})
+
+	if err := alice.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SendOffer("bob", nil); err != client.ErrClosed {
+		t.Errorf("send after Close = %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseCIDRs("10.0.0.0/8, 2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := trustedProxies
+	trustedProxies = proxies
+	t.Cleanup(func() { trustedProxies = saved })
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		realIP    string
+		want      string
+	}{
+		{"direct", "203.0.113.5:4000", "", "", "203.0.113.5"},
+		{"untrusted proxy headers ignored", "203.0.113.5:4000", "198.51.100.1", "198.51.100.2", "203.0.113.5"},
+		{"trusted proxy", "10.0.0.1:4000", "198.51.100.1", "", "198.51.100.1"},
+		{"spoofed leftmost hop", "10.0.0.1:4000", "1.2.3.4, 198.51.100.1", "", "198.51.100.1"},
+		{"chained trusted proxies", "10.0.0.1:4000", "198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		{"only trusted hops", "10.0.0.1:4000", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"garbage hop", "10.0.0.1:4000", "198.51.100.1, junk", "", "10.0.0.1"},
+		{"real ip", "10.0.0.1:4000", "", "198.51.100.9", "198.51.100.9"},
+		{"invalid real ip", "10.0.0.1:4000", "", "junk", "10.0.0.1"},
+		{"ipv6 proxy", "[2001:db8::1]:4000", "2001:db9::7", "", "2001:db9::7"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = tt.remote
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseCIDRsInvalid(t *testing.T) {
+	if _, err := parseCIDRs("10.0.0.0/8,not-a-cidr"); err == nil {
+		t.Error("parseCIDRs accepted an invalid network")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+	"github.com/liberty-reach/signaling/protocol"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes signaling messages on a client's WebSocket connection. The
+// codec is negotiated with the WebSocket subprotocol; clients that don't ask
+// for one get JSON.
+type Codec interface {
+	// Subprotocol is the WebSocket subprotocol selecting the codec
+	Subprotocol() string
+	// FrameType is the WebSocket message type frames are sent as
+	FrameType() int
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// jsonCodec encodes messages as JSON text frames
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string { return protocol.SubprotocolJSON }
+func (jsonCodec) FrameType() int      { return websocket.TextMessage }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// msgpackCodec encodes messages as MessagePack binary frames, using the same
+// field names as JSON
+type msgpackCodec struct{}
+
+func (msgpackCodec) Subprotocol() string { return protocol.SubprotocolMsgPack }
+func (msgpackCodec) FrameType() int      { return websocket.BinaryMessage }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// codecs maps subprotocols to their codecs
+var codecs = map[string]Codec{
+	protocol.SubprotocolJSON:    jsonCodec{},
+	protocol.SubprotocolMsgPack: msgpackCodec{},
+}
+
+// subprotocols are offered to clients in order of preference. The access
+// token marker is accepted last so browsers passing only a token get it
+// echoed back, which they require, and use JSON.
+var subprotocols = []string{protocol.SubprotocolJSON, protocol.SubprotocolMsgPack, protocol.SubprotocolAccessToken}
+
+// codecFor returns the codec for a negotiated subprotocol, defaulting to JSON
+func codecFor(subprotocol string) Codec {
+	if codec, ok := codecs[subprotocol]; ok {
+		return codec
+	}
+	return jsonCodec{}
+}
+
+// encodeFrame converts a queued message, which is always JSON, into the
+// client's wire format
+func (c *Client) encodeFrame(message []byte) ([]byte, error) {
+	if _, ok := c.codec.(jsonCodec); ok {
+		return message, nil
+	}
+
+	var msg SignalingMessage
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return nil, err
+	}
+	return c.codec.Marshal(msg)
+}
+
+// decodeFrame converts a frame from the client into the JSON form handled by
+// processMessage
+func (c *Client) decodeFrame(frame []byte) ([]byte, error) {
+	if _, ok := c.codec.(jsonCodec); ok {
+		return frame, nil
+	}
+
+	var msg SignalingMessage
+	if err := c.codec.Unmarshal(frame, &msg); err != nil {
+		return nil, err
+	}
+	return json.Marshal(msg)
+}
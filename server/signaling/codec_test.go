@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/liberty-reach/signaling/protocol"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	msg := SignalingMessage{
+		ID:        "m1",
+		Type:      MsgOffer,
+		From:      "alice",
+		To:        "bob",
+		Room:      "call",
+		Payload:   map[string]interface{}{"sdp": "v=0\r\n", "session_id": "s1"},
+		Timestamp: 1700000000,
+		Hops:      maxRelayHops,
+	}
+
+	for _, codec := range []Codec{jsonCodec{}, msgpackCodec{}} {
+		data, err := codec.Marshal(msg)
+		if err != nil {
+			t.Fatalf("%s: Marshal: %v", codec.Subprotocol(), err)
+		}
+		var got SignalingMessage
+		if err := codec.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: Unmarshal: %v", codec.Subprotocol(), err)
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("%s: round trip = %+v, want %+v", codec.Subprotocol(), got, msg)
+		}
+	}
+}
+
+func TestMsgpackCodecUsesJSONNames(t *testing.T) {
+	data, err := msgpackCodec{}.Marshal(SignalingMessage{Type: MsgPing, ToDevice: "phone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"type", "to_device"} {
+		if !bytes.Contains(data, []byte(name)) {
+			t.Errorf("msgpack frame lacks field name %q", name)
+		}
+	}
+}
+
+func TestCodecFor(t *testing.T) {
+	tests := []struct {
+		subprotocol string
+		want        Codec
+		frameType   int
+	}{
+		{protocol.SubprotocolJSON, jsonCodec{}, websocket.TextMessage},
+		{protocol.SubprotocolMsgPack, msgpackCodec{}, websocket.BinaryMessage},
+		{protocol.SubprotocolAccessToken, jsonCodec{}, websocket.TextMessage},
+		{"", jsonCodec{}, websocket.TextMessage},
+	}
+	for _, tt := range tests {
+		codec := codecFor(tt.subprotocol)
+		if codec != tt.want || codec.FrameType() != tt.frameType {
+			t.Errorf("codecFor(%q) = %T with frame type %d, want %T with %d", tt.subprotocol, codec, codec.FrameType(), tt.want, tt.frameType)
+		}
+	}
+}
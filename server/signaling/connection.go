@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 	"golang.org/x/time/rate"
@@ -12,42 +18,148 @@ import (
 
 // Client represents a connected WebSocket client
 type Client struct {
-	ID           string
-	UserID       string
-	DeviceID     string
-	Conn         *websocket.Conn
-	Send         chan []byte
-	Logger       *zap.Logger
-	LastSeen     time.Time
-	Presence     string // "online", "away", "offline"
-	Subscriptions []string
+	ID               string
+	UserID           string
+	DeviceID         string
+	Conn             *websocket.Conn
+	Send             chan []byte
+	Priority         chan []byte // call setup messages, written before Send
+	Logger           *zap.Logger
+	LastSeen         time.Time
+	ConnectedAt      time.Time
+	Presence         string    // "online", "away", "offline"; guarded by presenceMu
+	StatusMsg        string    // guarded by presenceMu
+	lastActive       time.Time // last activity written to the presence record; guarded by presenceMu
+	presenceMu       sync.Mutex
+	presenceWatches  []string // users whose presence updates the client receives; guarded by the manager's watchersMu
+	Subscriptions    []string
+	Scopes           []string
+	Guest            bool // tokenless session limited to public rooms
+	Timings          Timings
+	remoteIP         string // counted against per-IP limits until disconnect
+	fingerprint      string // X-Device-Fingerprint sent at the handshake
+	closing          chan struct{}
+	closeOnce        sync.Once
+	closeReq         closeRequest
+	consecutiveDrops int32
+	codec            Codec               // wire format negotiated at upgrade
+	resumeToken      string              // restores this client's rooms after a drop
+	tokenExpiry      int64               // unix nanoseconds, 0 if the token never expires; atomic
+	lastData         int64               // unix nanoseconds of the last message read; atomic
+	highWaterSamples int                 // samples in a row with a nearly full send buffer; touched only by the sampler
+	sessions         map[string]struct{} // call sessions this client has offered
+	sessionsMu       sync.Mutex
+}
+
+// closeRequest describes a server-initiated close of a client connection
+type closeRequest struct {
+	code   int
+	reason string
+	flush  bool
+}
+
+// Drop reasons for the dropped messages counter
+const (
+	dropReasonBufferFull = "buffer_full"
+)
+
+// errSendBufferFull is returned when a client's send buffer is full
+var errSendBufferFull = errors.New("send buffer full")
+
+// errUnknownMessageType is reported to clients sending an unrecognized type
+var errUnknownMessageType = errors.New("unknown message type")
+
+// Timings holds a client's WebSocket keepalive and write timeouts
+type Timings struct {
+	WriteWait  time.Duration // time allowed to write a frame
+	PongWait   time.Duration // time allowed to read the next pong
+	PingPeriod time.Duration // interval between pings, must be less than PongWait
+}
+
+// errInvalidTimings is returned for non-positive timeouts or a ping period
+// that is not below the pong wait
+var errInvalidTimings = errors.New("timeouts must be positive and ping period less than pong wait")
+
+// Validate checks that pings are sent before the pong wait expires
+func (t Timings) Validate() error {
+	if t.WriteWait <= 0 || t.PingPeriod <= 0 || t.PingPeriod >= t.PongWait {
+		return errInvalidTimings
+	}
+	return nil
 }
 
 // NewClient creates a new client
-func NewClient(userID, deviceID string, conn *websocket.Conn, logger *zap.Logger) *Client {
+func NewClient(userID, deviceID string, conn *websocket.Conn, logger *zap.Logger, timings Timings) *Client {
 	return &Client{
-		ID:       uuid.New().String(),
-		UserID:   userID,
-		DeviceID: deviceID,
-		Conn:     conn,
-		Send:     make(chan []byte, 256),
-		Logger:   logger,
-		LastSeen: time.Now(),
-		Presence: "online",
+		ID:          uuid.New().String(),
+		UserID:      userID,
+		DeviceID:    deviceID,
+		Conn:        conn,
+		Send:        make(chan []byte, 256),
+		Priority:    make(chan []byte, prioritySendBuffer),
+		Logger:      logger,
+		LastSeen:    time.Now(),
+		ConnectedAt: time.Now(),
+		lastData:    time.Now().UnixNano(),
+		Presence:    PresenceOnline,
+		Timings:     timings,
+		closing:     make(chan struct{}),
+		codec:       jsonCodec{},
+	}
+}
+
+// deviceKey returns the key identifying a client's user and device
+func (c *Client) deviceKey() string {
+	return c.UserID + ":" + c.DeviceID
+}
+
+// Disconnect asks the write pump to flush queued messages and close the
+// connection. It is safe to call more than once.
+func (c *Client) Disconnect() {
+	c.closeWith(websocket.CloseNormalClosure, "", true)
+}
+
+// closeWith asks the write pump to close the connection with the given
+// close code, optionally flushing queued messages first
+func (c *Client) closeWith(code int, reason string, flush bool) {
+	c.closeOnce.Do(func() {
+		c.closeReq = closeRequest{code: code, reason: reason, flush: flush}
+		close(c.closing)
+	})
+}
+
+// closed reports whether the client has been asked to disconnect
+func (c *Client) closed() bool {
+	select {
+	case <-c.closing:
+		return true
+	default:
+		return false
 	}
 }
 
 // ReadPump reads messages from the WebSocket connection
 func (c *Client) ReadPump(connManager *ConnectionManager) {
+	// The write pump owns closing the connection so queued messages can be
+	// flushed first
+	reason := disconnectServer
 	defer func() {
+		recordDisconnect(c, reason)
 		connManager.RemoveClient(c)
-		c.Conn.Close()
+		c.closeWith(websocket.CloseNormalClosure, "", false)
 	}()
 
-	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timings.PongWait))
+	refreshed := time.Now()
 	c.Conn.SetPongHandler(func(string) error {
-		c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.Conn.SetReadDeadline(time.Now().Add(c.Timings.PongWait))
 		c.LastSeen = time.Now()
+
+		// Keep the Redis records of a long-lived connection from expiring
+		if c.LastSeen.Sub(refreshed) >= clientRecordRefresh {
+			refreshed = c.LastSeen
+			connManager.refreshClientInRedis(c)
+		}
 		return nil
 	})
 
@@ -57,8 +169,29 @@ func (c *Client) ReadPump(connManager *ConnectionManager) {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				c.Logger.Error("WebSocket read error", zap.Error(err))
 			}
+			reason = disconnectReason(err, c.closed())
+			break
+		}
+
+		// Stop reading once the connection is being closed
+		if c.closed() {
 			break
 		}
+		c.touchData()
+
+		message, err = c.decodeFrame(message)
+		if err != nil {
+			c.sendError(ErrCodeInvalidPayload, "malformed frame")
+			continue
+		}
+
+		// Long-poll sends are limited per request in authenticateHTTP
+		if limiter := connManager.GetRateLimiter(rateLimitKey(c.UserID, c.remoteIP, c.Guest)); !limiter.Allow() {
+			audit.Log(auditRateLimited, c.UserID, c.remoteIP, "websocket message")
+			metrics.RateLimitExceeded.Inc()
+			c.sendRateLimited(retryDelay(limiter))
+			continue
+		}
 
 		// Process message
 		if err := c.processMessage(message, connManager); err != nil {
@@ -69,36 +202,138 @@ func (c *Client) ReadPump(connManager *ConnectionManager) {
 
 // WritePump writes messages to the WebSocket connection
 func (c *Client) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.Timings.PingPeriod)
+	var expiryWarned int64
 	defer func() {
 		ticker.Stop()
 		c.Conn.Close()
 	}()
 
 	for {
+		// Call setup messages go out before anything else queued
 		select {
+		case message := <-c.Priority:
+			if err := c.writeMessage(message); err != nil {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+		case message := <-c.Priority:
+			if err := c.writeMessage(message); err != nil {
+				return
+			}
+
 		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.Conn.SetWriteDeadline(time.Now().Add(c.Timings.WriteWait))
 			if !ok {
 				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
+			if err := c.writeMessage(message); err != nil {
 				return
 			}
-			w.Write(message)
 
-			if err := w.Close(); err != nil {
-				return
+		case <-c.closing:
+			if c.closeReq.flush {
+				c.flushQueued()
 			}
+			c.Conn.SetWriteDeadline(time.Now().Add(c.Timings.WriteWait))
+			c.Conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(c.closeReq.code, c.closeReq.reason))
+			return
 
 		case <-ticker.C:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.Conn.SetWriteDeadline(time.Now().Add(c.Timings.WriteWait))
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+			c.checkTokenExpiry(&expiryWarned)
+		}
+	}
+}
+
+// writeBatchMaxBytes caps a coalesced frame; the last message added may
+// take it past the cap
+const writeBatchMaxBytes = 64 << 10
+
+// newline separates coalesced messages in a frame
+var newline = []byte{'\n'}
+
+// writeMessage writes a single frame to the connection in the client's
+// codec, coalescing queued messages into it when -write-batch-max allows.
+// Messages the codec can't encode are skipped.
+func (c *Client) writeMessage(message []byte) error {
+	frame, err := c.encodeFrame(message)
+	if err != nil {
+		metrics.MarshalErrors.Inc()
+		c.Logger.Error("Failed to encode frame", zap.Error(err))
+		return nil
+	}
+
+	c.Conn.SetWriteDeadline(time.Now().Add(c.Timings.WriteWait))
+
+	w, err := c.Conn.NextWriter(c.codec.FrameType())
+	if err != nil {
+		return err
+	}
+	w.Write(frame)
+
+	// Coalesce messages that are already queued into the same frame, one
+	// per line, call setup messages first. JSON encoding never emits a raw
+	// newline, so clients can split frames safely.
+	if _, ok := c.codec.(jsonCodec); ok && *writeBatchMax > 1 {
+		size := len(frame)
+	batch:
+		for n := 1; n < *writeBatchMax && size < writeBatchMaxBytes; n++ {
+			var next []byte
+			select {
+			case next = <-c.Priority:
+			default:
+				select {
+				case message, ok := <-c.Send:
+					if !ok {
+						break batch
+					}
+					next = message
+				default:
+					break batch
+				}
+			}
+			w.Write(newline)
+			w.Write(next)
+			size += len(next) + 1
+		}
+	}
+
+	return w.Close()
+}
+
+// flushQueued writes any messages already queued without waiting for more
+func (c *Client) flushQueued() {
+	for {
+		select {
+		case message := <-c.Priority:
+			if err := c.writeMessage(message); err != nil {
+				return
+			}
+			continue
+		default:
+		}
+
+		select {
+		case message, ok := <-c.Send:
+			if !ok {
+				return
+			}
+			if err := c.writeMessage(message); err != nil {
+				return
+			}
+		default:
+			return
 		}
 	}
 }
@@ -111,104 +346,464 @@ func (c *Client) processMessage(data []byte, connManager *ConnectionManager) err
 	}
 
 	msg.Timestamp = time.Now().Unix()
+	msg.Hops = maxRelayHops
+
+	timer := prometheus.NewTimer(metrics.MessageProcessing.WithLabelValues(messageTypeLabel(msg.Type)))
+	defer timer.ObserveDuration()
+
+	if scope := requiredScope(msg.Type); scope != "" && !c.hasScope(scope) &&
+		!(c.Guest && guestAllowed(msg.Type)) {
+		audit.Log(auditScopeDenied, c.UserID, c.remoteIP, "token lacks scope "+scope)
+		return c.sendError(ErrCodeForbidden, "token lacks scope "+scope)
+	}
+
+	if connManager.sdp != nil {
+		relay, err := connManager.sdp.Sanitize(&msg)
+		if err != nil {
+			return c.sendError(ErrCodeInvalidPayload, err.Error())
+		}
+		if !relay {
+			return nil
+		}
+	}
+
+	if msg.Type != MsgPing && msg.Type != MsgPresence {
+		connManager.recordActivity(c)
+	}
 
 	switch msg.Type {
 	case MsgOffer:
-		return connManager.RelayMessage(msg, c.UserID)
+		kind, err := c.classifyOffer(msg)
+		if err != nil {
+			return c.sendError(ErrCodeInvalidPayload, err.Error())
+		}
+		metrics.Offers.WithLabelValues(kind).Inc()
+		return c.relay(msg, connManager)
 	case MsgAnswer:
-		return connManager.RelayMessage(msg, c.UserID)
+		if _, _, err := sessionFields(msg); err != nil {
+			return c.sendError(ErrCodeInvalidPayload, err.Error())
+		}
+		return c.relay(msg, connManager)
 	case MsgCandidate:
-		return connManager.RelayMessage(msg, c.UserID)
+		return c.relay(msg, connManager)
 	case MsgPing:
 		return c.sendPong()
+	case MsgWhoami:
+		return c.sendSessionInfo(connManager)
 	case MsgSubscribe:
-		return connManager.Subscribe(c, msg.Room)
+		err := connManager.Subscribe(c, msg.Room, msg.Replay)
+		if code := roomAccessErrorCode(err); code != "" {
+			return c.sendError(code, err.Error())
+		}
+		return err
+	case MsgKnock:
+		err := connManager.Knock(c, msg.Room)
+		if code := roomAccessErrorCode(err); code != "" {
+			return c.sendError(code, err.Error())
+		}
+		return err
 	case MsgUnsubscribe:
 		return connManager.Unsubscribe(c, msg.Room)
+	case MsgTyping:
+		err := connManager.setTyping(c, msg.Room, msg.Payload)
+		if code := roomSendErrorCode(err); code != "" {
+			return c.sendError(code, err.Error())
+		}
+		return err
+	case MsgReceipt:
+		err := connManager.sendReceipt(c, msg.Room, msg.Payload)
+		if code := roomSendErrorCode(err); code != "" {
+			return c.sendError(code, err.Error())
+		}
+		return err
+	case MsgReauth:
+		if err := c.reauth(msg.Payload, connManager); err != nil {
+			code := ErrCodeForbidden
+			if err == errReauthNoToken {
+				code = ErrCodeInvalidPayload
+			}
+			return c.sendError(code, err.Error())
+		}
+		return nil
+	case MsgPresence:
+		if err := connManager.setPresence(c, msg.Payload); err == errInvalidPresence {
+			return c.sendError(ErrCodeInvalidPayload, err.Error())
+		}
+		return nil
+	case MsgPresenceSubscribe:
+		err := connManager.watchPresence(c, msg.Payload)
+		if err == errInvalidPresenceSubscribe {
+			return c.sendError(ErrCodeInvalidPayload, err.Error())
+		}
+		return err
+	default:
+		metrics.UnknownMessageTypes.WithLabelValues(unknownTypeLabel(msg.Type)).Inc()
+		return c.sendError(ErrCodeUnknownType, errUnknownMessageType.Error())
 	}
+}
 
-	return nil
+// relay relays a message from this client. Messages to users who blocked
+// the client are dropped, telling the client only with -notify-blocked.
+// A message with a room and no recipient goes to the room's other members.
+// With -dedup-window, a message repeating the ID of one the user sent
+// within the window is dropped silently.
+func (c *Client) relay(msg SignalingMessage, connManager *ConnectionManager) error {
+	if *dedupWindow > 0 && msg.ID != "" && connManager.isDuplicate(c.UserID, msg.ID) {
+		metrics.DuplicateDropped.Inc()
+		return nil
+	}
+
+	if msg.To == "" && msg.Room != "" {
+		err := connManager.relayToRoom(c, msg)
+		if code := roomSendErrorCode(err); code != "" {
+			return c.sendError(code, err.Error())
+		}
+		return err
+	}
+
+	err := connManager.RelayMessage(msg, c.UserID)
+	if err == errBlocked {
+		if *notifyBlocked {
+			return c.sendError(ErrCodeForbidden, err.Error())
+		}
+		return nil
+	}
+	return err
+}
+
+// hasScope reports whether the client's token grants a scope
+func (c *Client) hasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// sendSessionInfo answers a whoami request with the client's session
+func (c *Client) sendSessionInfo(connManager *ConnectionManager) error {
+	connManager.roomsMu.RLock()
+	subscriptions := append([]string{}, c.Subscriptions...)
+	connManager.roomsMu.RUnlock()
+
+	data, err := json.Marshal(SignalingMessage{
+		Type: MsgWhoami,
+		Payload: SessionInfo{
+			UserID:         c.UserID,
+			DeviceID:       c.DeviceID,
+			ClientID:       c.ID,
+			ServerID:       connManager.serverID,
+			Subscriptions:  subscriptions,
+			ConnectedSince: c.ConnectedAt.Unix(),
+		},
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	return c.Enqueue(data)
 }
 
 // sendPong sends a pong response
 func (c *Client) sendPong() error {
-	return c.Send <- []byte(`{"type":"pong"}`)
+	return c.Enqueue([]byte(`{"type":"pong"}`))
+}
+
+// sendError sends an error frame to the client
+func (c *Client) sendError(code, message string) error {
+	msg := SignalingMessage{
+		Type:      MsgError,
+		Payload:   ErrorPayload{Code: code, Message: message},
+		Timestamp: time.Now().Unix(),
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.Enqueue(data)
 }
 
-// Send sends a message to the client
-func (c *Client) Send(msg []byte) error {
+// sendRateLimited tells the client its message was dropped by the rate
+// limit and when it may send again
+func (c *Client) sendRateLimited(delay time.Duration) error {
+	msg := SignalingMessage{
+		Type: MsgError,
+		Payload: ErrorPayload{
+			Code:         ErrCodeRateLimited,
+			Message:      "rate limit exceeded",
+			RetryAfterMS: delay.Milliseconds(),
+		},
+		Timestamp: time.Now().Unix(),
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.Enqueue(data)
+}
+
+// prioritySendBuffer is the size of a client's high-priority queue
+const prioritySendBuffer = 64
+
+// highPriority reports whether messages of a type jump ahead of queued
+// normal traffic. Call setup stalls on a late offer, answer or candidate,
+// while presence, typing and room traffic can wait.
+func highPriority(msgType string) bool {
+	switch msgType {
+	case MsgOffer, MsgAnswer, MsgCandidate:
+		return true
+	}
+	return false
+}
+
+// EnqueueFor queues a message of the given type on the queue its priority
+// calls for
+func (c *Client) EnqueueFor(msgType string, msg []byte) error {
+	if highPriority(msgType) {
+		return c.enqueue(c.Priority, msg)
+	}
+	return c.enqueue(c.Send, msg)
+}
+
+// Enqueue queues a message for the client without blocking. A client whose
+// buffer stays full for too many consecutive messages is disconnected.
+func (c *Client) Enqueue(msg []byte) error {
+	return c.enqueue(c.Send, msg)
+}
+
+// enqueue queues a message on one of the client's queues without blocking,
+// disconnecting the client once too many messages in a row are dropped
+func (c *Client) enqueue(queue chan []byte, msg []byte) error {
 	select {
-	case c.Send <- msg:
+	case queue <- msg:
+		atomic.StoreInt32(&c.consecutiveDrops, 0)
 		return nil
 	default:
-		return errors.New("send buffer full")
+		metrics.DroppedMessages.WithLabelValues(dropReasonBufferFull).Inc()
+
+		drops := atomic.AddInt32(&c.consecutiveDrops, 1)
+		if *slowConsumerThreshold > 0 && int(drops) == *slowConsumerThreshold {
+			c.Logger.Warn("Disconnecting slow consumer",
+				zap.String("client_id", c.ID),
+				zap.String("user_id", c.UserID),
+				zap.Int32("dropped", drops))
+			audit.Log(auditForceDisconnect, c.UserID, c.remoteIP, "slow consumer")
+			c.closeWith(CloseSlowConsumer, "slow consumer", false)
+		}
+		return errSendBufferFull
 	}
 }
 
+// Duplicate-device connection policies
+const (
+	devicePolicyReplace = "replace"
+	devicePolicyReject  = "reject"
+)
+
+// errDeviceConnected is returned when a device is already connected under
+// the reject policy
+var errDeviceConnected = errors.New("device already connected")
+
+// errServerFull is returned when the server holds -max-connections clients
+var errServerFull = errors.New("server connection limit reached")
+
 // ConnectionManager manages all client connections
 type ConnectionManager struct {
-	clients      map[string]*Client
-	clientsMu    sync.RWMutex
-	rooms        map[string]map[string]*Client // room -> client_id -> client
-	roomsMu      sync.RWMutex
-	redis        *redis.Client
-	logger       *zap.Logger
-	rateLimiters map[string]*rate.Limiter
-	rateLimitersMu sync.RWMutex
-	ctx          context.Context
-	cancel       context.CancelFunc
+	clients          map[string]*Client
+	devices          map[string]*Client // user_id:device_id -> client
+	clientsMu        sync.RWMutex
+	clientCount      int64            // len(clients), readable without clientsMu
+	rooms            map[string]*Room // room -> room with local members
+	roomsMu          sync.RWMutex
+	redis            redis.UniversalClient
+	replica          redis.UniversalClient // routes lag-tolerant reads; nil reads from redis
+	namespace        string                // -redis-namespace prefix of every key and channel
+	serverID         string                // identifies this instance to the others sharing Redis
+	logger           *zap.Logger
+	rateLimiters     map[string]*rate.Limiter
+	rateLimitersMu   sync.RWMutex
+	ipLimits         *ipLimiter
+	breaker          *circuitBreaker
+	sdp              *sdpSanitizer // nil unless SDP sanitization is enabled
+	auth             Authenticator // validates tokens sent in reauth messages
+	presenceMu       sync.Mutex
+	pendingPresence  map[string]Presence
+	presenceTimers   map[string]*time.Timer
+	presenceWatchers map[string]map[string]*Client // user_id -> client_id -> client receiving the user's presence
+	watchersMu       sync.RWMutex
+	typing           map[string]*time.Timer // room + client ID -> typing expiry
+	typingMu         sync.Mutex
+	roomBudgets      map[string]*roomBudget // room -> per-sender send budgets
+	roomBudgetsMu    sync.Mutex
+	pumps            sync.WaitGroup
+	ctx              context.Context
+	cancel           context.CancelFunc
+
+	// OnJoin and OnLeave, if set, are called after a client joins or leaves
+	// a room. They must be set before clients connect.
+	OnJoin  RoomHook
+	OnLeave RoomHook
 }
 
 // NewConnectionManager creates a new connection manager
-func NewConnectionManager(redisClient *redis.Client, logger *zap.Logger) *ConnectionManager {
+func NewConnectionManager(redisClient redis.UniversalClient, logger *zap.Logger) *ConnectionManager {
 	ctx, cancel := context.WithCancel(context.Background())
-	
+
 	cm := &ConnectionManager{
-		clients:      make(map[string]*Client),
-		rooms:        make(map[string]map[string]*Client),
-		redis:        redisClient,
-		logger:       logger,
-		rateLimiters: make(map[string]*rate.Limiter),
-		ctx:          ctx,
-		cancel:       cancel,
+		clients:          make(map[string]*Client),
+		devices:          make(map[string]*Client),
+		rooms:            make(map[string]*Room),
+		redis:            redisClient,
+		namespace:        redisNamespacePrefix(*redisNS),
+		serverID:         getServerID(),
+		logger:           logger,
+		rateLimiters:     make(map[string]*rate.Limiter),
+		ipLimits:         newIPLimiter(),
+		breaker:          newCircuitBreaker(logger),
+		pendingPresence:  make(map[string]Presence),
+		presenceTimers:   make(map[string]*time.Timer),
+		presenceWatchers: make(map[string]map[string]*Client),
+		typing:           make(map[string]*time.Timer),
+		roomBudgets:      make(map[string]*roomBudget),
+		ctx:              ctx,
+		cancel:           cancel,
 	}
 
 	// Start Redis subscriber
 	go cm.redisSubscriber()
+	go cm.presenceExpirySubscriber()
+	go cm.ipLimiterPruner()
+	go cm.roomReconciler()
+	go cm.connectionStatsSampler()
+	go cm.sendBufferSampler()
+	go cm.announcementSubscriber()
+	if *idleTimeout > 0 {
+		go cm.idleReaper()
+	}
 
 	return cm
 }
 
-// AddClient adds a client to the manager
-func (cm *ConnectionManager) AddClient(client *Client) {
+// AddClient adds a client to the manager, applying the duplicate-device
+// policy if the same user and device is already connected. The client is
+// recorded in Redis after the clients lock is released, so a slow Redis
+// doesn't hold up other connections.
+func (cm *ConnectionManager) AddClient(client *Client) error {
 	cm.clientsMu.Lock()
-	defer cm.clientsMu.Unlock()
+
+	existing, replacing := cm.devices[client.deviceKey()]
+	if !replacing && cm.AtCapacity() {
+		cm.clientsMu.Unlock()
+		metrics.ConnectionsRejected.Inc()
+		return errServerFull
+	}
+
+	if replacing {
+		if *duplicateDevicePolicy == devicePolicyReject {
+			cm.clientsMu.Unlock()
+			return errDeviceConnected
+		}
+
+		// Replace the older session
+		audit.Log(auditForceDisconnect, existing.UserID, existing.remoteIP, "replaced by a new session for the device")
+		existing.Enqueue([]byte(`{"type":"` + MsgReplaced + `"}`))
+		existing.closeWith(CloseReplaced, "replaced by a new connection", true)
+		delete(cm.clients, existing.ID)
+
+		cm.logger.Info("Replaced existing device session",
+			zap.String("user_id", client.UserID),
+			zap.String("device_id", client.DeviceID))
+	}
 
 	cm.clients[client.ID] = client
-	
+	cm.devices[client.deviceKey()] = client
+	atomic.StoreInt64(&cm.clientCount, int64(len(cm.clients)))
+	cm.clientsMu.Unlock()
+
 	// Store in Redis for horizontal scaling
 	cm.storeClientInRedis(client)
+
+	// A disconnect while the record was written may have removed it first;
+	// take it out again unless another session holds the device
+	cm.clientsMu.RLock()
+	_, held := cm.devices[client.deviceKey()]
+	cm.clientsMu.RUnlock()
+	if !held {
+		cm.removeClientFromRedis(client)
+	}
+	return nil
+}
+
+// AtCapacity reports whether the server holds -max-connections clients
+func (cm *ConnectionManager) AtCapacity() bool {
+	return *maxConnections > 0 && atomic.LoadInt64(&cm.clientCount) >= int64(*maxConnections)
+}
+
+// HasDevice reports whether a user's device is already connected
+func (cm *ConnectionManager) HasDevice(userID, deviceID string) bool {
+	cm.clientsMu.RLock()
+	defer cm.clientsMu.RUnlock()
+	_, ok := cm.devices[userID+":"+deviceID]
+	return ok
 }
 
 // RemoveClient removes a client from the manager
 func (cm *ConnectionManager) RemoveClient(client *Client) {
 	cm.clientsMu.Lock()
-	defer cm.clientsMu.Unlock()
-
 	delete(cm.clients, client.ID)
-	
-	// Remove from all rooms
+	atomic.StoreInt64(&cm.clientCount, int64(len(cm.clients)))
+
+	// A replaced session no longer owns the device entry
+	ownsDevice := cm.devices[client.deviceKey()] == client
+	if ownsDevice {
+		delete(cm.devices, client.deviceKey())
+	}
+	cm.clientsMu.Unlock()
+
+	// Remove from all rooms, noting how many members each has left
+	left := make(map[string]int)
 	cm.roomsMu.Lock()
-	for room, clients := range cm.rooms {
-		delete(clients, client.ID)
-		if len(clients) == 0 {
-			delete(cm.rooms, room)
+	subscriptions := client.Subscriptions
+	for id, room := range cm.rooms {
+		if room.removeMember(client) {
+			left[id] = len(room.members)
+		}
+		if room.Empty() {
+			cm.removeRoom(id)
 		}
 	}
+	client.Subscriptions = nil
 	cm.roomsMu.Unlock()
-	
+
+	for room, occupancy := range left {
+		cm.stopTyping(client, room)
+		cm.unindexUserRoom(client, room)
+		cm.announceMembership(room, client, MsgRoomLeave, occupancy)
+		cm.fireLeave(room, client)
+	}
+	cm.saveResumeState(client, subscriptions)
+	cm.unwatchPresence(client)
+
 	// Remove from Redis
-	cm.removeClientFromRedis(client)
+	if ownsDevice {
+		cm.removeClientFromRedis(client)
+	}
+}
+
+// Counts returns the number of local clients and rooms
+func (cm *ConnectionManager) Counts() (clients, rooms int) {
+	cm.clientsMu.RLock()
+	clients = len(cm.clients)
+	cm.clientsMu.RUnlock()
+
+	cm.roomsMu.RLock()
+	rooms = len(cm.rooms)
+	cm.roomsMu.RUnlock()
+
+	return clients, rooms
 }
 
 // GetClient gets a client by ID
@@ -233,51 +828,177 @@ func (cm *ConnectionManager) GetClientByUserID(userID string) []*Client {
 	return clients
 }
 
-// RelayMessage relays a message to the target user
+// recipients returns the local clients a relayed message is for: the
+// ToDevice device of its target user if set, otherwise all of their devices
+func (cm *ConnectionManager) recipients(msg SignalingMessage) []*Client {
+	if msg.ToDevice == "" {
+		return cm.GetClientByUserID(msg.To)
+	}
+
+	cm.clientsMu.RLock()
+	defer cm.clientsMu.RUnlock()
+	if client, ok := cm.devices[msg.To+":"+msg.ToDevice]; ok {
+		return []*Client{client}
+	}
+	return nil
+}
+
+// RelayMessage relays a message to the target user, or only to one of their
+// devices when ToDevice is set
 func (cm *ConnectionManager) RelayMessage(msg SignalingMessage, fromUserID string) error {
+	// Honor the recipient's block list; acks only confirm delivery
+	if msg.Type != MsgAck && cm.isBlocked(msg.To, fromUserID) {
+		metrics.BlockedMessages.Inc()
+		return errBlocked
+	}
+
 	// Find target clients
-	targetClients := cm.GetClientByUserID(msg.To)
-	if len(targetClients) == 0 {
+	if len(cm.recipients(msg)) == 0 {
 		// Try to find in Redis (other server instances)
 		return cm.relayViaRedis(msg, fromUserID)
 	}
 
 	msg.From = fromUserID
-	data, _ := json.Marshal(msg)
+	cm.deliverLocal(msg)
+
+	return nil
+}
+
+// deliverLocal delivers a relayed message to the target user's clients on
+// this server, acknowledging it to the sender if it carries an ID. It
+// reports whether any client accepted the message.
+func (cm *ConnectionManager) deliverLocal(msg SignalingMessage) bool {
+	data, err := cm.marshalMessage(msg)
+	if err != nil {
+		return false
+	}
 
-	for _, client := range targetClients {
-		if err := client.Send(data); err != nil {
-			cm.logger.Warn("Failed to send message", zap.Error(err))
+	delivered := false
+	for _, client := range cm.recipients(msg) {
+		if err := client.EnqueueFor(msg.Type, data); err != nil {
+			cm.logger.Debug("Failed to send message", zap.String("client_id", client.ID), zap.Error(err))
+			continue
 		}
+		delivered = true
 	}
 
-	return nil
+	if delivered && msg.ID != "" && msg.Type != MsgAck {
+		cm.sendAck(msg)
+	}
+	return delivered
+}
+
+// sendAck acknowledges delivery of a message to its sender, which may be
+// connected to another server
+func (cm *ConnectionManager) sendAck(msg SignalingMessage) {
+	ack := SignalingMessage{
+		ID:        msg.ID,
+		Type:      MsgAck,
+		To:        msg.From,
+		Timestamp: time.Now().Unix(),
+		Hops:      maxRelayHops,
+	}
+
+	if err := cm.RelayMessage(ack, msg.To); err != nil {
+		cm.logger.Debug("Failed to send ack", zap.String("id", msg.ID), zap.Error(err))
+	}
 }
 
-// Subscribe adds a client to a room
-func (cm *ConnectionManager) Subscribe(client *Client, room string) error {
+// Subscribe adds a client to a room. With replay, the room's recent history
+// is delivered to the client before any live messages.
+func (cm *ConnectionManager) Subscribe(client *Client, room string, replay bool) error {
+	if err := cm.authorizeJoin(client, room); err != nil {
+		return err
+	}
+
+	// Load metadata for rooms this server hasn't seen yet
+	cm.roomsMu.RLock()
+	_, exists := cm.rooms[room]
+	cm.roomsMu.RUnlock()
+
+	info := RoomInfo{ID: room}
+	if !exists {
+		if stored, err := cm.GetRoom(room); err == nil {
+			info = *stored
+		}
+	}
+
+	var history [][]byte
+	if replay {
+		var err error
+		if history, err = cm.roomHistory(room, *roomReplayCount); err != nil {
+			cm.logger.Warn("Failed to load room history", zap.String("room", room), zap.Error(err))
+		}
+	}
+
 	cm.roomsMu.Lock()
-	defer cm.roomsMu.Unlock()
+	r, ok := cm.rooms[room]
+	if !ok {
+		r = newRoom(info)
+		cm.rooms[room] = r
+		metrics.Rooms.Set(float64(len(cm.rooms)))
+	}
+	if _, member := r.members[client.ID]; member {
+		// Already subscribed
+		cm.roomsMu.Unlock()
+		return nil
+	}
+	if *maxRoomsPerClient > 0 && len(client.Subscriptions) >= *maxRoomsPerClient {
+		if r.Empty() {
+			cm.removeRoom(room)
+		}
+		cm.roomsMu.Unlock()
+		return errTooManyRooms
+	}
 
-	if _, ok := cm.rooms[room]; !ok {
-		cm.rooms[room] = make(map[string]*Client)
+	// Queue the backlog before the client becomes visible to broadcasts
+	for _, data := range history {
+		client.Enqueue(data)
 	}
-	cm.rooms[room][client.ID] = client
+	r.addMember(client)
 	client.Subscriptions = append(client.Subscriptions, room)
+	occupancy := len(r.members)
 
-	// Subscribe in Redis
-	return cm.redisSubscribe(room)
+	// Subscribe in Redis once per room, for as long as it has local members
+	if r.pubsub == nil {
+		r.pubsub, r.pubsubDone = cm.redisSubscribe(room)
+		metrics.RedisSubscriptions.Inc()
+	}
+	cm.roomsMu.Unlock()
+
+	cm.indexUserRoom(client, room)
+	cm.announceMembership(room, client, MsgRoomJoin, occupancy)
+	cm.fireJoin(room, client)
+	return nil
+}
+
+// removeRoom drops an empty room and its Redis subscription. The caller must
+// hold roomsMu.
+func (cm *ConnectionManager) removeRoom(room string) {
+	r, ok := cm.rooms[room]
+	if !ok {
+		return
+	}
+	if r.pubsub != nil {
+		r.pubsub.Close()
+		r.pubsub = nil
+		metrics.RedisSubscriptions.Dec()
+	}
+	delete(cm.rooms, room)
+	metrics.Rooms.Set(float64(len(cm.rooms)))
+	cm.dropRoomBudget(room)
 }
 
 // Unsubscribe removes a client from a room
 func (cm *ConnectionManager) Unsubscribe(client *Client, room string) error {
 	cm.roomsMu.Lock()
-	defer cm.roomsMu.Unlock()
-
-	if clients, ok := cm.rooms[room]; ok {
-		delete(clients, client.ID)
-		if len(clients) == 0 {
-			delete(cm.rooms, room)
+	left := false
+	occupancy := 0
+	if r, ok := cm.rooms[room]; ok {
+		left = r.removeMember(client)
+		occupancy = len(r.members)
+		if r.Empty() {
+			cm.removeRoom(room)
 		}
 	}
 
@@ -288,65 +1009,218 @@ func (cm *ConnectionManager) Unsubscribe(client *Client, room string) error {
 			break
 		}
 	}
+	cm.roomsMu.Unlock()
 
+	if left {
+		cm.stopTyping(client, room)
+		cm.unindexUserRoom(client, room)
+		cm.announceMembership(room, client, MsgRoomLeave, occupancy)
+		cm.fireLeave(room, client)
+	}
 	return nil
 }
 
-// BroadcastToRoom sends a message to all clients in a room
+// BroadcastToRoom sends a message to all clients in a room on every server,
+// recording it in the room's history
 func (cm *ConnectionManager) BroadcastToRoom(room string, msg SignalingMessage) error {
-	cm.roomsMu.RLock()
-	defer cm.roomsMu.RUnlock()
+	return cm.broadcastToRoomExcept(room, msg, nil)
+}
+
+// broadcastToRoomExcept sends a message to the clients in a room on every
+// server other than except, recording it in the room's history
+func (cm *ConnectionManager) broadcastToRoomExcept(room string, msg SignalingMessage, except *Client) error {
+	cm.recordRoomHistory(room, msg)
+	if err := cm.deliverToRoomExcept(room, msg, except); err != nil {
+		return err
+	}
+	return cm.publishToRoom(room, msg)
+}
+
+// relayToRoom broadcasts a message from c to the other members of its room,
+// charging it to the sender's room budget. The sender must be subscribed to
+// the room.
+func (cm *ConnectionManager) relayToRoom(c *Client, msg SignalingMessage) error {
+	if !cm.isMember(c, msg.Room) {
+		return errNotSubscribed
+	}
+	msg.From = c.UserID
 
-	clients, ok := cm.rooms[room]
+	data, err := cm.marshalMessage(msg)
+	if err != nil {
+		return err
+	}
+	if err := cm.allowRoomSend(c, msg.Room, len(data)); err != nil {
+		return err
+	}
+	return cm.broadcastToRoomExcept(msg.Room, msg, c)
+}
+
+// deliverToRoom sends a message to the room's clients on this server
+func (cm *ConnectionManager) deliverToRoom(room string, msg SignalingMessage) error {
+	return cm.deliverToRoomExcept(room, msg, nil)
+}
+
+// deliverToRoomExcept sends a message to the room's clients on this server
+// other than except
+func (cm *ConnectionManager) deliverToRoomExcept(room string, msg SignalingMessage, except *Client) error {
+	data, err := cm.marshalMessage(msg)
+	if err != nil {
+		return err
+	}
+	cm.deliverDataExcept(room, data, except)
+	return nil
+}
+
+// deliverDataExcept sends an encoded message to the room's clients on this
+// server other than except
+func (cm *ConnectionManager) deliverDataExcept(room string, data []byte, except *Client) {
+	// Snapshot the members so sends don't hold up joins and leaves
+	cm.roomsMu.RLock()
+	r, ok := cm.rooms[room]
 	if !ok {
-		return nil
+		cm.roomsMu.RUnlock()
+		return
+	}
+	members := make([]*Client, 0, len(r.members))
+	for _, client := range r.members {
+		if client != except {
+			members = append(members, client)
+		}
 	}
+	cm.roomsMu.RUnlock()
 
-	data, _ := json.Marshal(msg)
-	for _, client := range clients {
-		if err := client.Send(data); err != nil {
-			cm.logger.Warn("Failed to broadcast", zap.Error(err))
+	fanOut(members, *broadcastWorkers, func(client *Client) {
+		if err := client.Enqueue(data); err != nil {
+			cm.logger.Debug("Failed to broadcast", zap.String("client_id", client.ID), zap.Error(err))
+		}
+	})
+}
+
+// fanOutMin is the smallest room whose broadcast is spread across workers;
+// smaller rooms are sent to inline
+const fanOutMin = 256
+
+// fanOut calls send for each client, using up to workers goroutines for
+// large lists
+func fanOut(clients []*Client, workers int, send func(*Client)) {
+	if len(clients) < fanOutMin || workers <= 1 {
+		for _, client := range clients {
+			send(client)
 		}
+		return
 	}
 
-	return nil
+	var wg sync.WaitGroup
+	next := make(chan *Client)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for client := range next {
+				send(client)
+			}
+		}()
+	}
+	for _, client := range clients {
+		next <- client
+	}
+	close(next)
+	wg.Wait()
+}
+
+// marshalMessage encodes a message for delivery. Failures are counted and
+// logged so callers skip the send instead of delivering a corrupt frame.
+func (cm *ConnectionManager) marshalMessage(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		metrics.MarshalErrors.Inc()
+		cm.logger.Error("Failed to marshal message", zap.Error(err))
+	}
+	return data, err
 }
 
-// GetRateLimiter gets or creates a rate limiter for a user
-func (cm *ConnectionManager) GetRateLimiter(userID string) *rate.Limiter {
+// GetRateLimiter gets or creates the rate limiter kept under a
+// rateLimitKey. With the Redis backend the limit is shared across
+// instances, and the local limiter is used only while Redis is unavailable.
+func (cm *ConnectionManager) GetRateLimiter(key string) RateLimiter {
 	cm.rateLimitersMu.RLock()
-	limiter, ok := cm.rateLimiters[userID]
+	limiter, ok := cm.rateLimiters[key]
 	cm.rateLimitersMu.RUnlock()
 
-	if ok {
-		return limiter
+	if !ok {
+		limiter = newLocalRateLimiter()
+
+		cm.rateLimitersMu.Lock()
+		cm.rateLimiters[key] = limiter
+		cm.rateLimitersMu.Unlock()
 	}
 
-	// Create new limiter (100 requests per second)
-	limiter = rate.NewLimiter(rate.Every(time.Second/100), 100)
+	if *rateLimitBackend == rateLimitBackendRedis {
+		return &redisRateLimiter{cm: cm, userID: key, fallback: limiter}
+	}
+	return limiter
+}
 
-	cm.rateLimitersMu.Lock()
-	cm.rateLimiters[userID] = limiter
-	cm.rateLimitersMu.Unlock()
+// StartPumps runs a client's read and write pumps, tracked so shutdown can
+// wait for them
+func (cm *ConnectionManager) StartPumps(client *Client) {
+	if client.Guest {
+		metrics.GuestSessions.Inc()
+	}
 
-	return limiter
+	cm.pumps.Add(2)
+	go func() {
+		defer cm.pumps.Done()
+		client.ReadPump(cm)
+		if client.Guest {
+			metrics.GuestSessions.Dec()
+		}
+		if client.remoteIP != "" {
+			cm.ipLimits.Release(client.remoteIP)
+		}
+	}()
+	go func() {
+		defer cm.pumps.Done()
+		client.WritePump()
+	}()
 }
 
-// Close shuts down the connection manager
+// Close shuts down the connection manager. Clients stop reading and their
+// write pumps get a grace period to flush queued messages before the
+// remaining connections are closed. Presence changes still in the debounce
+// window are published before the manager stops.
 func (cm *ConnectionManager) Close() {
-	cm.cancel()
-	
-	cm.clientsMu.Lock()
+	cm.clientsMu.RLock()
+	clients := make([]*Client, 0, len(cm.clients))
 	for _, client := range cm.clients {
-		client.Conn.Close()
+		clients = append(clients, client)
 	}
-	cm.clientsMu.Unlock()
+	cm.clientsMu.RUnlock()
+
+	for _, client := range clients {
+		client.closeWith(CloseServerShutdown, "server shutting down", true)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cm.pumps.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(*shutdownGrace):
+		cm.logger.Warn("Shutdown grace period expired, closing remaining connections")
+		for _, client := range clients {
+			if client.Conn != nil {
+				client.Conn.Close()
+			}
+		}
+	}
+
+	cm.flushAllPresence()
+	cm.cancel()
 }
 
-// WebSocket timing constants
-const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512 * 1024
-)
+// Maximum message size allowed from a client
+const maxMessageSize = 512 * 1024
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// serveTestManager serves a manager's routes, authenticating tokens signed
+// with testSecret
+func serveTestManager(t *testing.T, cm *ConnectionManager) *httptest.Server {
+	t.Helper()
+	auth := &JWTAuthenticator{Secret: testSecret}
+	cm.auth = auth
+	srv := httptest.NewServer(newRouter(cm, auth))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testToken signs a token for a user's device with testSecret
+func testToken(t *testing.T, userID, deviceID string, scopes ...string) string {
+	t.Helper()
+	token, err := GenerateJWT(userID, deviceID, testSecret, WithScopes(scopes...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// dialWith opens a WebSocket to a test server with the given handshake
+// headers
+func dialWith(t *testing.T, srv *httptest.Server, header http.Header) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", header)
+	if conn != nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+// waitFor polls cond until it holds or two seconds have passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// testConn is a WebSocket client of a test server
+type testConn struct {
+	t       *testing.T
+	conn    *websocket.Conn
+	pending []SignalingMessage
+}
+
+// dialTest connects a user's device to a test server
+func dialTest(t *testing.T, srv *httptest.Server, userID, deviceID string) *testConn {
+	t.Helper()
+	conn, _, err := dialWith(t, srv, http.Header{"Authorization": {"Bearer " + testToken(t, userID, deviceID)}})
+	if err != nil {
+		t.Fatalf("dial as %s/%s: %v", userID, deviceID, err)
+	}
+	return &testConn{t: t, conn: conn}
+}
+
+// send writes a message to the server
+func (c *testConn) send(msg SignalingMessage) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.t.Fatalf("send %s: %v", msg.Type, err)
+	}
+}
+
+// read reads the next frame, splitting coalesced messages
+func (c *testConn) read(wait time.Duration) error {
+	c.conn.SetReadDeadline(time.Now().Add(wait))
+	_, frame, err := c.conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	for _, line := range bytes.Split(frame, []byte("\n")) {
+		var msg SignalingMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			c.t.Fatalf("undecodable message %q: %v", line, err)
+		}
+		c.pending = append(c.pending, msg)
+	}
+	return nil
+}
+
+// next returns the next message of type msgType, discarding messages of
+// other types before it
+func (c *testConn) next(msgType string) SignalingMessage {
+	c.t.Helper()
+	for {
+		for i, msg := range c.pending {
+			if msg.Type == msgType {
+				c.pending = c.pending[i+1:]
+				return msg
+			}
+		}
+		c.pending = nil
+		if err := c.read(time.Second); err != nil {
+			c.t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+	}
+}
+
+// none fails the test if a message of type msgType arrives within wait
+func (c *testConn) none(msgType string, wait time.Duration) {
+	c.t.Helper()
+	deadline := time.Now().Add(wait)
+	for {
+		for _, msg := range c.pending {
+			if msg.Type == msgType {
+				c.t.Fatalf("unexpected %s message: %+v", msgType, msg)
+			}
+		}
+		c.pending = nil
+		if time.Until(deadline) <= 0 || c.read(time.Until(deadline)) != nil {
+			return
+		}
+	}
+}
+
+// closeError reads until the server closes the connection and returns
+// the close frame it sent
+func (c *testConn) closeError() *websocket.CloseError {
+	c.t.Helper()
+	for {
+		err := c.read(time.Second)
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) {
+			c.t.Fatalf("connection ended without a close frame: %v", err)
+		}
+		return closeErr
+	}
+}
+
+func TestTimingsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		timings Timings
+		want    error
+	}{
+		{"defaults", Timings{WriteWait: 10 * time.Second, PongWait: 60 * time.Second, PingPeriod: 54 * time.Second}, nil},
+		{"zero write wait", Timings{PongWait: 60 * time.Second, PingPeriod: 54 * time.Second}, errInvalidTimings},
+		{"zero ping period", Timings{WriteWait: 10 * time.Second, PongWait: 60 * time.Second}, errInvalidTimings},
+		{"ping equals pong wait", Timings{WriteWait: 10 * time.Second, PongWait: time.Minute, PingPeriod: time.Minute}, errInvalidTimings},
+		{"ping after pong wait", Timings{WriteWait: 10 * time.Second, PongWait: 30 * time.Second, PingPeriod: time.Minute}, errInvalidTimings},
+	}
+	for _, tt := range tests {
+		if err := tt.timings.Validate(); err != tt.want {
+			t.Errorf("%s: Validate() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestEnqueueForPriority(t *testing.T) {
+	client := NewClient("alice", "phone", nil, zap.NewNop(), wsTimings())
+
+	tests := []struct {
+		msgType  string
+		priority bool
+	}{
+		{MsgOffer, true},
+		{MsgAnswer, true},
+		{MsgCandidate, true},
+		{MsgPresence, false},
+		{MsgTyping, false},
+		{MsgAck, false},
+	}
+	for _, tt := range tests {
+		if err := client.EnqueueFor(tt.msgType, []byte(tt.msgType)); err != nil {
+			t.Fatalf("EnqueueFor(%q): %v", tt.msgType, err)
+		}
+		queue, other := client.Send, client.Priority
+		if tt.priority {
+			queue, other = other, queue
+		}
+		if len(queue) != 1 || len(other) != 0 {
+			t.Errorf("EnqueueFor(%q) queued on the wrong queue", tt.msgType)
+		}
+		<-queue
+	}
+}
+
+func TestFanOutSendsToEveryClient(t *testing.T) {
+	for _, n := range []int{0, 3, fanOutMin, fanOutMin*2 + 1} {
+		clients := make([]*Client, n)
+		for i := range clients {
+			clients[i] = &Client{}
+		}
+
+		var mu sync.Mutex
+		seen := make(map[*Client]int)
+		fanOut(clients, 4, func(c *Client) {
+			mu.Lock()
+			seen[c]++
+			mu.Unlock()
+		})
+
+		if len(seen) != n {
+			t.Errorf("%d clients: sent to %d", n, len(seen))
+		}
+		for _, count := range seen {
+			if count != 1 {
+				t.Errorf("%d clients: a client was sent to %d times", n, count)
+				break
+			}
+		}
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	phone := NewClient("alice", "phone", nil, zap.NewNop(), wsTimings())
+	laptop := NewClient("alice", "laptop", nil, zap.NewNop(), wsTimings())
+	bob := NewClient("bob", "phone", nil, zap.NewNop(), wsTimings())
+	cm := &ConnectionManager{
+		clients: map[string]*Client{phone.ID: phone, laptop.ID: laptop, bob.ID: bob},
+		devices: map[string]*Client{"alice:phone": phone, "alice:laptop": laptop, "bob:phone": bob},
+	}
+
+	tests := []struct {
+		name string
+		msg  SignalingMessage
+		want []*Client
+	}{
+		{"all devices", SignalingMessage{To: "alice"}, []*Client{phone, laptop}},
+		{"one device", SignalingMessage{To: "alice", ToDevice: "laptop"}, []*Client{laptop}},
+		{"unknown device", SignalingMessage{To: "alice", ToDevice: "tablet"}, nil},
+		{"other user's device", SignalingMessage{To: "bob", ToDevice: "laptop"}, nil},
+		{"unknown user", SignalingMessage{To: "carol"}, nil},
+	}
+	for _, tt := range tests {
+		got := cm.recipients(tt.msg)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %d recipients, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for _, want := range tt.want {
+			found := false
+			for _, c := range got {
+				found = found || c == want
+			}
+			if !found {
+				t.Errorf("%s: missing device %s", tt.name, want.DeviceID)
+			}
+		}
+	}
+}
+
+func TestDuplicateDevicePolicy(t *testing.T) {
+	policy := *duplicateDevicePolicy
+	t.Cleanup(func() { *duplicateDevicePolicy = policy })
+
+	*duplicateDevicePolicy = devicePolicyReplace
+	srv := serveTestManager(t, newTestManager(t))
+	first := dialTest(t, srv, "alice", "phone")
+	second := dialTest(t, srv, "alice", "phone")
+	first.next(MsgReplaced)
+	// The close code and reason are part of the wire protocol
+	if err := first.closeError(); err.Code != 4001 || err.Text != "replaced by a new connection" {
+		t.Errorf("replace: old connection closed with %d %q, want 4001 \"replaced by a new connection\"", err.Code, err.Text)
+	}
+	second.send(SignalingMessage{Type: MsgPing})
+	second.next(MsgPong)
+
+	*duplicateDevicePolicy = devicePolicyReject
+	srv = serveTestManager(t, newTestManager(t))
+	first = dialTest(t, srv, "alice", "phone")
+	_, resp, err := dialWith(t, srv, http.Header{"Authorization": {"Bearer " + testToken(t, "alice", "phone")}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("reject: second connection got %v, want 409", err)
+	}
+	first.send(SignalingMessage{Type: MsgPing})
+	first.next(MsgPong)
+}
+
+func TestSlowConsumerDisconnected(t *testing.T) {
+	threshold, wait := *slowConsumerThreshold, *writeWait
+	*slowConsumerThreshold, *writeWait = 8, 200*time.Millisecond
+	t.Cleanup(func() { *slowConsumerThreshold, *writeWait = threshold, wait })
+
+	cm := newTestManager(t)
+	srv := serveTestManager(t, cm)
+	dialTest(t, srv, "alice", "phone") // never reads
+	waitFor(t, "alice to connect", func() bool { return cm.HasDevice("alice", "phone") })
+	client := cm.GetClientByUserID("alice")[0]
+
+	big, _ := json.Marshal(SignalingMessage{Type: MsgAnnouncement, Payload: strings.Repeat("x", 64<<10)})
+	for i := 0; i < 10000 && !client.closed(); i++ {
+		client.Enqueue(big)
+	}
+	if !client.closed() {
+		t.Fatal("client that never reads was not disconnected")
+	}
+	if client.closeReq.code != CloseSlowConsumer {
+		t.Errorf("closed with %d, want %d", client.closeReq.code, CloseSlowConsumer)
+	}
+	waitFor(t, "alice to be removed", func() bool { return !cm.HasDevice("alice", "phone") })
+}
+
+func TestShutdownFlushesQueuedMessages(t *testing.T) {
+	cm := newTestManager(t)
+	srv := serveTestManager(t, cm)
+	alice := dialTest(t, srv, "alice", "phone")
+	waitFor(t, "alice to connect", func() bool { return cm.HasDevice("alice", "phone") })
+	client := cm.GetClientByUserID("alice")[0]
+
+	const queued = 50
+	for i := 0; i < queued; i++ {
+		data, _ := json.Marshal(SignalingMessage{Type: MsgAnnouncement, Payload: float64(i)})
+		if err := client.Enqueue(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cm.Close()
+
+	for i := 0; i < queued; i++ {
+		if got := alice.next(MsgAnnouncement).Payload; got != float64(i) {
+			t.Fatalf("message %d has payload %v", i, got)
+		}
+	}
+	if err := alice.closeError(); err.Code != CloseServerShutdown {
+		t.Errorf("closed with %d, want %d", err.Code, CloseServerShutdown)
+	}
+}
+
+func TestOfferAcknowledged(t *testing.T) {
+	cm := newTestManager(t)
+	srv := serveTestManager(t, cm)
+	alice := dialTest(t, srv, "alice", "phone")
+	bob := dialTest(t, srv, "bob", "laptop")
+	waitFor(t, "both to connect", func() bool { return cm.HasDevice("alice", "phone") && cm.HasDevice("bob", "laptop") })
+
+	alice.send(SignalingMessage{ID: "offer-1", Type: MsgOffer, To: "bob", Payload: map[string]interface{}{"sdp": "v=0"}})
+	if offer := bob.next(MsgOffer); offer.ID != "offer-1" || offer.From != "alice" {
+		t.Errorf("bob received %+v", offer)
+	}
+	if ack := alice.next(MsgAck); ack.ID != "offer-1" {
+		t.Errorf("ack for %q, want offer-1", ack.ID)
+	}
+	bob.none(MsgAck, 100*time.Millisecond)
+}
+
+func TestUnmarshalablePayloadDropped(t *testing.T) {
+	cm := newTestManager(t)
+	alice := NewClient("alice", "phone", nil, zap.NewNop(), wsTimings())
+	if err := cm.AddClient(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.Subscribe(alice, "standup", false); err != nil {
+		t.Fatal(err)
+	}
+	before := testutil.ToFloat64(metrics.MarshalErrors)
+
+	bad := SignalingMessage{Type: MsgAnnouncement, To: "alice", Room: "standup", Payload: math.NaN()}
+	if cm.deliverLocal(bad) {
+		t.Error("deliverLocal reported an unmarshalable message delivered")
+	}
+	if err := cm.BroadcastToRoom("standup", bad); err == nil {
+		t.Error("BroadcastToRoom accepted an unmarshalable message")
+	}
+
+	if n := len(alice.Send) + len(alice.Priority); n != 0 {
+		t.Errorf("%d frames queued for alice, want none", n)
+	}
+	if got := testutil.ToFloat64(metrics.MarshalErrors) - before; got != 2 {
+		t.Errorf("marshal errors counted %v times, want 2", got)
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	cm := newTestManager(t)
+	srv := serveTestManager(t, cm)
+	alice := dialTest(t, srv, "alice", "phone")
+	for _, room := range []string{"one", "two"} {
+		alice.send(SignalingMessage{Type: MsgSubscribe, Room: room})
+	}
+	alice.send(SignalingMessage{Type: MsgWhoami})
+
+	data, _ := json.Marshal(alice.next(MsgWhoami).Payload)
+	var info SessionInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		t.Fatal(err)
+	}
+	client := cm.GetClientByUserID("alice")[0]
+	if info.UserID != "alice" || info.DeviceID != "phone" || info.ClientID != client.ID || info.ServerID != cm.serverID {
+		t.Errorf("session info %+v, want alice's phone as client %s on %s", info, client.ID, cm.serverID)
+	}
+	if len(info.Subscriptions) != 2 || info.Subscriptions[0] != "one" || info.Subscriptions[1] != "two" {
+		t.Errorf("subscriptions %v, want [one two]", info.Subscriptions)
+	}
+	if since := time.Since(time.Unix(info.ConnectedSince, 0)); since < 0 || since > time.Minute {
+		t.Errorf("connected since %d, want about now", info.ConnectedSince)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	limit := *maxConnections
+	*maxConnections = 2
+	t.Cleanup(func() { *maxConnections = limit })
+
+	cm := newTestManager(t)
+	srv := serveTestManager(t, cm)
+	dialTest(t, srv, "alice", "phone")
+	bob := dialTest(t, srv, "bob", "laptop")
+	waitFor(t, "both to connect", func() bool { clients, _ := cm.Counts(); return clients == 2 })
+
+	rejected := testutil.ToFloat64(metrics.ConnectionsRejected)
+	dial := func(userID, deviceID string) int {
+		_, resp, _ := dialWith(t, srv, http.Header{"Authorization": {"Bearer " + testToken(t, userID, deviceID)}})
+		if resp == nil {
+			t.Fatalf("no handshake response for %s/%s", userID, deviceID)
+		}
+		return resp.StatusCode
+	}
+	if status := dial("carol", "phone"); status != http.StatusServiceUnavailable {
+		t.Errorf("third connection: status %d, want 503", status)
+	}
+	if got := testutil.ToFloat64(metrics.ConnectionsRejected) - rejected; got != 1 {
+		t.Errorf("rejections counted %v times, want once", got)
+	}
+
+	// Replacing a connected device doesn't add to the count
+	if status := dial("alice", "phone"); status != http.StatusSwitchingProtocols {
+		t.Errorf("reconnecting device: status %d, want 101", status)
+	}
+
+	// A slot frees up when a client leaves
+	bob.conn.Close()
+	waitFor(t, "bob to disconnect", func() bool { return !cm.HasDevice("bob", "laptop") })
+	if status := dial("carol", "phone"); status != http.StatusSwitchingProtocols {
+		t.Errorf("connection after one left: status %d, want 101", status)
+	}
+}
+
+// serveWrites answers each WebSocket handshake by passing write a server
+// side client on the connection, which stays open until the test ends
+func serveWrites(tb testing.TB, write func(c *Client)) *httptest.Server {
+	tb.Helper()
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		write(NewClient("bob", "laptop", conn, zap.NewNop(), wsTimings()))
+		<-done
+	}))
+	tb.Cleanup(srv.Close)
+	tb.Cleanup(func() { close(done) })
+	return srv
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	batchMax := *writeBatchMax
+	*writeBatchMax = 8
+	t.Cleanup(func() { *writeBatchMax = batchMax })
+
+	// Each connection gets one coalesced frame once the test is listening
+	start := make(chan struct{}, 1)
+	srv := serveWrites(t, func(c *Client) {
+		c.EnqueueFor(MsgPresence, []byte(`{"type":"presence","from":"carol"}`))
+		c.EnqueueFor(MsgTyping, []byte(`{"type":"typing","from":"carol","room":"standup"}`))
+		c.EnqueueFor(MsgCandidate, []byte(`{"type":"candidate","from":"alice"}`))
+		<-start
+		c.writeMessage([]byte(`{"type":"answer","from":"alice"}`))
+	})
+	want := []string{MsgAnswer, MsgCandidate, MsgPresence, MsgTyping}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start <- struct{}{}
+	c := &testConn{t: t, conn: conn}
+	if err := c.read(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.pending) != len(want) {
+		t.Fatalf("frame held %d messages, want %d: %+v", len(c.pending), len(want), c.pending)
+	}
+	for i, msg := range c.pending {
+		if msg.Type != want[i] {
+			t.Errorf("message %d in the frame is %s, want %s", i, msg.Type, want[i])
+		}
+	}
+
+	// The client package splits the frame back into messages
+	_, received := dialClient(t, srv.URL, "alice", "phone")
+	start <- struct{}{}
+	for i, msgType := range want {
+		select {
+		case msg := <-received:
+			if msg.Type != msgType {
+				t.Errorf("client message %d is %s, want %s", i, msg.Type, msgType)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("client received %d messages, want %d", i, len(want))
+		}
+	}
+}
+
+func BenchmarkWriteMessage(b *testing.B) {
+	msg := []byte(`{"type":"candidate","from":"alice","payload":{"candidate":"candidate:1 1 udp 2122260223 192.0.2.1 54321 typ host"}}`)
+	const burst = 16
+
+	for _, batchMax := range []int{1, burst} {
+		b.Run(fmt.Sprintf("batch=%d", batchMax), func(b *testing.B) {
+			saved := *writeBatchMax
+			*writeBatchMax = batchMax
+			b.Cleanup(func() { *writeBatchMax = saved })
+
+			clients := make(chan *Client, 1)
+			srv := serveWrites(b, func(c *Client) { clients <- c })
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			go func() {
+				for {
+					if _, _, err := conn.NextReader(); err != nil {
+						return
+					}
+				}
+			}()
+			c := <-clients
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 1; j < burst; j++ {
+					c.Send <- msg
+				}
+				if err := c.writeMessage(msg); err != nil {
+					b.Fatal(err)
+				}
+				for len(c.Send) > 0 {
+					if err := c.writeMessage(<-c.Send); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
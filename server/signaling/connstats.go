@@ -0,0 +1,44 @@
+package main
+
+import "time"
+
+// connectionStatsInterval is how often the per-user connection distribution
+// is sampled
+const connectionStatsInterval = 30 * time.Second
+
+// connectionStatsSampler periodically records how connections are spread
+// across users
+func (cm *ConnectionManager) connectionStatsSampler() {
+	ticker := time.NewTicker(connectionStatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cm.sampleConnectionStats()
+		case <-cm.ctx.Done():
+			return
+		}
+	}
+}
+
+// sampleConnectionStats sets the unique users gauge and observes each
+// user's connection count. The clients lock is held only to copy user IDs.
+func (cm *ConnectionManager) sampleConnectionStats() {
+	cm.clientsMu.RLock()
+	userIDs := make([]string, 0, len(cm.clients))
+	for _, client := range cm.clients {
+		userIDs = append(userIDs, client.UserID)
+	}
+	cm.clientsMu.RUnlock()
+
+	perUser := make(map[string]int, len(userIDs))
+	for _, userID := range userIDs {
+		perUser[userID]++
+	}
+
+	metrics.UniqueUsers.Set(float64(len(perUser)))
+	for _, n := range perUser {
+		metrics.ConnectionsPerUser.Observe(float64(n))
+	}
+}
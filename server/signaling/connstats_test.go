@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+// connectionsPerUser returns the connections per user histogram's sample
+// count, sum and cumulative bucket counts by upper bound
+func connectionsPerUser(t *testing.T) (uint64, float64, map[float64]uint64) {
+	t.Helper()
+	var m dto.Metric
+	if err := metrics.ConnectionsPerUser.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	buckets := make(map[float64]uint64)
+	for _, b := range m.GetHistogram().GetBucket() {
+		buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum(), buckets
+}
+
+func TestSampleConnectionStats(t *testing.T) {
+	cm := newTestManager(t)
+	for _, device := range [][2]string{{"alice", "phone"}, {"alice", "laptop"}, {"bob", "phone"}} {
+		if err := cm.AddClient(NewClient(device[0], device[1], nil, zap.NewNop(), wsTimings())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count, sum, buckets := connectionsPerUser(t)
+
+	cm.sampleConnectionStats()
+
+	if got := testutil.ToFloat64(metrics.UniqueUsers); got != 2 {
+		t.Errorf("unique users = %v, want 2", got)
+	}
+	gotCount, gotSum, gotBuckets := connectionsPerUser(t)
+	if gotCount-count != 2 || gotSum-sum != 3 {
+		t.Errorf("observed %d users holding %v connections, want 2 holding 3", gotCount-count, gotSum-sum)
+	}
+	// bob holds one connection and alice two
+	for bound, want := range map[float64]uint64{1: 1, 2: 2, 3: 2} {
+		if got := gotBuckets[bound] - buckets[bound]; got != want {
+			t.Errorf("bucket le=%v grew by %d, want %d", bound, got, want)
+		}
+	}
+}
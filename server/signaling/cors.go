@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CORS response values for browser clients of the HTTP API
+const (
+	corsAllowMethods = "GET, POST, PUT, DELETE, OPTIONS"
+	corsAllowHeaders = "Authorization, Content-Type"
+	corsMaxAge       = "600"
+)
+
+// corsPolicy lets browser pages on other origins call the HTTP endpoints
+type corsPolicy struct {
+	origins   map[string]bool
+	anyOrigin bool
+}
+
+// newCORSPolicy allows the comma-separated origins; "*" allows any origin
+func newCORSPolicy(origins string) *corsPolicy {
+	p := &corsPolicy{origins: make(map[string]bool)}
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		switch origin {
+		case "":
+		case "*":
+			p.anyOrigin = true
+		default:
+			p.origins[origin] = true
+		}
+	}
+	return p
+}
+
+// allowed reports whether requests from origin may read responses
+func (p *corsPolicy) allowed(origin string) bool {
+	return origin != "" && (p.anyOrigin || p.origins[origin])
+}
+
+// checkOrigin is the WebSocket upgrader's origin check. Handshakes without
+// an Origin come from non-browser clients; browsers may connect from the
+// server's own host or an allowed origin.
+func (p *corsPolicy) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return p.allowed(strings.TrimRight(origin, "/"))
+}
+
+// Wrap adds CORS headers for allowed origins and answers preflight requests.
+// The WebSocket endpoint is left alone: browsers don't apply CORS to
+// upgrades, whose origin is checked by the upgrader.
+func (p *corsPolicy) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		w.Header().Add("Vary", "Origin")
+		if !p.allowed(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Echo the origin rather than "*" so credentialed requests work
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCORSPolicyAllowed(t *testing.T) {
+	tests := []struct {
+		origins, origin string
+		want            bool
+	}{
+		{"https://app.example", "https://app.example", true},
+		{" https://a.example/ , https://b.example", "https://a.example", true},
+		{" https://a.example/ , https://b.example", "https://b.example", true},
+		{"https://app.example", "https://evil.example", false},
+		{"https://app.example", "http://app.example", false},
+		{"https://app.example", "", false},
+		{"*", "https://anything.example", true},
+		{"*", "", false},
+		{"", "https://app.example", false},
+	}
+	for _, tt := range tests {
+		if got := newCORSPolicy(tt.origins).allowed(tt.origin); got != tt.want {
+			t.Errorf("newCORSPolicy(%q).allowed(%q) = %v, want %v", tt.origins, tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestCORSPolicyWrap(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := newCORSPolicy("https://app.example").Wrap(next)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		origin     string
+		preflight  bool
+		wantStatus int
+		wantOrigin string
+	}{
+		{"allowed request", http.MethodGet, "/presence", "https://app.example", false, http.StatusOK, "https://app.example"},
+		{"other origin", http.MethodGet, "/presence", "https://evil.example", false, http.StatusOK, ""},
+		{"allowed preflight", http.MethodOptions, "/presence", "https://app.example", true, http.StatusNoContent, "https://app.example"},
+		{"refused preflight", http.MethodOptions, "/presence", "https://evil.example", true, http.StatusForbidden, ""},
+		{"websocket", http.MethodGet, "/ws", "https://app.example", false, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("Origin", tt.origin)
+		if tt.preflight {
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.wantStatus)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+			t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", tt.name, got, tt.wantOrigin)
+		}
+		if tt.preflight && tt.wantStatus == http.StatusNoContent && rec.Header().Get("Access-Control-Allow-Methods") == "" {
+			t.Errorf("%s: preflight response has no allowed methods", tt.name)
+		}
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	check := upgrader.CheckOrigin
+	upgrader.CheckOrigin = newCORSPolicy("https://app.example").checkOrigin
+	t.Cleanup(func() { upgrader.CheckOrigin = check })
+	srv := serveTestManager(t, newTestManager(t))
+
+	tests := []struct {
+		name       string
+		origin     string
+		wantStatus int
+	}{
+		{"no origin", "", http.StatusSwitchingProtocols},
+		{"same origin", "http://" + srv.Listener.Addr().String(), http.StatusSwitchingProtocols},
+		{"allowed origin", "https://app.example", http.StatusSwitchingProtocols},
+		{"other origin", "https://evil.example", http.StatusForbidden},
+	}
+	for i, tt := range tests {
+		rejected := testutil.ToFloat64(metrics.UpgradeFailures.WithLabelValues(upgradeFailureOrigin))
+		header := http.Header{"Authorization": {"Bearer " + testToken(t, "alice", fmt.Sprintf("device%d", i))}}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		_, resp, _ := dialWith(t, srv, header)
+		if resp == nil || resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: handshake response %v, want status %d", tt.name, resp, tt.wantStatus)
+		}
+		want := 0.0
+		if tt.wantStatus == http.StatusForbidden {
+			want = 1
+		}
+		if got := testutil.ToFloat64(metrics.UpgradeFailures.WithLabelValues(upgradeFailureOrigin)) - rejected; got != want {
+			t.Errorf("%s: counted %v origin rejections, want %v", tt.name, got, want)
+		}
+	}
+
+	// A request that isn't an upgrade is counted under its own reason
+	bad := testutil.ToFloat64(metrics.UpgradeFailures.WithLabelValues(upgradeFailureBadHandshake))
+	req, _ := http.NewRequest("GET", srv.URL+"/ws", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken(t, "alice", "plain"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain request: status %d, want 400", resp.StatusCode)
+	}
+	if got := testutil.ToFloat64(metrics.UpgradeFailures.WithLabelValues(upgradeFailureBadHandshake)) - bad; got != 1 {
+		t.Errorf("counted %v bad handshakes, want 1", got)
+	}
+}
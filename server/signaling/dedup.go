@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+
+	"go.uber.org/zap"
+)
+
+// redisDedupKey prefixes the markers of message IDs each user relayed
+// within -dedup-window
+const redisDedupKey = "lr:dedup:"
+
+// isDuplicate reports whether a user already relayed a message with this ID
+// within -dedup-window, marking the ID as seen otherwise. The window covers
+// all of the user's connections on every server. If Redis can't be reached
+// the message is treated as new.
+func (cm *ConnectionManager) isDuplicate(userID, msgID string) bool {
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	fresh, err := cm.redis.SetNX(ctx, cm.key(dedupKey(userID, msgID)), 1, *dedupWindow).Result()
+	if err != nil {
+		metrics.RedisErrors.WithLabelValues("dedup").Inc()
+		cm.logger.Debug("Failed to check message ID", zap.String("user_id", userID), zap.Error(err))
+		return false
+	}
+	return !fresh
+}
+
+// dedupKey returns the key marking a user's message ID as seen. The ID comes
+// from the client, so it is hashed to keep keys a fixed size.
+func dedupKey(userID, msgID string) string {
+	sum := sha256.Sum256([]byte(msgID))
+	return redisDedupKey + userID + ":" + base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+func TestIsDuplicate(t *testing.T) {
+	cm := newTestManager(t)
+	window := *dedupWindow
+	*dedupWindow = time.Minute
+	t.Cleanup(func() { *dedupWindow = window })
+
+	if cm.isDuplicate("alice", "m1") {
+		t.Fatal("first message reported as duplicate")
+	}
+	if !cm.isDuplicate("alice", "m1") {
+		t.Error("repeated ID within the window not reported as duplicate")
+	}
+	if cm.isDuplicate("alice", "m2") {
+		t.Error("new ID reported as duplicate")
+	}
+	if cm.isDuplicate("bob", "m1") {
+		t.Error("another user's ID reported as duplicate")
+	}
+}
+
+func TestDedupKeyBounded(t *testing.T) {
+	long := strings.Repeat("x", 1<<20)
+	if key, short := dedupKey("alice", long), dedupKey("alice", "m1"); len(key) != len(short) {
+		t.Errorf("key for a 1 MiB ID is %d bytes, want %d like any other", len(key), len(short))
+	}
+	if dedupKey("alice", long) == dedupKey("alice", long+"y") {
+		t.Error("distinct long IDs share a key")
+	}
+}
+
+func TestIsDuplicateWithoutRedis(t *testing.T) {
+	window := *dedupWindow
+	*dedupWindow = time.Minute
+	t.Cleanup(func() { *dedupWindow = window })
+
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	defer client.Close()
+	cm := &ConnectionManager{redis: client, ctx: context.Background(), logger: zap.NewNop()}
+
+	for i := 0; i < 2; i++ {
+		if cm.isDuplicate("alice", "m1") {
+			t.Fatal("message reported as duplicate with Redis unreachable")
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Disconnect reasons, labeling signaling_disconnects_total and
+// signaling_connection_duration_seconds
+const (
+	disconnectNormal          = "normal"           // client closed with 1000
+	disconnectGoingAway       = "going_away"       // client closed with 1001, e.g. a page unload
+	disconnectAbnormal        = "abnormal"         // connection dropped without a close frame
+	disconnectPolicyViolation = "policy_violation" // client closed with 1008
+	disconnectReadTimeout     = "read_timeout"     // no pong or message within -pong-wait
+	disconnectServer          = "server"           // the server closed the connection
+	disconnectOther           = "other"            // any other close code or read error
+)
+
+// disconnectReason classifies the error that ended a client's read loop.
+// serverClosed reports whether the server had already asked to close the
+// connection, which makes the read fail whatever the error.
+func disconnectReason(err error, serverClosed bool) string {
+	if serverClosed {
+		return disconnectServer
+	}
+
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		switch closeErr.Code {
+		case websocket.CloseNormalClosure:
+			return disconnectNormal
+		case websocket.CloseGoingAway:
+			return disconnectGoingAway
+		case websocket.CloseAbnormalClosure:
+			return disconnectAbnormal
+		case websocket.ClosePolicyViolation:
+			return disconnectPolicyViolation
+		}
+		return disconnectOther
+	}
+
+	// Other network errors, like a reset, mean the connection dropped
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return disconnectReadTimeout
+		}
+		return disconnectAbnormal
+	}
+	return disconnectOther
+}
+
+// recordDisconnect counts a client's disconnect and how long it was connected
+func recordDisconnect(c *Client, reason string) {
+	metrics.Disconnects.WithLabelValues(reason).Inc()
+	metrics.ConnectionDuration.WithLabelValues(reason).Observe(time.Since(c.ConnectedAt).Seconds())
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDisconnectReason(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}
+	reset := &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}
+
+	tests := []struct {
+		name         string
+		err          error
+		serverClosed bool
+		want         string
+	}{
+		{"normal close", &websocket.CloseError{Code: websocket.CloseNormalClosure}, false, disconnectNormal},
+		{"going away", &websocket.CloseError{Code: websocket.CloseGoingAway}, false, disconnectGoingAway},
+		{"no close frame", &websocket.CloseError{Code: websocket.CloseAbnormalClosure}, false, disconnectAbnormal},
+		{"policy violation", &websocket.CloseError{Code: websocket.ClosePolicyViolation}, false, disconnectPolicyViolation},
+		{"other close code", &websocket.CloseError{Code: 4000}, false, disconnectOther},
+		{"wrapped close", fmt.Errorf("read: %w", &websocket.CloseError{Code: websocket.CloseGoingAway}), false, disconnectGoingAway},
+		{"read timeout", timeout, false, disconnectReadTimeout},
+		{"reset", reset, false, disconnectAbnormal},
+		{"other error", errors.New("boom"), false, disconnectOther},
+		{"server closed", reset, true, disconnectServer},
+	}
+	for _, tt := range tests {
+		if got := disconnectReason(tt.err, tt.serverClosed); got != tt.want {
+			t.Errorf("%s: disconnectReason = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
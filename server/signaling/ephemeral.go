@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// typingTimeout is how long a typing indicator lasts without being renewed
+var typingTimeout = 5 * time.Second
+
+// maxReceiptIDLength caps the message ID a read receipt refers to
+const maxReceiptIDLength = 128
+
+var (
+	errInvalidTyping  = errors.New("typing requires a boolean typing field")
+	errInvalidReceipt = errors.New("receipt requires a message_id of at most 128 characters")
+)
+
+// typingKey identifies one client typing in one room
+func typingKey(room string, c *Client) string {
+	return room + "\x00" + c.ID
+}
+
+// setTyping starts or stops a client's typing indicator in a room. Room
+// members other than the sender, on every server, are told when it starts
+// and when it stops,
+// either explicitly or after typingTimeout without renewal; renewals while
+// already typing only extend the timeout.
+func (cm *ConnectionManager) setTyping(c *Client, room string, payload interface{}) error {
+	var req TypingPayload
+	if err := decodePayload(payload, &req); err != nil {
+		return errInvalidTyping
+	}
+	if !cm.isMember(c, room) {
+		return errNotSubscribed
+	}
+
+	if !req.Typing {
+		cm.stopTyping(c, room)
+		return nil
+	}
+
+	key := typingKey(room, c)
+	cm.typingMu.Lock()
+	if timer, ok := cm.typing[key]; ok {
+		timer.Reset(typingTimeout)
+		cm.typingMu.Unlock()
+		return nil
+	}
+	cm.typing[key] = time.AfterFunc(typingTimeout, func() {
+		cm.stopTyping(c, room)
+	})
+	cm.typingMu.Unlock()
+
+	return cm.broadcastEphemeral(c, room, MsgTyping, TypingPayload{Typing: true})
+}
+
+// stopTyping clears a client's typing indicator in a room, telling the other
+// members on every server if it was set
+func (cm *ConnectionManager) stopTyping(c *Client, room string) {
+	key := typingKey(room, c)
+	cm.typingMu.Lock()
+	timer, ok := cm.typing[key]
+	if ok {
+		timer.Stop()
+		delete(cm.typing, key)
+	}
+	cm.typingMu.Unlock()
+
+	// Not charged to the room budget, so a throttled sender's indicator
+	// still clears
+	if ok {
+		msg := SignalingMessage{
+			Type:      MsgTyping,
+			From:      c.UserID,
+			Room:      room,
+			Payload:   TypingPayload{Typing: false},
+			Timestamp: time.Now().Unix(),
+		}
+		cm.deliverToRoomExcept(room, msg, c)
+		cm.publishToRoom(room, msg)
+	}
+}
+
+// sendReceipt tells the other members of a room that a client has read up
+// to a message
+func (cm *ConnectionManager) sendReceipt(c *Client, room string, payload interface{}) error {
+	var req ReceiptPayload
+	if err := decodePayload(payload, &req); err != nil {
+		return errInvalidReceipt
+	}
+	if req.MessageID == "" || len(req.MessageID) > maxReceiptIDLength {
+		return errInvalidReceipt
+	}
+	if !cm.isMember(c, room) {
+		return errNotSubscribed
+	}
+
+	return cm.broadcastEphemeral(c, room, MsgReceipt, req)
+}
+
+// broadcastEphemeral delivers a message from c to the room's other members
+// on every server, charging it to the sender's room budget. Ephemeral
+// messages are never recorded in room history.
+func (cm *ConnectionManager) broadcastEphemeral(c *Client, room, msgType string, payload interface{}) error {
+	msg := SignalingMessage{
+		Type:      msgType,
+		From:      c.UserID,
+		Room:      room,
+		Payload:   payload,
+		Timestamp: time.Now().Unix(),
+	}
+	data, err := cm.marshalMessage(msg)
+	if err != nil {
+		return err
+	}
+	if err := cm.allowRoomSend(c, room, len(data)); err != nil {
+		return err
+	}
+
+	cm.deliverDataExcept(room, data, c)
+	return cm.publishToRoom(room, msg)
+}
+
+// roomSendErrorCode maps a room message, typing or receipt error to its
+// error frame code, returning "" for errors that aren't the client's fault
+func roomSendErrorCode(err error) string {
+	switch err {
+	case errInvalidTyping, errInvalidReceipt:
+		return ErrCodeInvalidPayload
+	case errRoomThrottled:
+		return ErrCodeRoomThrottled
+	}
+	return roomAccessErrorCode(err)
+}
+
+// isMember reports whether a client is subscribed to a room
+func (cm *ConnectionManager) isMember(c *Client, room string) bool {
+	cm.roomsMu.RLock()
+	defer cm.roomsMu.RUnlock()
+
+	r, ok := cm.rooms[room]
+	if !ok {
+		return false
+	}
+	_, ok = r.members[c.ID]
+	return ok
+}
+
+// decodePayload converts a message payload into a typed struct
+func decodePayload(payload interface{}, v interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// typing reports the typing flag of a typing message
+func typing(t *testing.T, msg SignalingMessage) bool {
+	t.Helper()
+	var payload TypingPayload
+	if err := decodePayload(msg.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload.Typing
+}
+
+func TestEphemeralAcrossServers(t *testing.T) {
+	timeout := typingTimeout
+	typingTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { typingTimeout = timeout })
+
+	client, namespace := newTestRedis(t), "test-"+uuid.New().String()
+	a, b := newTestManagerOn(t, client, namespace), newTestManagerOn(t, client, namespace)
+	srvA, srvB := serveTestManager(t, a), serveTestManager(t, b)
+
+	alice := dialTest(t, srvA, "alice", "phone")
+	carol := dialTest(t, srvA, "carol", "phone")
+	bob := dialTest(t, srvB, "bob", "laptop")
+	for _, c := range []*testConn{alice, carol, bob} {
+		c.send(SignalingMessage{Type: MsgSubscribe, Room: "standup"})
+	}
+	joined := func(cm *ConnectionManager, userID string) bool {
+		clients := cm.GetClientByUserID(userID)
+		return len(clients) == 1 && cm.isMember(clients[0], "standup")
+	}
+	waitFor(t, "everyone to join", func() bool {
+		return joined(a, "alice") && joined(a, "carol") && joined(b, "bob")
+	})
+	waitFor(t, "both servers to subscribe", func() bool {
+		subs := client.PubSubNumSub(context.Background(), a.roomChannel("standup")).Val()
+		return subs[a.roomChannel("standup")] == 2
+	})
+
+	alice.send(SignalingMessage{Type: MsgTyping, Room: "standup", Payload: TypingPayload{Typing: true}})
+	for _, c := range []*testConn{carol, bob} {
+		if msg := c.next(MsgTyping); msg.From != "alice" || !typing(t, msg) {
+			t.Errorf("typing message %+v, want alice typing", msg)
+		}
+	}
+
+	// Left alone the indicator expires on both servers
+	for _, c := range []*testConn{carol, bob} {
+		if msg := c.next(MsgTyping); msg.From != "alice" || typing(t, msg) {
+			t.Errorf("typing message %+v, want alice stopped typing", msg)
+		}
+	}
+
+	alice.send(SignalingMessage{Type: MsgReceipt, Room: "standup", Payload: ReceiptPayload{MessageID: "m1"}})
+	if msg := bob.next(MsgReceipt); msg.From != "alice" {
+		t.Errorf("receipt %+v, want one from alice", msg)
+	}
+
+	// Neither kind of message is kept for replay
+	for _, cm := range []*ConnectionManager{a, b} {
+		history, err := cm.roomHistory("standup", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 0 {
+			t.Errorf("room history holds %d ephemeral messages", len(history))
+		}
+	}
+}
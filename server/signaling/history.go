@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+
+	"go.uber.org/zap"
+)
+
+// Room history key suffix (appended to redisRoomKey + room)
+const roomHistorySuffix = ":history"
+
+// recordRoomHistory appends a message to the room's capped history list
+func (cm *ConnectionManager) recordRoomHistory(room string, msg SignalingMessage) {
+	size := *roomHistorySize
+	if size <= 0 {
+		return
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	key := cm.key(redisRoomKey + room + roomHistorySuffix)
+	pipe := cm.redis.TxPipeline()
+	pipe.LPush(ctx, key, data)
+	pipe.LTrim(ctx, key, 0, int64(size-1))
+	if _, err := pipe.Exec(ctx); err != nil {
+		cm.logger.Debug("Failed to record room history", zap.String("room", room), zap.Error(err))
+	}
+}
+
+// roomHistory returns up to n of the room's most recent messages, oldest first
+func (cm *ConnectionManager) roomHistory(room string, n int) ([][]byte, error) {
+	if n <= 0 || *roomHistorySize <= 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	// The list is newest first
+	entries, err := cm.redis.LRange(ctx, cm.key(redisRoomKey+room+roomHistorySuffix), 0, int64(n-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([][]byte, len(entries))
+	for i, entry := range entries {
+		history[len(entries)-1-i] = []byte(entry)
+	}
+	return history, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// touchData records that a message arrived from the client. Pongs don't
+// count, so a client that only keeps the connection alive still goes idle.
+func (c *Client) touchData() {
+	atomic.StoreInt64(&c.lastData, time.Now().UnixNano())
+}
+
+// idleFor returns how long ago the client last sent a message
+func (c *Client) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastData)))
+}
+
+// idleReaper closes WebSocket connections that have sent no messages within
+// -idle-timeout, checking a few times per timeout
+func (cm *ConnectionManager) idleReaper() {
+	ticker := time.NewTicker(*idleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cm.reapIdle(*idleTimeout)
+		case <-cm.ctx.Done():
+			return
+		}
+	}
+}
+
+// reapIdle closes WebSocket connections idle for longer than timeout.
+// Long-poll sessions expire on their own.
+func (cm *ConnectionManager) reapIdle(timeout time.Duration) {
+	var idle []*Client
+	cm.clientsMu.RLock()
+	for _, client := range cm.clients {
+		if client.Conn != nil && client.idleFor() > timeout {
+			idle = append(idle, client)
+		}
+	}
+	cm.clientsMu.RUnlock()
+
+	for _, client := range idle {
+		client.Logger.Info("Closing idle connection", zap.Duration("idle", client.idleFor()))
+		metrics.IdleReaped.Inc()
+		client.closeWith(CloseIdle, "idle timeout", true)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestIdleReaperIgnoresPongs(t *testing.T) {
+	period, timeout := *pingPeriod, *idleTimeout
+	*pingPeriod, *idleTimeout = 50*time.Millisecond, 400*time.Millisecond
+	t.Cleanup(func() { *pingPeriod, *idleTimeout = period, timeout })
+
+	srv := serveTestManager(t, newTestManager(t))
+	reaped := testutil.ToFloat64(metrics.IdleReaped)
+	alice := dialTest(t, srv, "alice", "phone")
+	start := time.Now()
+
+	// Answer every ping, ignoring pongs that race the server's close
+	var pongs int32
+	alice.conn.SetPingHandler(func(data string) error {
+		if alice.conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second)) == nil {
+			atomic.AddInt32(&pongs, 1)
+		}
+		return nil
+	})
+	var err error
+	for err == nil {
+		err = alice.read(3 * time.Second)
+	}
+
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseIdle || closeErr.Text != "idle timeout" {
+		t.Fatalf("connection ended with %v, want close %d idle timeout", err, CloseIdle)
+	}
+	if elapsed := time.Since(start); elapsed < *idleTimeout {
+		t.Errorf("closed after %v, before the idle timeout", elapsed)
+	}
+	if atomic.LoadInt32(&pongs) == 0 {
+		t.Error("no pings answered before the close")
+	}
+	if got := testutil.ToFloat64(metrics.IdleReaped) - reaped; got != 1 {
+		t.Errorf("idle reaped counted %v times, want once", got)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ipLimiterIdle is how long an IP without connections is remembered
+const ipLimiterIdle = 5 * time.Minute
+
+var (
+	errIPConnLimit      = errors.New("too many connections from this address")
+	errIPHandshakeLimit = errors.New("too many handshakes from this address")
+)
+
+// ipEntry tracks one remote address
+type ipEntry struct {
+	conns    int
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// ipLimiter caps concurrent connections and the handshake rate per remote
+// IP, independently of per-user rate limiting
+type ipLimiter struct {
+	mu      sync.Mutex
+	entries map[string]*ipEntry
+}
+
+// newIPLimiter creates an empty IP limiter
+func newIPLimiter() *ipLimiter {
+	return &ipLimiter{entries: make(map[string]*ipEntry)}
+}
+
+// Acquire admits a new connection from ip, or returns why it was refused
+func (l *ipLimiter) Acquire(ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[ip]
+	if !ok {
+		entry = &ipEntry{
+			limiter: rate.NewLimiter(rate.Limit(*ipHandshakeRate), *ipHandshakeBurst),
+		}
+		l.entries[ip] = entry
+	}
+	entry.lastSeen = time.Now()
+
+	if *ipHandshakeRate > 0 && !entry.limiter.Allow() {
+		return errIPHandshakeLimit
+	}
+	if *maxConnsPerIP > 0 && entry.conns >= *maxConnsPerIP {
+		return errIPConnLimit
+	}
+
+	entry.conns++
+	return nil
+}
+
+// Release records that a connection from ip has closed
+func (l *ipLimiter) Release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry, ok := l.entries[ip]; ok && entry.conns > 0 {
+		entry.conns--
+		entry.lastSeen = time.Now()
+	}
+}
+
+// prune forgets addresses with no connections that have been idle long
+// enough for their handshake limiter to refill
+func (l *ipLimiter) prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, entry := range l.entries {
+		if entry.conns == 0 && time.Since(entry.lastSeen) > ipLimiterIdle {
+			delete(l.entries, ip)
+		}
+	}
+}
+
+// ipLimiterPruner periodically prunes idle IP entries
+func (cm *ConnectionManager) ipLimiterPruner() {
+	ticker := time.NewTicker(ipLimiterIdle)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cm.ipLimits.prune()
+		case <-cm.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+// setIPLimits sets the per-IP limit flags for the duration of a test
+func setIPLimits(t *testing.T, conns int, rate float64, burst int) {
+	t.Helper()
+	oldConns, oldRate, oldBurst := *maxConnsPerIP, *ipHandshakeRate, *ipHandshakeBurst
+	*maxConnsPerIP, *ipHandshakeRate, *ipHandshakeBurst = conns, rate, burst
+	t.Cleanup(func() {
+		*maxConnsPerIP, *ipHandshakeRate, *ipHandshakeBurst = oldConns, oldRate, oldBurst
+	})
+}
+
+func TestIPLimiterConnLimit(t *testing.T) {
+	setIPLimits(t, 2, 0, 1)
+	l := newIPLimiter()
+
+	for i := 0; i < 2; i++ {
+		if err := l.Acquire("192.0.2.1"); err != nil {
+			t.Fatalf("Acquire %d: %v", i, err)
+		}
+	}
+	if err := l.Acquire("192.0.2.1"); err != errIPConnLimit {
+		t.Fatalf("Acquire over limit = %v, want errIPConnLimit", err)
+	}
+	if err := l.Acquire("192.0.2.2"); err != nil {
+		t.Fatalf("Acquire from another address: %v", err)
+	}
+
+	l.Release("192.0.2.1")
+	if err := l.Acquire("192.0.2.1"); err != nil {
+		t.Fatalf("Acquire after Release: %v", err)
+	}
+}
+
+func TestIPLimiterHandshakeRate(t *testing.T) {
+	setIPLimits(t, 0, 0.001, 3)
+	l := newIPLimiter()
+
+	for i := 0; i < 3; i++ {
+		if err := l.Acquire("192.0.2.1"); err != nil {
+			t.Fatalf("Acquire %d: %v", i, err)
+		}
+		l.Release("192.0.2.1")
+	}
+	if err := l.Acquire("192.0.2.1"); err != errIPHandshakeLimit {
+		t.Fatalf("Acquire over burst = %v, want errIPHandshakeLimit", err)
+	}
+}
+
+func TestIPLimiterPrune(t *testing.T) {
+	setIPLimits(t, 0, 0, 1)
+	l := newIPLimiter()
+
+	if err := l.Acquire("192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Acquire("192.0.2.2"); err != nil {
+		t.Fatal(err)
+	}
+	l.Release("192.0.2.2")
+	for _, entry := range l.entries {
+		entry.lastSeen = entry.lastSeen.Add(-2 * ipLimiterIdle)
+	}
+
+	l.prune()
+	if _, ok := l.entries["192.0.2.1"]; !ok {
+		t.Error("prune dropped an address with open connections")
+	}
+	if _, ok := l.entries["192.0.2.2"]; ok {
+		t.Error("prune kept an idle address")
+	}
+}
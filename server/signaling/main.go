@@ -4,176 +4,488 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
-	"golang.org/x/time/rate"
 )
 
 var (
-	addr        = flag.String("addr", ":8080", "HTTP server address")
-	redisAddr   = flag.String("redis", "localhost:6379", "Redis server address")
-	jwtSecret   = flag.String("jwt-secret", os.Getenv("JWT_SECRET"), "JWT secret key")
-	certFile    = flag.String("cert", "", "TLS certificate file")
-	keyFile     = flag.String("key", "", "TLS key file")
-	verbose     = flag.Bool("verbose", false, "Enable verbose logging")
+	addr                   = flag.String("addr", ":8080", "HTTP server address")
+	redisAddr              = flag.String("redis", "localhost:6379", "Redis server address")
+	redisMode              = flag.String("redis-mode", "single", "Redis deployment mode (single|sentinel|cluster)")
+	redisMaster            = flag.String("redis-master-name", "", "Redis Sentinel master name")
+	redisAddrs             = flag.String("redis-addrs", "", "Comma-separated Redis Sentinel or Cluster addresses")
+	redisPassword          = flag.String("redis-password", os.Getenv("REDIS_PASSWORD"), "Redis password")
+	redisDB                = flag.Int("redis-db", 0, "Redis database number (single and sentinel modes)")
+	redisTLS               = flag.Bool("redis-tls", false, "Connect to Redis over TLS")
+	redisTLSCA             = flag.String("redis-tls-ca", "", "CA certificate file for verifying Redis (system roots if empty)")
+	redisTLSSkipVerify     = flag.Bool("redis-tls-skip-verify", false, "Skip verifying the Redis server certificate (testing only)")
+	redisNS                = flag.String("redis-namespace", "", "Prefix for every Redis key and channel, separating environments that share a Redis instance")
+	jwtSecret              = flag.String("jwt-secret", os.Getenv("JWT_SECRET"), "JWT secret key")
+	jwtIssuer              = flag.String("jwt-issuer", "liberty-reach-signaling", "Required JWT issuer (empty disables the check)")
+	jwtAudience            = flag.String("jwt-audience", "", "Required JWT audience, e.g. liberty-reach-signaling (empty disables the check)")
+	jwtLeeway              = flag.Duration("jwt-leeway", 30*time.Second, "Clock skew tolerated when checking JWT exp, nbf and iat")
+	allowInsecureAuth      = flag.Bool("allow-insecure-auth", false, "Start without a JWT secret, accepting tokens anyone can forge (development only)")
+	certFile               = flag.String("cert", "", "TLS certificate file")
+	keyFile                = flag.String("key", "", "TLS key file")
+	verbose                = flag.Bool("verbose", false, "Enable verbose logging")
+	selfCheck              = flag.Bool("check", false, "Check Redis, JWT and TLS configuration, print a report and exit (non-zero on failure)")
+	region                 = flag.String("region", "", "Region of this server, used to route relays to same-region servers")
+	redisOpTimeout         = flag.Duration("redis-op-timeout", 3*time.Second, "Timeout for individual Redis operations")
+	redisReplicaReads      = flag.Bool("redis-read-from-replicas", false, "Send presence, device and room directory reads to Redis replicas (sentinel and cluster modes)")
+	presenceDebounce       = flag.Duration("presence-debounce", 2*time.Second, "Window for coalescing presence publishes per user (0 disables)")
+	duplicateDevicePolicy  = flag.String("duplicate-device-policy", devicePolicyReplace, "Policy when a device connects twice (replace|reject)")
+	slowConsumerThreshold  = flag.Int("slow-consumer-threshold", 64, "Consecutive full-buffer drops before a client is disconnected (0 disables)")
+	roomHistorySize        = flag.Int("room-history-size", 50, "Recent messages kept per room for replay (0 disables)")
+	roomReplayCount        = flag.Int("room-replay-count", 20, "Messages replayed to a client subscribing with replay")
+	rateLimitBackend       = flag.String("rate-limit-backend", rateLimitBackendLocal, "Where per-user rate limits are kept (local|redis)")
+	offlineQueue           = flag.Bool("offline-queue", false, "Hold relayed messages for users with no connection until they connect")
+	offlineQueueTTL        = flag.Duration("offline-queue-ttl", 24*time.Hour, "How long messages are held for an offline user")
+	offlineQueueSize       = flag.Int("offline-queue-size", 100, "Messages held per offline user; older ones are dropped")
+	maxRoomsPerClient      = flag.Int("max-rooms-per-client", 100, "Rooms a single connection may subscribe to (0 disables)")
+	writeWait              = flag.Duration("write-wait", 10*time.Second, "Time allowed to write a WebSocket frame")
+	pongWait               = flag.Duration("pong-wait", 60*time.Second, "Time allowed to read the next pong before a client is dropped")
+	pingPeriod             = flag.Duration("ping-period", 54*time.Second, "Interval between WebSocket pings (must be less than -pong-wait)")
+	idleTimeout            = flag.Duration("idle-timeout", 0, "Close WebSocket connections that send no messages for this long, even if they answer pings (0 disables)")
+	dedupWindow            = flag.Duration("dedup-window", 0, "Drop relayed messages repeating the id of one the sender relayed within this window (0 disables)")
+	notifyBlocked          = flag.Bool("notify-blocked", false, "Send an error frame to senders whose messages a recipient's block list dropped")
+	roomReconcileInterval  = flag.Duration("room-reconcile-interval", time.Minute, "How often room membership is checked and repaired (0 disables)")
+	resumeGrace            = flag.Duration("resume-grace", 2*time.Minute, "How long a dropped WebSocket client may resume its rooms with its resume token (0 disables)")
+	writeBatchMax          = flag.Int("write-batch-max", 0, "Queued messages coalesced into one newline-delimited frame (0 or 1 disables)")
+	roomMsgRate            = flag.Float64("room-msg-rate", 10, "Messages per second each sender may broadcast to a room (0 disables)")
+	roomByteRate           = flag.Int("room-byte-rate", 64<<10, "Bytes per second each sender may broadcast to a room (0 disables)")
+	broadcastWorkers       = flag.Int("broadcast-workers", 8, "Concurrent sends when broadcasting to a large room")
+	shutdownGrace          = flag.Duration("shutdown-grace", 5*time.Second, "Time allowed to flush queued messages to clients on shutdown")
+	maxConnections         = flag.Int("max-connections", 0, "Concurrent connections allowed in total, including long-poll sessions (0 disables)")
+	maxConnsPerIP          = flag.Int("max-conns-per-ip", 50, "Concurrent WebSocket connections and HTTP API requests allowed per remote IP (0 disables)")
+	ipHandshakeRate        = flag.Float64("ip-handshake-rate", 5, "WebSocket handshakes and HTTP API requests per second allowed per remote IP (0 disables)")
+	ipHandshakeBurst       = flag.Int("ip-handshake-burst", 20, "Burst of WebSocket handshakes and HTTP API requests allowed per remote IP")
+	trustedProxyList       = flag.String("trusted-proxies", "", "Comma-separated proxy networks whose X-Forwarded-For and X-Real-IP headers are believed")
+	allowQueryToken        = flag.Bool("allow-query-token", true, "Accept the JWT in the token query parameter (deprecated; it leaks into logs, prefer the Authorization header or access_token subprotocol)")
+	tokenBinding           = flag.Bool("token-binding", false, "Reject tokens carrying ip_hash or device_hash claims when presented from another network or device")
+	tokenBindingV4Bits     = flag.Int("token-binding-ipv4-bits", 24, "Prefix length of the IPv4 network a token's ip_hash covers")
+	tokenBindingV6Bits     = flag.Int("token-binding-ipv6-bits", 48, "Prefix length of the IPv6 network a token's ip_hash covers")
+	allowGuests            = flag.Bool("allow-guests", false, "Admit tokenless WebSocket clients as guests limited to public rooms")
+	sanitizeSDP            = flag.Bool("sanitize-sdp", false, "Check ICE candidates in relayed offers, answers and candidates")
+	blockedCandidateCIDRs  = flag.String("blocked-candidate-cidrs", defaultBlockedCandidateCIDRs, "Comma-separated address ranges ICE candidates may not use (with -sanitize-sdp)")
+	blockedCandidateAction = flag.String("blocked-candidate-action", candidateActionStrip, "What to do with a blocked ICE candidate (strip|reject)")
+	maxCandidates          = flag.Int("max-candidates", 32, "ICE candidates allowed per offer or answer (with -sanitize-sdp, 0 disables)")
+	adminToken             = flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token for the admin API (disabled if empty)")
+	announceRate           = flag.Float64("announce-rate", 1, "Announcements per second accepted by POST /admin/broadcast")
+	auditLog               = flag.String("audit-log", "stdout", "Where security audit events are written (stdout, stderr or a file path)")
+	corsOrigins            = flag.String("cors-origins", "", "Comma-separated origins allowed to call the HTTP endpoints and open WebSockets from browsers (* for any, empty allows only same-origin WebSockets)")
 )
 
 var (
-	logger *zap.Logger
+	logger   *zap.Logger
+	audit    *AuditLogger
+	logLevel zap.AtomicLevel // adjustable at runtime via /admin/loglevel
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			// Allow all origins for now (configure in production)
-			return true
-		},
+		Subprotocols:    subprotocols,
+		Error:           upgradeError,
 	}
-	
+
 	// Metrics
-	metrics = NewMetrics()
+	metrics = NewMetrics(prometheus.DefaultRegisterer)
 )
 
 func main() {
 	flag.Parse()
-	
+
+	if *selfCheck {
+		if !reportSelfChecks(os.Stdout, runSelfChecks()) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Initialize logger
-	var err error
+	logConfig := zap.NewProductionConfig()
 	if *verbose {
-		logger, err = zap.NewDevelopment()
-	} else {
-		logger, err = zap.NewProduction()
+		logConfig = zap.NewDevelopmentConfig()
 	}
+	logLevel = logConfig.Level
+
+	var err error
+	logger, err = logConfig.Build()
 	if err != nil {
 		log.Fatalf("Failed to create logger: %v", err)
 	}
 	defer logger.Sync()
-	
+
+	audit, err = NewAuditLogger(*auditLog)
+	if err != nil {
+		logger.Fatal("Failed to create audit logger", zap.Error(err))
+	}
+	defer audit.Sync()
+
+	if *duplicateDevicePolicy != devicePolicyReplace && *duplicateDevicePolicy != devicePolicyReject {
+		logger.Fatal("Invalid duplicate device policy", zap.String("policy", *duplicateDevicePolicy))
+	}
+
+	if *rateLimitBackend != rateLimitBackendLocal && *rateLimitBackend != rateLimitBackendRedis {
+		logger.Fatal("Invalid rate limit backend", zap.String("backend", *rateLimitBackend))
+	}
+
+	if err := wsTimings().Validate(); err != nil {
+		logger.Fatal("Invalid WebSocket timings", zap.Error(err))
+	}
+
+	trustedProxies, err = parseCIDRs(*trustedProxyList)
+	if err != nil {
+		logger.Fatal("Invalid trusted proxies", zap.Error(err))
+	}
+
+	if err := requireJWTSecret(*jwtSecret, *allowInsecureAuth, logger); err != nil {
+		logger.Fatal("Refusing to start", zap.Error(err))
+	}
+
 	// Initialize Redis
-	redisClient, err := newRedisClient(*redisAddr)
+	redisSec, err := redisSecurityFromFlags()
+	if err != nil {
+		logger.Fatal("Invalid Redis security settings", zap.Error(err))
+	}
+	redisClient, err := newRedisClient(*redisMode, *redisMaster, parseRedisAddrs(*redisAddr, *redisAddrs), false, redisSec)
 	if err != nil {
 		logger.Fatal("Failed to connect to Redis", zap.Error(err))
 	}
 	defer redisClient.Close()
-	
+
 	// Initialize connection manager
 	connManager := NewConnectionManager(redisClient, logger)
-	
-	// Setup HTTP routes
-	router := mux.NewRouter()
-	router.HandleFunc("/ws", handleWebSocket(connManager)).Methods("GET")
-	router.HandleFunc("/health", handleHealth).Methods("GET")
-	router.HandleFunc("/metrics", promhttp.Handler().ServeHTTP).Methods("GET")
-	
+
+	if *redisReplicaReads {
+		connManager.replica, err = newRedisClient(*redisMode, *redisMaster, parseRedisAddrs(*redisAddr, *redisAddrs), true, redisSec)
+		if err != nil {
+			logger.Fatal("Failed to connect to Redis replicas", zap.Error(err))
+		}
+		defer connManager.replica.Close()
+	}
+
+	if *sanitizeSDP {
+		connManager.sdp, err = newSDPSanitizer(*blockedCandidateCIDRs, *blockedCandidateAction, *maxCandidates)
+		if err != nil {
+			logger.Fatal("Invalid SDP sanitizer settings", zap.Error(err))
+		}
+	}
+
+	// Authenticate clients with JWTs; other Authenticators can be swapped in
+	var auth Authenticator = &JWTAuthenticator{
+		Secret:   *jwtSecret,
+		Issuer:   *jwtIssuer,
+		Audience: *jwtAudience,
+		Leeway:   *jwtLeeway,
+	}
+	connManager.auth = auth
+
+	router := newRouter(connManager, auth)
+
+	// Browser pages on other origins
+	cors := newCORSPolicy(*corsOrigins)
+	upgrader.CheckOrigin = cors.checkOrigin
+	var handler http.Handler = router
+	if *corsOrigins != "" {
+		handler = cors.Wrap(router)
+	}
+
 	// Create server
 	server := &http.Server{
 		Addr:         *addr,
-		Handler:      router,
+		Handler:      handler,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
-	
+
 	// Graceful shutdown
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
-	
+
+	// Serve TLS from a reloadable certificate; SIGHUP picks up a renewal
+	if *certFile != "" && *keyFile != "" {
+		certs, err := newCertReloader(*certFile, *keyFile)
+		if err != nil {
+			logger.Fatal("Failed to load TLS certificate", zap.Error(err))
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+		go certs.watch(ctx, logger)
+	}
+
 	// Start server
 	go func() {
-		logger.Info("Starting signaling server", 
+		logger.Info("Starting signaling server",
 			zap.String("address", *addr),
-			zap.String("redis", *redisAddr))
-		
+			zap.String("redis", *redisAddr),
+			zap.String("redis_mode", *redisMode))
+
 		if *certFile != "" && *keyFile != "" {
-			err = server.ListenAndServeTLS(*certFile, *keyFile)
+			// Empty paths: the certificate comes from GetCertificate
+			err = server.ListenAndServeTLS("", "")
 		} else {
 			err = server.ListenAndServe()
 		}
-		
+
 		if err != nil && err != http.ErrServerClosed {
 			logger.Fatal("Server failed", zap.Error(err))
 		}
 	}()
-	
+
 	// Wait for shutdown signal
 	<-ctx.Done()
-	
+
 	// Graceful shutdown
 	logger.Info("Shutting down server...")
-	
+
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
-	
+
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		logger.Error("Server shutdown failed", zap.Error(err))
 	}
-	
+
 	connManager.Close()
 	logger.Info("Server stopped")
 }
 
+// newRouter sets up the WebSocket, long-poll, presence, contact, block,
+// admin and health routes
+func newRouter(connManager *ConnectionManager, auth Authenticator) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/ws", handleWebSocket(connManager, auth)).Methods("GET")
+	router.HandleFunc("/health", handleHealth(connManager)).Methods("GET")
+
+	// Long-poll fallback for networks that block WebSocket upgrades
+	polls := NewPollSessions(connManager)
+	router.HandleFunc("/poll/send", handlePollSend(polls, auth)).Methods("POST")
+	router.HandleFunc("/poll/recv", handlePollRecv(polls, auth)).Methods("GET")
+	router.HandleFunc("/metrics", promhttp.Handler().ServeHTTP).Methods("GET")
+
+	// Batch presence lookups for contact lists
+	router.HandleFunc("/presence/query", handlePresenceQuery(connManager, auth)).Methods("POST")
+
+	// Who may see a user's presence, and their contacts
+	router.HandleFunc("/presence/visibility", handlePresenceVisibility(connManager, auth)).Methods("GET", "PUT")
+	router.HandleFunc("/contacts", handleContacts(connManager, auth)).Methods("GET")
+	router.HandleFunc("/contacts/{userID}", handleContacts(connManager, auth)).Methods("PUT", "DELETE")
+
+	// Users' own block lists
+	router.HandleFunc("/blocks", handleBlocks(connManager, auth)).Methods("GET")
+	router.HandleFunc("/blocks/{userID}", handleBlocks(connManager, auth)).Methods("PUT", "DELETE")
+
+	// Admin API
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(requireAdmin)
+	admin.HandleFunc("/rooms", handleListRooms(connManager)).Methods("GET")
+	admin.HandleFunc("/rooms", handleCreateRoom(connManager)).Methods("POST")
+	admin.HandleFunc("/rooms/{room}", handleGetRoom(connManager)).Methods("GET")
+	admin.HandleFunc("/rooms/{room}/join_rule", handleSetJoinRule(connManager)).Methods("PUT")
+	admin.HandleFunc("/rooms/{room}/invites", handleInviteUser(connManager)).Methods("POST")
+	admin.HandleFunc("/rooms/{room}/invites/{userID}", handleRevokeInvite(connManager)).Methods("DELETE")
+	admin.HandleFunc("/broadcast", handleAdminBroadcast(connManager)).Methods("POST")
+	admin.HandleFunc("/users/{userID}/blocks", handleAdminBlocks(connManager)).Methods("GET")
+	admin.HandleFunc("/users/{userID}/blocks/{blockedID}", handleAdminBlocks(connManager)).Methods("PUT", "DELETE")
+
+	// GET returns {"level": "info"}; PUT with the same body changes it
+	admin.Handle("/loglevel", logLevel).Methods("GET", "PUT")
+
+	return router
+}
+
 // handleWebSocket handles WebSocket connections
-func handleWebSocket(connManager *ConnectionManager) http.HandlerFunc {
+func handleWebSocket(connManager *ConnectionManager, auth Authenticator) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Per-IP limits apply before authentication to blunt pre-auth floods
+		ip := clientIP(r)
+		if err := connManager.ipLimits.Acquire(ip); err != nil {
+			audit.Log(auditIPLimited, "", ip, err.Error())
+			http.Error(w, "Too many connections", http.StatusTooManyRequests)
+			metrics.RateLimitExceeded.Inc()
+			return
+		}
+		admitted := false
+		defer func() {
+			if !admitted {
+				connManager.ipLimits.Release(ip)
+			}
+		}()
+
 		// Authenticate
-		token := r.URL.Query().Get("token")
-		if token == "" {
+		claims, err := auth.Authenticate(r)
+		if err == errMissingToken && *allowGuests {
+			claims, err = newGuestClaims(), nil
+		}
+		if err == errMissingToken {
+			audit.Log(auditAuthFailure, "", ip, err.Error())
 			http.Error(w, "Missing token", http.StatusUnauthorized)
 			return
 		}
-		
-		claims, err := validateJWT(token, *jwtSecret)
 		if err != nil {
+			audit.Log(auditAuthFailure, "", ip, err.Error())
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
-		
+
 		// Rate limiting
-		limiter := connManager.GetRateLimiter(claims.UserID)
-		if limiter.Allow() == rate.LimitExceeded {
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		limiter := connManager.GetRateLimiter(rateLimitKey(claims.UserID, ip, claims.Guest))
+		if !limiter.Allow() {
+			audit.Log(auditRateLimited, claims.UserID, ip, "websocket handshake")
+			writeRateLimited(w, retryDelay(limiter))
 			metrics.RateLimitExceeded.Inc()
 			return
 		}
-		
+
+		// Refuse new sessions up front once the server is full
+		if connManager.AtCapacity() && !connManager.HasDevice(claims.UserID, claims.DeviceID) {
+			metrics.ConnectionsRejected.Inc()
+			http.Error(w, "Server at capacity", http.StatusServiceUnavailable)
+			return
+		}
+
+		// Refuse a second session for the same device up front
+		if *duplicateDevicePolicy == devicePolicyReject && connManager.HasDevice(claims.UserID, claims.DeviceID) {
+			http.Error(w, "Device already connected", http.StatusConflict)
+			return
+		}
+
 		// Upgrade to WebSocket
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
+			// Handshake errors were answered and counted by upgradeError;
+			// anything else failed after the connection was hijacked
+			if _, ok := err.(websocket.HandshakeError); ok {
+				logger.Debug("WebSocket handshake rejected", zap.Error(err))
+				return
+			}
+			metrics.UpgradeFailures.WithLabelValues(upgradeFailureWrite).Inc()
 			logger.Error("WebSocket upgrade failed", zap.Error(err))
 			return
 		}
-		
+
 		// Create client session
-		client := NewClient(claims.UserID, claims.DeviceID, conn, logger)
-		
+		client := NewClient(claims.UserID, claims.DeviceID, conn, logger, wsTimings())
+		client.Scopes = claims.EffectiveScopes()
+		client.Guest = claims.Guest
+		client.remoteIP = ip
+		client.fingerprint = r.Header.Get(deviceFingerprintHeader)
+		client.codec = codecFor(conn.Subprotocol())
+		if claims.ExpiresAt != nil {
+			client.setTokenExpiry(claims.ExpiresAt.Time)
+		}
+		if *resumeGrace > 0 && !client.Guest {
+			client.resumeToken = newResumeToken()
+		}
+
 		// Register client
-		connManager.AddClient(client)
+		if err := connManager.AddClient(client); err != nil {
+			// Lost a race with another session for the same device, or for
+			// the last free slot
+			code := CloseDeviceConnected
+			if err == errServerFull {
+				code = CloseServerFull
+			}
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(code, err.Error()),
+				time.Now().Add(*writeWait))
+			conn.Close()
+			return
+		}
 		metrics.ActiveConnections.Inc()
-		
-		// Handle client messages
-		go client.ReadPump(connManager)
-		go client.WritePump()
-		
+
+		// Restore the rooms of a dropped session and hand out a new token
+		if client.resumeToken != "" {
+			var restored []string
+			if token := r.URL.Query().Get("resume_token"); token != "" {
+				restored = connManager.resumeSession(client, token)
+			}
+			client.sendResumeToken(restored)
+		}
+		connManager.deliverOffline(client)
+
+		// Handle client messages; the read pump releases the IP slot
+		admitted = true
+		connManager.StartPumps(client)
+
 		logger.Info("Client connected",
 			zap.String("user_id", claims.UserID),
 			zap.String("device_id", claims.DeviceID),
-			zap.String("remote_addr", r.RemoteAddr))
+			zap.String("remote_addr", ip))
 	}
 }
 
-// handleHealth handles health check requests
-func handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"healthy","timestamp":` + fmt.Sprintf("%d", time.Now().Unix()) + `}`))
+// Upgrade failure reasons for the upgrade failures counter
+const (
+	upgradeFailureBadHandshake = "bad_handshake"
+	upgradeFailureOrigin       = "origin_rejected"
+	upgradeFailureMethod       = "method_not_allowed"
+	upgradeFailureHijack       = "hijack_failed"
+	upgradeFailureWrite        = "handshake_write"
+)
+
+// upgradeError answers a rejected WebSocket handshake with the status the
+// upgrader chose and counts it by reason
+func upgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	label := upgradeFailureBadHandshake
+	switch status {
+	case http.StatusForbidden:
+		label = upgradeFailureOrigin
+		audit.Log(auditOriginRejected, "", clientIP(r), r.Header.Get("Origin"))
+	case http.StatusMethodNotAllowed:
+		label = upgradeFailureMethod
+	case http.StatusInternalServerError:
+		label = upgradeFailureHijack
+	}
+	metrics.UpgradeFailures.WithLabelValues(label).Inc()
+
+	w.Header().Set("Sec-Websocket-Version", "13")
+	http.Error(w, http.StatusText(status), status)
+}
+
+// wsTimings returns the configured WebSocket timings
+func wsTimings() Timings {
+	return Timings{
+		WriteWait:  *writeWait,
+		PongWait:   *pongWait,
+		PingPeriod: *pingPeriod,
+	}
+}
+
+// handleHealth handles health check requests, reporting load figures that
+// are cheap to snapshot
+func handleHealth(connManager *ConnectionManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		clients, rooms := connManager.Counts()
+		pool := connManager.redis.PoolStats()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":      "healthy",
+			"timestamp":   time.Now().Unix(),
+			"connections": clients,
+			"rooms":       rooms,
+			"goroutines":  runtime.NumGoroutine(),
+			"redis_pool": map[string]uint32{
+				"hits":        pool.Hits,
+				"misses":      pool.Misses,
+				"timeouts":    pool.Timeouts,
+				"total_conns": pool.TotalConns,
+				"idle_conns":  pool.IdleConns,
+				"stale_conns": pool.StaleConns,
+			},
+		})
+	}
 }
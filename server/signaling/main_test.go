@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestHealth(t *testing.T) {
+	cm := newTestManager(t)
+	srv := serveTestManager(t, cm)
+	alice := dialTest(t, srv, "alice", "phone")
+	alice.send(SignalingMessage{Type: MsgSubscribe, Room: "standup"})
+	waitFor(t, "alice to join", func() bool {
+		clients := cm.GetClientByUserID("alice")
+		return len(clients) == 1 && cm.isMember(clients[0], "standup")
+	})
+
+	resp, err := http.Get(srv.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q", ct)
+	}
+
+	var health map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]interface{}{"status": "healthy", "connections": 1.0, "rooms": 1.0} {
+		if health[key] != want {
+			t.Errorf("%s = %v, want %v", key, health[key], want)
+		}
+	}
+	for _, key := range []string{"timestamp", "goroutines"} {
+		if n, _ := health[key].(float64); n <= 0 {
+			t.Errorf("%s = %v, want a positive number", key, health[key])
+		}
+	}
+	pool, _ := health["redis_pool"].(map[string]interface{})
+	for _, key := range []string{"hits", "misses", "timeouts", "total_conns", "idle_conns", "stale_conns"} {
+		if _, ok := pool[key].(float64); !ok {
+			t.Errorf("redis_pool.%s missing", key)
+		}
+	}
+	if n, _ := pool["total_conns"].(float64); n < 1 {
+		t.Errorf("redis_pool.total_conns = %v, want the manager's connections", pool["total_conns"])
+	}
+}
+
+// testAdminToken is the admin token set by useAdminToken
+const testAdminToken = "test-admin-token"
+
+// useAdminToken enables the admin API with testAdminToken for a test
+func useAdminToken(t *testing.T) {
+	token := *adminToken
+	*adminToken = testAdminToken
+	t.Cleanup(func() { *adminToken = token })
+}
+
+// adminRequest calls the admin API of a test server with testAdminToken
+func adminRequest(t *testing.T, srv *httptest.Server, method, path, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, srv.URL+"/admin"+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestRuntimeLogLevel(t *testing.T) {
+	useAdminToken(t)
+	savedLevel, savedLogger := logLevel, logger
+	t.Cleanup(func() { logLevel, logger = savedLevel, savedLogger })
+
+	logLevel = zap.NewAtomicLevelAt(zap.InfoLevel)
+	core, logs := observer.New(logLevel)
+	logger = zap.New(core)
+	srv := serveTestManager(t, newTestManager(t))
+
+	logger.Debug("before")
+	resp := adminRequest(t, srv, "PUT", "/loglevel", `{"level":"debug"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT: status %d", resp.StatusCode)
+	}
+	logger.Debug("after")
+
+	if logs.FilterMessage("before").Len() != 0 || logs.FilterMessage("after").Len() != 1 {
+		t.Errorf("debug logs %v, want only the one after raising the level", logs.All())
+	}
+
+	var body struct {
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(adminRequest(t, srv, "GET", "/loglevel", "").Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Level != "debug" {
+		t.Errorf("GET level = %q, want debug", body.Level)
+	}
+
+	if resp := adminRequest(t, srv, "PUT", "/loglevel", `{"level":"loud"}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid level: status %d, want 400", resp.StatusCode)
+	}
+	if logLevel.Level() != zap.DebugLevel {
+		t.Errorf("invalid request changed the level to %v", logLevel.Level())
+	}
+}
+
+func TestRequireJWTSecret(t *testing.T) {
+	tests := []struct {
+		name          string
+		secret        string
+		allowInsecure bool
+		wantErr       error
+		wantWarning   bool
+	}{
+		{"configured", testSecret, false, nil, false},
+		{"missing", "", false, errNoJWTSecret, false},
+		{"missing, insecure allowed", "", true, nil, true},
+	}
+	for _, tt := range tests {
+		core, logs := observer.New(zap.WarnLevel)
+		if err := requireJWTSecret(tt.secret, tt.allowInsecure, zap.New(core)); err != tt.wantErr {
+			t.Errorf("%s: requireJWTSecret = %v, want %v", tt.name, err, tt.wantErr)
+		}
+		if warned := logs.Len() > 0; warned != tt.wantWarning {
+			t.Errorf("%s: warned %v, want %v", tt.name, warned, tt.wantWarning)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// redisOfflineKey prefixes each user's queue of messages relayed while
+// they had no connection
+const redisOfflineKey = "lr:offline:"
+
+// queueOffline stores a relayed message for a user with no live
+// connection, keeping only the newest -offline-queue-size messages
+func (cm *ConnectionManager) queueOffline(ctx context.Context, userID string, data []byte) error {
+	key := cm.key(redisOfflineKey + userID)
+
+	pipe := cm.redis.TxPipeline()
+	pipe.RPush(ctx, key, data)
+	pipe.LTrim(ctx, key, int64(-*offlineQueueSize), -1)
+	pipe.Expire(ctx, key, *offlineQueueTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	metrics.OfflineQueued.Inc()
+	return nil
+}
+
+// deliverOffline hands a newly connected client the messages queued while
+// its user was offline. The queue is taken as a whole, so only the first
+// device to connect receives them; messages its send buffer can't hold are
+// put back for the next connection.
+func (cm *ConnectionManager) deliverOffline(client *Client) {
+	if !*offlineQueue {
+		return
+	}
+
+	key := cm.key(redisOfflineKey + client.UserID)
+
+	var queued *redis.StringSliceCmd
+	err := cm.withRedisOnce("offline_deliver", func(ctx context.Context) error {
+		pipe := cm.redis.TxPipeline()
+		queued = pipe.LRange(ctx, key, 0, -1)
+		pipe.Del(ctx, key)
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+	if err != nil {
+		if err != errRedisUnavailable {
+			cm.logger.Warn("Failed to load offline messages", zap.String("user_id", client.UserID), zap.Error(err))
+		}
+		return
+	}
+
+	oldest := time.Now().Add(-*offlineQueueTTL).Unix()
+	messages := queued.Val()
+	for i, data := range messages {
+		var msg SignalingMessage
+		if err := json.Unmarshal([]byte(data), &msg); err != nil || msg.Timestamp < oldest {
+			continue
+		}
+
+		if err := client.EnqueueFor(msg.Type, []byte(data)); err != nil {
+			// Keep the rest for the next connection rather than losing them
+			cm.requeueOffline(client.UserID, messages[i:])
+			return
+		}
+		if msg.ID != "" {
+			cm.sendAck(msg)
+		}
+	}
+}
+
+// requeueOffline puts messages that could not be delivered back at the
+// front of a user's offline queue, in their original order
+func (cm *ConnectionManager) requeueOffline(userID string, messages []string) {
+	key := cm.key(redisOfflineKey + userID)
+
+	// LPUSH prepends each value in turn, so push the last message first
+	values := make([]interface{}, len(messages))
+	for i, data := range messages {
+		values[len(messages)-1-i] = data
+	}
+
+	err := cm.withRedisOnce("offline_requeue", func(ctx context.Context) error {
+		pipe := cm.redis.TxPipeline()
+		pipe.LPush(ctx, key, values...)
+		pipe.LTrim(ctx, key, int64(-*offlineQueueSize), -1)
+		pipe.Expire(ctx, key, *offlineQueueTTL)
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+	if err != nil {
+		cm.logger.Warn("Failed to requeue offline messages",
+			zap.String("user_id", userID),
+			zap.Int("messages", len(messages)),
+			zap.Error(err))
+	}
+}
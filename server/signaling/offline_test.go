@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOfflineQueueDelivery(t *testing.T) {
+	enabled := *offlineQueue
+	*offlineQueue = true
+	t.Cleanup(func() { *offlineQueue = enabled })
+
+	cm := newTestManager(t)
+	srv := serveTestManager(t, cm)
+	alice := dialTest(t, srv, "alice", "phone")
+	waitFor(t, "alice to connect", func() bool { return cm.HasDevice("alice", "phone") })
+
+	alice.send(SignalingMessage{ID: "offer-1", Type: MsgOffer, To: "bob", Payload: map[string]interface{}{"sdp": "v=0"}})
+	alice.send(SignalingMessage{ID: "cand-1", Type: MsgCandidate, To: "bob", Payload: map[string]interface{}{"candidate": "c1"}})
+	waitFor(t, "both messages to be queued", func() bool {
+		return cm.redis.LLen(context.Background(), cm.key(redisOfflineKey+"bob")).Val() == 2
+	})
+
+	bob := dialTest(t, srv, "bob", "laptop")
+	if msg := bob.next(MsgOffer); msg.ID != "offer-1" || msg.From != "alice" {
+		t.Errorf("bob's first queued message %+v, want alice's offer", msg)
+	}
+	if msg := bob.next(MsgCandidate); msg.ID != "cand-1" {
+		t.Errorf("bob's second queued message %+v, want alice's candidate", msg)
+	}
+
+	// Delivery on connect is acknowledged to the sender
+	acked := map[string]bool{}
+	for len(acked) < 2 {
+		acked[alice.next(MsgAck).ID] = true
+	}
+	if !acked["offer-1"] || !acked["cand-1"] {
+		t.Errorf("acks for %v, want offer-1 and cand-1", acked)
+	}
+
+	// The queue was handed over whole
+	bob2 := dialTest(t, srv, "bob", "tablet")
+	bob2.none(MsgOffer, 100*time.Millisecond)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Long-poll transport settings
+const (
+	pollWait           = 10 * time.Second // how long GET /poll/recv waits; below the server write timeout
+	pollSessionTimeout = 60 * time.Second // idle poll sessions are removed after this
+	maxPollBatch       = 64               // messages returned by a single receive
+)
+
+// PollSessions tracks long-poll clients for networks that block WebSocket
+// upgrades. Each session is a Client without a connection whose send
+// queue is drained by GET /poll/recv instead of a write pump.
+type PollSessions struct {
+	connManager *ConnectionManager
+	sessions    map[string]*Client            // user_id:device_id -> client
+	unsent      map[*Client][]json.RawMessage // drained by a receive whose response failed
+	mu          sync.Mutex
+}
+
+// NewPollSessions creates the poll session registry and starts expiring
+// idle sessions
+func NewPollSessions(connManager *ConnectionManager) *PollSessions {
+	ps := &PollSessions{
+		connManager: connManager,
+		sessions:    make(map[string]*Client),
+		unsent:      make(map[*Client][]json.RawMessage),
+	}
+
+	go ps.expireLoop()
+
+	return ps
+}
+
+// session returns the poll client for a token's device, registering a new
+// one if there is none
+func (ps *PollSessions) session(claims *Claims) (*Client, error) {
+	key := claims.UserID + ":" + claims.DeviceID
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if client, ok := ps.sessions[key]; ok {
+		if !client.closed() {
+			client.LastSeen = time.Now()
+			return client, nil
+		}
+
+		// Replaced or disconnected; start over with a fresh session
+		delete(ps.sessions, key)
+		ps.connManager.RemoveClient(client)
+	}
+
+	client := NewClient(claims.UserID, claims.DeviceID, nil, logger, wsTimings())
+	client.Scopes = claims.EffectiveScopes()
+
+	if err := ps.connManager.AddClient(client); err != nil {
+		return nil, err
+	}
+	ps.sessions[key] = client
+	ps.connManager.deliverOffline(client)
+
+	logger.Info("Poll session started",
+		zap.String("user_id", claims.UserID),
+		zap.String("device_id", claims.DeviceID))
+
+	return client, nil
+}
+
+// touch records that a poll client is still active
+func (ps *PollSessions) touch(client *Client) {
+	ps.mu.Lock()
+	client.LastSeen = time.Now()
+	ps.mu.Unlock()
+}
+
+// remove drops a poll session and unregisters its client
+func (ps *PollSessions) remove(client *Client) {
+	ps.mu.Lock()
+	if ps.sessions[client.deviceKey()] == client {
+		delete(ps.sessions, client.deviceKey())
+	}
+	delete(ps.unsent, client)
+	ps.mu.Unlock()
+
+	ps.connManager.RemoveClient(client)
+}
+
+// takeUnsent returns and forgets the messages a failed receive left for the
+// client
+func (ps *PollSessions) takeUnsent(client *Client) []json.RawMessage {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	messages := ps.unsent[client]
+	delete(ps.unsent, client)
+	return messages
+}
+
+// keepUnsent holds messages whose response failed for the client's next
+// receive
+func (ps *PollSessions) keepUnsent(client *Client, messages []json.RawMessage) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.sessions[client.deviceKey()] == client {
+		ps.unsent[client] = messages
+	}
+}
+
+// expireLoop removes sessions that have stopped polling
+func (ps *PollSessions) expireLoop() {
+	ticker := time.NewTicker(pollSessionTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var expired []*Client
+			ps.mu.Lock()
+			for _, client := range ps.sessions {
+				if time.Since(client.LastSeen) > pollSessionTimeout || client.closed() {
+					expired = append(expired, client)
+				}
+			}
+			ps.mu.Unlock()
+
+			for _, client := range expired {
+				ps.remove(client)
+			}
+		case <-ps.connManager.ctx.Done():
+			return
+		}
+	}
+}
+
+// authenticateHTTP authenticates a plain HTTP API request and applies the
+// per-IP and per-user limits
+func authenticateHTTP(w http.ResponseWriter, r *http.Request, connManager *ConnectionManager, auth Authenticator) (*Claims, bool) {
+	// Requests count against their address like WebSocket connections do,
+	// until the handler returns
+	ip := clientIP(r)
+	if err := connManager.ipLimits.Acquire(ip); err != nil {
+		audit.Log(auditIPLimited, "", ip, err.Error())
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		metrics.RateLimitExceeded.Inc()
+		return nil, false
+	}
+	context.AfterFunc(r.Context(), func() { connManager.ipLimits.Release(ip) })
+
+	claims, err := auth.Authenticate(r)
+	if err == errMissingToken {
+		audit.Log(auditAuthFailure, "", ip, err.Error())
+		http.Error(w, "Missing token", http.StatusUnauthorized)
+		return nil, false
+	}
+	if err != nil {
+		audit.Log(auditAuthFailure, "", ip, err.Error())
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	if limiter := connManager.GetRateLimiter(claims.UserID); !limiter.Allow() {
+		audit.Log(auditRateLimited, claims.UserID, ip, r.URL.Path)
+		writeRateLimited(w, retryDelay(limiter))
+		metrics.RateLimitExceeded.Inc()
+		return nil, false
+	}
+
+	return claims, true
+}
+
+// handlePollSend accepts a signaling message from a long-poll client
+func handlePollSend(polls *PollSessions, auth Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := authenticateHTTP(w, r, polls.connManager, auth)
+		if !ok {
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+		if err != nil || !json.Valid(data) {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		client, err := polls.session(claims)
+		if err == errDeviceConnected {
+			http.Error(w, "Device already connected", http.StatusConflict)
+			return
+		}
+		if err == errServerFull {
+			http.Error(w, "Server at capacity", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to start session", http.StatusInternalServerError)
+			return
+		}
+
+		if err := client.processMessage(data, polls.connManager); err != nil {
+			client.Logger.Error("Failed to process message", zap.Error(err))
+			http.Error(w, "Failed to process message", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handlePollRecv returns queued messages for a long-poll client, waiting up
+// to pollWait for the first one
+func handlePollRecv(polls *PollSessions, auth Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := authenticateHTTP(w, r, polls.connManager, auth)
+		if !ok {
+			return
+		}
+
+		client, err := polls.session(claims)
+		if err == errDeviceConnected {
+			http.Error(w, "Device already connected", http.StatusConflict)
+			return
+		}
+		if err == errServerFull {
+			http.Error(w, "Server at capacity", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to start session", http.StatusInternalServerError)
+			return
+		}
+
+		// Messages a failed response drained go out first
+		messages := polls.takeUnsent(client)
+		if len(messages) == 0 {
+			messages = make([]json.RawMessage, 0)
+			timer := time.NewTimer(pollWait)
+			defer timer.Stop()
+
+			select {
+			case msg := <-client.Priority:
+				messages = append(messages, msg)
+			case msg := <-client.Send:
+				messages = append(messages, msg)
+			case <-client.closing:
+			case <-timer.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		// Drain whatever else is already queued, call setup first
+	drainPriority:
+		for len(messages) < maxPollBatch {
+			select {
+			case msg := <-client.Priority:
+				messages = append(messages, msg)
+			default:
+				break drainPriority
+			}
+		}
+	drain:
+		for len(messages) < maxPollBatch {
+			select {
+			case msg := <-client.Send:
+				messages = append(messages, msg)
+			default:
+				break drain
+			}
+		}
+
+		// The session was replaced or dropped; the client must start a new one
+		if client.closed() {
+			polls.remove(client)
+		}
+
+		polls.touch(client)
+
+		data, err := json.Marshal(map[string]interface{}{
+			"messages": messages,
+			"closed":   client.closed(),
+		})
+		if err != nil {
+			http.Error(w, "Failed to encode messages", http.StatusInternalServerError)
+			return
+		}
+
+		// Keep the messages for the next receive unless the response
+		// reached the connection
+		w.Header().Set("Content-Type", "application/json")
+		if _, err = w.Write(data); err == nil {
+			err = http.NewResponseController(w).Flush()
+		}
+		if err != nil {
+			polls.keepUnsent(client, messages)
+			client.Logger.Debug("Failed to write poll response", zap.Error(err))
+		}
+	}
+}
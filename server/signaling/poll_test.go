@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// pollSend posts a message to a test server's long-poll endpoint and
+// returns the response status
+func pollSend(t *testing.T, srv *httptest.Server, token string, msg SignalingMessage) int {
+	t.Helper()
+	body, _ := json.Marshal(msg)
+	req, _ := http.NewRequest("POST", srv.URL+"/poll/send", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// pollRecv receives the messages queued for a long-poll session
+func pollRecv(t *testing.T, srv *httptest.Server, token string) []SignalingMessage {
+	t.Helper()
+	req, _ := http.NewRequest("GET", srv.URL+"/poll/recv", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Messages []SignalingMessage `json:"messages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("poll receive: status %d: %v", resp.StatusCode, err)
+	}
+	return body.Messages
+}
+
+// hasType reports whether messages include one of type msgType
+func hasType(messages []SignalingMessage, msgType string) bool {
+	for _, msg := range messages {
+		if msg.Type == msgType {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPollOfferAnswer(t *testing.T) {
+	srv := serveTestManager(t, newTestManager(t))
+	alice, bob := testToken(t, "alice", "phone"), testToken(t, "bob", "laptop")
+
+	// Sending starts a session
+	for _, token := range []string{alice, bob} {
+		if status := pollSend(t, srv, token, SignalingMessage{Type: MsgPing}); status != http.StatusNoContent {
+			t.Fatalf("ping: status %d", status)
+		}
+		if !hasType(pollRecv(t, srv, token), MsgPong) {
+			t.Fatal("no pong received")
+		}
+	}
+
+	if status := pollSend(t, srv, alice, SignalingMessage{Type: MsgOffer, To: "bob", Payload: map[string]interface{}{"sdp": "v=0"}}); status != http.StatusNoContent {
+		t.Fatalf("offer: status %d", status)
+	}
+	if !hasType(pollRecv(t, srv, bob), MsgOffer) {
+		t.Fatal("bob received no offer")
+	}
+	if status := pollSend(t, srv, bob, SignalingMessage{Type: MsgAnswer, To: "alice", Payload: map[string]interface{}{"sdp": "v=0"}}); status != http.StatusNoContent {
+		t.Fatalf("answer: status %d", status)
+	}
+	if !hasType(pollRecv(t, srv, alice), MsgAnswer) {
+		t.Fatal("alice received no answer")
+	}
+}
+
+// failingWriter is a ResponseWriter whose connection has gone away
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestPollRecvKeepsUnsentMessages(t *testing.T) {
+	cm := newTestManager(t)
+	auth := &JWTAuthenticator{Secret: testSecret}
+	polls := NewPollSessions(cm)
+	recv := handlePollRecv(polls, auth)
+	token := testToken(t, "alice", "phone")
+
+	client, err := polls.session(&Claims{UserID: "alice", DeviceID: "phone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Enqueue([]byte(`{"type":"announcement","payload":"kept"}`))
+
+	request := func() *http.Request {
+		r := httptest.NewRequest("GET", "/poll/recv", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+	recv(failingWriter{httptest.NewRecorder()}, request())
+
+	w := httptest.NewRecorder()
+	recv(w, request())
+	var body struct {
+		Messages []SignalingMessage `json:"messages"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Messages) != 1 || body.Messages[0].Payload != "kept" {
+		t.Errorf("after a failed response received %+v, want the kept message", body.Messages)
+	}
+}
+
+func TestAuthenticateHTTPIPLimit(t *testing.T) {
+	rate, burst := *ipHandshakeRate, *ipHandshakeBurst
+	*ipHandshakeRate, *ipHandshakeBurst = 0.001, 2
+	t.Cleanup(func() { *ipHandshakeRate, *ipHandshakeBurst = rate, burst })
+
+	srv := serveTestManager(t, newTestManager(t))
+	token := testToken(t, "alice", "phone")
+	want := []int{http.StatusNoContent, http.StatusNoContent, http.StatusTooManyRequests}
+	for i, status := range want {
+		if got := pollSend(t, srv, token, SignalingMessage{Type: MsgPing}); got != status {
+			t.Errorf("request %d: status %d, want %d", i+1, got, status)
+		}
+	}
+}
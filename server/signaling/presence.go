@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// presenceActivityInterval limits how often client activity rewrites the
+// user's last-active time
+const presenceActivityInterval = time.Minute
+
+// maxStatusMsgLength caps custom status messages, in bytes
+const maxStatusMsgLength = 256
+
+// maxPresenceQueryIDs caps the users in one batch presence query
+const maxPresenceQueryIDs = 500
+
+// errInvalidPresence is returned for an unknown state or oversized status
+var errInvalidPresence = errors.New("invalid presence")
+
+// errInvalidPresenceSubscribe is returned for a presence subscription that
+// can't be decoded or names more than maxPresenceQueryIDs users
+var errInvalidPresenceSubscribe = errors.New("invalid presence subscription")
+
+// setPresence applies a presence message from a client
+func (cm *ConnectionManager) setPresence(c *Client, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return errInvalidPresence
+	}
+
+	var req Presence
+	if err := json.Unmarshal(data, &req); err != nil {
+		return errInvalidPresence
+	}
+
+	switch req.Presence {
+	case PresenceOnline, PresenceAway, PresenceOffline:
+	default:
+		return errInvalidPresence
+	}
+	if len(req.StatusMsg) > maxStatusMsgLength {
+		return errInvalidPresence
+	}
+
+	c.presenceMu.Lock()
+	c.Presence = req.Presence
+	c.StatusMsg = req.StatusMsg
+	c.lastActive = time.Now()
+	record := c.presenceRecordLocked()
+	c.presenceMu.Unlock()
+
+	cm.UpdatePresence(c.UserID, record)
+	return nil
+}
+
+// recordActivity refreshes the user's last-active time, at most once per
+// presenceActivityInterval
+func (cm *ConnectionManager) recordActivity(c *Client) {
+	if c.Guest {
+		return
+	}
+
+	c.presenceMu.Lock()
+	if time.Since(c.lastActive) < presenceActivityInterval {
+		c.presenceMu.Unlock()
+		return
+	}
+	c.lastActive = time.Now()
+	record := c.presenceRecordLocked()
+	c.presenceMu.Unlock()
+
+	cm.UpdatePresence(c.UserID, record)
+}
+
+// presenceRecord builds the presence record for a client's current state
+func (c *Client) presenceRecord() Presence {
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+	return c.presenceRecordLocked()
+}
+
+// presenceRecordLocked builds the presence record for a client's current
+// state. The caller must hold presenceMu.
+func (c *Client) presenceRecordLocked() Presence {
+	return Presence{
+		Presence:        c.Presence,
+		StatusMsg:       c.StatusMsg,
+		LastActiveTS:    c.lastActive.UnixMilli(),
+		CurrentlyActive: c.Presence == PresenceOnline,
+	}
+}
+
+// schedulePresencePublish coalesces presence changes for a user within the
+// debounce window so only the latest state is published
+func (cm *ConnectionManager) schedulePresencePublish(userID string, presence Presence) {
+	window := *presenceDebounce
+	if window <= 0 {
+		cm.publishPresence(userID, presence)
+		return
+	}
+
+	cm.presenceMu.Lock()
+	defer cm.presenceMu.Unlock()
+
+	// The latest state always replaces any pending one
+	cm.pendingPresence[userID] = presence
+	if _, ok := cm.presenceTimers[userID]; ok {
+		return
+	}
+
+	cm.presenceTimers[userID] = time.AfterFunc(window, func() {
+		cm.flushPresence(userID)
+	})
+}
+
+// flushPresence publishes the pending presence state for a user
+func (cm *ConnectionManager) flushPresence(userID string) {
+	cm.presenceMu.Lock()
+	presence, ok := cm.pendingPresence[userID]
+	delete(cm.pendingPresence, userID)
+	delete(cm.presenceTimers, userID)
+	cm.presenceMu.Unlock()
+
+	if ok {
+		cm.publishPresence(userID, presence)
+	}
+}
+
+// flushAllPresence publishes every pending presence state now, stopping
+// their debounce timers
+func (cm *ConnectionManager) flushAllPresence() {
+	cm.presenceMu.Lock()
+	pending := cm.pendingPresence
+	for _, timer := range cm.presenceTimers {
+		timer.Stop()
+	}
+	cm.pendingPresence = make(map[string]Presence)
+	cm.presenceTimers = make(map[string]*time.Timer)
+	cm.presenceMu.Unlock()
+
+	for userID, presence := range pending {
+		cm.publishPresence(userID, presence)
+	}
+}
+
+// watchPresence replaces the users whose presence updates c receives with
+// those in a presence_subscribe payload, then sends c each one's current
+// presence. Like queries, users hiding their presence from c's user appear
+// offline, and their updates aren't delivered.
+func (cm *ConnectionManager) watchPresence(c *Client, payload interface{}) error {
+	var req PresenceSubscribePayload
+	if err := decodePayload(payload, &req); err != nil || len(req.UserIDs) > maxPresenceQueryIDs {
+		return errInvalidPresenceSubscribe
+	}
+	userIDs := make([]string, 0, len(req.UserIDs))
+	seen := make(map[string]bool, len(req.UserIDs))
+	for _, userID := range req.UserIDs {
+		if userID != "" && !seen[userID] {
+			seen[userID] = true
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	cm.watchersMu.Lock()
+	cm.unwatchPresenceLocked(c)
+	for _, userID := range userIDs {
+		watchers, ok := cm.presenceWatchers[userID]
+		if !ok {
+			watchers = make(map[string]*Client)
+			cm.presenceWatchers[userID] = watchers
+		}
+		watchers[c.ID] = c
+	}
+	c.presenceWatches = userIDs
+	cm.watchersMu.Unlock()
+
+	if len(userIDs) == 0 {
+		return nil
+	}
+	presences, err := cm.GetPresences(c.UserID, userIDs)
+	if err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		data, err := cm.marshalMessage(SignalingMessage{
+			Type:      MsgPresence,
+			From:      userID,
+			Payload:   presences[userID],
+			Timestamp: time.Now().Unix(),
+		})
+		if err != nil {
+			return err
+		}
+		c.EnqueueFor(MsgPresence, data)
+	}
+	return nil
+}
+
+// unwatchPresence stops the presence updates a client receives
+func (cm *ConnectionManager) unwatchPresence(c *Client) {
+	cm.watchersMu.Lock()
+	defer cm.watchersMu.Unlock()
+	cm.unwatchPresenceLocked(c)
+}
+
+// unwatchPresenceLocked stops the presence updates a client receives. The
+// caller must hold watchersMu.
+func (cm *ConnectionManager) unwatchPresenceLocked(c *Client) {
+	for _, userID := range c.presenceWatches {
+		delete(cm.presenceWatchers[userID], c.ID)
+		if len(cm.presenceWatchers[userID]) == 0 {
+			delete(cm.presenceWatchers, userID)
+		}
+	}
+	c.presenceWatches = nil
+}
+
+// deliverPresence delivers a published presence update to the local clients
+// watching its user whose users may see it
+func (cm *ConnectionManager) deliverPresence(msg SignalingMessage) {
+	cm.watchersMu.RLock()
+	watchers := make([]*Client, 0, len(cm.presenceWatchers[msg.From]))
+	for _, client := range cm.presenceWatchers[msg.From] {
+		watchers = append(watchers, client)
+	}
+	cm.watchersMu.RUnlock()
+	if len(watchers) == 0 {
+		return
+	}
+
+	data, err := cm.marshalMessage(msg)
+	if err != nil {
+		return
+	}
+
+	// Check each watching user once, however many devices they have here
+	allowed := make(map[string]bool)
+	for _, client := range watchers {
+		visible, checked := allowed[client.UserID]
+		if !checked {
+			result, err := cm.visibleTo(client.UserID, []string{msg.From})
+			if err != nil {
+				cm.logger.Debug("Failed to check presence visibility", zap.String("user_id", msg.From), zap.Error(err))
+			}
+			visible = result[msg.From]
+			allowed[client.UserID] = visible
+		}
+		if visible {
+			client.EnqueueFor(MsgPresence, data)
+		}
+	}
+}
+
+// presenceExpiryChannel carries Redis expiry notifications for every database
+const presenceExpiryChannel = "__keyevent@*__:expired"
+
+// presenceExpiredKey claims the offline publish for an expired presence
+// record, so only one instance publishes it
+const presenceExpiredKey = "lr:presence-expired:"
+
+// presenceExpirySubscriber publishes an offline update when a user's presence
+// record expires, so a crashed client doesn't appear online for the rest of
+// the record's TTL. Needs keyspace notifications for expired keys; without
+// them, expired records still read as offline but nothing is published.
+func (cm *ConnectionManager) presenceExpirySubscriber() {
+	cm.checkKeyspaceNotifications()
+
+	pubsub := cm.redis.PSubscribe(cm.ctx, presenceExpiryChannel)
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-cm.ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !strings.HasPrefix(msg.Payload, cm.key(redisPresenceKey)) {
+				continue
+			}
+			cm.presenceExpired(strings.TrimPrefix(msg.Payload, cm.key(redisPresenceKey)))
+		}
+	}
+}
+
+// presenceExpired handles the expiry of a user's presence record
+func (cm *ConnectionManager) presenceExpired(userID string) {
+	// A user still connected here just went quiet; restore their record
+	if clients := cm.GetClientByUserID(userID); len(clients) > 0 {
+		cm.UpdatePresence(userID, clients[0].presenceRecord())
+		return
+	}
+
+	// Every instance is notified; the first to claim the expiry publishes
+	var claimed bool
+	err := cm.withRedisRetry("presence_expiry", func(ctx context.Context) error {
+		var err error
+		claimed, err = cm.redis.SetNX(ctx, cm.key(presenceExpiredKey+userID), cm.serverID, time.Minute).Result()
+		return err
+	})
+	if err != nil || !claimed {
+		return
+	}
+
+	cm.publishPresence(userID, Presence{Presence: PresenceOffline})
+}
+
+// checkKeyspaceNotifications warns when Redis isn't configured to publish
+// expiry events. Servers that don't allow CONFIG GET are assumed to be.
+func (cm *ConnectionManager) checkKeyspaceNotifications() {
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	config, err := cm.redis.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		cm.logger.Debug("Cannot read notify-keyspace-events", zap.Error(err))
+		return
+	}
+
+	if !keyspaceExpiryEnabled(config["notify-keyspace-events"]) {
+		cm.logger.Warn("Redis notify-keyspace-events does not include Ex; " +
+			"clients won't be told when presence records expire")
+	}
+}
+
+// keyspaceExpiryEnabled reports whether notify-keyspace-events flags publish
+// keyevent notifications for expired keys
+func keyspaceExpiryEnabled(flags string) bool {
+	return strings.Contains(flags, "E") && strings.ContainsAny(flags, "xA")
+}
+
+// handlePresenceQuery returns the presence of a batch of users
+func handlePresenceQuery(connManager *ConnectionManager, auth Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := authenticateHTTP(w, r, connManager, auth)
+		if !ok {
+			return
+		}
+		if !claims.HasScope(ScopePresence) {
+			http.Error(w, "Token lacks scope "+ScopePresence, http.StatusForbidden)
+			return
+		}
+
+		var req struct {
+			UserIDs []string `json:"user_ids"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if len(req.UserIDs) == 0 {
+			http.Error(w, "Missing user_ids", http.StatusBadRequest)
+			return
+		}
+		if len(req.UserIDs) > maxPresenceQueryIDs {
+			http.Error(w, "Too many user_ids", http.StatusBadRequest)
+			return
+		}
+
+		presences, err := connManager.GetPresences(claims.UserID, req.UserIDs)
+		if err != nil {
+			connManager.logger.Error("Failed to query presence", zap.Error(err))
+			http.Error(w, "Failed to query presence", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"presence": presences,
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestDecodePresence(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want Presence
+	}{
+		{"version 1", `{"presence":"online","timestamp":1700000000}`,
+			Presence{Presence: PresenceOnline, LastActiveTS: 1700000000000, CurrentlyActive: true}},
+		{"version 1 away", `{"presence":"away","timestamp":1700000000}`,
+			Presence{Presence: PresenceAway, LastActiveTS: 1700000000000}},
+		{"version 2", `{"v":2,"presence":"away","status_msg":"lunch","last_active_ts":1700000000123,"currently_active":false}`,
+			Presence{Presence: PresenceAway, StatusMsg: "lunch", LastActiveTS: 1700000000123}},
+		{"no presence", `{"v":2}`, Presence{Presence: PresenceOffline}},
+		{"invalid", `not json`, Presence{Presence: PresenceOffline}},
+	}
+	for _, tt := range tests {
+		if got := decodePresence(tt.data); got != tt.want {
+			t.Errorf("%s: decodePresence = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetPresenceInvalid(t *testing.T) {
+	cm := &ConnectionManager{}
+	client := NewClient("alice", "phone", nil, zap.NewNop(), wsTimings())
+
+	tests := map[string]interface{}{
+		"unknown state":    map[string]interface{}{"presence": "busy"},
+		"missing state":    map[string]interface{}{"status_msg": "hi"},
+		"wrong type":       "online",
+		"long status":      map[string]interface{}{"presence": "online", "status_msg": strings.Repeat("x", maxStatusMsgLength+1)},
+		"unmarshalable":    map[string]interface{}{"presence": func() {}},
+		"state not string": map[string]interface{}{"presence": 1},
+	}
+	for name, payload := range tests {
+		if err := cm.setPresence(client, payload); err != errInvalidPresence {
+			t.Errorf("%s: setPresence = %v, want errInvalidPresence", name, err)
+		}
+	}
+	if client.Presence != PresenceOnline {
+		t.Errorf("presence changed to %q by invalid updates", client.Presence)
+	}
+}
+
+func TestKeyspaceExpiryEnabled(t *testing.T) {
+	tests := map[string]bool{
+		"Ex":   true,
+		"xE":   true,
+		"AE":   true,
+		"KEA":  true,
+		"Egx$": true,
+		"":     false,
+		"x":    false,
+		"E":    false,
+		"Kx":   false,
+		"KA":   false,
+		"Eg":   false,
+	}
+	for flags, want := range tests {
+		if got := keyspaceExpiryEnabled(flags); got != want {
+			t.Errorf("keyspaceExpiryEnabled(%q) = %v, want %v", flags, got, want)
+		}
+	}
+}
+
+func TestPresenceDebounce(t *testing.T) {
+	debounce := *presenceDebounce
+	*presenceDebounce = 50 * time.Millisecond
+	t.Cleanup(func() { *presenceDebounce = debounce })
+
+	cm := newTestManager(t)
+	pubsub := cm.redis.Subscribe(context.Background(), cm.key(redisPubSubChannel))
+	t.Cleanup(func() { pubsub.Close() })
+	if _, err := pubsub.Receive(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	published := pubsub.Channel()
+
+	cm.UpdatePresence("alice", Presence{Presence: PresenceOnline})
+	cm.UpdatePresence("alice", Presence{Presence: PresenceAway})
+	cm.UpdatePresence("alice", Presence{Presence: PresenceAway, StatusMsg: "lunch"})
+
+	select {
+	case m := <-published:
+		var msg struct {
+			Type    string   `json:"type"`
+			From    string   `json:"from"`
+			Payload Presence `json:"payload"`
+		}
+		if err := json.Unmarshal([]byte(m.Payload), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != MsgPresence || msg.From != "alice" || msg.Payload.Presence != PresenceAway || msg.Payload.StatusMsg != "lunch" {
+			t.Errorf("published %s, want alice's final state", m.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no presence published")
+	}
+
+	if n := countMessages(published, 200*time.Millisecond); n != 0 {
+		t.Errorf("%d more presence publishes, want one in total", n)
+	}
+}
+
+// queryPresence posts a batch presence query to a test server as viewer
+func queryPresence(t *testing.T, srv *httptest.Server, viewer string, userIDs []string) (int, map[string]Presence) {
+	t.Helper()
+	body, _ := json.Marshal(map[string][]string{"user_ids": userIDs})
+	req, _ := http.NewRequest("POST", srv.URL+"/presence/query", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken(t, viewer, "phone"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Presence map[string]Presence `json:"presence"`
+	}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, result.Presence
+}
+
+func TestPresenceQuery(t *testing.T) {
+	cm := newTestManager(t)
+	srv := serveTestManager(t, cm)
+	cm.UpdatePresence("alice", Presence{Presence: PresenceOnline, StatusMsg: "around"})
+	cm.UpdatePresence("bob", Presence{Presence: PresenceOffline})
+
+	status, presences := queryPresence(t, srv, "dave", []string{"alice", "bob", "carol"})
+	if status != http.StatusOK {
+		t.Fatalf("query: status %d", status)
+	}
+	want := map[string]string{"alice": PresenceOnline, "bob": PresenceOffline, "carol": PresenceOffline}
+	if len(presences) != len(want) {
+		t.Errorf("got presence for %d users, want %d", len(presences), len(want))
+	}
+	for user, state := range want {
+		if presences[user].Presence != state {
+			t.Errorf("%s is %q, want %q", user, presences[user].Presence, state)
+		}
+	}
+	if presences["alice"].StatusMsg != "around" {
+		t.Errorf("alice's status message %q", presences["alice"].StatusMsg)
+	}
+
+	tooMany := make([]string, maxPresenceQueryIDs+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("user-%d", i)
+	}
+	for name, ids := range map[string][]string{"empty": {}, "over the cap": tooMany} {
+		if status, _ := queryPresence(t, srv, "dave", ids); status != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", name, status)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Package protocol defines the signaling wire format shared by the server
+// and Go clients
+package protocol
+
+// SignalingMessage represents a WebSocket signaling message
+type SignalingMessage struct {
+	ID        string      `json:"id,omitempty"` // relays: acknowledged to the sender once delivered
+	Type      string      `json:"type"`
+	From      string      `json:"from"`
+	To        string      `json:"to"`
+	ToDevice  string      `json:"to_device,omitempty"` // relays: deliver only to this device of To
+	Room      string      `json:"room,omitempty"`
+	Payload   interface{} `json:"payload,omitempty"`
+	Timestamp int64       `json:"timestamp"`
+	Replay    bool        `json:"replay,omitempty"` // subscribe: deliver recent room history first
+	Hops      int         `json:"hops,omitempty"`   // relays remaining before the message is dropped
+}
+
+// WebSocket subprotocols selecting the wire format. Without one, messages
+// are JSON.
+const (
+	SubprotocolJSON    = "liberty-reach.v1+json"
+	SubprotocolMsgPack = "liberty-reach.v1+msgpack"
+)
+
+// SubprotocolAccessToken marks a JWT passed as the next subprotocol, for
+// browsers, which can't set an Authorization header on WebSocket requests:
+// new WebSocket(url, ["access_token", jwt])
+const SubprotocolAccessToken = "access_token"
+
+// Message types
+const (
+	MsgOffer         = "offer"
+	MsgAnswer        = "answer"
+	MsgCandidate     = "candidate"
+	MsgPing          = "ping"
+	MsgPong          = "pong"
+	MsgSubscribe     = "subscribe"
+	MsgUnsubscribe   = "unsubscribe"
+	MsgPresence      = "presence"
+	MsgKnock         = "knock"
+	MsgError         = "error"
+	MsgReplaced      = "replaced"
+	MsgAck           = "ack"
+	MsgWhoami        = "whoami"
+	MsgTyping        = "typing"
+	MsgReceipt       = "receipt"
+	MsgResume        = "resume"
+	MsgReauth        = "reauth"
+	MsgTokenExpiring = "token_expiring"
+	MsgRoomJoin      = "room_join"
+	MsgRoomLeave     = "room_leave"
+	MsgAnnouncement  = "announcement"
+
+	MsgPresenceSubscribe = "presence_subscribe"
+)
+
+// Presence states
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// Presence is a user's presence record, returned by presence queries and
+// carried by presence messages. Clients set Presence and StatusMsg; the
+// server fills in the rest.
+type Presence struct {
+	Presence        string `json:"presence"`
+	StatusMsg       string `json:"status_msg,omitempty"`
+	LastActiveTS    int64  `json:"last_active_ts,omitempty"` // unix milliseconds
+	CurrentlyActive bool   `json:"currently_active"`
+}
+
+// SessionDescription is the payload of offers and answers. Offers and
+// answers within one call carry the same SessionID; an offer renegotiating
+// an established session sets ICERestart to gather fresh candidates.
+type SessionDescription struct {
+	Type       string `json:"type"` // "offer" or "answer"
+	SDP        string `json:"sdp"`
+	SessionID  string `json:"session_id,omitempty"`
+	ICERestart bool   `json:"ice_restart,omitempty"`
+}
+
+// TypingPayload is the payload of typing messages. Typing indicators expire
+// a few seconds after the last message setting them.
+type TypingPayload struct {
+	Typing bool `json:"typing"`
+}
+
+// ReceiptPayload is the payload of read receipts
+type ReceiptPayload struct {
+	MessageID string `json:"message_id"`
+}
+
+// PresenceSubscribePayload is the payload of presence_subscribe messages.
+// UserIDs replaces the users whose presence updates the connection receives;
+// an empty list stops them.
+type PresenceSubscribePayload struct {
+	UserIDs []string `json:"user_ids"`
+}
+
+// RoomMemberPayload is the payload of room_join and room_leave messages,
+// telling a room's members who joined or left it. Occupancy counts the
+// room's members after the change.
+type RoomMemberPayload struct {
+	UserID    string `json:"user_id"`
+	DeviceID  string `json:"device_id,omitempty"`
+	Occupancy int    `json:"occupancy"`
+}
+
+// ResumePayload is sent when a client connects. Reconnecting to /ws with
+// the resume_token query parameter within ExpiresIn seconds of a drop
+// restores the client's rooms; Restored lists the rooms restored this way.
+type ResumePayload struct {
+	ResumeToken string   `json:"resume_token"`
+	ExpiresIn   int64    `json:"expires_in"` // seconds
+	Restored    []string `json:"restored,omitempty"`
+}
+
+// TokenExpiringPayload warns that the connection's token expires in InMS
+// milliseconds, after which the server closes it with CloseTokenExpired
+type TokenExpiringPayload struct {
+	InMS int64 `json:"in_ms"`
+}
+
+// ReauthPayload carries a fresh token for the connection's user and device.
+// The server's reply echoes the type with the new token's expiry.
+type ReauthPayload struct {
+	Token     string `json:"token,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"` // unix seconds, in the reply
+}
+
+// SessionInfo is the payload of the reply to a whoami request
+type SessionInfo struct {
+	UserID         string   `json:"user_id"`
+	DeviceID       string   `json:"device_id"`
+	ClientID       string   `json:"client_id"`
+	ServerID       string   `json:"server_id"`
+	Subscriptions  []string `json:"subscriptions"`
+	ConnectedSince int64    `json:"connected_since"` // unix seconds
+}
+
+// Error frame codes
+const (
+	ErrCodeForbidden      = "forbidden"
+	ErrCodeKnockRequired  = "knock_required"
+	ErrCodeInvalidPayload = "invalid_payload"
+	ErrCodeRoomLimit      = "room_limit"
+	ErrCodeRoomThrottled  = "room_throttled"
+	ErrCodeRateLimited    = "rate_limited"
+	ErrCodeUnknownType    = "unknown_message_type"
+)
+
+// WebSocket close codes sent when the server ends a connection. They are in
+// the 4000-4999 range reserved for applications; the close reason repeats
+// the cause in words.
+const (
+	CloseServerShutdown  = 4000 // server is draining; reconnect, possibly to another instance
+	CloseReplaced        = 4001 // a newer connection for the same device took over
+	CloseSlowConsumer    = 4002 // the client fell too far behind reading messages
+	CloseTokenExpired    = 4003 // the JWT expired; reconnect with a fresh token
+	CloseDeviceConnected = 4004 // the device is already connected and -duplicate-device-policy is reject
+	CloseServerFull      = 4005 // the server reached -max-connections; retry later
+	CloseIdle            = 4006 // the client sent no messages within -idle-timeout
+)
+
+// ErrorPayload is the payload of an error frame sent to a client
+type ErrorPayload struct {
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	RetryAfterMS int64  `json:"retry_after_ms,omitempty"` // with rate_limited, when to send again
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// Per-user message rate limit
+const (
+	userRateLimit = 100 // messages per second
+	userRateBurst = 100
+)
+
+// Rate limit backends
+const (
+	rateLimitBackendLocal = "local" // per-instance limiters
+	rateLimitBackendRedis = "redis" // one bucket per user shared by all instances
+)
+
+// redisRateLimitKey prefixes the shared token bucket of each user
+const redisRateLimitKey = "lr:ratelimit:"
+
+// rateLimitKey returns the key a session's rate limit is kept under. Guests
+// get a fresh user ID on every connection, so they are limited by IP
+// instead; keying them by user ID would leave a limiter behind per
+// reconnect.
+func rateLimitKey(userID, ip string, guest bool) string {
+	if guest {
+		return "guest:" + ip
+	}
+	return userID
+}
+
+// RateLimiter decides whether a user may send another message
+type RateLimiter interface {
+	Allow() bool
+}
+
+// tokenBucketScript atomically refills and takes a token from a bucket
+// stored as a hash of {tokens, ts}. Redis' own clock is used so instances
+// with skewed clocks agree.
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return allowed
+`)
+
+// redisRateLimiter limits a user with a token bucket in Redis, falling back
+// to the local limiter while Redis is unavailable
+type redisRateLimiter struct {
+	cm       *ConnectionManager
+	userID   string
+	fallback *rate.Limiter
+}
+
+// Allow takes a token from the user's shared bucket. A single attempt is
+// made so Redis trouble can't slow every message down.
+func (l *redisRateLimiter) Allow() bool {
+	if !l.cm.breaker.Allow() {
+		return l.fallback.Allow()
+	}
+
+	ctx, cancel := l.cm.redisContext()
+	defer cancel()
+
+	allowed, err := tokenBucketScript.Run(ctx, l.cm.redis, []string{l.cm.key(redisRateLimitKey + l.userID)},
+		userRateLimit, userRateBurst).Int()
+	if err != nil {
+		metrics.RedisErrors.WithLabelValues("rate_limit").Inc()
+		l.cm.breaker.Failure()
+		return l.fallback.Allow()
+	}
+
+	l.cm.breaker.Success()
+	return allowed == 1
+}
+
+// retryDelay estimates how long until a limiter allows another message.
+// The shared Redis bucket is empty when it refuses, so the estimate there is
+// the time to refill one token.
+func retryDelay(limiter RateLimiter) time.Duration {
+	switch l := limiter.(type) {
+	case *rate.Limiter:
+		r := l.Reserve()
+		defer r.Cancel()
+		if !r.OK() {
+			return time.Second
+		}
+		return r.Delay()
+	}
+	return time.Second / userRateLimit
+}
+
+// writeRateLimited answers a rate limited HTTP request with a 429 telling
+// the client when to retry, in a Retry-After header (whole seconds) and a
+// JSON body (milliseconds)
+func writeRateLimited(w http.ResponseWriter, delay time.Duration) {
+	seconds := int64((delay + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":          "rate limit exceeded",
+		"retry_after_ms": delay.Milliseconds(),
+	})
+}
+
+// newLocalRateLimiter creates an in-memory limiter for one user
+func newLocalRateLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Every(time.Second/userRateLimit), userRateBurst)
+}
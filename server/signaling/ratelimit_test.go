@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRateLimitKey(t *testing.T) {
+	tests := []struct {
+		userID, ip string
+		guest      bool
+		want       string
+	}{
+		{"alice", "192.0.2.1", false, "alice"},
+		{"alice", "192.0.2.2", false, "alice"},
+		{"guest-1", "192.0.2.1", true, "guest:192.0.2.1"},
+		{"guest-2", "192.0.2.1", true, "guest:192.0.2.1"},
+	}
+	for _, tt := range tests {
+		if got := rateLimitKey(tt.userID, tt.ip, tt.guest); got != tt.want {
+			t.Errorf("rateLimitKey(%q, %q, %v) = %q, want %q", tt.userID, tt.ip, tt.guest, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	limiter := newLocalRateLimiter()
+	if d := retryDelay(limiter); d != 0 {
+		t.Errorf("retryDelay with tokens left = %v, want 0", d)
+	}
+	for limiter.Allow() {
+	}
+	if d := retryDelay(limiter); d <= 0 || d > time.Second/userRateLimit {
+		t.Errorf("retryDelay on an empty bucket = %v, want up to %v", d, time.Second/userRateLimit)
+	}
+	if d := retryDelay(&redisRateLimiter{}); d != time.Second/userRateLimit {
+		t.Errorf("retryDelay for the shared limiter = %v, want %v", d, time.Second/userRateLimit)
+	}
+}
+
+func TestWriteRateLimited(t *testing.T) {
+	tests := []struct {
+		delay      time.Duration
+		wantHeader string
+	}{
+		{0, "1"},
+		{10 * time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		writeRateLimited(rec, tt.delay)
+
+		if rec.Code != http.StatusTooManyRequests {
+			t.Errorf("%v: status = %d, want 429", tt.delay, rec.Code)
+		}
+		if got := rec.Header().Get("Retry-After"); got != tt.wantHeader {
+			t.Errorf("%v: Retry-After = %q, want %q", tt.delay, got, tt.wantHeader)
+		}
+		var body struct {
+			RetryAfterMS int64 `json:"retry_after_ms"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.RetryAfterMS != tt.delay.Milliseconds() {
+			t.Errorf("%v: retry_after_ms = %d (%v), want %d", tt.delay, body.RetryAfterMS, err, tt.delay.Milliseconds())
+		}
+	}
+}
+
+func TestRedisRateLimitShared(t *testing.T) {
+	backend := *rateLimitBackend
+	*rateLimitBackend = rateLimitBackendRedis
+	t.Cleanup(func() { *rateLimitBackend = backend })
+
+	client := newTestRedis(t)
+	namespace := "test-" + uuid.New().String()
+	a, b := newTestManagerOn(t, client, namespace), newTestManagerOn(t, client, namespace)
+	limiters := []RateLimiter{a.GetRateLimiter("alice"), b.GetRateLimiter("alice")}
+
+	// Separate buckets would let both instances spend a full burst
+	allowed := 0
+	for i := 0; i < 2*userRateBurst; i++ {
+		if limiters[i%2].Allow() {
+			allowed++
+		}
+	}
+	if allowed < userRateBurst || allowed > userRateBurst+userRateBurst/10 {
+		t.Errorf("instances allowed %d messages between them, want about %d", allowed, userRateBurst)
+	}
+
+	// Other users have buckets of their own
+	if !a.GetRateLimiter("bob").Allow() {
+		t.Error("bob limited by alice's traffic")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Room reconciliation fix kinds, used as metric labels
+const (
+	reconcileDeadMember    = "dead_member"
+	reconcileMissingMember = "missing_member"
+	reconcileEmptyRoom     = "empty_room"
+	reconcileResubscribed  = "resubscribed"
+	reconcileUnindexed     = "unindexed_member"
+)
+
+// roomMembership is one client's membership of a room
+type roomMembership struct {
+	room   string
+	client *Client
+}
+
+// roomSubscription is a room's Redis subscription as reconciliation found it
+type roomSubscription struct {
+	room   string
+	pubsub *redis.PubSub
+}
+
+// roomReconciler periodically repairs drift between the rooms map, the
+// clients' own subscription lists and the rooms' state in Redis
+func (cm *ConnectionManager) roomReconciler() {
+	if *roomReconcileInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(*roomReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if fixes := cm.reconcileRooms(); len(fixes) > 0 {
+				fields := make([]zap.Field, 0, len(fixes))
+				for kind, n := range fixes {
+					fields = append(fields, zap.Int(kind, n))
+				}
+				cm.logger.Warn("Repaired room membership drift", fields...)
+			}
+		case <-cm.ctx.Done():
+			return
+		}
+	}
+}
+
+// reconcileRooms makes room membership consistent and returns the number of
+// fixes of each kind:
+//   - members that are no longer connected are dropped, and from the
+//     user's room index in Redis
+//   - clients missing from rooms they list as subscribed are re-added
+//   - rooms left without members are removed
+//   - rooms whose Redis subscription has stopped delivering, or whose
+//     channel has no subscribers in Redis, are resubscribed
+//   - members missing from their user's room index in Redis are re-indexed
+//
+// Local state is repaired under the rooms lock; Redis is only checked and
+// resubscribed once it's released.
+func (cm *ConnectionManager) reconcileRooms() map[string]int {
+	fixes := make(map[string]int)
+
+	cm.clientsMu.RLock()
+	live := make(map[string]*Client, len(cm.clients))
+	for id, client := range cm.clients {
+		live[id] = client
+	}
+	cm.clientsMu.RUnlock()
+
+	var (
+		dead       []roomMembership
+		ended      []roomSubscription
+		subscribed []roomSubscription
+		indexed    = make(map[string][]string) // user_id -> rooms with members here
+	)
+
+	cm.roomsMu.Lock()
+	for room, r := range cm.rooms {
+		for id, client := range r.members {
+			if live[id] != client {
+				r.removeMember(client)
+				dead = append(dead, roomMembership{room, client})
+				fixes[reconcileDeadMember]++
+			}
+		}
+	}
+
+	for _, client := range live {
+		for _, room := range client.Subscriptions {
+			r, ok := cm.rooms[room]
+			if !ok {
+				r = newRoom(RoomInfo{ID: room})
+				cm.rooms[room] = r
+			}
+			if r.addMember(client) {
+				fixes[reconcileMissingMember]++
+			}
+		}
+	}
+
+	for room, r := range cm.rooms {
+		if r.Empty() {
+			cm.removeRoom(room)
+			fixes[reconcileEmptyRoom]++
+			continue
+		}
+		if r.pubsub == nil || r.subscriptionEnded() {
+			ended = append(ended, roomSubscription{room, r.pubsub})
+		} else {
+			subscribed = append(subscribed, roomSubscription{room, r.pubsub})
+		}
+		seen := make(map[string]bool, len(r.members))
+		for _, client := range r.members {
+			if !client.Guest && !seen[client.UserID] {
+				seen[client.UserID] = true
+				indexed[client.UserID] = append(indexed[client.UserID], room)
+			}
+		}
+	}
+	metrics.Rooms.Set(float64(len(cm.rooms)))
+	cm.roomsMu.Unlock()
+
+	for _, m := range dead {
+		cm.unindexUserRoom(m.client, m.room)
+	}
+
+	// A channel with no subscribers at all can't include ours
+	if len(subscribed) > 0 {
+		channels := make([]string, len(subscribed))
+		for i, sub := range subscribed {
+			channels[i] = cm.roomChannel(sub.room)
+		}
+		var counts map[string]int64
+		err := cm.withRedisRetry("reconcile_subscriptions", func(ctx context.Context) error {
+			var err error
+			counts, err = cm.redis.PubSubNumSub(ctx, channels...).Result()
+			return err
+		})
+		if err == nil {
+			for i, sub := range subscribed {
+				if counts[channels[i]] == 0 {
+					ended = append(ended, sub)
+				}
+			}
+		}
+	}
+
+	for _, sub := range ended {
+		if cm.resubscribeRoom(sub) {
+			fixes[reconcileResubscribed]++
+		}
+	}
+
+	if len(indexed) > 0 {
+		var added []*redis.IntCmd
+		err := cm.withRedisRetry("reconcile_user_rooms", func(ctx context.Context) error {
+			added = added[:0]
+			_, err := cm.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for userID, rooms := range indexed {
+					members := make([]interface{}, len(rooms))
+					for i, room := range rooms {
+						members[i] = room
+					}
+					added = append(added, pipe.SAdd(ctx, cm.key(redisUserRoomsKey+userID), members...))
+				}
+				return nil
+			})
+			return err
+		})
+		if err == nil {
+			for _, cmd := range added {
+				if n := cmd.Val(); n > 0 {
+					fixes[reconcileUnindexed] += int(n)
+				}
+			}
+		}
+	}
+
+	for kind, n := range fixes {
+		metrics.RoomReconcileFixes.WithLabelValues(kind).Add(float64(n))
+	}
+	return fixes
+}
+
+// resubscribeRoom replaces a room's Redis subscription found to be broken,
+// reporting whether it did. The room is left alone if it was removed or
+// resubscribed in the meantime.
+func (cm *ConnectionManager) resubscribeRoom(sub roomSubscription) bool {
+	pubsub, done := cm.redisSubscribe(sub.room)
+
+	cm.roomsMu.Lock()
+	r, ok := cm.rooms[sub.room]
+	replaced := ok && r.pubsub == sub.pubsub
+	if replaced {
+		r.pubsub, r.pubsubDone = pubsub, done
+		if sub.pubsub == nil {
+			metrics.RedisSubscriptions.Inc()
+		}
+	}
+	cm.roomsMu.Unlock()
+
+	if !replaced {
+		pubsub.Close()
+		return false
+	}
+	if sub.pubsub != nil {
+		sub.pubsub.Close()
+	}
+	return true
+}
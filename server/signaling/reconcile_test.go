@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestReconcileRoomsRepairsDrift(t *testing.T) {
+	cm := newTestManager(t)
+	ctx := context.Background()
+	alice := NewClient("alice", "phone", nil, zap.NewNop(), wsTimings())
+	carol := NewClient("carol", "laptop", nil, zap.NewNop(), wsTimings())
+	ghost := NewClient("bob", "tablet", nil, zap.NewNop(), wsTimings())
+	for _, client := range []*Client{alice, carol} {
+		if err := cm.AddClient(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, room := range []string{"one", "two"} {
+		if err := cm.Subscribe(alice, room, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cm.Subscribe(ghost, "one", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// bob's disconnect was never processed, carol's join was lost, the
+	// subscription to two was dropped in Redis and alice's room index is gone
+	carol.Subscriptions = append(carol.Subscriptions, "three")
+	cm.roomsMu.RLock()
+	err := cm.rooms["two"].pubsub.Unsubscribe(ctx, cm.roomChannel("two"))
+	cm.roomsMu.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.redis.Del(ctx, cm.key(redisUserRoomsKey+"alice"))
+
+	want := map[string]int{
+		reconcileDeadMember:    1,
+		reconcileMissingMember: 1,
+		reconcileResubscribed:  2,
+		reconcileUnindexed:     3,
+	}
+	if fixes := cm.reconcileRooms(); !reflect.DeepEqual(fixes, want) {
+		t.Errorf("first pass fixed %v, want %v", fixes, want)
+	}
+
+	if cm.isMember(ghost, "one") || !cm.isMember(carol, "three") {
+		t.Error("membership not repaired")
+	}
+	counts := cm.redis.PubSubNumSub(ctx, cm.roomChannel("two"), cm.roomChannel("three")).Val()
+	for room, n := range counts {
+		if n != 1 {
+			t.Errorf("%s has %d subscribers in Redis, want 1", room, n)
+		}
+	}
+	indexes := map[string][]string{"alice": {"one", "two"}, "bob": {}, "carol": {"three"}}
+	for userID, want := range indexes {
+		rooms := cm.redis.SMembers(ctx, cm.key(redisUserRoomsKey+userID)).Val()
+		sort.Strings(rooms)
+		if !reflect.DeepEqual(rooms, want) {
+			t.Errorf("%s indexed in %v, want %v", userID, rooms, want)
+		}
+	}
+
+	if fixes := cm.reconcileRooms(); len(fixes) != 0 {
+		t.Errorf("second pass fixed %v, want nothing", fixes)
+	}
+}
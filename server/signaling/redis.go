@@ -2,115 +2,459 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 )
 
 // Redis keys
 const (
-	redisClientKey    = "lr:client:"
-	redisRoomKey      = "lr:room:"
-	redisPresenceKey  = "lr:presence:"
+	redisClientKey     = "lr:client:"
+	redisDevicesKey    = "lr:devices:"
+	redisRoomKey       = "lr:room:"
+	redisRoomsKey      = "lr:rooms"
+	redisPresenceKey   = "lr:presence:"
 	redisPubSubChannel = "lr:signaling"
 )
 
-// newRedisClient creates a new Redis client
-func newRedisClient(addr string) (*redis.Client, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr:        addr,
-		PoolSize:    100,
-		MinIdleConns: 10,
-		ConnMaxIdleTime: time.Minute,
-	})
+// redisNamespacePrefix turns -redis-namespace into the prefix of every key
+// and channel, so environments sharing a Redis instance stay apart
+func redisNamespacePrefix(namespace string) string {
+	if namespace == "" || strings.HasSuffix(namespace, ":") {
+		return namespace
+	}
+	return namespace + ":"
+}
+
+// key prefixes a Redis key, key pattern or channel with the namespace
+func (cm *ConnectionManager) key(k string) string {
+	return cm.namespace + k
+}
+
+// relayRegionGlobal labels relays published on the global channel
+const relayRegionGlobal = "global"
+
+// maxRelayHops is the hop limit given to messages at ingress. Each relay
+// between servers spends one, so a routing loop cannot circulate a message
+// forever.
+const maxRelayHops = 8
+
+// Redis deployment modes
+const (
+	redisModeSingle   = "single"
+	redisModeSentinel = "sentinel"
+	redisModeCluster  = "cluster"
+)
+
+// Redis connection pool settings
+const (
+	redisPoolSize        = 100
+	redisMinIdleConns    = 10
+	redisConnMaxIdleTime = time.Minute
+)
+
+// redisSecurity holds the credentials, database and TLS settings applied to
+// every Redis connection
+type redisSecurity struct {
+	Password string
+	DB       int
+	TLS      *tls.Config // nil for plaintext connections
+}
+
+// redisSecurityFromFlags builds the Redis security settings from
+// -redis-password, -redis-db and the -redis-tls flags
+func redisSecurityFromFlags() (redisSecurity, error) {
+	sec := redisSecurity{Password: *redisPassword, DB: *redisDB}
+	if !*redisTLS {
+		if *redisTLSCA != "" || *redisTLSSkipVerify {
+			return sec, errors.New("-redis-tls-ca and -redis-tls-skip-verify require -redis-tls")
+		}
+		return sec, nil
+	}
+
+	sec.TLS = &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: *redisTLSSkipVerify,
+	}
+	if *redisTLSCA != "" {
+		pem, err := os.ReadFile(*redisTLSCA)
+		if err != nil {
+			return sec, fmt.Errorf("reading Redis CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return sec, fmt.Errorf("no certificates in Redis CA file %s", *redisTLSCA)
+		}
+		sec.TLS.RootCAs = pool
+	}
+	return sec, nil
+}
+
+// newRedisClient creates a new Redis client for the given deployment mode.
+// A replicas client sends read-only commands to replicas: in cluster mode
+// spread randomly over each slot's primary and replicas, in sentinel mode to
+// the master's replicas. sec applies to the data nodes; sentinels are
+// reached without credentials.
+func newRedisClient(mode, masterName string, addrs []string, replicas bool, sec redisSecurity) (redis.UniversalClient, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no Redis addresses configured")
+	}
+	if replicas && mode == redisModeSingle {
+		return nil, errors.New("reading from replicas requires sentinel or cluster mode")
+	}
+	if sec.DB != 0 && mode == redisModeCluster {
+		return nil, errors.New("cluster mode supports only database 0")
+	}
+
+	var client redis.UniversalClient
+	switch mode {
+	case redisModeSingle:
+		client = redis.NewClient(&redis.Options{
+			Addr:            addrs[0],
+			Password:        sec.Password,
+			DB:              sec.DB,
+			TLSConfig:       sec.TLS,
+			PoolSize:        redisPoolSize,
+			MinIdleConns:    redisMinIdleConns,
+			ConnMaxIdleTime: redisConnMaxIdleTime,
+		})
+	case redisModeSentinel:
+		if masterName == "" {
+			return nil, errors.New("sentinel mode requires a master name")
+		}
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:      masterName,
+			SentinelAddrs:   addrs,
+			ReplicaOnly:     replicas,
+			Password:        sec.Password,
+			DB:              sec.DB,
+			TLSConfig:       sec.TLS,
+			PoolSize:        redisPoolSize,
+			MinIdleConns:    redisMinIdleConns,
+			ConnMaxIdleTime: redisConnMaxIdleTime,
+		})
+	case redisModeCluster:
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:           addrs,
+			ReadOnly:        replicas,
+			RouteRandomly:   replicas,
+			Password:        sec.Password,
+			TLSConfig:       sec.TLS,
+			PoolSize:        redisPoolSize,
+			MinIdleConns:    redisMinIdleConns,
+			ConnMaxIdleTime: redisConnMaxIdleTime,
+		})
+	default:
+		return nil, fmt.Errorf("unknown Redis mode %q", mode)
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := client.Ping(ctx).Err(); err != nil {
+	if err := pingRedis(ctx, client); err != nil {
+		client.Close()
 		return nil, err
 	}
 
 	return client, nil
 }
 
-// storeClientInRedis stores client info in Redis
+// pingRedis checks a new client can reach Redis; tests replace it to build
+// clients for deployments they can't reach
+var pingRedis = func(ctx context.Context, client redis.UniversalClient) error {
+	return client.Ping(ctx).Err()
+}
+
+// parseRedisAddrs returns the comma-separated address list, or the single
+// address if no list is given
+func parseRedisAddrs(addr, addrList string) []string {
+	if addrList == "" {
+		return []string{addr}
+	}
+
+	var addrs []string
+	for _, a := range strings.Split(addrList, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// readRedis returns the client for reads that tolerate replication lag: the
+// replica client with -redis-read-from-replicas, otherwise the primary.
+// Reads that must see the caller's own writes use cm.redis.
+func (cm *ConnectionManager) readRedis() redis.UniversalClient {
+	if cm.replica != nil {
+		return cm.replica
+	}
+	return cm.redis
+}
+
+// redisContext returns a context for a single Redis operation, bounded by the
+// operation timeout and cancelled when the manager shuts down
+func (cm *ConnectionManager) redisContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(cm.ctx, *redisOpTimeout)
+}
+
+// clientRecordTTL is how long a client's Redis records outlive their last
+// refresh, so the records of a server that died without cleaning up expire
+const clientRecordTTL = time.Hour
+
+// clientRecordRefresh is how often a connected client's heartbeats rewrite
+// its Redis records
+var clientRecordRefresh = 10 * time.Minute
+
+// storeClientInRedis records a client and its place in the user's device
+// index in one transaction. The user's presence record is left alone so a
+// status set from another device survives.
 func (cm *ConnectionManager) storeClientInRedis(client *Client) {
-	ctx := context.Background()
-	key := redisClientKey + client.UserID + ":" + client.DeviceID
+	key := cm.key(redisClientKey + client.UserID + ":" + client.DeviceID)
+	devicesKey := cm.key(redisDevicesKey + client.UserID)
 
 	data := map[string]interface{}{
-		"client_id":   client.ID,
-		"user_id":     client.UserID,
-		"device_id":   client.DeviceID,
-		"server_id":   getServerID(),
-		"last_seen":   client.LastSeen.Unix(),
-		"presence":    client.Presence,
+		"client_id": client.ID,
+		"user_id":   client.UserID,
+		"device_id": client.DeviceID,
+		"server_id": cm.serverID,
+		"last_seen": client.LastSeen.Unix(),
+		"presence":  client.presenceRecord().Presence,
+		"region":    *region,
 	}
 
 	jsonData, _ := json.Marshal(data)
-	cm.redis.Set(ctx, key, jsonData, time.Hour).Err()
+
+	err := cm.withRedisRetry("store_client", func(ctx context.Context) error {
+		pipe := cm.redis.TxPipeline()
+		pipe.Set(ctx, key, jsonData, clientRecordTTL)
+		pipe.SAdd(ctx, devicesKey, client.DeviceID)
+		pipe.Expire(ctx, devicesKey, clientRecordTTL)
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+	if err != nil && err != errRedisUnavailable {
+		cm.logger.Debug("Failed to store client in Redis", zap.Error(err))
+	}
 }
 
-// removeClientFromRedis removes client from Redis
+// refreshClientInRedis rewrites a connected client's records, renewing their
+// expiry. A session that has since been replaced is left alone.
+func (cm *ConnectionManager) refreshClientInRedis(client *Client) {
+	cm.clientsMu.RLock()
+	current := cm.devices[client.deviceKey()] == client
+	cm.clientsMu.RUnlock()
+
+	if current {
+		cm.storeClientInRedis(client)
+	}
+}
+
+// removeClientFromRedis removes a client and its device index entry in one
+// transaction
 func (cm *ConnectionManager) removeClientFromRedis(client *Client) {
-	ctx := context.Background()
-	key := redisClientKey + client.UserID + ":" + client.DeviceID
-	cm.redis.Del(ctx, key).Err()
+	key := cm.key(redisClientKey + client.UserID + ":" + client.DeviceID)
+	devicesKey := cm.key(redisDevicesKey + client.UserID)
+
+	err := cm.withRedisRetry("remove_client", func(ctx context.Context) error {
+		pipe := cm.redis.TxPipeline()
+		pipe.Del(ctx, key)
+		pipe.SRem(ctx, devicesKey, client.DeviceID)
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+	if err != nil && err != errRedisUnavailable {
+		cm.logger.Debug("Failed to remove client from Redis", zap.Error(err))
+	}
 }
 
-// redisSubscribe subscribes to Redis pub/sub for cross-server messaging
-func (cm *ConnectionManager) redisSubscribe(room string) error {
-	ctx := context.Background()
-	pubsub := cm.redis.Subscribe(ctx, redisPubSubChannel)
-	
+// roomChannel returns the pub/sub channel carrying a room's messages
+// between servers
+func (cm *ConnectionManager) roomChannel(room string) string {
+	return cm.key(redisPubSubChannel + ":room:" + room)
+}
+
+// roomMessage is a room message as published to other servers
+type roomMessage struct {
+	Origin  string           `json:"origin"` // server ID of the publisher
+	Message SignalingMessage `json:"message"`
+}
+
+// publishToRoom publishes a message to the room's members on other servers.
+// While Redis is unavailable only local members receive it.
+func (cm *ConnectionManager) publishToRoom(room string, msg SignalingMessage) error {
+	data, err := json.Marshal(roomMessage{Origin: cm.serverID, Message: msg})
+	if err != nil {
+		return err
+	}
+
+	err = cm.withRedisOnce("room_publish", func(ctx context.Context) error {
+		return cm.redis.Publish(ctx, cm.roomChannel(room), data).Err()
+	})
+	if err == errRedisUnavailable {
+		return nil
+	}
+	return err
+}
+
+// redisSubscribe subscribes to the room's pub/sub channel, delivering
+// messages other servers publish to it to the room's local members until
+// the returned subscription is closed. The returned channel is closed once
+// delivery stops.
+func (cm *ConnectionManager) redisSubscribe(room string) (*redis.PubSub, chan struct{}) {
+	pubsub := cm.redis.Subscribe(cm.ctx, cm.roomChannel(room))
+	done := make(chan struct{})
+
 	go func() {
+		defer close(done)
 		ch := pubsub.Channel()
 		for {
 			select {
 			case <-cm.ctx.Done():
 				pubsub.Close()
 				return
-			case msg := <-ch:
-				var signalingMsg SignalingMessage
-				if err := json.Unmarshal([]byte(msg.Payload), &signalingMsg); err != nil {
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				var rm roomMessage
+				if err := json.Unmarshal([]byte(msg.Payload), &rm); err != nil {
 					continue
 				}
-				
-				// Only process if message is for this room
-				if signalingMsg.Room == room {
-					cm.BroadcastToRoom(room, signalingMsg)
+				// Delivered locally when published
+				if rm.Origin == cm.serverID {
+					continue
 				}
+				cm.deliverToRoom(room, rm.Message)
 			}
 		}
 	}()
-	
-	return nil
+
+	return pubsub, done
 }
 
-// relayViaRedis relays message via Redis pub/sub
+// relayViaRedis relays message via Redis pub/sub. Targets whose servers
+// advertise a region are reached on that region's channel; the rest on the
+// global channel.
 func (cm *ConnectionManager) relayViaRedis(msg SignalingMessage, fromUserID string) error {
-	ctx := context.Background()
-	
-	// Try to find target on another server
-	key := redisClientKey + msg.To + ":*"
-	keys, err := cm.redis.Keys(ctx, key).Result()
-	if err != nil || len(keys) == 0 {
-		return nil // Target not found anywhere
+	if msg.Hops <= 0 {
+		metrics.RelayTTLExceeded.Inc()
+		cm.logger.Debug("Dropping message with no relay hops left",
+			zap.String("type", msg.Type),
+			zap.String("to", msg.To))
+		return nil
 	}
+	msg.Hops--
 
-	// Publish to Redis pub/sub
 	msg.From = fromUserID
-	data, _ := json.Marshal(msg)
-	
-	return cm.redis.Publish(ctx, redisPubSubChannel, string(data)).Err()
+	data, err := cm.marshalMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	// Find the target on another server through its device index,
+	// checking the primary before giving up in case a replica is behind.
+	// Only the lookup is retried; the publish or queueing that follows
+	// happens once, so a failure part way can't deliver a message twice.
+	lookup := cm.lookupDevices
+	if msg.ToDevice != "" {
+		lookup = func(ctx context.Context, client redis.UniversalClient, userID string) ([]interface{}, error) {
+			return cm.lookupDevice(ctx, client, userID, msg.ToDevice)
+		}
+	}
+	var entries []interface{}
+	err = cm.withRedisRetry("relay_lookup", func(ctx context.Context) error {
+		var err error
+		entries, err = lookup(ctx, cm.readRedis(), msg.To)
+		if err == nil && len(entries) == 0 && cm.replica != nil {
+			entries, err = lookup(ctx, cm.redis, msg.To)
+		}
+		return err
+	})
+	if err == errRedisUnavailable {
+		// Local-only delivery while Redis is down
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	channels := cm.relayChannels(entries)
+	if len(channels) == 0 {
+		// Target not found anywhere; hold the message until they
+		// connect. Messages for a device that is gone are dropped.
+		if !*offlineQueue || msg.Type == MsgAck || msg.ToDevice != "" {
+			return nil
+		}
+		err = cm.withRedisOnce("offline_queue", func(ctx context.Context) error {
+			return cm.queueOffline(ctx, msg.To, data)
+		})
+		if err == errRedisUnavailable {
+			return nil
+		}
+		return err
+	}
+
+	for channel, label := range channels {
+		err := cm.withRedisOnce("relay", func(ctx context.Context) error {
+			return cm.redis.Publish(ctx, channel, string(data)).Err()
+		})
+		if err == errRedisUnavailable {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		metrics.RedisRelays.WithLabelValues(label).Inc()
+	}
+	return nil
+}
+
+// relayChannels maps each channel a relay must be published on to its
+// metrics label, publishing once per channel hosting one of the target's
+// device entries. Every server hears the global channel, so if any device
+// needs it the region channels would only deliver the message twice.
+func (cm *ConnectionManager) relayChannels(entries []interface{}) map[string]string {
+	channels := make(map[string]string)
+	for _, entry := range entries {
+		raw, ok := entry.(string)
+		if !ok {
+			continue
+		}
+		var info struct {
+			Region string `json:"region"`
+		}
+		json.Unmarshal([]byte(raw), &info)
+
+		if info.Region == "" {
+			return map[string]string{cm.key(redisPubSubChannel): relayRegionGlobal}
+		}
+		channels[cm.regionChannel(info.Region)] = info.Region
+	}
+	return channels
+}
+
+// regionChannel returns the pub/sub channel for relays to a region
+func (cm *ConnectionManager) regionChannel(region string) string {
+	return cm.key(redisPubSubChannel + ":" + region)
 }
 
 // redisSubscriber listens to Redis pub/sub
 func (cm *ConnectionManager) redisSubscriber() {
-	pubsub := cm.redis.Subscribe(cm.ctx, redisPubSubChannel)
+	channels := []string{cm.key(redisPubSubChannel)}
+	if *region != "" {
+		channels = append(channels, cm.regionChannel(*region))
+	}
+
+	pubsub := cm.redis.Subscribe(cm.ctx, channels...)
 	defer pubsub.Close()
 
 	ch := pubsub.Channel()
@@ -123,75 +467,178 @@ func (cm *ConnectionManager) redisSubscriber() {
 			if err := json.Unmarshal([]byte(msg.Payload), &signalingMsg); err != nil {
 				continue
 			}
-			
+
 			// Skip if from this server
 			if signalingMsg.From == "" {
 				continue
 			}
-			
-			// Relay to local clients
-			cm.RelayMessage(signalingMsg, signalingMsg.From)
+
+			// Presence goes to its watchers rather than a recipient
+			if signalingMsg.Type == MsgPresence {
+				cm.deliverPresence(signalingMsg)
+				continue
+			}
+
+			// Deliver to local clients only; relaying again would loop
+			cm.deliverLocal(signalingMsg)
 		}
 	}
 }
 
+// lookupDevices returns the client records of a user's devices connected to
+// any server, read with client
+func (cm *ConnectionManager) lookupDevices(ctx context.Context, client redis.UniversalClient, userID string) ([]interface{}, error) {
+	devices, err := client.SMembers(ctx, cm.key(redisDevicesKey+userID)).Result()
+	if err != nil || len(devices) == 0 {
+		return nil, err
+	}
+
+	keys := make([]string, len(devices))
+	for i, device := range devices {
+		keys[i] = cm.key(redisClientKey + userID + ":" + device)
+	}
+	return client.MGet(ctx, keys...).Result()
+}
+
+// lookupDevice returns the client record of one of a user's devices if it
+// is connected to any server, read with client
+func (cm *ConnectionManager) lookupDevice(ctx context.Context, client redis.UniversalClient, userID, deviceID string) ([]interface{}, error) {
+	entry, err := client.Get(ctx, cm.key(redisClientKey+userID+":"+deviceID)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{entry}, nil
+}
+
+// presenceSchemaVersion is the version of presence records stored in Redis.
+// Version 1 records held only {presence, timestamp}.
+const presenceSchemaVersion = 2
+
+// storedPresence is a presence record as stored in Redis
+type storedPresence struct {
+	Version   int   `json:"v"`
+	Timestamp int64 `json:"timestamp,omitempty"` // version 1 only, unix seconds
+	Presence
+}
+
 // UpdatePresence updates user presence in Redis
-func (cm *ConnectionManager) UpdatePresence(userID, presence string) {
-	ctx := context.Background()
-	key := redisPresenceKey + userID
-	
-	data := map[string]interface{}{
-		"presence":  presence,
-		"timestamp": time.Now().Unix(),
+func (cm *ConnectionManager) UpdatePresence(userID string, presence Presence) {
+	key := cm.key(redisPresenceKey + userID)
+
+	jsonData, err := cm.marshalMessage(storedPresence{
+		Version:  presenceSchemaVersion,
+		Presence: presence,
+	})
+	if err != nil {
+		return
 	}
-	
-	jsonData, _ := json.Marshal(data)
-	cm.redis.Set(ctx, key, jsonData, time.Hour).Err()
-	
-	// Publish presence update
+	err = cm.withRedisRetry("presence_update", func(ctx context.Context) error {
+		return cm.redis.Set(ctx, key, jsonData, time.Hour).Err()
+	})
+	if err != nil && err != errRedisUnavailable {
+		cm.logger.Warn("Failed to store presence", zap.String("user_id", userID), zap.Error(err))
+	}
+
+	// Publish presence update, coalescing rapid changes
+	cm.schedulePresencePublish(userID, presence)
+}
+
+// publishPresence publishes a presence update to every server, each
+// delivering it to the clients there watching the user
+func (cm *ConnectionManager) publishPresence(userID string, presence Presence) {
 	msg := SignalingMessage{
 		Type:      MsgPresence,
-		To:        userID,
-		Payload:   data,
+		From:      userID,
+		Payload:   presence,
 		Timestamp: time.Now().Unix(),
+		Hops:      maxRelayHops,
+	}
+	msgData, err := cm.marshalMessage(msg)
+	if err != nil {
+		return
+	}
+	err = cm.withRedisOnce("publish_presence", func(ctx context.Context) error {
+		return cm.redis.Publish(ctx, cm.key(redisPubSubChannel), string(msgData)).Err()
+	})
+	if err != nil && err != errRedisUnavailable {
+		cm.logger.Debug("Failed to publish presence", zap.Error(err))
 	}
-	data, _ = json.Marshal(msg)
-	cm.redis.Publish(ctx, redisPubSubChannel, string(data)).Err()
 }
 
-// GetPresence gets user presence from Redis
-func (cm *ConnectionManager) GetPresence(userID string) (string, error) {
-	ctx := context.Background()
-	key := redisPresenceKey + userID
-	
-	data, err := cm.redis.Get(ctx, key).Result()
+// GetPresence gets user presence from Redis as viewer may see it. Users
+// without a record, or hiding their presence from viewer, are offline.
+func (cm *ConnectionManager) GetPresence(viewer, userID string) (Presence, error) {
+	presences, err := cm.GetPresences(viewer, []string{userID})
 	if err != nil {
-		return "offline", nil
+		return Presence{Presence: PresenceOffline}, err
 	}
-	
-	var presence map[string]interface{}
-	if err := json.Unmarshal([]byte(data), &presence); err != nil {
-		return "offline", nil
+	return presences[userID], nil
+}
+
+// GetPresences gets presence for several users with a single MGET, as
+// viewer may see it. Users without a record, or hiding their presence from
+// viewer, are offline.
+func (cm *ConnectionManager) GetPresences(viewer string, userIDs []string) (map[string]Presence, error) {
+	keys := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		keys[i] = cm.key(redisPresenceKey + userID)
+	}
+
+	var entries []interface{}
+	err := cm.withRedisRetry("presence_query", func(ctx context.Context) error {
+		var err error
+		entries, err = cm.readRedis().MGet(ctx, keys...).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	
-	if p, ok := presence["presence"].(string); ok {
-		return p, nil
+
+	presences := make(map[string]Presence, len(userIDs))
+	for i, userID := range userIDs {
+		raw, ok := entries[i].(string)
+		if !ok {
+			presences[userID] = Presence{Presence: PresenceOffline}
+			continue
+		}
+		presences[userID] = decodePresence(raw)
 	}
-	
-	return "offline", nil
+
+	if err := cm.filterPresences(viewer, presences); err != nil {
+		return nil, err
+	}
+	return presences, nil
 }
 
-// Server ID for distributed setup
-var serverID string
+// decodePresence reads a stored presence record, upgrading older schema
+// versions
+func decodePresence(data string) Presence {
+	var stored storedPresence
+	if err := json.Unmarshal([]byte(data), &stored); err != nil || stored.Presence.Presence == "" {
+		return Presence{Presence: PresenceOffline}
+	}
 
-func getServerID() string {
-	if serverID == "" {
-		serverID = generateServerID()
+	if stored.Version < 2 {
+		stored.LastActiveTS = stored.Timestamp * 1000
+		stored.CurrentlyActive = stored.Presence.Presence == PresenceOnline
 	}
+
+	return stored.Presence
+}
+
+// serverID identifies this process among the instances sharing Redis
+var serverID = generateServerID()
+
+// getServerID returns this process's server ID
+func getServerID() string {
 	return serverID
 }
 
+// generateServerID returns a random server ID, so instances started at the
+// same moment, as in a rolling deploy or scale-up, never share one
 func generateServerID() string {
-	// In production, use hostname or container ID
-	return "server-" + time.Now().Format("20060102150405")
+	return "server-" + uuid.New().String()
 }
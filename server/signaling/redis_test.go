@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+func TestParseRedisAddrs(t *testing.T) {
+	tests := []struct {
+		addr, list string
+		want       []string
+	}{
+		{"localhost:6379", "", []string{"localhost:6379"}},
+		{"localhost:6379", "a:26379,b:26379", []string{"a:26379", "b:26379"}},
+		{"localhost:6379", " a:7000 , ,b:7001,", []string{"a:7000", "b:7001"}},
+		{"localhost:6379", " , ", nil},
+	}
+	for _, tt := range tests {
+		if got := parseRedisAddrs(tt.addr, tt.list); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRedisAddrs(%q, %q) = %q, want %q", tt.addr, tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestNewRedisClientInvalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		masterName string
+		addrs      []string
+		replicas   bool
+		sec        redisSecurity
+	}{
+		{"no addresses", redisModeSingle, "", nil, false, redisSecurity{}},
+		{"sentinel without master", redisModeSentinel, "", []string{"localhost:26379"}, false, redisSecurity{}},
+		{"unknown mode", "replicated", "", []string{"localhost:6379"}, false, redisSecurity{}},
+		{"replicas in single mode", redisModeSingle, "", []string{"localhost:6379"}, true, redisSecurity{}},
+		{"database in cluster mode", redisModeCluster, "", []string{"localhost:7000"}, false, redisSecurity{DB: 1}},
+	}
+	for _, tt := range tests {
+		client, err := newRedisClient(tt.mode, tt.masterName, tt.addrs, tt.replicas, tt.sec)
+		if err == nil {
+			client.Close()
+			t.Errorf("%s: newRedisClient succeeded, want error", tt.name)
+		}
+	}
+}
+
+func TestNewRedisClientModes(t *testing.T) {
+	ping := pingRedis
+	pingRedis = func(context.Context, redis.UniversalClient) error { return nil }
+	t.Cleanup(func() { pingRedis = ping })
+
+	tests := []struct {
+		name       string
+		mode       string
+		masterName string
+		addrs      []string
+		replicas   bool
+		check      func(redis.UniversalClient) bool
+	}{
+		{"single", redisModeSingle, "", []string{"localhost:6379"}, false, func(c redis.UniversalClient) bool {
+			client, ok := c.(*redis.Client)
+			return ok && client.Options().Addr == "localhost:6379"
+		}},
+		{"sentinel", redisModeSentinel, "mymaster", []string{"a:26379", "b:26379"}, false, func(c redis.UniversalClient) bool {
+			client, ok := c.(*redis.Client)
+			return ok && client.Options().Addr == "FailoverClient"
+		}},
+		{"sentinel replicas", redisModeSentinel, "mymaster", []string{"a:26379"}, true, func(c redis.UniversalClient) bool {
+			_, ok := c.(*redis.Client)
+			return ok
+		}},
+		{"cluster", redisModeCluster, "", []string{"a:7000", "b:7001"}, false, func(c redis.UniversalClient) bool {
+			client, ok := c.(*redis.ClusterClient)
+			return ok && !client.Options().ReadOnly && reflect.DeepEqual(client.Options().Addrs, []string{"a:7000", "b:7001"})
+		}},
+		{"cluster replicas", redisModeCluster, "", []string{"a:7000"}, true, func(c redis.UniversalClient) bool {
+			client, ok := c.(*redis.ClusterClient)
+			return ok && client.Options().ReadOnly && client.Options().RouteRandomly
+		}},
+	}
+	for _, tt := range tests {
+		client, err := newRedisClient(tt.mode, tt.masterName, tt.addrs, tt.replicas, redisSecurity{Password: "secret"})
+		if err != nil {
+			t.Errorf("%s: newRedisClient: %v", tt.name, err)
+			continue
+		}
+		if !tt.check(client) {
+			t.Errorf("%s: newRedisClient built %T", tt.name, client)
+		}
+		client.Close()
+	}
+}
+
+func TestRelayChannels(t *testing.T) {
+	cm := &ConnectionManager{namespace: "ns:"}
+	tests := []struct {
+		name    string
+		entries []interface{}
+		want    map[string]string
+	}{
+		{"no devices", nil, map[string]string{}},
+		{"one region", []interface{}{`{"region":"eu"}`, `{"region":"eu"}`},
+			map[string]string{"ns:lr:signaling:eu": "eu"}},
+		{"two regions", []interface{}{`{"region":"eu"}`, `{"region":"us"}`},
+			map[string]string{"ns:lr:signaling:eu": "eu", "ns:lr:signaling:us": "us"}},
+		{"unregioned device", []interface{}{`{"region":"eu"}`, `{}`},
+			map[string]string{"ns:lr:signaling": relayRegionGlobal}},
+		{"unregioned first", []interface{}{`{}`, `{"region":"us"}`},
+			map[string]string{"ns:lr:signaling": relayRegionGlobal}},
+		{"non-string entries", []interface{}{nil, 42}, map[string]string{}},
+	}
+	for _, tt := range tests {
+		if got := cm.relayChannels(tt.entries); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: relayChannels = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRedisNamespacePrefix(t *testing.T) {
+	tests := map[string]string{
+		"":         "",
+		"staging":  "staging:",
+		"staging:": "staging:",
+		"a:b":      "a:b:",
+	}
+	for namespace, want := range tests {
+		if got := redisNamespacePrefix(namespace); got != want {
+			t.Errorf("redisNamespacePrefix(%q) = %q, want %q", namespace, got, want)
+		}
+	}
+
+	cm := &ConnectionManager{namespace: redisNamespacePrefix("staging")}
+	if got := cm.key(redisPresenceKey + "alice"); got != "staging:lr:presence:alice" {
+		t.Errorf("key = %q", got)
+	}
+}
+
+func TestGenerateServerID(t *testing.T) {
+	a, b := generateServerID(), generateServerID()
+	if a == b {
+		t.Errorf("generateServerID returned %q twice", a)
+	}
+	if !strings.HasPrefix(a, "server-") {
+		t.Errorf("generateServerID = %q, want a server- prefix", a)
+	}
+	if getServerID() != serverID || serverID == "" {
+		t.Errorf("getServerID = %q, want the process ID %q", getServerID(), serverID)
+	}
+}
+
+// setRedisSecurityFlags sets the Redis security flags for the duration of a
+// test
+func setRedisSecurityFlags(t *testing.T, password string, db int, useTLS bool, ca string, skipVerify bool) {
+	t.Helper()
+	oldPassword, oldDB, oldTLS, oldCA, oldSkip := *redisPassword, *redisDB, *redisTLS, *redisTLSCA, *redisTLSSkipVerify
+	*redisPassword, *redisDB, *redisTLS, *redisTLSCA, *redisTLSSkipVerify = password, db, useTLS, ca, skipVerify
+	t.Cleanup(func() {
+		*redisPassword, *redisDB, *redisTLS, *redisTLSCA, *redisTLSSkipVerify = oldPassword, oldDB, oldTLS, oldCA, oldSkip
+	})
+}
+
+// writeTestCA writes a self-signed CA certificate to a temporary file
+func writeTestCA(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test redis CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRedisSecurityFromFlags(t *testing.T) {
+	setRedisSecurityFlags(t, "secret", 2, false, "", false)
+	sec, err := redisSecurityFromFlags()
+	if err != nil || sec.Password != "secret" || sec.DB != 2 || sec.TLS != nil {
+		t.Errorf("plaintext: %+v, %v", sec, err)
+	}
+
+	setRedisSecurityFlags(t, "", 0, true, "", true)
+	sec, err = redisSecurityFromFlags()
+	if err != nil || sec.TLS == nil || !sec.TLS.InsecureSkipVerify || sec.TLS.RootCAs != nil {
+		t.Errorf("TLS without verification: %+v, %v", sec, err)
+	}
+
+	setRedisSecurityFlags(t, "", 0, true, writeTestCA(t), false)
+	sec, err = redisSecurityFromFlags()
+	if err != nil || sec.TLS == nil || sec.TLS.InsecureSkipVerify || sec.TLS.RootCAs == nil {
+		t.Errorf("TLS with CA: %+v, %v", sec, err)
+	}
+}
+
+func TestRedisSecurityFromFlagsInvalid(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		useTLS     bool
+		ca         string
+		skipVerify bool
+	}{
+		{"CA without TLS", false, notPEM, false},
+		{"skip verify without TLS", false, "", true},
+		{"missing CA file", true, filepath.Join(t.TempDir(), "missing.pem"), false},
+		{"CA file without certificates", true, notPEM, false},
+	}
+	for _, tt := range tests {
+		setRedisSecurityFlags(t, "", 0, tt.useTLS, tt.ca, tt.skipVerify)
+		if _, err := redisSecurityFromFlags(); err == nil {
+			t.Errorf("%s: redisSecurityFromFlags succeeded", tt.name)
+		}
+	}
+}
+
+// hangingHook holds Redis commands named cmd until their context ends, as a
+// Redis server that stopped answering would
+type hangingHook struct {
+	cmd string
+}
+
+func (h hangingHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h hangingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() != h.cmd {
+			return next(ctx, cmd)
+		}
+		<-ctx.Done()
+		cmd.SetErr(ctx.Err())
+		return ctx.Err()
+	}
+}
+
+func (h hangingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestRedisOpCancelledWithManager(t *testing.T) {
+	cm := newTestManager(t)
+	cm.redis.(*redis.Client).AddHook(hangingHook{cmd: "mget"})
+
+	time.AfterFunc(50*time.Millisecond, cm.cancel)
+	start := time.Now()
+	if _, err := cm.GetPresences("alice", []string{"bob"}); err == nil {
+		t.Error("GetPresences succeeded against a hung Redis")
+	}
+	if elapsed := time.Since(start); elapsed > *redisOpTimeout/2 {
+		t.Errorf("GetPresences returned %v after shutdown began", elapsed)
+	}
+}
+
+func TestRelayHopLimit(t *testing.T) {
+	cm := newTestManager(t)
+	relays := relayTarget(t, cm)
+
+	if err := cm.relayViaRedis(SignalingMessage{Type: MsgOffer, To: "bob", Hops: 1}, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	var relayed SignalingMessage
+	select {
+	case m := <-relays:
+		if err := json.Unmarshal([]byte(m.Payload), &relayed); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message with one hop left not relayed")
+	}
+	if relayed.Hops != 0 {
+		t.Fatalf("relayed with %d hops left, want 0", relayed.Hops)
+	}
+
+	// The relayed copy has spent its last hop
+	exceeded := testutil.ToFloat64(metrics.RelayTTLExceeded)
+	if err := cm.relayViaRedis(relayed, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countMessages(relays, 100*time.Millisecond); n != 0 {
+		t.Errorf("message with no hops left relayed %d times", n)
+	}
+	if got := testutil.ToFloat64(metrics.RelayTTLExceeded) - exceeded; got != 1 {
+		t.Errorf("hop limit counted %v times, want once", got)
+	}
+}
+
+func TestNamespacesIsolated(t *testing.T) {
+	client := newTestRedis(t)
+	a := newTestManagerOn(t, client, "tenant-a-"+uuid.New().String())
+	bNamespace := "tenant-b-" + uuid.New().String()
+	b, c := newTestManagerOn(t, client, bNamespace), newTestManagerOn(t, client, bNamespace)
+	srvA, srvB, srvC := serveTestManager(t, a), serveTestManager(t, b), serveTestManager(t, c)
+
+	alice := dialTest(t, srvA, "alice", "phone")
+	bob := dialTest(t, srvB, "bob", "laptop")
+	carol := dialTest(t, srvC, "carol", "phone")
+	waitFor(t, "bob to be recorded", func() bool {
+		devices, _ := c.lookupDevices(context.Background(), client, "bob")
+		return len(devices) == 1
+	})
+
+	// Clients
+	if devices, err := a.lookupDevices(context.Background(), client, "bob"); err != nil || len(devices) != 0 {
+		t.Errorf("other namespace sees bob's devices %v (%v)", devices, err)
+	}
+
+	// Relays. Alice's offer is handled before her ping is answered, so had
+	// it crossed over it would have reached bob first.
+	alice.send(SignalingMessage{Type: MsgOffer, To: "bob", Payload: map[string]interface{}{"sdp": "from alice"}})
+	alice.send(SignalingMessage{Type: MsgPing})
+	alice.next(MsgPong)
+	carol.send(SignalingMessage{Type: MsgOffer, To: "bob", Payload: map[string]interface{}{"sdp": "from carol"}})
+	if msg := bob.next(MsgOffer); msg.From != "carol" {
+		t.Errorf("bob received an offer from %s, want carol's", msg.From)
+	}
+
+	// Rooms
+	if _, err := a.CreateRoom(RoomInfo{ID: "standup", Name: "Tenant A"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetRoom("standup"); err != errRoomNotFound {
+		t.Errorf("other namespace GetRoom = %v, want errRoomNotFound", err)
+	}
+	for _, conn := range []*testConn{alice, bob, carol} {
+		conn.send(SignalingMessage{Type: MsgSubscribe, Room: "standup"})
+	}
+	waitFor(t, "everyone to join", func() bool {
+		joined := func(cm *ConnectionManager, userID string) bool {
+			clients := cm.GetClientByUserID(userID)
+			return len(clients) == 1 && cm.isMember(clients[0], "standup")
+		}
+		return joined(a, "alice") && joined(b, "bob") && joined(c, "carol")
+	})
+	waitFor(t, "the room channels to be subscribed", func() bool {
+		counts := client.PubSubNumSub(context.Background(), a.roomChannel("standup"), b.roomChannel("standup")).Val()
+		return counts[a.roomChannel("standup")] == 1 && counts[b.roomChannel("standup")] == 2
+	})
+	alice.send(SignalingMessage{Type: MsgCandidate, Room: "standup", Payload: "from alice"})
+	alice.send(SignalingMessage{Type: MsgPing})
+	alice.next(MsgPong)
+	bob.send(SignalingMessage{Type: MsgCandidate, Room: "standup", Payload: "from bob"})
+	if msg := carol.next(MsgCandidate); msg.From != "bob" {
+		t.Errorf("carol received a room message from %s, want bob's", msg.From)
+	}
+}
+
+// roundTripHook counts the round trips made to Redis and the commands sent
+type roundTripHook struct {
+	mu    sync.Mutex
+	trips int
+	cmds  []string
+}
+
+func (h *roundTripHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *roundTripHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.record(cmd)
+		return next(ctx, cmd)
+	}
+}
+
+func (h *roundTripHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		h.record(cmds...)
+		return next(ctx, cmds)
+	}
+}
+
+// reset forgets the round trips recorded so far
+func (h *roundTripHook) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.trips, h.cmds = 0, nil
+}
+
+// record counts one round trip carrying cmds
+func (h *roundTripHook) record(cmds ...redis.Cmder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.trips++
+	for _, cmd := range cmds {
+		h.cmds = append(h.cmds, cmd.Name())
+	}
+}
+
+func TestStoreClientOneRoundTrip(t *testing.T) {
+	// Hooks can't be added once the client is in use
+	rdb := newTestRedis(t)
+	hook := &roundTripHook{}
+	rdb.AddHook(hook)
+	cm := newTestManagerOn(t, rdb, "test-"+uuid.New().String())
+	ctx := context.Background()
+	cm.UpdatePresence("alice", Presence{Presence: PresenceAway, StatusMsg: "in a meeting"})
+
+	hook.reset()
+	cm.storeClientInRedis(NewClient("alice", "phone", nil, zap.NewNop(), wsTimings()))
+	hook.mu.Lock()
+	trips, cmds := hook.trips, hook.cmds
+	hook.mu.Unlock()
+
+	if want := []string{"multi", "set", "sadd", "expire", "exec"}; trips != 1 || !reflect.DeepEqual(cmds, want) {
+		t.Errorf("stored in %d round trips sending %v, want one sending %v", trips, cmds, want)
+	}
+	for _, key := range []string{cm.key(redisClientKey + "alice:phone"), cm.key(redisDevicesKey + "alice")} {
+		if ttl := cm.redis.TTL(ctx, key).Val(); ttl <= clientRecordTTL-time.Minute || ttl > clientRecordTTL {
+			t.Errorf("%s expires in %v, want %v", key, ttl, clientRecordTTL)
+		}
+	}
+	if devices := cm.redis.SMembers(ctx, cm.key(redisDevicesKey+"alice")).Val(); !reflect.DeepEqual(devices, []string{"phone"}) {
+		t.Errorf("device index holds %v, want [phone]", devices)
+	}
+
+	// Another device's status survives the connection
+	presence := decodePresence(cm.redis.Get(ctx, cm.key(redisPresenceKey+"alice")).Val())
+	if presence.StatusMsg != "in a meeting" {
+		t.Errorf("presence after connecting = %+v, want the stored status kept", presence)
+	}
+}
+
+func TestHeartbeatRefreshesClientRecord(t *testing.T) {
+	period, refresh := *pingPeriod, clientRecordRefresh
+	*pingPeriod, clientRecordRefresh = 50*time.Millisecond, 0
+	t.Cleanup(func() { *pingPeriod, clientRecordRefresh = period, refresh })
+
+	cm := newTestManager(t)
+	srv := serveTestManager(t, cm)
+	dialClient(t, srv.URL, "alice", "phone")
+	waitFor(t, "alice to connect", func() bool { return cm.HasDevice("alice", "phone") })
+
+	ctx := context.Background()
+	keys := []string{cm.key(redisClientKey + "alice:phone"), cm.key(redisDevicesKey + "alice")}
+	for _, key := range keys {
+		cm.redis.Expire(ctx, key, 5*time.Second)
+	}
+	waitFor(t, "a heartbeat to renew the records", func() bool {
+		for _, key := range keys {
+			if cm.redis.TTL(ctx, key).Val() <= 5*time.Second {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func BenchmarkStoreClientInRedis(b *testing.B) {
+	rdb := newTestRedis(b)
+	hook := &roundTripHook{}
+	rdb.AddHook(hook)
+	cm := newTestManagerOn(b, rdb, "test-"+uuid.New().String())
+	client := NewClient("alice", "phone", nil, zap.NewNop(), wsTimings())
+
+	hook.reset()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cm.storeClientInRedis(client)
+	}
+	b.StopTimer()
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	b.ReportMetric(float64(hook.trips)/float64(b.N), "roundtrips/op")
+}
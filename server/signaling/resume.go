@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+
+	"go.uber.org/zap"
+)
+
+// redisResumeKey prefixes the room subscriptions saved for a resume token
+// when its connection drops
+const redisResumeKey = "lr:resume:"
+
+// resumeState is what a resume token restores
+type resumeState struct {
+	UserID   string   `json:"user_id"`
+	DeviceID string   `json:"device_id"`
+	Rooms    []string `json:"rooms"`
+}
+
+// newResumeToken returns an unguessable resume token
+func newResumeToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// saveResumeState keeps a disconnected client's rooms under its resume
+// token for -resume-grace
+func (cm *ConnectionManager) saveResumeState(client *Client, rooms []string) {
+	if client.resumeToken == "" || len(rooms) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(resumeState{
+		UserID:   client.UserID,
+		DeviceID: client.DeviceID,
+		Rooms:    rooms,
+	})
+	if err != nil {
+		return
+	}
+
+	err = cm.withRedisRetry("resume_save", func(ctx context.Context) error {
+		return cm.redis.Set(ctx, cm.key(redisResumeKey+client.resumeToken), data, *resumeGrace).Err()
+	})
+	if err != nil && err != errRedisUnavailable {
+		cm.logger.Debug("Failed to save resume state", zap.String("client_id", client.ID), zap.Error(err))
+	}
+}
+
+// resumeSession resubscribes a client to the rooms saved under a resume
+// token issued to the same user and device. Each token works once. Rooms the
+// client may no longer join are skipped.
+func (cm *ConnectionManager) resumeSession(client *Client, token string) []string {
+	var data string
+	err := cm.withRedisOnce("resume_load", func(ctx context.Context) error {
+		var err error
+		data, err = cm.redis.GetDel(ctx, cm.key(redisResumeKey+token)).Result()
+		return err
+	})
+	if err != nil {
+		return nil
+	}
+
+	var state resumeState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return nil
+	}
+	if state.UserID != client.UserID || state.DeviceID != client.DeviceID {
+		audit.Log(auditAuthFailure, client.UserID, client.remoteIP, "resume token issued to another device")
+		return nil
+	}
+
+	var restored []string
+	for _, room := range state.Rooms {
+		if err := cm.Subscribe(client, room, false); err != nil {
+			cm.logger.Debug("Skipped room on resume", zap.String("room", room), zap.Error(err))
+			continue
+		}
+		restored = append(restored, room)
+	}
+	return restored
+}
+
+// sendResumeToken tells a newly connected client the token that resumes its
+// rooms after a drop, and which rooms were restored
+func (c *Client) sendResumeToken(restored []string) error {
+	data, err := json.Marshal(SignalingMessage{
+		Type: MsgResume,
+		Payload: ResumePayload{
+			ResumeToken: c.resumeToken,
+			ExpiresIn:   int64(resumeGrace.Seconds()),
+			Restored:    restored,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return c.Enqueue(data)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialResume connects a user's device to a test server presenting a resume
+// token, returning the resume message the server answers with
+func dialResume(t *testing.T, srv string, userID, deviceID, token string) (*testConn, ResumePayload) {
+	t.Helper()
+	header := http.Header{"Authorization": {"Bearer " + testToken(t, userID, deviceID)}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv, "http")+"/ws?resume_token="+token, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &testConn{t: t, conn: conn}
+	data, _ := json.Marshal(c.next(MsgResume).Payload)
+	var resume ResumePayload
+	if err := json.Unmarshal(data, &resume); err != nil {
+		t.Fatal(err)
+	}
+	return c, resume
+}
+
+func TestResumeRestoresSubscriptions(t *testing.T) {
+	cm := newTestManager(t)
+	srv := serveTestManager(t, cm)
+
+	first, resume := dialResume(t, srv.URL, "alice", "phone", "")
+	if resume.ResumeToken == "" || len(resume.Restored) != 0 {
+		t.Fatalf("first connection got %+v, want a token and nothing restored", resume)
+	}
+	for _, room := range []string{"one", "two"} {
+		first.send(SignalingMessage{Type: MsgSubscribe, Room: room})
+	}
+	waitFor(t, "alice to join", func() bool {
+		clients := cm.GetClientByUserID("alice")
+		return len(clients) == 1 && cm.isMember(clients[0], "two")
+	})
+	first.conn.Close()
+	waitFor(t, "alice to disconnect", func() bool { return !cm.HasDevice("alice", "phone") })
+
+	_, resumed := dialResume(t, srv.URL, "alice", "phone", resume.ResumeToken)
+	if want := []string{"one", "two"}; !reflect.DeepEqual(resumed.Restored, want) {
+		t.Errorf("resume restored %v, want %v", resumed.Restored, want)
+	}
+	client := cm.GetClientByUserID("alice")[0]
+	for _, room := range []string{"one", "two"} {
+		if !cm.isMember(client, room) {
+			t.Errorf("resumed client not subscribed to %s", room)
+		}
+	}
+	if resumed.ResumeToken == "" || resumed.ResumeToken == resume.ResumeToken {
+		t.Errorf("resumed connection got token %q, want a fresh one", resumed.ResumeToken)
+	}
+
+	// Each token works once
+	_, reused := dialResume(t, srv.URL, "alice", "phone", resume.ResumeToken)
+	if len(reused.Restored) != 0 {
+		t.Errorf("reused token restored %v", reused.Restored)
+	}
+}
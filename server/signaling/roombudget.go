@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// roomBudgetSuffix holds a room's budget overrides, a hash with msg_rate
+// and byte_rate fields (appended to redisRoomKey + room)
+const roomBudgetSuffix = ":budget"
+
+// roomBudgetRefresh is how often a room's overrides are reloaded and idle
+// senders forgotten
+const roomBudgetRefresh = 30 * time.Second
+
+// Room throttling reasons, used as metric labels
+const (
+	throttleMessages = "messages"
+	throttleBytes    = "bytes"
+)
+
+// errRoomThrottled is returned when a sender is over a room's budget
+var errRoomThrottled = errors.New("room send budget exceeded")
+
+// roomBudget is the per-sender send budget in one room
+type roomBudget struct {
+	msgRate  float64 // messages per second, 0 for unlimited
+	byteRate int     // bytes per second, 0 for unlimited
+	loadedAt time.Time
+	senders  map[string]*senderBudget // client ID -> budget
+}
+
+// senderBudget tracks one client's sends in one room
+type senderBudget struct {
+	msgs     *rate.Limiter
+	bytes    *rate.Limiter
+	lastUsed time.Time
+}
+
+// allowRoomSend charges a message of size bytes from c to the room's
+// budget. Each sender gets its own budget, so one client flooding a room
+// doesn't throttle the others.
+func (cm *ConnectionManager) allowRoomSend(c *Client, room string, size int) error {
+	if *roomMsgRate <= 0 && *roomByteRate <= 0 {
+		return nil
+	}
+
+	budget := cm.roomBudget(room)
+
+	cm.roomBudgetsMu.Lock()
+	defer cm.roomBudgetsMu.Unlock()
+
+	now := time.Now()
+	s, ok := budget.senders[c.ID]
+	if !ok {
+		s = &senderBudget{}
+		if budget.msgRate > 0 {
+			s.msgs = rate.NewLimiter(rate.Limit(budget.msgRate), int(budget.msgRate)+1)
+		}
+		if budget.byteRate > 0 {
+			s.bytes = rate.NewLimiter(rate.Limit(budget.byteRate), budget.byteRate)
+		}
+		budget.senders[c.ID] = s
+	}
+	s.lastUsed = now
+
+	if s.msgs != nil && !s.msgs.AllowN(now, 1) {
+		metrics.RoomThrottled.WithLabelValues(throttleMessages).Inc()
+		return errRoomThrottled
+	}
+	if s.bytes != nil && !s.bytes.AllowN(now, size) {
+		metrics.RoomThrottled.WithLabelValues(throttleBytes).Inc()
+		return errRoomThrottled
+	}
+	return nil
+}
+
+// roomBudget returns a room's budget, reloading its overrides from Redis
+// when they are stale
+func (cm *ConnectionManager) roomBudget(room string) *roomBudget {
+	cm.roomBudgetsMu.Lock()
+	budget, ok := cm.roomBudgets[room]
+	cm.roomBudgetsMu.Unlock()
+	if ok && time.Since(budget.loadedAt) < roomBudgetRefresh {
+		return budget
+	}
+
+	msgRate, byteRate := cm.loadRoomBudget(room)
+
+	cm.roomBudgetsMu.Lock()
+	defer cm.roomBudgetsMu.Unlock()
+
+	now := time.Now()
+	budget, ok = cm.roomBudgets[room]
+	if !ok || budget.msgRate != msgRate || budget.byteRate != byteRate {
+		// New limits apply to fresh limiters
+		budget = &roomBudget{senders: make(map[string]*senderBudget)}
+		cm.roomBudgets[room] = budget
+	}
+	budget.msgRate, budget.byteRate, budget.loadedAt = msgRate, byteRate, now
+
+	for id, s := range budget.senders {
+		if now.Sub(s.lastUsed) > roomBudgetRefresh {
+			delete(budget.senders, id)
+		}
+	}
+	return budget
+}
+
+// loadRoomBudget reads a room's budget overrides, falling back to the
+// -room-msg-rate and -room-byte-rate defaults for unset or unreadable fields
+func (cm *ConnectionManager) loadRoomBudget(room string) (float64, int) {
+	msgRate, byteRate := *roomMsgRate, *roomByteRate
+
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	fields, err := cm.redis.HGetAll(ctx, cm.key(redisRoomKey+room+roomBudgetSuffix)).Result()
+	if err != nil {
+		metrics.RedisErrors.WithLabelValues("room_budget").Inc()
+		cm.logger.Debug("Failed to load room budget", zap.String("room", room), zap.Error(err))
+		return msgRate, byteRate
+	}
+
+	if v, err := strconv.ParseFloat(fields["msg_rate"], 64); err == nil && v >= 0 {
+		msgRate = v
+	}
+	if v, err := strconv.Atoi(fields["byte_rate"]); err == nil && v >= 0 {
+		byteRate = v
+	}
+	return msgRate, byteRate
+}
+
+// dropRoomBudget forgets a room's budget once it has no local members
+func (cm *ConnectionManager) dropRoomBudget(room string) {
+	cm.roomBudgetsMu.Lock()
+	delete(cm.roomBudgets, room)
+	cm.roomBudgetsMu.Unlock()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// newBudgetManager returns a manager whose budget for room is already
+// loaded, so no Redis lookup is needed
+func newBudgetManager(t *testing.T, room string, msgRate float64, byteRate int) *ConnectionManager {
+	t.Helper()
+	oldMsg, oldBytes := *roomMsgRate, *roomByteRate
+	*roomMsgRate, *roomByteRate = msgRate, byteRate
+	t.Cleanup(func() { *roomMsgRate, *roomByteRate = oldMsg, oldBytes })
+
+	return &ConnectionManager{roomBudgets: map[string]*roomBudget{
+		room: {msgRate: msgRate, byteRate: byteRate, loadedAt: time.Now(), senders: make(map[string]*senderBudget)},
+	}}
+}
+
+func TestAllowRoomSendMessages(t *testing.T) {
+	cm := newBudgetManager(t, "call", 2, 0)
+	alice, bob := &Client{ID: "alice-1"}, &Client{ID: "bob-1"}
+
+	// A budget of 2 msg/s allows a burst of 3
+	for i := 0; i < 3; i++ {
+		if err := cm.allowRoomSend(alice, "call", 100); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	if err := cm.allowRoomSend(alice, "call", 100); err != errRoomThrottled {
+		t.Errorf("message over budget = %v, want errRoomThrottled", err)
+	}
+	if err := cm.allowRoomSend(bob, "call", 100); err != nil {
+		t.Errorf("other sender throttled: %v", err)
+	}
+}
+
+func TestAllowRoomSendBytes(t *testing.T) {
+	cm := newBudgetManager(t, "call", 0, 1000)
+	alice := &Client{ID: "alice-1"}
+
+	if err := cm.allowRoomSend(alice, "call", 600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.allowRoomSend(alice, "call", 600); err != errRoomThrottled {
+		t.Errorf("bytes over budget = %v, want errRoomThrottled", err)
+	}
+	if err := cm.allowRoomSend(alice, "call", 300); err != nil {
+		t.Errorf("bytes within budget: %v", err)
+	}
+}
+
+func TestAllowRoomSendUnlimited(t *testing.T) {
+	cm := newBudgetManager(t, "call", 0, 0)
+	alice := &Client{ID: "alice-1"}
+	for i := 0; i < 100; i++ {
+		if err := cm.allowRoomSend(alice, "call", 1<<20); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Room join rules
+const (
+	JoinRulePublic = "public"
+	JoinRuleInvite = "invite"
+	JoinRuleKnock  = "knock"
+)
+
+// Room policy key suffixes (appended to redisRoomKey + room)
+const (
+	roomMetaSuffix     = ":meta"
+	roomJoinRuleSuffix = ":join_rule"
+	roomInvitesSuffix  = ":invites"
+	roomKnocksSuffix   = ":knocks"
+)
+
+// RoomInfo holds a room's persisted metadata
+type RoomInfo struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Topic     string    `json:"topic,omitempty"`
+	Owner     string    `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Room is a signaling room: its metadata plus the clients on this server
+// subscribed to it. Members are guarded by the manager's rooms lock.
+type Room struct {
+	RoomInfo
+	members    map[string]*Client // client_id -> client
+	pubsub     *redis.PubSub      // room traffic from other servers
+	pubsubDone chan struct{}      // closed when pubsub stops delivering
+}
+
+// RoomHook is called when a client joins or leaves a room
+type RoomHook func(room string, client *Client)
+
+// newRoom creates a room with no members
+func newRoom(info RoomInfo) *Room {
+	return &Room{
+		RoomInfo: info,
+		members:  make(map[string]*Client),
+	}
+}
+
+// addMember adds a client, reporting whether it wasn't already a member
+func (r *Room) addMember(client *Client) bool {
+	if _, ok := r.members[client.ID]; ok {
+		return false
+	}
+	r.members[client.ID] = client
+	return true
+}
+
+// removeMember removes a client, reporting whether it was a member
+func (r *Room) removeMember(client *Client) bool {
+	if _, ok := r.members[client.ID]; !ok {
+		return false
+	}
+	delete(r.members, client.ID)
+	return true
+}
+
+// subscriptionEnded reports whether the room's Redis subscription has
+// stopped delivering messages
+func (r *Room) subscriptionEnded() bool {
+	select {
+	case <-r.pubsubDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// Empty reports whether the room has no local members
+func (r *Room) Empty() bool {
+	return len(r.members) == 0
+}
+
+// Room errors
+var (
+	errRoomNotFound      = errors.New("room not found")
+	errRoomExists        = errors.New("room already exists")
+	errInvalidJoinRule   = errors.New("invalid join rule")
+	errRoomInviteOnly    = errors.New("room is invite-only")
+	errRoomKnockRequired = errors.New("room requires a knock before joining")
+	errKnockNotAllowed   = errors.New("room does not accept knocks")
+	errGuestForbidden    = errors.New("guests may only join public rooms")
+	errTooManyRooms      = errors.New("room subscription limit reached")
+	errNotSubscribed     = errors.New("not subscribed to room")
+)
+
+// validJoinRule reports whether rule is a known join rule
+func validJoinRule(rule string) bool {
+	switch rule {
+	case JoinRulePublic, JoinRuleInvite, JoinRuleKnock:
+		return true
+	}
+	return false
+}
+
+// roomAccessErrorCode maps a room access error to its error frame code,
+// returning "" for errors that aren't access decisions
+func roomAccessErrorCode(err error) string {
+	switch err {
+	case errRoomInviteOnly, errKnockNotAllowed, errGuestForbidden, errNotSubscribed:
+		return ErrCodeForbidden
+	case errRoomKnockRequired:
+		return ErrCodeKnockRequired
+	case errTooManyRooms:
+		return ErrCodeRoomLimit
+	}
+	return ""
+}
+
+// fireJoin runs the OnJoin hook, if any
+func (cm *ConnectionManager) fireJoin(room string, client *Client) {
+	if cm.OnJoin != nil {
+		cm.OnJoin(room, client)
+	}
+}
+
+// fireLeave runs the OnLeave hook, if any
+func (cm *ConnectionManager) fireLeave(room string, client *Client) {
+	if cm.OnLeave != nil {
+		cm.OnLeave(room, client)
+	}
+}
+
+// announceMembership tells a room's other members on this server that a
+// client joined or left it, with the room's occupancy after the change
+func (cm *ConnectionManager) announceMembership(room string, client *Client, msgType string, occupancy int) {
+	cm.deliverToRoomExcept(room, SignalingMessage{
+		Type: msgType,
+		From: client.UserID,
+		Room: room,
+		Payload: RoomMemberPayload{
+			UserID:    client.UserID,
+			DeviceID:  client.DeviceID,
+			Occupancy: occupancy,
+		},
+		Timestamp: time.Now().Unix(),
+	}, client)
+}
+
+// CreateRoom persists metadata for a new room
+func (cm *ConnectionManager) CreateRoom(info RoomInfo) (*RoomInfo, error) {
+	if info.ID == "" {
+		return nil, errors.New("room id is required")
+	}
+	info.CreatedAt = time.Now().UTC()
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	created, err := cm.redis.SetNX(ctx, cm.key(redisRoomKey+info.ID+roomMetaSuffix), data, 0).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, errRoomExists
+	}
+
+	if err := cm.redis.SAdd(ctx, cm.key(redisRoomsKey), info.ID).Err(); err != nil {
+		return nil, err
+	}
+
+	// Pick up metadata if the room is already active locally
+	cm.roomsMu.Lock()
+	if r, ok := cm.rooms[info.ID]; ok {
+		r.RoomInfo = info
+	}
+	cm.roomsMu.Unlock()
+
+	return &info, nil
+}
+
+// GetRoom loads a room's metadata
+func (cm *ConnectionManager) GetRoom(room string) (*RoomInfo, error) {
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	data, err := cm.redis.Get(ctx, cm.key(redisRoomKey+room+roomMetaSuffix)).Bytes()
+	if err == redis.Nil {
+		return nil, errRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var info RoomInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ListRooms returns metadata for all created rooms, ordered by ID. Rooms are
+// read from replicas when enabled, so a room just created may be missing.
+func (cm *ConnectionManager) ListRooms() ([]RoomInfo, error) {
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	client := cm.readRedis()
+	ids, err := client.SMembers(ctx, cm.key(redisRoomsKey)).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	rooms := make([]RoomInfo, 0, len(ids))
+	for _, id := range ids {
+		data, err := client.Get(ctx, cm.key(redisRoomKey+id+roomMetaSuffix)).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var info RoomInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			continue
+		}
+		rooms = append(rooms, info)
+	}
+	return rooms, nil
+}
+
+// GetJoinRule returns the join rule for a room, defaulting to public
+func (cm *ConnectionManager) GetJoinRule(room string) (string, error) {
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	rule, err := cm.redis.Get(ctx, cm.key(redisRoomKey+room+roomJoinRuleSuffix)).Result()
+	if err == redis.Nil {
+		return JoinRulePublic, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return rule, nil
+}
+
+// SetJoinRule sets the join rule for a room
+func (cm *ConnectionManager) SetJoinRule(room, rule string) error {
+	if !validJoinRule(rule) {
+		return errInvalidJoinRule
+	}
+
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	return cm.redis.Set(ctx, cm.key(redisRoomKey+room+roomJoinRuleSuffix), rule, 0).Err()
+}
+
+// InviteUser adds a user to a room's invite list
+func (cm *ConnectionManager) InviteUser(room, userID string) error {
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	pipe := cm.redis.TxPipeline()
+	pipe.SAdd(ctx, cm.key(redisRoomKey+room+roomInvitesSuffix), userID)
+	pipe.SRem(ctx, cm.key(redisRoomKey+room+roomKnocksSuffix), userID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// RevokeInvite removes a user from a room's invite list
+func (cm *ConnectionManager) RevokeInvite(room, userID string) error {
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	return cm.redis.SRem(ctx, cm.key(redisRoomKey+room+roomInvitesSuffix), userID).Err()
+}
+
+// authorizeJoin checks whether a client may subscribe to a room
+func (cm *ConnectionManager) authorizeJoin(client *Client, room string) error {
+	rule, err := cm.GetJoinRule(room)
+	if err != nil {
+		return err
+	}
+
+	if rule == JoinRulePublic {
+		return nil
+	}
+	if client.Guest {
+		return errGuestForbidden
+	}
+
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	invited, err := cm.redis.SIsMember(ctx, cm.key(redisRoomKey+room+roomInvitesSuffix), client.UserID).Result()
+	if err != nil {
+		return err
+	}
+	if invited {
+		return nil
+	}
+
+	if rule == JoinRuleKnock {
+		return errRoomKnockRequired
+	}
+	return errRoomInviteOnly
+}
+
+// Knock records a request to join a knock room and notifies its members
+func (cm *ConnectionManager) Knock(client *Client, room string) error {
+	rule, err := cm.GetJoinRule(room)
+	if err != nil {
+		return err
+	}
+	if rule != JoinRuleKnock {
+		return errKnockNotAllowed
+	}
+
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	if err := cm.redis.SAdd(ctx, cm.key(redisRoomKey+room+roomKnocksSuffix), client.UserID).Err(); err != nil {
+		return err
+	}
+
+	return cm.deliverToRoom(room, SignalingMessage{
+		Type:      MsgKnock,
+		From:      client.UserID,
+		Room:      room,
+		Timestamp: time.Now().Unix(),
+	})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// newTestRedis returns a client for the Redis server at REDIS_ADDR, or for
+// an in-process miniredis when REDIS_ADDR is unset
+func newTestRedis(t testing.TB) *redis.Client {
+	t.Helper()
+
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = miniredis.RunT(t).Addr()
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		t.Skipf("Redis not available at %s: %v", addr, err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newTestManager returns a connection manager backed by newTestRedis, under
+// a namespace of its own
+func newTestManager(t testing.TB) *ConnectionManager {
+	t.Helper()
+	return newTestManagerOn(t, newTestRedis(t), "test-"+uuid.New().String())
+}
+
+// newTestManagerOn returns a connection manager using client under
+// namespace with a server ID of its own, so several managers can share one
+// Redis like separate servers
+func newTestManagerOn(t testing.TB, client *redis.Client, namespace string) *ConnectionManager {
+	t.Helper()
+
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	ns, id := *redisNS, serverID
+	*redisNS, serverID = namespace, generateServerID()
+	cm := NewConnectionManager(client, zap.NewNop())
+	*redisNS, serverID = ns, id
+
+	t.Cleanup(cm.cancel)
+	return cm
+}
+
+func TestValidJoinRule(t *testing.T) {
+	tests := map[string]bool{
+		JoinRulePublic: true,
+		JoinRuleInvite: true,
+		JoinRuleKnock:  true,
+		"":             false,
+		"private":      false,
+		"Public":       false,
+	}
+	for rule, want := range tests {
+		if got := validJoinRule(rule); got != want {
+			t.Errorf("validJoinRule(%q) = %v, want %v", rule, got, want)
+		}
+	}
+}
+
+func TestRoomAccessErrorCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{errRoomInviteOnly, ErrCodeForbidden},
+		{errKnockNotAllowed, ErrCodeForbidden},
+		{errGuestForbidden, ErrCodeForbidden},
+		{errNotSubscribed, ErrCodeForbidden},
+		{errRoomKnockRequired, ErrCodeKnockRequired},
+		{errTooManyRooms, ErrCodeRoomLimit},
+		{context.DeadlineExceeded, ""},
+	}
+	for _, tt := range tests {
+		if got := roomAccessErrorCode(tt.err); got != tt.want {
+			t.Errorf("roomAccessErrorCode(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorizeJoin(t *testing.T) {
+	cm := newTestManager(t)
+
+	member := NewClient("alice", "phone", nil, zap.NewNop(), wsTimings())
+	guest := NewClient("guest-1", "guest-1", nil, zap.NewNop(), wsTimings())
+	guest.Guest = true
+
+	if err := cm.SetJoinRule("invite-room", JoinRuleInvite); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.SetJoinRule("knock-room", JoinRuleKnock); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		client *Client
+		room   string
+		want   error
+	}{
+		{"public room", member, "public-room", nil},
+		{"guest in public room", guest, "public-room", nil},
+		{"uninvited", member, "invite-room", errRoomInviteOnly},
+		{"guest in invite room", guest, "invite-room", errGuestForbidden},
+		{"knock room", member, "knock-room", errRoomKnockRequired},
+	}
+	for _, tt := range tests {
+		if err := cm.authorizeJoin(tt.client, tt.room); err != tt.want {
+			t.Errorf("%s: authorizeJoin = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	if err := cm.InviteUser("invite-room", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.authorizeJoin(member, "invite-room"); err != nil {
+		t.Errorf("invited user: authorizeJoin = %v, want nil", err)
+	}
+}
+
+func TestRoomLifecycle(t *testing.T) {
+	cm := newTestManager(t)
+
+	var joined, left []string
+	cm.OnJoin = func(room string, client *Client) { joined = append(joined, room+"/"+client.UserID) }
+	cm.OnLeave = func(room string, client *Client) { left = append(left, room+"/"+client.UserID) }
+
+	info, err := cm.CreateRoom(RoomInfo{ID: "standup", Name: "Standup", Owner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.CreatedAt.IsZero() {
+		t.Error("CreateRoom left CreatedAt unset")
+	}
+	if _, err := cm.CreateRoom(RoomInfo{ID: "standup"}); err != errRoomExists {
+		t.Errorf("second CreateRoom = %v, want errRoomExists", err)
+	}
+	if _, err := cm.GetRoom("missing"); err != errRoomNotFound {
+		t.Errorf("GetRoom(missing) = %v, want errRoomNotFound", err)
+	}
+	rooms, err := cm.ListRooms()
+	if err != nil || len(rooms) != 1 || rooms[0].Name != "Standup" {
+		t.Errorf("ListRooms = %+v, %v", rooms, err)
+	}
+
+	alice := NewClient("alice", "phone", nil, zap.NewNop(), wsTimings())
+	if err := cm.Subscribe(alice, "standup", false); err != nil {
+		t.Fatal(err)
+	}
+	cm.roomsMu.RLock()
+	r := cm.rooms["standup"]
+	cm.roomsMu.RUnlock()
+	if r == nil || r.Name != "Standup" || r.Owner != "alice" || r.Empty() {
+		t.Errorf("active room = %+v, want the stored metadata and alice", r)
+	}
+
+	if err := cm.Unsubscribe(alice, "standup"); err != nil {
+		t.Fatal(err)
+	}
+	cm.roomsMu.RLock()
+	_, active := cm.rooms["standup"]
+	cm.roomsMu.RUnlock()
+	if active {
+		t.Error("room still active after its last member left")
+	}
+
+	if len(joined) != 1 || joined[0] != "standup/alice" || len(left) != 1 || left[0] != "standup/alice" {
+		t.Errorf("hooks saw joins %v and leaves %v", joined, left)
+	}
+}
+
+func TestRoomReplayOrder(t *testing.T) {
+	count := *roomReplayCount
+	*roomReplayCount = 2
+	t.Cleanup(func() { *roomReplayCount = count })
+
+	cm := newTestManager(t)
+	srv := serveTestManager(t, cm)
+	for _, payload := range []string{"1", "2", "3"} {
+		if err := cm.BroadcastToRoom("standup", SignalingMessage{Type: MsgAnnouncement, Room: "standup", Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	alice := dialTest(t, srv, "alice", "phone")
+	alice.send(SignalingMessage{Type: MsgSubscribe, Room: "standup", Replay: true})
+	waitFor(t, "alice to join", func() bool {
+		clients := cm.GetClientByUserID("alice")
+		return len(clients) == 1 && cm.isMember(clients[0], "standup")
+	})
+	if err := cm.BroadcastToRoom("standup", SignalingMessage{Type: MsgAnnouncement, Room: "standup", Payload: "4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"2", "3", "4"} {
+		if got := alice.next(MsgAnnouncement).Payload; got != want {
+			t.Fatalf("received message %v, want %s", got, want)
+		}
+	}
+}
+
+func TestMaxRoomsPerClient(t *testing.T) {
+	limit := *maxRoomsPerClient
+	*maxRoomsPerClient = 2
+	t.Cleanup(func() { *maxRoomsPerClient = limit })
+
+	cm := newTestManager(t)
+	alice := NewClient("alice", "phone", nil, zap.NewNop(), wsTimings())
+	for _, room := range []string{"one", "two"} {
+		if err := cm.Subscribe(alice, room, false); err != nil {
+			t.Fatalf("Subscribe(%s): %v", room, err)
+		}
+	}
+
+	if err := cm.Subscribe(alice, "three", false); err != errTooManyRooms {
+		t.Errorf("third Subscribe = %v, want errTooManyRooms", err)
+	}
+	cm.roomsMu.RLock()
+	_, created := cm.rooms["three"]
+	cm.roomsMu.RUnlock()
+	if created {
+		t.Error("refused subscription left an empty room behind")
+	}
+
+	if err := cm.Unsubscribe(alice, "one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.Subscribe(alice, "three", false); err != nil {
+		t.Errorf("Subscribe after leaving a room = %v", err)
+	}
+}
+
+func TestRoomGauges(t *testing.T) {
+	cm := newTestManager(t)
+	subscriptions := testutil.ToFloat64(metrics.RedisSubscriptions)
+	alice := NewClient("alice", "phone", nil, zap.NewNop(), wsTimings())
+	bob := NewClient("bob", "laptop", nil, zap.NewNop(), wsTimings())
+
+	steps := []struct {
+		name     string
+		do       func() error
+		wantRoom float64
+	}{
+		{"alice joins one", func() error { return cm.Subscribe(alice, "one", false) }, 1},
+		{"bob joins one", func() error { return cm.Subscribe(bob, "one", false) }, 1},
+		{"alice joins two", func() error { return cm.Subscribe(alice, "two", false) }, 2},
+		{"alice leaves one", func() error { return cm.Unsubscribe(alice, "one") }, 2},
+		{"bob leaves one", func() error { return cm.Unsubscribe(bob, "one") }, 1},
+		{"bob leaves one again", func() error { return cm.Unsubscribe(bob, "one") }, 1},
+		{"alice disconnects", func() error { cm.RemoveClient(alice); return nil }, 0},
+	}
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := testutil.ToFloat64(metrics.Rooms); got != step.wantRoom {
+			t.Errorf("%s: rooms gauge %v, want %v", step.name, got, step.wantRoom)
+		}
+		// One Redis subscription per active room
+		if got := testutil.ToFloat64(metrics.RedisSubscriptions) - subscriptions; got != step.wantRoom {
+			t.Errorf("%s: subscriptions gauge up %v, want %v", step.name, got, step.wantRoom)
+		}
+	}
+}
+
+func TestRoomMembershipEvents(t *testing.T) {
+	cm := newTestManager(t)
+	srv := serveTestManager(t, cm)
+
+	alice := dialTest(t, srv, "alice", "phone")
+	alice.send(SignalingMessage{Type: MsgSubscribe, Room: "standup"})
+	waitFor(t, "alice to join", func() bool {
+		clients := cm.GetClientByUserID("alice")
+		return len(clients) == 1 && cm.isMember(clients[0], "standup")
+	})
+
+	// member returns the next membership event alice receives of msgType
+	member := func(msgType string) RoomMemberPayload {
+		t.Helper()
+		msg := alice.next(msgType)
+		var payload RoomMemberPayload
+		if err := decodePayload(msg.Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Room != "standup" {
+			t.Errorf("%s for room %q, want standup", msgType, msg.Room)
+		}
+		return payload
+	}
+
+	bob := dialTest(t, srv, "bob", "laptop")
+	carol := dialTest(t, srv, "carol", "tablet")
+	bob.send(SignalingMessage{Type: MsgSubscribe, Room: "standup"})
+	if got, want := member(MsgRoomJoin), (RoomMemberPayload{UserID: "bob", DeviceID: "laptop", Occupancy: 2}); got != want {
+		t.Errorf("join announced %+v, want %+v", got, want)
+	}
+	carol.send(SignalingMessage{Type: MsgSubscribe, Room: "standup"})
+	if got, want := member(MsgRoomJoin), (RoomMemberPayload{UserID: "carol", DeviceID: "tablet", Occupancy: 3}); got != want {
+		t.Errorf("join announced %+v, want %+v", got, want)
+	}
+
+	// Leaving and disconnecting both tell the members who remain
+	bob.send(SignalingMessage{Type: MsgUnsubscribe, Room: "standup"})
+	if got, want := member(MsgRoomLeave), (RoomMemberPayload{UserID: "bob", DeviceID: "laptop", Occupancy: 2}); got != want {
+		t.Errorf("leave announced %+v, want %+v", got, want)
+	}
+	carol.conn.Close()
+	if got, want := member(MsgRoomLeave), (RoomMemberPayload{UserID: "carol", DeviceID: "tablet", Occupancy: 1}); got != want {
+		t.Errorf("disconnect announced %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// defaultBlockedCandidateCIDRs covers loopback, link-local and the
+// RFC 1918 / unique local ranges
+const defaultBlockedCandidateCIDRs = "127.0.0.0/8,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,169.254.0.0/16,::1/128,fc00::/7,fe80::/10"
+
+// Actions for ICE candidates in blocked ranges
+const (
+	candidateActionStrip  = "strip"  // drop the candidate and relay the rest
+	candidateActionReject = "reject" // refuse the whole message
+)
+
+var (
+	errMalformedCandidate = errors.New("malformed ICE candidate")
+	errBlockedCandidate   = errors.New("ICE candidate address not allowed")
+	errTooManyCandidates  = errors.New("too many ICE candidates")
+)
+
+// sdpSanitizer checks the SDP and ICE candidates in offers, answers and
+// candidate messages before they are relayed, so clients can't point peers
+// at internal addresses
+type sdpSanitizer struct {
+	blocked       []*net.IPNet
+	action        string
+	maxCandidates int
+}
+
+// newSDPSanitizer creates a sanitizer blocking the comma-separated CIDRs
+func newSDPSanitizer(cidrs, action string, maxCandidates int) (*sdpSanitizer, error) {
+	if action != candidateActionStrip && action != candidateActionReject {
+		return nil, errors.New("invalid blocked candidate action: " + action)
+	}
+
+	blocked, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sdpSanitizer{blocked: blocked, action: action, maxCandidates: maxCandidates}, nil
+}
+
+// Sanitize validates msg's payload in place. It reports whether the message
+// should still be relayed; a candidate message whose only candidate was
+// stripped is not.
+func (s *sdpSanitizer) Sanitize(msg *SignalingMessage) (bool, error) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return true, nil
+	}
+
+	switch msg.Type {
+	case MsgOffer, MsgAnswer:
+		sdp, ok := payload["sdp"].(string)
+		if !ok {
+			return true, nil
+		}
+		cleaned, err := s.sanitizeSDP(sdp)
+		if err != nil {
+			return false, err
+		}
+		payload["sdp"] = cleaned
+		return true, nil
+	case MsgCandidate:
+		candidate, ok := payload["candidate"].(string)
+		if !ok || candidate == "" {
+			// An empty candidate signals end-of-candidates
+			return true, nil
+		}
+		allowed, err := s.checkCandidate(candidate)
+		if err != nil {
+			return false, err
+		}
+		return allowed, nil
+	}
+
+	return true, nil
+}
+
+// sanitizeSDP drops or rejects blocked candidate lines in an SDP body
+func (s *sdpSanitizer) sanitizeSDP(sdp string) (string, error) {
+	newline := "\r\n"
+	if !strings.Contains(sdp, newline) {
+		newline = "\n"
+	}
+
+	lines := strings.Split(sdp, newline)
+	kept := lines[:0]
+	candidates := 0
+
+	for _, line := range lines {
+		if strings.HasPrefix(line, "a=candidate:") {
+			candidates++
+			if s.maxCandidates > 0 && candidates > s.maxCandidates {
+				return "", errTooManyCandidates
+			}
+
+			allowed, err := s.checkCandidate(line)
+			if err != nil {
+				return "", err
+			}
+			if !allowed {
+				continue
+			}
+		}
+		kept = append(kept, line)
+	}
+
+	return strings.Join(kept, newline), nil
+}
+
+// checkCandidate parses a candidate attribute and reports whether it may be
+// relayed. Blocked candidates are an error under the reject action.
+func (s *sdpSanitizer) checkCandidate(candidate string) (bool, error) {
+	// candidate:<foundation> <component> <transport> <priority> <address> <port> typ <type> ...
+	fields := strings.Fields(strings.TrimPrefix(candidate, "a="))
+	if len(fields) < 8 || !strings.HasPrefix(fields[0], "candidate:") || fields[6] != "typ" {
+		return false, errMalformedCandidate
+	}
+
+	// Hostname candidates (mDNS .local names) carry no address to check
+	ip := net.ParseIP(fields[4])
+	if ip == nil || !s.isBlocked(ip) {
+		return true, nil
+	}
+
+	metrics.BlockedCandidates.WithLabelValues(s.action).Inc()
+
+	if s.action == candidateActionReject {
+		return false, errBlockedCandidate
+	}
+	return false, nil
+}
+
+// isBlocked reports whether ip falls in a blocked range
+func (s *sdpSanitizer) isBlocked(ip net.IP) bool {
+	for _, network := range s.blocked {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
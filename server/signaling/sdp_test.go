@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testSDP = "v=0\r\n" +
+	"o=- 1 2 IN IP4 127.0.0.1\r\n" +
+	"a=candidate:1 1 udp 2122260223 192.168.1.10 54400 typ host\r\n" +
+	"a=candidate:2 1 udp 1686052607 203.0.113.7 54400 typ srflx raddr 192.168.1.10 rport 54400\r\n" +
+	"a=candidate:3 1 udp 2122260223 abcd.local 54401 typ host\r\n"
+
+func newTestSanitizer(t *testing.T, action string, maxCandidates int) *sdpSanitizer {
+	t.Helper()
+	s, err := newSDPSanitizer(defaultBlockedCandidateCIDRs, action, maxCandidates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestNewSDPSanitizerInvalid(t *testing.T) {
+	if _, err := newSDPSanitizer(defaultBlockedCandidateCIDRs, "drop", 0); err == nil {
+		t.Error("unknown action accepted")
+	}
+	if _, err := newSDPSanitizer("10.0.0.0/33", candidateActionStrip, 0); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+}
+
+func TestSanitizeSDPStrip(t *testing.T) {
+	s := newTestSanitizer(t, candidateActionStrip, 0)
+
+	cleaned, err := s.sanitizeSDP(testSDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(cleaned, "192.168.1.10 54400 typ host") {
+		t.Error("private host candidate was kept")
+	}
+	if !strings.Contains(cleaned, "203.0.113.7") || !strings.Contains(cleaned, "abcd.local") {
+		t.Errorf("public or mDNS candidate was dropped:\n%s", cleaned)
+	}
+	if !strings.HasPrefix(cleaned, "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\n") {
+		t.Errorf("non-candidate lines changed:\n%s", cleaned)
+	}
+}
+
+func TestSanitizeSDPReject(t *testing.T) {
+	s := newTestSanitizer(t, candidateActionReject, 0)
+	if _, err := s.sanitizeSDP(testSDP); err != errBlockedCandidate {
+		t.Errorf("sanitizeSDP = %v, want errBlockedCandidate", err)
+	}
+}
+
+func TestSanitizeSDPMaxCandidates(t *testing.T) {
+	s := newTestSanitizer(t, candidateActionStrip, 2)
+	if _, err := s.sanitizeSDP(testSDP); err != errTooManyCandidates {
+		t.Errorf("sanitizeSDP = %v, want errTooManyCandidates", err)
+	}
+}
+
+func TestSanitizeCandidateMessage(t *testing.T) {
+	s := newTestSanitizer(t, candidateActionStrip, 0)
+	tests := []struct {
+		name      string
+		candidate string
+		want      bool
+		wantErr   error
+	}{
+		{"public", "candidate:2 1 udp 1686052607 203.0.113.7 54400 typ srflx", true, nil},
+		{"loopback", "candidate:1 1 udp 2122260223 127.0.0.1 54400 typ host", false, nil},
+		{"ipv6 link-local", "candidate:1 1 udp 2122260223 fe80::1 54400 typ host", false, nil},
+		{"end of candidates", "", true, nil},
+		{"malformed", "candidate:1 1 udp", false, errMalformedCandidate},
+	}
+	for _, tt := range tests {
+		msg := &SignalingMessage{Type: MsgCandidate, Payload: map[string]interface{}{"candidate": tt.candidate}}
+		got, err := s.Sanitize(msg)
+		if got != tt.want || err != tt.wantErr {
+			t.Errorf("%s: Sanitize = %v, %v; want %v, %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
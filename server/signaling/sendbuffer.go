@@ -0,0 +1,57 @@
+package main
+
+import "time"
+
+// Send buffer sampling
+const (
+	sendBufferSampleInterval = 5 * time.Second
+	sendBufferHighWater      = 0.75 // fraction of the send buffer in use
+	slowClientSamples        = 3    // samples in a row above the high-water mark
+)
+
+// sendBufferSampler periodically records how full clients' send buffers are
+func (cm *ConnectionManager) sendBufferSampler() {
+	ticker := time.NewTicker(sendBufferSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cm.sampleSendBuffers()
+		case <-cm.ctx.Done():
+			return
+		}
+	}
+}
+
+// sampleSendBuffers observes each client's send buffer usage and sets the
+// slow clients gauge to the number of clients above the high-water mark for
+// slowClientSamples samples in a row. The clients lock is held only to copy
+// the client list.
+func (cm *ConnectionManager) sampleSendBuffers() {
+	cm.clientsMu.RLock()
+	clients := make([]*Client, 0, len(cm.clients))
+	for _, client := range cm.clients {
+		clients = append(clients, client)
+	}
+	cm.clientsMu.RUnlock()
+
+	slow := 0
+	for _, client := range clients {
+		if cap(client.Send) == 0 {
+			continue
+		}
+		usage := float64(len(client.Send)) / float64(cap(client.Send))
+		metrics.SendBufferUsage.Observe(usage)
+
+		if usage < sendBufferHighWater {
+			client.highWaterSamples = 0
+			continue
+		}
+		client.highWaterSamples++
+		if client.highWaterSamples >= slowClientSamples {
+			slow++
+		}
+	}
+	metrics.SlowClients.Set(float64(slow))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestSampleSendBuffersMarksSlowClients(t *testing.T) {
+	slow := NewClient("alice", "phone", nil, zap.NewNop(), wsTimings())
+	idle := NewClient("bob", "laptop", nil, zap.NewNop(), wsTimings())
+	cm := &ConnectionManager{clients: map[string]*Client{slow.ID: slow, idle.ID: idle}}
+
+	for i := 0; i < cap(slow.Send)*3/4; i++ {
+		slow.Send <- nil
+	}
+
+	for i := 1; i <= slowClientSamples; i++ {
+		cm.sampleSendBuffers()
+		want := 0.0
+		if i >= slowClientSamples {
+			want = 1
+		}
+		if got := testutil.ToFloat64(metrics.SlowClients); got != want {
+			t.Errorf("after %d samples: slow clients = %v, want %v", i, got, want)
+		}
+	}
+
+	// Draining below the high-water mark clears the streak
+	<-slow.Send
+	cm.sampleSendBuffers()
+	if got := testutil.ToFloat64(metrics.SlowClients); got != 0 {
+		t.Errorf("after draining: slow clients = %v, want 0", got)
+	}
+	if slow.highWaterSamples != 0 || idle.highWaterSamples != 0 {
+		t.Errorf("high-water streaks = %d, %d, want 0", slow.highWaterSamples, idle.highWaterSamples)
+	}
+}
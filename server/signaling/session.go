@@ -0,0 +1,79 @@
+package main
+
+import "errors"
+
+// Offer kinds for the offers counter
+const (
+	offerKindInitial       = "initial"
+	offerKindRenegotiation = "renegotiation"
+	offerKindICERestart    = "ice_restart"
+)
+
+// Limits on the call sessions tracked per client
+const (
+	maxSessionIDLength = 128
+	maxTrackedSessions = 64
+)
+
+var (
+	errInvalidSessionID  = errors.New("session_id must be a non-empty string of at most 128 characters")
+	errInvalidICERestart = errors.New("ice_restart must be a boolean")
+)
+
+// sessionFields returns the session_id and ice_restart fields of an offer or
+// answer payload. Both are optional; payloads without them are relayed as
+// before.
+func sessionFields(msg SignalingMessage) (string, bool, error) {
+	payload, ok := msg.Payload.(map[string]interface{})
+	if !ok {
+		return "", false, nil
+	}
+
+	var sessionID string
+	if raw, ok := payload["session_id"]; ok {
+		sessionID, ok = raw.(string)
+		if !ok || sessionID == "" || len(sessionID) > maxSessionIDLength {
+			return "", false, errInvalidSessionID
+		}
+	}
+
+	var iceRestart bool
+	if raw, ok := payload["ice_restart"]; ok {
+		iceRestart, ok = raw.(bool)
+		if !ok {
+			return "", false, errInvalidICERestart
+		}
+	}
+
+	return sessionID, iceRestart, nil
+}
+
+// classifyOffer reports whether an offer starts a call session, renegotiates
+// one the client already offered, or restarts ICE. Offers without a
+// session_id always count as initial.
+func (c *Client) classifyOffer(msg SignalingMessage) (string, error) {
+	sessionID, iceRestart, err := sessionFields(msg)
+	if err != nil {
+		return "", err
+	}
+	if iceRestart {
+		return offerKindICERestart, nil
+	}
+	if sessionID == "" {
+		return offerKindInitial, nil
+	}
+
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+
+	if _, ok := c.sessions[sessionID]; ok {
+		return offerKindRenegotiation, nil
+	}
+
+	// Forget old sessions rather than grow without bound on long connections
+	if c.sessions == nil || len(c.sessions) >= maxTrackedSessions {
+		c.sessions = make(map[string]struct{})
+	}
+	c.sessions[sessionID] = struct{}{}
+	return offerKindInitial, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestSessionFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload interface{}
+		wantID  string
+		wantICE bool
+		wantErr error
+	}{
+		{"no payload", nil, "", false, nil},
+		{"no fields", map[string]interface{}{"sdp": "v=0"}, "", false, nil},
+		{"session and restart", map[string]interface{}{"session_id": "s1", "ice_restart": true}, "s1", true, nil},
+		{"empty session", map[string]interface{}{"session_id": ""}, "", false, errInvalidSessionID},
+		{"long session", map[string]interface{}{"session_id": strings.Repeat("s", maxSessionIDLength+1)}, "", false, errInvalidSessionID},
+		{"numeric session", map[string]interface{}{"session_id": 7}, "", false, errInvalidSessionID},
+		{"string restart", map[string]interface{}{"ice_restart": "yes"}, "", false, errInvalidICERestart},
+	}
+	for _, tt := range tests {
+		id, ice, err := sessionFields(SignalingMessage{Type: MsgOffer, Payload: tt.payload})
+		if id != tt.wantID || ice != tt.wantICE || err != tt.wantErr {
+			t.Errorf("%s: sessionFields = %q, %v, %v; want %q, %v, %v", tt.name, id, ice, err, tt.wantID, tt.wantICE, tt.wantErr)
+		}
+	}
+}
+
+func TestClassifyOffer(t *testing.T) {
+	client := NewClient("alice", "phone", nil, zap.NewNop(), wsTimings())
+	offer := func(fields map[string]interface{}) SignalingMessage {
+		return SignalingMessage{Type: MsgOffer, Payload: fields}
+	}
+
+	steps := []struct {
+		msg  SignalingMessage
+		want string
+	}{
+		{offer(map[string]interface{}{}), offerKindInitial},
+		{offer(map[string]interface{}{"session_id": "s1"}), offerKindInitial},
+		{offer(map[string]interface{}{"session_id": "s1"}), offerKindRenegotiation},
+		{offer(map[string]interface{}{"session_id": "s2"}), offerKindInitial},
+		{offer(map[string]interface{}{"session_id": "s1", "ice_restart": true}), offerKindICERestart},
+	}
+	for i, step := range steps {
+		got, err := client.classifyOffer(step.msg)
+		if err != nil || got != step.want {
+			t.Errorf("offer %d: classifyOffer = %q, %v; want %q", i, got, err, step.want)
+		}
+	}
+}
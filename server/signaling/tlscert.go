@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// certReloader serves the TLS certificate from -cert/-key, reloading it on
+// SIGHUP so renewed certificates take effect without dropping connections
+type certReloader struct {
+	certPath string
+	keyPath  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+// newCertReloader loads the initial key pair
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	r := &certReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the key pair from disk and swaps it in. On failure the
+// current certificate stays in use.
+func (r *certReloader) Reload() error {
+	cert, err := loadKeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+	r.cert.Store(cert)
+	return nil
+}
+
+// GetCertificate returns the current certificate for new handshakes
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// watch reloads the certificate on every SIGHUP until ctx is done
+func (r *certReloader) watch(ctx context.Context, logger *zap.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-hup:
+			if err := r.Reload(); err != nil {
+				logger.Error("TLS certificate reload failed, keeping the current certificate", zap.Error(err))
+				continue
+			}
+			logger.Info("TLS certificate reloaded", zap.String("cert", r.certPath))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// loadKeyPair loads a certificate and key, rejecting a mismatched pair or a
+// certificate outside its validity period
+func loadKeyPair(certPath, keyPath string) (*tls.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if now := time.Now(); now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate expired %s", leaf.NotAfter.Format(time.RFC3339))
+	} else if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("certificate not valid until %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	pair.Leaf = leaf
+	return &pair, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"testing"
+)
+
+// copyFile overwrites dst with the contents of src
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloadNewHandshakes(t *testing.T) {
+	certPath, keyPath := writeKeyPair(t, "first")
+	renewedCert, renewedKey := writeKeyPair(t, "renewed")
+
+	certs, err := newCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: certs.GetCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}(conn)
+		}
+	}()
+
+	// served returns the name on the certificate a new handshake gets
+	served := func() string {
+		t.Helper()
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	if name := served(); name != "first" {
+		t.Fatalf("served %q before the swap, want first", name)
+	}
+
+	// A half-written renewal is rejected and the current certificate kept
+	copyFile(t, renewedCert, certPath)
+	if err := certs.Reload(); err == nil {
+		t.Error("reloaded a mismatched key pair")
+	}
+	if name := served(); name != "first" {
+		t.Errorf("served %q after a failed reload, want first", name)
+	}
+
+	copyFile(t, renewedKey, keyPath)
+	if err := certs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name := served(); name != "renewed" {
+		t.Errorf("served %q after the swap, want renewed", name)
+	}
+}
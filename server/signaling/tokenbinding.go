@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net"
+)
+
+// deviceFingerprintHeader carries the device fingerprint a token may be
+// bound to
+const deviceFingerprintHeader = "X-Device-Fingerprint"
+
+// errTokenBinding is returned when a bound token is presented from another
+// network or device than it was issued to
+var errTokenBinding = errors.New("token presented from a context it is not bound to")
+
+// bindingHash hashes a binding value for the ip_hash and device_hash claims:
+// unpadded base64url of its HMAC-SHA256 keyed by the JWT secret. A plain
+// hash of a network could be reversed by trying every /24.
+func bindingHash(secret, value string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ipBinding returns the binding value of a client IP: its network under
+// -token-binding-ipv4-bits or -token-binding-ipv6-bits, so a client moving
+// within its provider's network keeps a valid token
+func ipBinding(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	mask := net.CIDRMask(*tokenBindingV6Bits, 128)
+	if v4 := parsed.To4(); v4 != nil {
+		parsed, mask = v4, net.CIDRMask(*tokenBindingV4Bits, 32)
+	}
+	network := net.IPNet{IP: parsed.Mask(mask), Mask: mask}
+	return network.String()
+}
+
+// tokenBinder is implemented by Authenticators whose tokens may carry
+// binding claims
+type tokenBinder interface {
+	checkBinding(claims *Claims, ip, fingerprint string) error
+}
+
+// checkTokenBinding verifies that a token bound to a network or device is
+// presented from that network, by the client IP, and device, by its
+// fingerprint, with the claims hashed under secret. Tokens without binding
+// claims pass.
+func checkTokenBinding(claims *Claims, secret, ip, fingerprint string) error {
+	if claims.IPHash != "" && !bindingMatches(claims.IPHash, secret, ipBinding(ip)) {
+		return errTokenBinding
+	}
+	if claims.DeviceHash != "" && (fingerprint == "" || !bindingMatches(claims.DeviceHash, secret, fingerprint)) {
+		return errTokenBinding
+	}
+	return nil
+}
+
+// bindingMatches compares a binding claim with the hash of a value in
+// constant time
+func bindingMatches(claim, secret, value string) bool {
+	return subtle.ConstantTimeCompare([]byte(claim), []byte(bindingHash(secret, value))) == 1
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPBinding(t *testing.T) {
+	tests := map[string]string{
+		"203.0.113.77":          "203.0.113.0/24",
+		"::ffff:203.0.113.77":   "203.0.113.0/24",
+		"2001:db8:abcd:12::1":   "2001:db8:abcd::/48",
+		"2001:db8:abcd:ffff::9": "2001:db8:abcd::/48",
+		"not-an-ip":             "not-an-ip",
+	}
+	for ip, want := range tests {
+		if got := ipBinding(ip); got != want {
+			t.Errorf("ipBinding(%q) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestCheckTokenBinding(t *testing.T) {
+	ipHash := bindingHash(testSecret, ipBinding("203.0.113.77"))
+	deviceHash := bindingHash(testSecret, "fp-1")
+
+	tests := []struct {
+		name        string
+		claims      Claims
+		ip          string
+		fingerprint string
+		want        error
+	}{
+		{"unbound", Claims{}, "198.51.100.1", "", nil},
+		{"same address", Claims{IPHash: ipHash}, "203.0.113.77", "", nil},
+		{"same network", Claims{IPHash: ipHash}, "203.0.113.5", "", nil},
+		{"other network", Claims{IPHash: ipHash}, "203.0.114.77", "", errTokenBinding},
+		{"same device", Claims{DeviceHash: deviceHash}, "198.51.100.1", "fp-1", nil},
+		{"other device", Claims{DeviceHash: deviceHash}, "198.51.100.1", "fp-2", errTokenBinding},
+		{"missing fingerprint", Claims{DeviceHash: deviceHash}, "198.51.100.1", "", errTokenBinding},
+		{"both match", Claims{IPHash: ipHash, DeviceHash: deviceHash}, "203.0.113.1", "fp-1", nil},
+		{"device matches, network doesn't", Claims{IPHash: ipHash, DeviceHash: deviceHash}, "192.0.2.1", "fp-1", errTokenBinding},
+		{"other secret", Claims{IPHash: bindingHash("other-secret", ipBinding("203.0.113.77"))}, "203.0.113.77", "", errTokenBinding},
+	}
+	for _, tt := range tests {
+		if err := checkTokenBinding(&tt.claims, testSecret, tt.ip, tt.fingerprint); err != tt.want {
+			t.Errorf("%s: checkTokenBinding = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestBoundTokenNetwork(t *testing.T) {
+	binding := *tokenBinding
+	*tokenBinding = true
+	t.Cleanup(func() { *tokenBinding = binding })
+
+	token, err := GenerateJWT("alice", "phone", testSecret, BindToIP("203.0.113.77"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &JWTAuthenticator{Secret: testSecret}
+	authenticate := func(remoteAddr string) error {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Authorization", "Bearer "+token)
+		_, err := auth.Authenticate(r)
+		return err
+	}
+
+	if err := authenticate("203.0.113.5:4000"); err != nil {
+		t.Errorf("same network: %v", err)
+	}
+	if err := authenticate("198.51.100.1:4000"); err != errTokenBinding {
+		t.Errorf("other network: %v, want %v", err, errTokenBinding)
+	}
+}
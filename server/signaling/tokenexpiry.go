@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// tokenExpiryWarning is how long before its token expires a client is sent
+// token_expiring. Expiry is checked on the ping ticker, so the warning may
+// come up to a ping period earlier.
+const tokenExpiryWarning = time.Minute
+
+// Re-authentication errors
+var (
+	errReauthUnsupported = errors.New("authenticator does not support in-band re-authentication")
+	errReauthMismatch    = errors.New("token is for another user or device")
+	errReauthGuest       = errors.New("guests cannot re-authenticate")
+	errReauthNoToken     = errors.New("reauth requires a token")
+)
+
+// TokenValidator is implemented by Authenticators that can validate a bare
+// token, as sent in a reauth message
+type TokenValidator interface {
+	ValidateToken(token string) (*Claims, error)
+}
+
+// ValidateToken validates a JWT outside of an HTTP request
+func (a *JWTAuthenticator) ValidateToken(token string) (*Claims, error) {
+	return validateJWT(token, a.Secret, a.Issuer, a.Audience, a.Leeway)
+}
+
+// setTokenExpiry records when the client's token expires; the zero time
+// means it never does
+func (c *Client) setTokenExpiry(t time.Time) {
+	var exp int64
+	if !t.IsZero() {
+		exp = t.UnixNano()
+	}
+	atomic.StoreInt64(&c.tokenExpiry, exp)
+}
+
+// checkTokenExpiry is run by the write pump on every ping tick. It warns the
+// client once per token as expiry nears and closes the connection with
+// CloseTokenExpired once it has passed. warned holds the expiry last warned
+// about.
+func (c *Client) checkTokenExpiry(warned *int64) {
+	exp := atomic.LoadInt64(&c.tokenExpiry)
+	if exp == 0 {
+		return
+	}
+
+	remaining := time.Until(time.Unix(0, exp))
+	if remaining <= 0 {
+		c.closeWith(CloseTokenExpired, "token expired", true)
+		return
+	}
+	if remaining <= tokenExpiryWarning+c.Timings.PingPeriod && *warned != exp {
+		*warned = exp
+		c.sendTokenExpiring(remaining)
+	}
+}
+
+// sendTokenExpiring warns the client that its token expires soon
+func (c *Client) sendTokenExpiring(remaining time.Duration) {
+	data, err := json.Marshal(SignalingMessage{
+		Type:      MsgTokenExpiring,
+		Payload:   TokenExpiringPayload{InMS: remaining.Milliseconds()},
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return
+	}
+	c.Enqueue(data)
+}
+
+// reauth replaces the client's token with a fresh one for the same user and
+// device, extending the connection past the old token's expiry
+func (c *Client) reauth(payload interface{}, connManager *ConnectionManager) error {
+	if c.Guest {
+		return errReauthGuest
+	}
+	validator, ok := connManager.auth.(TokenValidator)
+	if !ok {
+		return errReauthUnsupported
+	}
+
+	var req ReauthPayload
+	if err := decodePayload(payload, &req); err != nil || req.Token == "" {
+		return errReauthNoToken
+	}
+
+	claims, err := validator.ValidateToken(req.Token)
+	if err != nil {
+		audit.Log(auditAuthFailure, c.UserID, c.remoteIP, "reauth: "+err.Error())
+		return err
+	}
+	if claims.UserID != c.UserID || claims.DeviceID != c.DeviceID {
+		audit.Log(auditAuthFailure, c.UserID, c.remoteIP, "reauth: "+errReauthMismatch.Error())
+		return errReauthMismatch
+	}
+	if binder, ok := validator.(tokenBinder); ok && *tokenBinding {
+		if err := binder.checkBinding(claims, c.remoteIP, c.fingerprint); err != nil {
+			audit.Log(auditAuthFailure, c.UserID, c.remoteIP, "reauth: "+err.Error())
+			return err
+		}
+	}
+
+	c.Scopes = claims.EffectiveScopes()
+	var expiresAt int64
+	if claims.ExpiresAt != nil {
+		c.setTokenExpiry(claims.ExpiresAt.Time)
+		expiresAt = claims.ExpiresAt.Unix()
+	} else {
+		c.setTokenExpiry(time.Time{})
+	}
+
+	data, err := json.Marshal(SignalingMessage{
+		Type:      MsgReauth,
+		Payload:   ReauthPayload{ExpiresAt: expiresAt},
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+	return c.Enqueue(data)
+}
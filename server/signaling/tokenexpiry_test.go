@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// expiringToken signs a token for one of alice's devices with testSecret
+func expiringToken(t *testing.T, deviceID string, exp time.Time) string {
+	t.Helper()
+	claims := Claims{
+		UserID:           "alice",
+		DeviceID:         deviceID,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(exp)},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestTokenExpiry(t *testing.T) {
+	period := *pingPeriod
+	*pingPeriod = 50 * time.Millisecond
+	t.Cleanup(func() { *pingPeriod = period })
+
+	srv := serveTestManager(t, newTestManager(t))
+	// Token expiry has a resolution of one second
+	exp := time.Now().Add(2 * time.Second).Truncate(time.Second)
+	dial := func(deviceID string) *testConn {
+		conn, _, err := dialWith(t, srv, http.Header{"Authorization": {"Bearer " + expiringToken(t, deviceID, exp)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &testConn{t: t, conn: conn}
+	}
+	phone, laptop := dial("phone"), dial("laptop")
+
+	for _, c := range []*testConn{phone, laptop} {
+		data, _ := json.Marshal(c.next(MsgTokenExpiring).Payload)
+		var warning TokenExpiringPayload
+		json.Unmarshal(data, &warning)
+		if warning.InMS <= 0 || warning.InMS > 2000 {
+			t.Errorf("warned of expiry in %dms, want within 2s", warning.InMS)
+		}
+	}
+
+	// The phone renews its token; the laptop doesn't
+	renewed := time.Now().Add(time.Hour)
+	phone.send(SignalingMessage{Type: MsgReauth, Payload: ReauthPayload{Token: expiringToken(t, "phone", renewed)}})
+	data, _ := json.Marshal(phone.next(MsgReauth).Payload)
+	var reply ReauthPayload
+	json.Unmarshal(data, &reply)
+	if reply.ExpiresAt != renewed.Unix() {
+		t.Errorf("reauth reply expires at %d, want %d", reply.ExpiresAt, renewed.Unix())
+	}
+	phone.send(SignalingMessage{Type: MsgReauth, Payload: ReauthPayload{Token: expiringToken(t, "laptop", renewed)}})
+	data, _ = json.Marshal(phone.next(MsgError).Payload)
+	var refusal ErrorPayload
+	json.Unmarshal(data, &refusal)
+	if refusal.Code != ErrCodeForbidden {
+		t.Errorf("reauth with another device's token got %+v, want %s", refusal, ErrCodeForbidden)
+	}
+
+	// Pongs written after the server hangs up would fail before the close
+	// frame is read
+	laptop.conn.SetPingHandler(func(string) error { return nil })
+	var err error
+	for err == nil {
+		err = laptop.read(3 * time.Second)
+	}
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseTokenExpired {
+		t.Errorf("expired connection ended with %v, want close code %d", err, CloseTokenExpired)
+	}
+	if time.Now().Before(exp) {
+		t.Error("connection closed before its token expired")
+	}
+
+	// Past the old expiry the renewed connection carries on
+	time.Sleep(2 * *pingPeriod)
+	phone.send(SignalingMessage{Type: MsgPing})
+	phone.next(MsgPong)
+}
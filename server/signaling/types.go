@@ -1,67 +1,309 @@
 package main
 
 import (
-	"time"
+	"regexp"
+	"sync"
 
+	"github.com/liberty-reach/signaling/protocol"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 // SignalingMessage represents a WebSocket signaling message
-type SignalingMessage struct {
-	Type      string      `json:"type"`
-	From      string      `json:"from"`
-	To        string      `json:"to"`
-	Room      string      `json:"room,omitempty"`
-	Payload   interface{} `json:"payload,omitempty"`
-	Timestamp int64       `json:"timestamp"`
-}
+type SignalingMessage = protocol.SignalingMessage
+
+// ErrorPayload is the payload of an error frame sent to a client
+type ErrorPayload = protocol.ErrorPayload
+
+// SessionDescription is the payload of offers and answers
+type SessionDescription = protocol.SessionDescription
+
+// TypingPayload is the payload of typing messages
+type TypingPayload = protocol.TypingPayload
+
+// ReceiptPayload is the payload of read receipts
+type ReceiptPayload = protocol.ReceiptPayload
+
+// RoomMemberPayload announces a room member joining or leaving
+type RoomMemberPayload = protocol.RoomMemberPayload
+
+// PresenceSubscribePayload is the payload of presence_subscribe messages
+type PresenceSubscribePayload = protocol.PresenceSubscribePayload
+
+// TokenExpiringPayload warns of a token's expiry
+type TokenExpiringPayload = protocol.TokenExpiringPayload
+
+// ReauthPayload carries a fresh token
+type ReauthPayload = protocol.ReauthPayload
+
+// ResumePayload carries a client's resume token
+type ResumePayload = protocol.ResumePayload
+
+// SessionInfo describes a client's session in reply to whoami
+type SessionInfo = protocol.SessionInfo
+
+// Presence is a user's presence record
+type Presence = protocol.Presence
+
+// Presence states
+const (
+	PresenceOnline  = protocol.PresenceOnline
+	PresenceAway    = protocol.PresenceAway
+	PresenceOffline = protocol.PresenceOffline
+)
 
 // Message types
 const (
-	MsgOffer      = "offer"
-	MsgAnswer     = "answer"
-	MsgCandidate  = "candidate"
-	MsgPing       = "ping"
-	MsgPong       = "pong"
-	MsgSubscribe  = "subscribe"
-	MsgUnsubscribe = "unsubscribe"
-	MsgPresence   = "presence"
+	MsgOffer         = protocol.MsgOffer
+	MsgAnswer        = protocol.MsgAnswer
+	MsgCandidate     = protocol.MsgCandidate
+	MsgPing          = protocol.MsgPing
+	MsgPong          = protocol.MsgPong
+	MsgSubscribe     = protocol.MsgSubscribe
+	MsgUnsubscribe   = protocol.MsgUnsubscribe
+	MsgPresence      = protocol.MsgPresence
+	MsgKnock         = protocol.MsgKnock
+	MsgError         = protocol.MsgError
+	MsgReplaced      = protocol.MsgReplaced
+	MsgAck           = protocol.MsgAck
+	MsgWhoami        = protocol.MsgWhoami
+	MsgTyping        = protocol.MsgTyping
+	MsgReceipt       = protocol.MsgReceipt
+	MsgResume        = protocol.MsgResume
+	MsgReauth        = protocol.MsgReauth
+	MsgTokenExpiring = protocol.MsgTokenExpiring
+	MsgRoomJoin      = protocol.MsgRoomJoin
+	MsgRoomLeave     = protocol.MsgRoomLeave
+	MsgAnnouncement  = protocol.MsgAnnouncement
+
+	MsgPresenceSubscribe = protocol.MsgPresenceSubscribe
+)
+
+// Error frame codes
+const (
+	ErrCodeForbidden      = protocol.ErrCodeForbidden
+	ErrCodeKnockRequired  = protocol.ErrCodeKnockRequired
+	ErrCodeInvalidPayload = protocol.ErrCodeInvalidPayload
+	ErrCodeRoomLimit      = protocol.ErrCodeRoomLimit
+	ErrCodeRoomThrottled  = protocol.ErrCodeRoomThrottled
+	ErrCodeRateLimited    = protocol.ErrCodeRateLimited
+	ErrCodeUnknownType    = protocol.ErrCodeUnknownType
+)
+
+// WebSocket close codes
+const (
+	CloseServerShutdown  = protocol.CloseServerShutdown
+	CloseReplaced        = protocol.CloseReplaced
+	CloseSlowConsumer    = protocol.CloseSlowConsumer
+	CloseTokenExpired    = protocol.CloseTokenExpired
+	CloseDeviceConnected = protocol.CloseDeviceConnected
+	CloseServerFull      = protocol.CloseServerFull
+	CloseIdle            = protocol.CloseIdle
 )
 
 // Metrics holds Prometheus metrics
 type Metrics struct {
-	ActiveConnections  prometheus.Gauge
-	MessagesSent       prometheus.Counter
-	MessagesReceived   prometheus.Counter
-	RateLimitExceeded  prometheus.Counter
-	ConnectionDuration prometheus.Histogram
+	ActiveConnections   prometheus.Gauge
+	MessagesSent        prometheus.Counter
+	MessagesReceived    prometheus.Counter
+	RateLimitExceeded   prometheus.Counter
+	ConnectionDuration  *prometheus.HistogramVec
+	Disconnects         *prometheus.CounterVec
+	RedisErrors         *prometheus.CounterVec
+	DroppedMessages     *prometheus.CounterVec
+	MessageProcessing   *prometheus.HistogramVec
+	RedisRelays         *prometheus.CounterVec
+	MarshalErrors       prometheus.Counter
+	GuestSessions       prometheus.Gauge
+	BlockedCandidates   *prometheus.CounterVec
+	UnknownMessageTypes *prometheus.CounterVec
+	OfflineQueued       prometheus.Counter
+	RelayTTLExceeded    prometheus.Counter
+	Offers              *prometheus.CounterVec
+	UpgradeFailures     *prometheus.CounterVec
+	ConnectionsRejected prometheus.Counter
+	RedisSubscriptions  prometheus.Gauge
+	Rooms               prometheus.Gauge
+	BlockedMessages     prometheus.Counter
+	RoomReconcileFixes  *prometheus.CounterVec
+	RoomThrottled       *prometheus.CounterVec
+	UniqueUsers         prometheus.Gauge
+	ConnectionsPerUser  prometheus.Histogram
+	IdleReaped          prometheus.Counter
+	SendBufferUsage     prometheus.Histogram
+	SlowClients         prometheus.Gauge
+	DuplicateDropped    prometheus.Counter
 }
 
-// NewMetrics creates and registers metrics
-func NewMetrics() *Metrics {
+// NewMetrics creates metrics and registers them with reg
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	factory := promauto.With(reg)
 	m := &Metrics{
-		ActiveConnections: promauto.NewGauge(prometheus.GaugeOpts{
+		ActiveConnections: factory.NewGauge(prometheus.GaugeOpts{
 			Name: "signaling_active_connections",
 			Help: "Number of active WebSocket connections",
 		}),
-		MessagesSent: promauto.NewCounter(prometheus.CounterOpts{
+		MessagesSent: factory.NewCounter(prometheus.CounterOpts{
 			Name: "signaling_messages_sent_total",
 			Help: "Total number of messages sent",
 		}),
-		MessagesReceived: promauto.NewCounter(prometheus.CounterOpts{
+		MessagesReceived: factory.NewCounter(prometheus.CounterOpts{
 			Name: "signaling_messages_received_total",
 			Help: "Total number of messages received",
 		}),
-		RateLimitExceeded: promauto.NewCounter(prometheus.CounterOpts{
+		RateLimitExceeded: factory.NewCounter(prometheus.CounterOpts{
 			Name: "signaling_rate_limit_exceeded_total",
 			Help: "Total number of rate limit exceeded events",
 		}),
-		ConnectionDuration: promauto.NewHistogram(prometheus.HistogramOpts{
+		ConnectionDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    "signaling_connection_duration_seconds",
-			Help:    "Duration of WebSocket connections",
+			Help:    "Duration of WebSocket connections, by how they ended",
 			Buckets: prometheus.DefBuckets,
+		}, []string{"reason"}),
+		Disconnects: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "signaling_disconnects_total",
+			Help: "Total number of WebSocket disconnects, by how they ended",
+		}, []string{"reason"}),
+		RedisErrors: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "signaling_redis_errors_total",
+			Help: "Total number of failed Redis operations",
+		}, []string{"operation"}),
+		DroppedMessages: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "signaling_dropped_messages_total",
+			Help: "Total number of messages dropped before delivery",
+		}, []string{"reason"}),
+		MessageProcessing: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "signaling_message_processing_seconds",
+			Help:    "Time spent processing client messages",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}, []string{"type"}),
+		RedisRelays: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "signaling_redis_relays_total",
+			Help: "Total number of messages relayed to other servers via Redis",
+		}, []string{"region"}),
+		MarshalErrors: factory.NewCounter(prometheus.CounterOpts{
+			Name: "signaling_marshal_errors_total",
+			Help: "Total number of messages skipped because they could not be encoded",
+		}),
+		GuestSessions: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "signaling_guest_sessions",
+			Help: "Number of connected guest sessions",
+		}),
+		BlockedCandidates: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "signaling_blocked_candidates_total",
+			Help: "Total number of ICE candidates in blocked address ranges",
+		}, []string{"action"}),
+		UnknownMessageTypes: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "signaling_unknown_message_type_total",
+			Help: "Total number of client messages with an unrecognized type",
+		}, []string{"type"}),
+		OfflineQueued: factory.NewCounter(prometheus.CounterOpts{
+			Name: "signaling_offline_queued_total",
+			Help: "Total number of messages held for offline users",
+		}),
+		RelayTTLExceeded: factory.NewCounter(prometheus.CounterOpts{
+			Name: "signaling_relay_ttl_exceeded_total",
+			Help: "Total number of messages dropped after exhausting their relay hops",
+		}),
+		Offers: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "signaling_offers_total",
+			Help: "Total number of offers relayed, by whether they start, renegotiate or ICE-restart a session",
+		}, []string{"kind"}),
+		UpgradeFailures: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "signaling_upgrade_failures_total",
+			Help: "Total number of failed WebSocket upgrades",
+		}, []string{"reason"}),
+		ConnectionsRejected: factory.NewCounter(prometheus.CounterOpts{
+			Name: "signaling_connections_rejected_total",
+			Help: "Total number of connections refused because the server was at -max-connections",
+		}),
+		RedisSubscriptions: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "signaling_redis_subscriptions",
+			Help: "Number of Redis pub/sub subscriptions held for rooms with local members",
+		}),
+		Rooms: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "signaling_rooms",
+			Help: "Number of rooms with local members",
+		}),
+		BlockedMessages: factory.NewCounter(prometheus.CounterOpts{
+			Name: "signaling_blocked_messages_total",
+			Help: "Total number of relayed messages dropped by the recipient's block list",
+		}),
+		RoomReconcileFixes: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "signaling_room_reconcile_fixes_total",
+			Help: "Total number of room membership inconsistencies repaired by reconciliation",
+		}, []string{"kind"}),
+		RoomThrottled: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "signaling_room_throttled_total",
+			Help: "Total number of room messages dropped for exceeding the sender's room budget",
+		}, []string{"reason"}),
+		UniqueUsers: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "signaling_unique_users",
+			Help: "Number of distinct users with a connection to this server",
+		}),
+		ConnectionsPerUser: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "signaling_connections_per_user",
+			Help:    "Connections held by each connected user, sampled every 30 seconds",
+			Buckets: []float64{1, 2, 3, 4, 5, 8, 12, 16, 32},
+		}),
+		IdleReaped: factory.NewCounter(prometheus.CounterOpts{
+			Name: "signaling_idle_reaped_total",
+			Help: "Total number of WebSocket connections closed for sending no messages within -idle-timeout",
+		}),
+		SendBufferUsage: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "signaling_send_buffer_usage",
+			Help:    "Fraction of each client's send buffer in use, sampled every 5 seconds",
+			Buckets: []float64{0, 0.1, 0.25, 0.5, 0.75, 0.9, 1},
+		}),
+		SlowClients: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "signaling_slow_clients",
+			Help: "Clients whose send buffer has been at least 75% full for the last 3 samples",
+		}),
+		DuplicateDropped: factory.NewCounter(prometheus.CounterOpts{
+			Name: "signaling_duplicate_dropped_total",
+			Help: "Total number of relayed messages dropped for repeating an id within -dedup-window",
 		}),
 	}
 	return m
 }
+
+// messageTypeLabel bounds metric label values to the known client message
+// types
+func messageTypeLabel(msgType string) string {
+	switch msgType {
+	case MsgOffer, MsgAnswer, MsgCandidate, MsgPing, MsgSubscribe, MsgUnsubscribe, MsgPresence, MsgPresenceSubscribe, MsgKnock, MsgWhoami, MsgTyping, MsgReceipt, MsgReauth:
+		return msgType
+	}
+	return "unknown"
+}
+
+// maxUnknownTypeLabels bounds the distinct unrecognized message types used
+// as metric labels; any beyond it are counted as "other"
+const maxUnknownTypeLabels = 32
+
+var (
+	unknownTypeLabels   = make(map[string]struct{})
+	unknownTypeLabelsMu sync.Mutex
+	unknownTypePattern  = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+)
+
+// unknownTypeLabel returns the metric label for an unrecognized message
+// type. The first few well-formed types seen keep their name so typos are
+// visible; everything else shares one label.
+func unknownTypeLabel(msgType string) string {
+	if !unknownTypePattern.MatchString(msgType) {
+		return "other"
+	}
+
+	unknownTypeLabelsMu.Lock()
+	defer unknownTypeLabelsMu.Unlock()
+
+	if _, ok := unknownTypeLabels[msgType]; ok {
+		return msgType
+	}
+	if len(unknownTypeLabels) >= maxUnknownTypeLabels {
+		return "other"
+	}
+	unknownTypeLabels[msgType] = struct{}{}
+	return msgType
+}
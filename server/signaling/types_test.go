@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestUnknownTypeLabel(t *testing.T) {
+	saved := unknownTypeLabels
+	unknownTypeLabels = make(map[string]struct{})
+	t.Cleanup(func() { unknownTypeLabels = saved })
+
+	tests := map[string]string{
+		"ofer":                              "ofer",
+		"call_invite":                       "call_invite",
+		"":                                  "other",
+		"Offer":                             "other",
+		"1offer":                            "other",
+		"offer-2":                           "other",
+		"a_very_long_message_type_name_xyz": "other",
+	}
+	for msgType, want := range tests {
+		if got := unknownTypeLabel(msgType); got != want {
+			t.Errorf("unknownTypeLabel(%q) = %q, want %q", msgType, got, want)
+		}
+	}
+
+	for i := 0; len(unknownTypeLabels) < maxUnknownTypeLabels; i++ {
+		unknownTypeLabel(fmt.Sprintf("type_%d", i))
+	}
+	if got := unknownTypeLabel("one_more"); got != "other" {
+		t.Errorf("label past the cap = %q, want other", got)
+	}
+	if got := unknownTypeLabel("ofer"); got != "ofer" {
+		t.Errorf("label seen before the cap = %q, want ofer", got)
+	}
+}
+
+func TestNewMetricsSeparateRegistries(t *testing.T) {
+	a, b := prometheus.NewRegistry(), prometheus.NewRegistry()
+	ma, mb := NewMetrics(a), NewMetrics(b)
+
+	ma.MessagesSent.Inc()
+	if got := testutil.ToFloat64(mb.MessagesSent); got != 0 {
+		t.Errorf("second registry's counter = %v, want 0", got)
+	}
+
+	families, err := a.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	others, err := b.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) == 0 || len(families) != len(others) {
+		t.Errorf("registries hold %d and %d metric families", len(families), len(others))
+	}
+}
+
+// histogramCount returns the number of observations of a histogram series
+// in the default registry whose labels include label=value
+func histogramCount(t *testing.T, name, label, value string) uint64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, pair := range m.GetLabel() {
+				if pair.GetName() == label && pair.GetValue() == value {
+					return m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestMessageProcessingObserved(t *testing.T) {
+	cm := newTestManager(t)
+	alice := NewClient("alice", "phone", nil, zap.NewNop(), wsTimings())
+	before := histogramCount(t, "signaling_message_processing_seconds", "type", MsgOffer)
+
+	data, _ := json.Marshal(SignalingMessage{Type: MsgOffer, To: "bob", Payload: map[string]interface{}{"sdp": "v=0"}})
+	if err := alice.processMessage(data, cm); err != nil {
+		t.Fatal(err)
+	}
+	if got := histogramCount(t, "signaling_message_processing_seconds", "type", MsgOffer); got != before+1 {
+		t.Errorf("offer latency observations = %d, want %d", got, before+1)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Presence visibility settings
+const (
+	VisibilityEveryone = "everyone" // anyone who queries
+	VisibilityContacts = "contacts" // users on the user's contact list
+	VisibilityRooms    = "rooms"    // users sharing a room with the user
+	VisibilityNobody   = "nobody"
+)
+
+// Redis keys for presence visibility
+const (
+	redisVisibilityKey = "lr:presence_visibility:" // a user's setting
+	redisContactsKey   = "lr:contacts:"            // set of a user's contacts
+	redisUserRoomsKey  = "lr:user_rooms:"          // set of rooms a user is in
+)
+
+// maxContacts caps each user's contact list
+const maxContacts = 1000
+
+// Visibility errors
+var (
+	errInvalidVisibility = errors.New("invalid presence visibility")
+	errTooManyContacts   = errors.New("contact list is full")
+	errInvalidContact    = errors.New("invalid contact")
+)
+
+// validVisibility reports whether v is a known visibility setting
+func validVisibility(v string) bool {
+	switch v {
+	case VisibilityEveryone, VisibilityContacts, VisibilityRooms, VisibilityNobody:
+		return true
+	}
+	return false
+}
+
+// GetVisibility returns who may see a user's presence, defaulting to
+// everyone
+func (cm *ConnectionManager) GetVisibility(userID string) (string, error) {
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	v, err := cm.redis.Get(ctx, cm.key(redisVisibilityKey+userID)).Result()
+	if err == redis.Nil {
+		return VisibilityEveryone, nil
+	}
+	return v, err
+}
+
+// SetVisibility sets who may see a user's presence
+func (cm *ConnectionManager) SetVisibility(userID, visibility string) error {
+	if !validVisibility(visibility) {
+		return errInvalidVisibility
+	}
+
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	return cm.redis.Set(ctx, cm.key(redisVisibilityKey+userID), visibility, 0).Err()
+}
+
+// AddContact adds contact to userID's contact list
+func (cm *ConnectionManager) AddContact(userID, contact string) error {
+	if contact == "" || contact == userID {
+		return errInvalidContact
+	}
+
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	count, err := cm.redis.SCard(ctx, cm.key(redisContactsKey+userID)).Result()
+	if err != nil {
+		return err
+	}
+	if count >= maxContacts {
+		return errTooManyContacts
+	}
+	return cm.redis.SAdd(ctx, cm.key(redisContactsKey+userID), contact).Err()
+}
+
+// RemoveContact removes contact from userID's contact list
+func (cm *ConnectionManager) RemoveContact(userID, contact string) error {
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	return cm.redis.SRem(ctx, cm.key(redisContactsKey+userID), contact).Err()
+}
+
+// Contacts returns userID's contact list, sorted
+func (cm *ConnectionManager) Contacts(userID string) ([]string, error) {
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	contacts, err := cm.redis.SMembers(ctx, cm.key(redisContactsKey+userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(contacts)
+	return contacts, nil
+}
+
+// indexUserRoom records that a signed-in client's user is in a room, for
+// rooms visibility
+func (cm *ConnectionManager) indexUserRoom(client *Client, room string) {
+	if client.Guest {
+		return
+	}
+
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	if err := cm.redis.SAdd(ctx, cm.key(redisUserRoomsKey+client.UserID), room).Err(); err != nil {
+		metrics.RedisErrors.WithLabelValues("user_rooms").Inc()
+	}
+}
+
+// unindexUserRoom drops a room from the user's index once none of the
+// user's clients here are left in it. A device still in the room on
+// another server loses visibility until it rejoins, erring on the side of
+// hiding presence.
+func (cm *ConnectionManager) unindexUserRoom(client *Client, room string) {
+	if client.Guest {
+		return
+	}
+
+	cm.roomsMu.RLock()
+	if r, ok := cm.rooms[room]; ok {
+		for _, member := range r.members {
+			if member.UserID == client.UserID {
+				cm.roomsMu.RUnlock()
+				return
+			}
+		}
+	}
+	cm.roomsMu.RUnlock()
+
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	if err := cm.redis.SRem(ctx, cm.key(redisUserRoomsKey+client.UserID), room).Err(); err != nil {
+		metrics.RedisErrors.WithLabelValues("user_rooms").Inc()
+	}
+}
+
+// filterPresences replaces the presence of users viewer may not see with
+// offline. Users whose visibility can't be checked are hidden too.
+func (cm *ConnectionManager) filterPresences(viewer string, presences map[string]Presence) error {
+	userIDs := make([]string, 0, len(presences))
+	for userID := range presences {
+		userIDs = append(userIDs, userID)
+	}
+
+	visible, err := cm.visibleTo(viewer, userIDs)
+	if err != nil {
+		return err
+	}
+	for userID := range presences {
+		if !visible[userID] {
+			presences[userID] = Presence{Presence: PresenceOffline}
+		}
+	}
+	return nil
+}
+
+// visibleTo reports which of userIDs let viewer see their presence. Users
+// always see their own.
+func (cm *ConnectionManager) visibleTo(viewer string, userIDs []string) (map[string]bool, error) {
+	visible := make(map[string]bool, len(userIDs))
+	others := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if userID == viewer {
+			visible[userID] = true
+		} else {
+			others = append(others, userID)
+		}
+	}
+	if len(others) == 0 {
+		return visible, nil
+	}
+
+	ctx, cancel := cm.redisContext()
+	defer cancel()
+
+	keys := make([]string, len(others))
+	for i, userID := range others {
+		keys[i] = cm.key(redisVisibilityKey + userID)
+	}
+	settings, err := cm.redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// Look up contacts and shared rooms only for users who need them
+	checks := make(map[string]interface{}, len(others))
+	pipe := cm.redis.Pipeline()
+	for i, userID := range others {
+		visibility, ok := settings[i].(string)
+		if !ok {
+			visibility = VisibilityEveryone
+		}
+		switch visibility {
+		case VisibilityEveryone:
+			visible[userID] = true
+		case VisibilityContacts:
+			checks[userID] = pipe.SIsMember(ctx, cm.key(redisContactsKey+userID), viewer)
+		case VisibilityRooms:
+			checks[userID] = pipe.SInter(ctx, cm.key(redisUserRoomsKey+userID), cm.key(redisUserRoomsKey+viewer))
+		}
+	}
+	if len(checks) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, err
+		}
+	}
+
+	for userID, check := range checks {
+		switch cmd := check.(type) {
+		case *redis.BoolCmd:
+			visible[userID] = cmd.Val()
+		case *redis.StringSliceCmd:
+			visible[userID] = len(cmd.Val()) > 0
+		}
+	}
+	return visible, nil
+}
+
+// handlePresenceVisibility reads (GET) or changes (PUT) the authenticated
+// user's presence visibility
+func handlePresenceVisibility(connManager *ConnectionManager, auth Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := authenticateHTTP(w, r, connManager, auth)
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodPut {
+			var body struct {
+				Visibility string `json:"visibility"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+				return
+			}
+
+			err := connManager.SetVisibility(claims.UserID, body.Visibility)
+			if err == errInvalidVisibility {
+				http.Error(w, "Invalid visibility", http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				logger.Error("Failed to set presence visibility", zap.String("user_id", claims.UserID), zap.Error(err))
+				http.Error(w, "Failed to set presence visibility", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		visibility, err := connManager.GetVisibility(claims.UserID)
+		if err != nil {
+			logger.Error("Failed to load presence visibility", zap.String("user_id", claims.UserID), zap.Error(err))
+			http.Error(w, "Failed to load presence visibility", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"visibility": visibility,
+		})
+	}
+}
+
+// handleContacts manages the authenticated user's contact list: GET lists
+// it, PUT /contacts/{userID} adds a contact and DELETE removes one
+func handleContacts(connManager *ConnectionManager, auth Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := authenticateHTTP(w, r, connManager, auth)
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			contacts, err := connManager.Contacts(claims.UserID)
+			if err != nil {
+				logger.Error("Failed to load contacts", zap.String("user_id", claims.UserID), zap.Error(err))
+				http.Error(w, "Failed to load contacts", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"contacts": contacts,
+			})
+			return
+		}
+
+		var err error
+		contact := mux.Vars(r)["userID"]
+		if r.Method == http.MethodPut {
+			err = connManager.AddContact(claims.UserID, contact)
+		} else {
+			err = connManager.RemoveContact(claims.UserID, contact)
+		}
+
+		switch err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errInvalidContact:
+			http.Error(w, "Invalid user", http.StatusBadRequest)
+		case errTooManyContacts:
+			http.Error(w, "Contact list is full", http.StatusConflict)
+		default:
+			logger.Error("Failed to update contacts", zap.String("user_id", claims.UserID), zap.Error(err))
+			http.Error(w, "Failed to update contacts", http.StatusInternalServerError)
+		}
+	}
+}
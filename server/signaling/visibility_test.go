@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestValidVisibility(t *testing.T) {
+	tests := map[string]bool{
+		VisibilityEveryone: true,
+		VisibilityContacts: true,
+		VisibilityRooms:    true,
+		VisibilityNobody:   true,
+		"":                 false,
+		"friends":          false,
+		"Everyone":         false,
+	}
+	for v, want := range tests {
+		if got := validVisibility(v); got != want {
+			t.Errorf("validVisibility(%q) = %v, want %v", v, got, want)
+		}
+	}
+}
+
+func TestVisibilityInputsRejectedBeforeRedis(t *testing.T) {
+	cm := &ConnectionManager{}
+	if err := cm.SetVisibility("alice", "friends"); err != errInvalidVisibility {
+		t.Errorf("SetVisibility = %v, want errInvalidVisibility", err)
+	}
+	for _, contact := range []string{"", "alice"} {
+		if err := cm.AddContact("alice", contact); err != errInvalidContact {
+			t.Errorf("AddContact(%q) = %v, want errInvalidContact", contact, err)
+		}
+	}
+}
+
+func TestPresenceVisibility(t *testing.T) {
+	debounce := *presenceDebounce
+	*presenceDebounce = 0
+	t.Cleanup(func() { *presenceDebounce = debounce })
+
+	// bob is alice's contact, dave shares a room with her and carol is
+	// a stranger
+	tests := []struct {
+		visibility string
+		viewer     string
+		visible    bool
+	}{
+		{VisibilityEveryone, "carol", true},
+		{VisibilityContacts, "bob", true},
+		{VisibilityContacts, "carol", false},
+		{VisibilityRooms, "dave", true},
+		{VisibilityRooms, "carol", false},
+		{VisibilityNobody, "alice", true},
+		{VisibilityNobody, "bob", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.visibility+"/"+tt.viewer, func(t *testing.T) {
+			cm := newTestManager(t)
+			srv := serveTestManager(t, cm)
+			if err := cm.SetVisibility("alice", tt.visibility); err != nil {
+				t.Fatal(err)
+			}
+			if err := cm.AddContact("alice", "bob"); err != nil {
+				t.Fatal(err)
+			}
+			for _, userID := range []string{"alice", "dave"} {
+				cm.indexUserRoom(NewClient(userID, "phone", nil, zap.NewNop(), wsTimings()), "standup")
+			}
+			cm.UpdatePresence("alice", Presence{Presence: PresenceOnline})
+
+			want := PresenceOffline
+			if tt.visible {
+				want = PresenceOnline
+			}
+			if got, err := cm.GetPresence(tt.viewer, "alice"); err != nil || got.Presence != want {
+				t.Errorf("query returned %+v, %v, want %s", got, err, want)
+			}
+
+			viewer := dialTest(t, srv, tt.viewer, "laptop")
+			viewer.send(SignalingMessage{Type: MsgPresenceSubscribe, Payload: PresenceSubscribePayload{UserIDs: []string{"alice"}}})
+			current := viewer.next(MsgPresence)
+			if got := decodePresenceMessage(t, current); current.From != "alice" || got.Presence != want {
+				t.Errorf("subscription started with %+v from %s, want %s from alice", got, current.From, want)
+			}
+
+			cm.UpdatePresence("alice", Presence{Presence: PresenceAway})
+			if !tt.visible {
+				viewer.none(MsgPresence, 200*time.Millisecond)
+				return
+			}
+			// alice's own device connecting may publish first
+			for decodePresenceMessage(t, viewer.next(MsgPresence)).Presence != PresenceAway {
+			}
+		})
+	}
+}
+
+// decodePresenceMessage returns the presence record a presence message
+// carries
+func decodePresenceMessage(t *testing.T, msg SignalingMessage) Presence {
+	t.Helper()
+	var presence Presence
+	if err := decodePayload(msg.Payload, &presence); err != nil {
+		t.Fatal(err)
+	}
+	return presence
+}